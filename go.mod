@@ -1,3 +1,5 @@
 module file-system
 
 go 1.21.1
+
+require golang.org/x/text v0.14.0
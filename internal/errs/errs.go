@@ -13,3 +13,18 @@ var ErrRecordIsNotDirectory = fmt.Errorf("record is not a directory")
 var ErrRecordNotFound = fmt.Errorf("record not found")
 var ErrIncorrectPassword = fmt.Errorf("incorrect password")
 var ErrPermissionDenied = fmt.Errorf("permission denied")
+var ErrGroupNotFound = fmt.Errorf("group not found")
+var ErrGroupInUse = fmt.Errorf("group is a primary group of a user")
+var ErrQuotaExceeded = fmt.Errorf("disk quota exceeded")
+var ErrNoSpaceLeft = fmt.Errorf("no space left on device")
+var ErrNoSuchDevice = fmt.Errorf("no such device")
+var ErrReadOnlyFileSystem = fmt.Errorf("read-only file system")
+var ErrFileTooLarge = fmt.Errorf("file too large")
+var ErrCorruptedDirectory = fmt.Errorf("corrupted directory")
+var ErrNameTooLong = fmt.Errorf("file name too long")
+var ErrBusy = fmt.Errorf("device or resource busy")
+var ErrNotMountPoint = fmt.Errorf("not a mount point")
+var ErrCrossDevice = fmt.Errorf("invalid cross-device link")
+var ErrDirectoryNotEmpty = fmt.Errorf("directory not empty")
+var ErrBadDescriptor = fmt.Errorf("bad file descriptor")
+var ErrWouldBlock = fmt.Errorf("resource temporarily unavailable")
@@ -0,0 +1,325 @@
+package allocator
+
+import (
+	"file-system/internal/errs"
+	"file-system/internal/filesystem/bitmap"
+	"fmt"
+	"math"
+	"math/bits"
+	"sync"
+)
+
+// NoGoal lets the allocator pick the position.
+const NoGoal = math.MaxUint32
+
+// Allocator hands out bits of a bitmap. Searches scan a 64 bit word at a
+// time and continue from where the previous one ended (next-fit), so churn
+// spreads over the whole image instead of piling up at the front.
+//
+// Files that keep growing get a preallocation window: free bits right after
+// the last allocated one are reserved in memory, and the next allocation
+// asking for that position takes them first. Reservations are never
+// written to the image and are dropped when space runs out.
+//
+// An Allocator is safe for concurrent use; it owns the bitmap it was
+// created over and nothing else may change it.
+type Allocator struct {
+	mu         sync.Mutex
+	used       *bitmap.Bitmap
+	reserved   *bitmap.Bitmap
+	windows    map[uint32]uint32
+	windowSize uint32
+	hint       uint32
+}
+
+// NewAllocator creates an allocator over used. A zero windowSize disables
+// preallocation.
+func NewAllocator(used *bitmap.Bitmap, windowSize uint32) *Allocator {
+	return &Allocator{
+		used:       used,
+		reserved:   bitmap.NewBitmap(used.Len(), nil, 0),
+		windows:    make(map[uint32]uint32),
+		windowSize: windowSize,
+	}
+}
+
+// Allocate takes a single bit, preferably goal. Without a goal the search
+// continues after the previous allocation.
+func (a *Allocator) Allocate(goal uint32) (uint32, error) {
+	a.mu.Lock()
+	defer a.mu.Unlock()
+
+	result, err := a.allocateRun(goal, 1, false)
+	if err != nil {
+		return 0, err
+	}
+	return result[0], nil
+}
+
+// AllocateRun takes count bits, contiguous if possible. A run continuing at
+// goal is served from its preallocation window first, and with preallocate
+// a new window is reserved after the run. If no free run is long enough the
+// bits are gathered one by one.
+func (a *Allocator) AllocateRun(goal uint32, count uint32, preallocate bool) ([]uint32, error) {
+	a.mu.Lock()
+	defer a.mu.Unlock()
+
+	return a.allocateRun(goal, count, preallocate)
+}
+
+func (a *Allocator) allocateRun(goal uint32, count uint32, preallocate bool) ([]uint32, error) {
+	if count == 0 {
+		return nil, nil
+	}
+
+	result := make([]uint32, 0, count)
+	if goal < a.used.Len() {
+		result = append(result, a.takeFromWindow(goal, count)...)
+		if len(result) > 0 {
+			goal = result[len(result)-1] + 1
+		}
+	} else {
+		goal = a.hint
+	}
+
+	remaining := count - uint32(len(result))
+	if remaining == 0 {
+		return result, nil
+	}
+
+	var windowSize uint32
+	if preallocate {
+		windowSize = a.windowSize
+	}
+
+	start, ok := a.findRun(goal, remaining+windowSize)
+	if !ok && windowSize > 0 {
+		start, ok = a.findRun(goal, remaining)
+	}
+	if ok {
+		for i := uint32(0); i < remaining; i++ {
+			a.used.SetBit(start+i, 1)
+		}
+		result = append(result, runOf(start, remaining)...)
+		a.hint = start + remaining
+		if windowSize > 0 {
+			a.reserveWindow(start+remaining, windowSize)
+		}
+		return result, nil
+	}
+
+	for uint32(len(result)) < count {
+		index, found := a.findRun(goal, 1)
+		if !found {
+			a.dropWindows()
+			if index, found = a.findRun(goal, 1); !found {
+				a.free(result...)
+				return nil, fmt.Errorf("%w - need %d", errs.ErrNoSpaceLeft, count)
+			}
+		}
+		a.used.SetBit(index, 1)
+		result = append(result, index)
+		goal = index + 1
+		a.hint = goal
+	}
+
+	return result, nil
+}
+
+// AllocateContiguous takes count bits in a single run at or after goal,
+// wrapping around, and fails if there is no such run.
+func (a *Allocator) AllocateContiguous(goal uint32, count uint32) ([]uint32, error) {
+	a.mu.Lock()
+	defer a.mu.Unlock()
+
+	start, ok := a.findRun(goal, count)
+	if !ok {
+		a.dropWindows()
+		if start, ok = a.findRun(goal, count); !ok {
+			return nil, fmt.Errorf("%w - no run of %d", errs.ErrNoSpaceLeft, count)
+		}
+	}
+
+	for i := uint32(0); i < count; i++ {
+		a.used.SetBit(start+i, 1)
+	}
+	a.hint = start + count
+
+	return runOf(start, count), nil
+}
+
+// Free releases the bits and drops the windows that were reserved behind
+// them.
+func (a *Allocator) Free(indices ...uint32) {
+	a.mu.Lock()
+	defer a.mu.Unlock()
+
+	a.free(indices...)
+}
+
+func (a *Allocator) free(indices ...uint32) {
+	for _, index := range indices {
+		a.used.SetBit(index, 0)
+		a.dropWindow(index + 1)
+	}
+}
+
+// Save writes the bitmap to the image. Reservations are not part of it.
+func (a *Allocator) Save() error {
+	a.mu.Lock()
+	defer a.mu.Unlock()
+
+	return a.used.Save()
+}
+
+// DropWindows releases every preallocation window.
+func (a *Allocator) DropWindows() {
+	a.mu.Lock()
+	defer a.mu.Unlock()
+
+	a.dropWindows()
+}
+
+func (a *Allocator) dropWindows() {
+	for start := range a.windows {
+		a.dropWindow(start)
+	}
+}
+
+// Reserved is the number of bits held by preallocation windows.
+func (a *Allocator) Reserved() uint32 {
+	a.mu.Lock()
+	defer a.mu.Unlock()
+
+	var result uint32
+	for _, length := range a.windows {
+		result += length
+	}
+	return result
+}
+
+func (a *Allocator) takeFromWindow(goal uint32, count uint32) []uint32 {
+	length, ok := a.windows[goal]
+	if !ok {
+		return nil
+	}
+	delete(a.windows, goal)
+
+	taken := min(length, count)
+	for i := uint32(0); i < taken; i++ {
+		a.reserved.SetBit(goal+i, 0)
+		a.used.SetBit(goal+i, 1)
+	}
+	if taken < length {
+		a.windows[goal+taken] = length - taken
+	}
+
+	return runOf(goal, taken)
+}
+
+func (a *Allocator) reserveWindow(start uint32, windowSize uint32) {
+	var length uint32
+	for length < windowSize && start+length < a.used.Len() && a.isFree(start+length) {
+		a.reserved.SetBit(start+length, 1)
+		length++
+	}
+	if length > 0 {
+		a.windows[start] = length
+	}
+}
+
+func (a *Allocator) dropWindow(start uint32) {
+	length, ok := a.windows[start]
+	if !ok {
+		return
+	}
+	delete(a.windows, start)
+	for i := uint32(0); i < length; i++ {
+		a.reserved.SetBit(start+i, 0)
+	}
+}
+
+func (a *Allocator) isFree(index uint32) bool {
+	used, _ := a.used.GetBit(index)
+	reserved, _ := a.reserved.GetBit(index)
+	return used == 0 && reserved == 0
+}
+
+// word returns the bits at wordIndex that are either used or reserved.
+func (a *Allocator) word(wordIndex uint32) uint64 {
+	return a.used.Word(wordIndex) | a.reserved.Word(wordIndex)
+}
+
+// findRun looks for length free bits in a row, starting at goal and
+// wrapping around once.
+func (a *Allocator) findRun(goal uint32, length uint32) (uint32, bool) {
+	size := a.used.Len()
+	if length == 0 || length > size {
+		return 0, false
+	}
+
+	if start, ok := a.findRunBetween(goal, size, length); ok {
+		return start, true
+	}
+	return a.findRunBetween(0, min(goal+length-1, size), length)
+}
+
+func (a *Allocator) findRunBetween(from, to uint32, length uint32) (uint32, bool) {
+	var runStart, runLength uint32
+	index := from
+
+	for index < to {
+		wordIndex := index / 64
+		offset := index % 64
+		word := a.word(wordIndex) | ^(math.MaxUint64 >> offset)
+
+		if word == math.MaxUint64 {
+			runLength = 0
+			index = (wordIndex + 1) * 64
+			continue
+		}
+		if word == 0 && offset == 0 {
+			if runLength == 0 {
+				runStart = index
+			}
+			runLength += 64
+			if runLength >= length && runStart+length <= to {
+				return runStart, true
+			}
+			index += 64
+			continue
+		}
+
+		// Walk the word one stretch of equal bits at a time
+		position := offset
+		for position < 64 && wordIndex*64+position < to {
+			rest := word << position
+			if rest&(1<<63) != 0 {
+				runLength = 0
+				position += uint32(bits.LeadingZeros64(^rest))
+				continue
+			}
+			free := uint32(bits.LeadingZeros64(rest))
+			free = min(free, 64-position)
+			if runLength == 0 {
+				runStart = wordIndex*64 + position
+			}
+			runLength += free
+			if runLength >= length && runStart+length <= to {
+				return runStart, true
+			}
+			position += free
+		}
+		index = (wordIndex + 1) * 64
+	}
+
+	return 0, false
+}
+
+func runOf(start uint32, length uint32) []uint32 {
+	result := make([]uint32, length)
+	for i := range result {
+		result[i] = start + uint32(i)
+	}
+	return result
+}
@@ -0,0 +1,179 @@
+package allocator
+
+import (
+	"errors"
+	"file-system/internal/errs"
+	"file-system/internal/filesystem/bitmap"
+	"math/rand"
+	"sync"
+	"testing"
+)
+
+// Bits in a bitmap for a 1 GiB image with 1 KiB blocks
+const gibibyteBlocks = 1 << 20
+
+func newBitmap(size uint32, used ...uint32) *bitmap.Bitmap {
+	b := bitmap.NewBitmap(size, nil, 0)
+	for _, index := range used {
+		b.SetBit(index, 1)
+	}
+	return b
+}
+
+func TestAllocateRunContiguous(t *testing.T) {
+	// Free runs: 2..3, 5..9, 11..199
+	a := NewAllocator(newBitmap(200, 0, 1, 4, 10), 0)
+
+	result, err := a.AllocateRun(NoGoal, 6, false)
+	if err != nil || result[0] != 11 || result[5] != 16 {
+		t.Errorf("AllocateRun expected run 11..16, got %v (%v)", result, err)
+	}
+
+	next, _ := a.Allocate(NoGoal)
+	if next != 17 {
+		t.Errorf("Allocate expected next fit 17, got %d", next)
+	}
+
+	wrapped, _ := a.AllocateRun(150, 60, false)
+	if wrapped[0] != 18 {
+		t.Errorf("AllocateRun expected wrap around to 18, got %d", wrapped[0])
+	}
+}
+
+func TestAllocateFragmented(t *testing.T) {
+	a := NewAllocator(newBitmap(10, 0, 2, 4, 6, 8), 0)
+
+	result, err := a.AllocateRun(NoGoal, 5, false)
+	if err != nil || len(result) != 5 {
+		t.Fatalf("AllocateRun expected 5 scattered bits, got %v (%v)", result, err)
+	}
+
+	if _, err := a.Allocate(NoGoal); !errors.Is(err, errs.ErrNoSpaceLeft) {
+		t.Errorf("Allocate on full bitmap: expected ErrNoSpaceLeft, got %v", err)
+	}
+}
+
+func TestPreallocationWindow(t *testing.T) {
+	a := NewAllocator(newBitmap(100), 8)
+
+	file, _ := a.AllocateRun(NoGoal, 2, true)
+	other, _ := a.AllocateRun(NoGoal, 1, true)
+	if other[0] != 10 {
+		t.Errorf("Allocation expected to skip window 2..9, got %d", other[0])
+	}
+
+	grown, _ := a.AllocateRun(file[1]+1, 3, true)
+	if grown[0] != 2 || grown[2] != 4 {
+		t.Errorf("Growing file expected blocks 2..4 from its window, got %v", grown)
+	}
+
+	a.Free(file[0], file[1], grown[0], grown[1], grown[2])
+	if a.Reserved() != 8 {
+		t.Errorf("Reserved mismatch after freeing: expected window of the other file (8), got %d", a.Reserved())
+	}
+}
+
+func TestWindowsDroppedWhenFull(t *testing.T) {
+	a := NewAllocator(newBitmap(16), 8)
+
+	a.AllocateRun(NoGoal, 4, true)
+	if _, err := a.AllocateRun(NoGoal, 12, false); err != nil {
+		t.Errorf("AllocateRun expected to reuse reserved space, got %v", err)
+	}
+}
+
+func TestConcurrentAllocate(t *testing.T) {
+	a := NewAllocator(newBitmap(4096), 8)
+
+	var wg sync.WaitGroup
+	results := make([][]uint32, 8)
+	for i := range results {
+		wg.Add(1)
+		go func(i int) {
+			defer wg.Done()
+			for j := 0; j < 32; j++ {
+				run, err := a.AllocateRun(NoGoal, 4, true)
+				if err != nil {
+					t.Error(err)
+					return
+				}
+				results[i] = append(results[i], run...)
+				if j%4 == 0 {
+					a.Free(run...)
+					results[i] = results[i][:len(results[i])-len(run)]
+				}
+			}
+		}(i)
+	}
+	wg.Wait()
+
+	seen := make(map[uint32]bool)
+	for _, indices := range results {
+		for _, index := range indices {
+			if seen[index] {
+				t.Fatalf("bit %d handed out twice", index)
+			}
+			seen[index] = true
+		}
+	}
+	if used := a.used.Count(1); used != uint32(len(seen)) {
+		t.Errorf("expected %d used bits, got %d", len(seen), used)
+	}
+}
+
+func fillRandomly(b *bitmap.Bitmap, share float64) {
+	r := rand.New(rand.NewSource(1))
+	for i := uint32(0); i < b.Len(); i++ {
+		if r.Float64() < share {
+			b.SetBit(i, 1)
+		}
+	}
+}
+
+func BenchmarkAllocate(b *testing.B) {
+	used := newBitmap(gibibyteBlocks)
+	fillRandomly(used, 0.5)
+	a := NewAllocator(used, 0)
+
+	b.ResetTimer()
+	for i := 0; i < b.N; i++ {
+		index, err := a.Allocate(NoGoal)
+		if err != nil {
+			b.Fatal(err)
+		}
+		a.Free(index)
+	}
+}
+
+func BenchmarkAllocateRun(b *testing.B) {
+	used := newBitmap(gibibyteBlocks)
+	fillRandomly(used, 0.1)
+	a := NewAllocator(used, 8)
+
+	b.ResetTimer()
+	for i := 0; i < b.N; i++ {
+		result, err := a.AllocateRun(NoGoal, 16, true)
+		if err != nil {
+			b.Fatal(err)
+		}
+		a.Free(result...)
+	}
+}
+
+// BenchmarkTakeFreeBit measures the plain first-fit scan on a nearly full
+// image for comparison.
+func BenchmarkTakeFreeBit(b *testing.B) {
+	used := newBitmap(gibibyteBlocks)
+	for i := uint32(0); i < used.Len()-1; i++ {
+		used.SetBit(i, 1)
+	}
+
+	b.ResetTimer()
+	for i := 0; i < b.N; i++ {
+		index, err := used.TakeFreeBit()
+		if err != nil {
+			b.Fatal(err)
+		}
+		used.SetBit(index, 0)
+	}
+}
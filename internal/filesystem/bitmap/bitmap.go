@@ -1,24 +1,33 @@
 package bitmap
 
 import (
+	"encoding/binary"
 	"errors"
-	"os"
+	"file-system/internal/filesystem/blockdevice"
+	"math"
+	"math/bits"
 )
 
 type Bitmap struct {
 	Data   []uint8
 	size   uint32
-	file   *os.File
+	file   blockdevice.BlockDevice
 	offset uint32
 }
 
-func NewBitmap(size uint32, file *os.File, offset uint32) *Bitmap {
+func NewBitmap(size uint32, file blockdevice.BlockDevice, offset uint32) *Bitmap {
 	data := make([]uint8, (size+7)/8)
 	return &Bitmap{data, size, file, offset}
 }
 
+// Size is the number of bytes the bitmap takes in the image.
 func (b Bitmap) Size() uint32 {
-	return b.size / 8
+	return (b.size + 7) / 8
+}
+
+// Len is the number of bits in the bitmap.
+func (b Bitmap) Len() uint32 {
+	return b.size
 }
 
 func (b *Bitmap) SetBit(index uint32, value int) error {
@@ -49,24 +58,79 @@ func (b *Bitmap) GetBit(index uint32) (int, error) {
 }
 
 func (b *Bitmap) TakeFreeBit() (uint32, error) {
-	for i := uint32(0); i < b.size; i++ {
-		bit, err := b.GetBit(i)
-		if err != nil {
-			return 0, err
+	for i := uint32(0); i < b.WordCount(); i++ {
+		word := b.Word(i)
+		if word == math.MaxUint64 {
+			continue
 		}
-		if bit == 0 {
-			err := b.SetBit(i, 1)
-			if err != nil {
-				return 0, err
-			}
-			return i, nil
+		index := i*64 + uint32(bits.LeadingZeros64(^word))
+		if err := b.SetBit(index, 1); err != nil {
+			return 0, err
 		}
+		return index, nil
 	}
 	return 0, errors.New("no zero bits found")
 }
 
-func ReadBitmapAt(file *os.File, offset uint32, size uint32) (*Bitmap, error) {
-	data := make([]uint8, size)
+// WordCount is the number of 64 bit words covering the bitmap.
+func (b Bitmap) WordCount() uint32 {
+	return (b.size + 63) / 64
+}
+
+// Word returns 64 bits starting at bit 64*index, the first bit being the
+// most significant one. Bits past the end of the bitmap read as set.
+func (b Bitmap) Word(index uint32) uint64 {
+	var chunk [8]byte
+	start := int(index) * 8
+	n := copy(chunk[:], b.Data[start:min(start+8, len(b.Data))])
+	for i := n; i < 8; i++ {
+		chunk[i] = 0xff
+	}
+	word := binary.BigEndian.Uint64(chunk[:])
+
+	if tail := int64(b.size) - int64(index)*64; tail < 64 {
+		word |= math.MaxUint64 >> tail
+	}
+	return word
+}
+
+// Count returns the number of bits equal to value.
+func (b Bitmap) Count(value int) uint32 {
+	var set uint32
+	for i := uint32(0); i < b.WordCount(); i++ {
+		set += uint32(bits.OnesCount64(b.Word(i)))
+	}
+	set -= b.WordCount()*64 - b.size
+	if value == 1 {
+		return set
+	}
+	return b.size - set
+}
+
+// RunLengths returns the lengths of all maximal runs of bits equal to value,
+// in the order they appear in the bitmap.
+func (b *Bitmap) RunLengths(value int) []uint32 {
+	var result []uint32
+	var current uint32
+	for i := uint32(0); i < b.size; i++ {
+		bit, _ := b.GetBit(i)
+		if bit == value {
+			current++
+			continue
+		}
+		if current > 0 {
+			result = append(result, current)
+			current = 0
+		}
+	}
+	if current > 0 {
+		result = append(result, current)
+	}
+	return result
+}
+
+func ReadBitmapAt(file blockdevice.BlockDevice, offset uint32, size uint32) (*Bitmap, error) {
+	data := make([]uint8, (size+7)/8)
 
 	_, err := file.ReadAt(data, int64(offset))
 	if err != nil {
@@ -80,7 +144,7 @@ func (b Bitmap) Save() error {
 	return b.writeAt(b.file, b.offset)
 }
 
-func (b Bitmap) writeAt(file *os.File, offset uint32) error {
+func (b Bitmap) writeAt(file blockdevice.BlockDevice, offset uint32) error {
 	_, err := file.WriteAt(b.Data, int64(offset))
 	if err != nil {
 		return err
@@ -0,0 +1,156 @@
+package blockdevice
+
+import (
+	"file-system/internal/errs"
+	"io"
+	"os"
+	"sync"
+)
+
+// BlockDevice is the storage an image lives on. Devices can be stacked:
+// a wrapper takes a device and is a device itself.
+type BlockDevice interface {
+	io.ReaderAt
+	io.WriterAt
+	// Size returns the number of bytes written to the device so far
+	Size() (int64, error)
+	Sync() error
+	Close() error
+}
+
+// readOnlyDevice is implemented by devices rejecting all writes.
+type readOnlyDevice interface {
+	ReadOnly() bool
+}
+
+// namedDevice is implemented by devices that have a name to show in
+// /proc/mounts.
+type namedDevice interface {
+	Name() string
+}
+
+// IsReadOnly reports whether the device rejects writes.
+func IsReadOnly(device BlockDevice) bool {
+	d, ok := device.(readOnlyDevice)
+	return ok && d.ReadOnly()
+}
+
+// Name returns the name of the device or "none" if it has no name.
+func Name(device BlockDevice) string {
+	if d, ok := device.(namedDevice); ok {
+		return d.Name()
+	}
+	return "none"
+}
+
+// File is a device backed by a file of the host.
+type File struct {
+	*os.File
+}
+
+// OpenFile opens an existing image file.
+func OpenFile(name string) (*File, error) {
+	file, err := os.OpenFile(name, os.O_RDWR, 0666)
+	if err != nil {
+		return nil, err
+	}
+	return &File{file}, nil
+}
+
+// CreateFile creates an empty image file, truncating an existing one.
+func CreateFile(name string) (*File, error) {
+	file, err := os.Create(name)
+	if err != nil {
+		return nil, err
+	}
+	return &File{file}, nil
+}
+
+func (f *File) Size() (int64, error) {
+	info, err := f.Stat()
+	if err != nil {
+		return 0, err
+	}
+	return info.Size(), nil
+}
+
+// Memory is a device keeping the whole image in RAM. It grows on writes
+// past its end like a file does.
+type Memory struct {
+	mu   sync.RWMutex
+	data []byte
+}
+
+func NewMemory(data []byte) *Memory {
+	return &Memory{data: data}
+}
+
+func (m *Memory) ReadAt(p []byte, offset int64) (int, error) {
+	m.mu.RLock()
+	defer m.mu.RUnlock()
+
+	if offset >= int64(len(m.data)) {
+		return 0, io.EOF
+	}
+	n := copy(p, m.data[offset:])
+	if n < len(p) {
+		return n, io.EOF
+	}
+	return n, nil
+}
+
+func (m *Memory) WriteAt(p []byte, offset int64) (int, error) {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+
+	if end := offset + int64(len(p)); end > int64(len(m.data)) {
+		m.data = append(m.data, make([]byte, end-int64(len(m.data)))...)
+	}
+	return copy(m.data[offset:], p), nil
+}
+
+func (m *Memory) Size() (int64, error) {
+	m.mu.RLock()
+	defer m.mu.RUnlock()
+	return int64(len(m.data)), nil
+}
+
+// Bytes returns a copy of the image.
+func (m *Memory) Bytes() []byte {
+	m.mu.RLock()
+	defer m.mu.RUnlock()
+	return append([]byte(nil), m.data...)
+}
+
+func (m *Memory) Name() string {
+	return "memory"
+}
+
+func (m *Memory) Sync() error {
+	return nil
+}
+
+func (m *Memory) Close() error {
+	return nil
+}
+
+// ReadOnly wraps a device and rejects every write to it.
+type ReadOnly struct {
+	BlockDevice
+}
+
+func NewReadOnly(device BlockDevice) *ReadOnly {
+	return &ReadOnly{device}
+}
+
+func (r *ReadOnly) WriteAt(p []byte, offset int64) (int, error) {
+	return 0, errs.ErrReadOnlyFileSystem
+}
+
+func (r *ReadOnly) ReadOnly() bool {
+	return true
+}
+
+func (r *ReadOnly) Name() string {
+	return Name(r.BlockDevice)
+}
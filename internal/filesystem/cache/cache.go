@@ -0,0 +1,245 @@
+package cache
+
+import (
+	"bytes"
+	"container/list"
+	"file-system/internal/filesystem/blockdevice"
+	"io"
+	"sort"
+	"sync"
+)
+
+type Policy int
+
+const (
+	// WriteThrough passes every change to the device at once and keeps the
+	// cache for reads only.
+	WriteThrough Policy = iota
+	// WriteBack keeps changes in memory until the page is evicted or the
+	// cache is flushed.
+	WriteBack
+)
+
+type page struct {
+	index int64
+	data  []byte
+	dirty bool
+}
+
+// Cache is an LRU page cache in front of a block device and a block device
+// itself. Writes that do not change the cached bytes are dropped, so
+// rewriting a whole bitmap to flip one bit costs a single page write.
+type Cache struct {
+	mu       sync.Mutex
+	device   blockdevice.BlockDevice
+	pageSize int64
+	capacity int
+	policy   Policy
+	size     int64
+	pages    map[int64]*list.Element
+	lru      *list.List
+}
+
+// NewCache creates a cache of capacity pages over device. Capacity below
+// one is raised to one.
+func NewCache(device blockdevice.BlockDevice, pageSize uint32, capacity int, policy Policy) (*Cache, error) {
+	size, err := device.Size()
+	if err != nil {
+		return nil, err
+	}
+
+	return &Cache{
+		device:   device,
+		pageSize: int64(pageSize),
+		capacity: max(capacity, 1),
+		policy:   policy,
+		size:     size,
+		pages:    make(map[int64]*list.Element),
+		lru:      list.New(),
+	}, nil
+}
+
+func (c *Cache) ReadAt(p []byte, offset int64) (int, error) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+
+	length := int64(len(p))
+	if offset+length > c.size {
+		length = max(c.size-offset, 0)
+	}
+
+	var n int64
+	for n < length {
+		pg, err := c.page((offset + n) / c.pageSize)
+		if err != nil {
+			return int(n), err
+		}
+		start := (offset + n) % c.pageSize
+		n += int64(copy(p[n:length], pg.data[start:]))
+	}
+
+	if n < int64(len(p)) {
+		return int(n), io.EOF
+	}
+	return int(n), nil
+}
+
+func (c *Cache) WriteAt(p []byte, offset int64) (int, error) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+
+	var n int64
+	for n < int64(len(p)) {
+		index := (offset + n) / c.pageSize
+		start := (offset + n) % c.pageSize
+		end := min(c.pageSize, start+int64(len(p))-n)
+		chunk := p[n : n+end-start]
+
+		pg, err := c.page(index)
+		if err != nil {
+			return int(n), err
+		}
+		// Growing the image has to reach the device even when the new
+		// bytes are zeros
+		grows := offset+n+int64(len(chunk)) > c.size
+
+		if changed := !bytes.Equal(pg.data[start:end], chunk); changed || grows {
+			if c.policy == WriteThrough {
+				if _, err := c.device.WriteAt(chunk, offset+n); err != nil {
+					return int(n), err
+				}
+			} else {
+				pg.dirty = true
+			}
+			copy(pg.data[start:end], chunk)
+			c.size = max(c.size, offset+n+int64(len(chunk)))
+		}
+		n += int64(len(chunk))
+	}
+
+	return int(n), nil
+}
+
+// Flush writes all dirty pages to the device, joining neighbouring pages
+// into one write.
+func (c *Cache) Flush() error {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	return c.flush()
+}
+
+// Sync flushes the cache and syncs the device.
+func (c *Cache) Sync() error {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+
+	if err := c.flush(); err != nil {
+		return err
+	}
+	return c.device.Sync()
+}
+
+// Size returns the size of the image including writes not yet flushed.
+func (c *Cache) Size() (int64, error) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	return c.size, nil
+}
+
+// Close flushes the cache and closes the device under it.
+func (c *Cache) Close() error {
+	if err := c.Sync(); err != nil {
+		c.device.Close()
+		return err
+	}
+	return c.device.Close()
+}
+
+// Dirty returns the number of pages not yet written to the device.
+func (c *Cache) Dirty() int {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+
+	var result int
+	for _, element := range c.pages {
+		if element.Value.(*page).dirty {
+			result++
+		}
+	}
+	return result
+}
+
+func (c *Cache) flush() error {
+	var dirty []*page
+	for _, element := range c.pages {
+		if pg := element.Value.(*page); pg.dirty {
+			dirty = append(dirty, pg)
+		}
+	}
+	sort.Slice(dirty, func(i, j int) bool { return dirty[i].index < dirty[j].index })
+
+	for i := 0; i < len(dirty); {
+		j := i + 1
+		for j < len(dirty) && dirty[j].index == dirty[j-1].index+1 {
+			j++
+		}
+
+		run := make([]byte, 0, int64(j-i)*c.pageSize)
+		for _, pg := range dirty[i:j] {
+			run = append(run, pg.data...)
+		}
+		if err := c.writePages(dirty[i].index, run); err != nil {
+			return err
+		}
+		for _, pg := range dirty[i:j] {
+			pg.dirty = false
+		}
+		i = j
+	}
+
+	return nil
+}
+
+// writePages writes data starting at the page, cut at the end of the image
+// so that flushing never grows the device past what was written.
+func (c *Cache) writePages(index int64, data []byte) error {
+	offset := index * c.pageSize
+	end := min(offset+int64(len(data)), c.size)
+	if end <= offset {
+		return nil
+	}
+	_, err := c.device.WriteAt(data[:end-offset], offset)
+	return err
+}
+
+// page returns the cached page, reading it from the device on a miss and
+// evicting the least recently used page when the cache is full.
+func (c *Cache) page(index int64) (*page, error) {
+	if element, ok := c.pages[index]; ok {
+		c.lru.MoveToFront(element)
+		return element.Value.(*page), nil
+	}
+
+	pg := &page{index: index, data: make([]byte, c.pageSize)}
+	if offset := index * c.pageSize; offset < c.size {
+		_, err := c.device.ReadAt(pg.data[:min(c.pageSize, c.size-offset)], offset)
+		if err != nil && err != io.EOF {
+			return nil, err
+		}
+	}
+
+	for c.lru.Len() >= c.capacity {
+		oldest := c.lru.Back()
+		victim := oldest.Value.(*page)
+		if victim.dirty {
+			if err := c.writePages(victim.index, victim.data); err != nil {
+				return nil, err
+			}
+		}
+		c.lru.Remove(oldest)
+		delete(c.pages, victim.index)
+	}
+
+	c.pages[index] = c.lru.PushFront(pg)
+	return pg, nil
+}
@@ -0,0 +1,101 @@
+package cache
+
+import (
+	"bytes"
+	"file-system/internal/filesystem/blockdevice"
+	"testing"
+)
+
+// countingDevice counts writes to check what reaches the device.
+type countingDevice struct {
+	*blockdevice.Memory
+	writes int
+}
+
+func newCountingDevice(size int) *countingDevice {
+	return &countingDevice{Memory: blockdevice.NewMemory(make([]byte, size))}
+}
+
+func (d *countingDevice) WriteAt(p []byte, offset int64) (int, error) {
+	d.writes++
+	return d.Memory.WriteAt(p, offset)
+}
+
+func TestWriteBackFlush(t *testing.T) {
+	device := newCountingDevice(64)
+	c, _ := NewCache(device, 16, 8, WriteBack)
+
+	c.WriteAt([]byte("hello"), 14)
+	c.WriteAt([]byte("world"), 50)
+	if device.writes != 0 {
+		t.Fatalf("Write-back cache wrote %d times before Flush", device.writes)
+	}
+
+	read := make([]byte, 5)
+	c.ReadAt(read, 14)
+	if string(read) != "hello" {
+		t.Errorf("ReadAt mismatch: expected \"hello\", got %q", read)
+	}
+
+	if err := c.Flush(); err != nil {
+		t.Fatalf("Flush error: %v", err)
+	}
+	// Pages 0 and 1 are joined, page 3 is written on its own
+	if device.writes != 2 {
+		t.Errorf("Flush wrote %d times, expected 2", device.writes)
+	}
+	if !bytes.Equal(device.Bytes()[14:19], []byte("hello")) || !bytes.Equal(device.Bytes()[50:55], []byte("world")) {
+		t.Errorf("Device content mismatch after Flush: %q", device.Bytes())
+	}
+	if len(device.Bytes()) != 64 {
+		t.Errorf("Flush changed the device size to %d", len(device.Bytes()))
+	}
+}
+
+func TestUnchangedWritesDropped(t *testing.T) {
+	device := newCountingDevice(64)
+	c, _ := NewCache(device, 16, 8, WriteThrough)
+
+	bitmap := make([]byte, 32)
+	c.WriteAt(bitmap, 0)
+	if device.writes != 0 {
+		t.Errorf("Writing unchanged bytes reached the device %d times", device.writes)
+	}
+
+	bitmap[20] = 1
+	c.WriteAt(bitmap, 0)
+	if device.writes != 1 || device.Bytes()[20] != 1 {
+		t.Errorf("Expected one write of the changed page, got %d", device.writes)
+	}
+}
+
+func TestEviction(t *testing.T) {
+	device := newCountingDevice(64)
+	c, _ := NewCache(device, 16, 2, WriteBack)
+
+	c.WriteAt([]byte{1}, 0)
+	c.WriteAt([]byte{2}, 16)
+	c.WriteAt([]byte{3}, 32)
+	if device.Bytes()[0] != 1 || c.Dirty() != 2 {
+		t.Errorf("Least recently used dirty page was not written on eviction")
+	}
+
+	read := make([]byte, 1)
+	c.ReadAt(read, 0)
+	if read[0] != 1 {
+		t.Errorf("Evicted page read back as %d, expected 1", read[0])
+	}
+}
+
+func TestGrowingWrite(t *testing.T) {
+	device := newCountingDevice(0)
+	c, _ := NewCache(device, 16, 4, WriteThrough)
+
+	c.WriteAt(make([]byte, 40), 0)
+	if len(device.Bytes()) != 40 {
+		t.Errorf("Zero write did not grow the device: size %d, expected 40", len(device.Bytes()))
+	}
+	if _, err := c.ReadAt(make([]byte, 8), 36); err == nil {
+		t.Errorf("Expected io.EOF reading past the end")
+	}
+}
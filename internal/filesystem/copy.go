@@ -0,0 +1,276 @@
+package filesystem
+
+import (
+	"errors"
+	"file-system/internal/errs"
+	"file-system/internal/filesystem/inode"
+	"fmt"
+	pathpkg "path"
+)
+
+// CopyOption configures CopyFile.
+type CopyOption func(*copyOptions)
+
+// existingPolicy decides what happens to a target file that already exists.
+type existingPolicy int
+
+const (
+	existingFail existingPolicy = iota
+	existingSkip
+	existingOverwrite
+	existingUpdate
+)
+
+type copyOptions struct {
+	archive  bool
+	existing existingPolicy
+}
+
+// CopyArchive preserves the mode, the times and the hidden flag of every
+// copied entry, like cp -a. The owner is kept only when root copies;
+// otherwise the copier owns the copy and the set-id bits are dropped.
+// Device nodes are copied as devices rather than read.
+//
+// Unlike cp -a there are no extended attributes or hard links to keep: an
+// inode stores only the fields above, and every inode is named by exactly
+// one directory entry, as the image has no link count and no way to add a
+// second name. Each copied entry therefore gets its own new inode.
+func CopyArchive() CopyOption {
+	return func(o *copyOptions) {
+		o.archive = true
+	}
+}
+
+// CopyNoClobber leaves existing target files untouched.
+func CopyNoClobber() CopyOption {
+	return func(o *copyOptions) {
+		o.existing = existingSkip
+	}
+}
+
+// CopyOverwrite replaces the content of existing target files.
+func CopyOverwrite() CopyOption {
+	return func(o *copyOptions) {
+		o.existing = existingOverwrite
+	}
+}
+
+// CopyUpdate replaces existing target files only if the source was
+// modified later.
+func CopyUpdate() CopyOption {
+	return func(o *copyOptions) {
+		o.existing = existingUpdate
+	}
+}
+
+// copier copies entries between two file systems, which may be the same.
+// The caller holds the locks of both, so their Locked methods are used. A
+// failing entry is recorded and the rest of the tree is still copied.
+type copier struct {
+	from, to *FileSystem
+	copyOptions
+	errors []error
+}
+
+func newCopier(from, to *FileSystem, opts []CopyOption) *copier {
+	c := &copier{from: from, to: to}
+	for _, opt := range opts {
+		opt(&c.copyOptions)
+	}
+	return c
+}
+
+// copy copies the entry at pathFrom to pathTo and, for a directory, the
+// tree below it. The children are listed before the target is created, so
+// copying a directory into itself ends.
+func (c *copier) copy(pathFrom, pathTo string) {
+	if _, ok := c.from.procPath(pathFrom); ok {
+		c.copyContent(pathFrom, pathTo, nil)
+		return
+	}
+
+	source, err := c.from.statLocked(pathFrom)
+	if err != nil {
+		c.fail(err)
+		return
+	}
+	if source.IsFile() {
+		c.copyContent(pathFrom, pathTo, source)
+		return
+	}
+
+	names, err := c.from.childNames(pathFrom)
+	if err != nil {
+		c.fail(err)
+		return
+	}
+
+	target, err := c.to.statLocked(pathTo)
+	switch {
+	case errors.Is(err, errs.ErrRecordNotFound):
+		err = c.to.createEntityLocked(pathTo, false, "", c.archive && source.IsHidden())
+	case err == nil && target.IsFile():
+		err = fmt.Errorf("%w - %s", errs.ErrRecordIsNotDirectory, pathpkg.Base(pathTo))
+	}
+	if err != nil {
+		c.fail(err)
+		return
+	}
+
+	for _, name := range names {
+		c.copy(pathpkg.Join(pathFrom, name), pathpkg.Join(pathTo, name))
+	}
+
+	if c.archive && (target == nil || c.existing != existingSkip) {
+		c.fail(c.to.preserveAttributes(pathTo, source))
+	}
+}
+
+// copyContent copies a file. A nil source is a /proc entry, which has no
+// inode and is copied by content only.
+func (c *copier) copyContent(pathFrom, pathTo string, source *inode.Inode) {
+	target, err := c.to.statLocked(pathTo)
+	exists := err == nil
+	if err != nil && !errors.Is(err, errs.ErrRecordNotFound) {
+		c.fail(err)
+		return
+	}
+
+	if exists {
+		name := pathpkg.Base(pathTo)
+		switch {
+		case !target.IsFile():
+			c.fail(fmt.Errorf("%w - %s", errs.ErrRecordIsNotFile, name))
+			return
+		case c.existing == existingSkip:
+			return
+		case c.existing == existingUpdate && source != nil && source.ModificationTime <= target.ModificationTime:
+			return
+		case c.existing == existingFail:
+			c.fail(fmt.Errorf("%w - %s", errs.ErrRecordAlreadyExists, name))
+			return
+		}
+	}
+
+	if c.archive && source != nil && source.IsDevice() {
+		if exists {
+			c.fail(fmt.Errorf("%w - %s", errs.ErrRecordAlreadyExists, pathpkg.Base(pathTo)))
+			return
+		}
+		err = c.to.createDeviceNodeLocked(pathTo, source.GetDeviceNumber())
+	} else {
+		var content string
+		if content, err = c.from.readFileLocked(pathFrom); err == nil {
+			if exists {
+				err = c.to.editFileLocked(pathTo, content)
+			} else {
+				err = c.to.createEntityLocked(pathTo, true, content, c.archive && source != nil && source.IsHidden())
+			}
+		}
+	}
+	if err != nil {
+		c.fail(err)
+		return
+	}
+
+	if c.archive && source != nil {
+		c.fail(c.to.preserveAttributes(pathTo, source))
+	}
+}
+
+func (c *copier) fail(err error) {
+	if err != nil {
+		c.errors = append(c.errors, err)
+	}
+}
+
+func (c *copier) err() error {
+	return errors.Join(c.errors...)
+}
+
+// statLocked returns the inode of the entry at path, taken from the layer
+// of an overlay that serves it.
+func (fs *FileSystem) statLocked(path string) (*inode.Inode, error) {
+	if fs.lower != nil {
+		absolutePath := fs.overlayPath(path)
+		switch fs.layerOf(absolutePath) {
+		case layerNone:
+			return nil, fmt.Errorf("%w - %s", errs.ErrRecordNotFound, pathpkg.Base(absolutePath))
+		case layerLower:
+			fileInode, _, err := fs.lower.statPath(absolutePath)
+			return fileInode, err
+		}
+	}
+	fileInode, _, err := fs.statPath(path)
+	return fileInode, err
+}
+
+// childNames returns the names in the directory at path without "." and
+// "..". Hidden entries are included unless the directory belongs to an
+// overlay, where they are whiteouts.
+func (fs *FileSystem) childNames(path string) ([]string, error) {
+	var names []string
+	if fs.lower != nil {
+		var err error
+		if names, err = fs.listDirectory(path, false); err != nil {
+			return nil, err
+		}
+	} else {
+		nd, err := fs.lookup(path)
+		if err != nil {
+			return nil, err
+		}
+		if err := fs.checkSearchPermission(nd.entry, nd.name); err != nil {
+			return nil, err
+		}
+		if fs.userManager.Current != nil && !nd.entry.HasReadPermission(*fs.userManager.Current) {
+			return nil, fmt.Errorf("%w - list %s", errs.ErrPermissionDenied, nd.name)
+		}
+		dir, err := fs.directoryManager.OpenDirectory(nd.entry, nd.entryIndex)
+		if err != nil {
+			return nil, err
+		}
+		records, err := fs.directoryManager.Records(dir)
+		if err != nil {
+			return nil, err
+		}
+		for _, r := range records {
+			names = append(names, r.Name)
+		}
+	}
+
+	result := names[:0]
+	for _, name := range names {
+		if name != "." && name != ".." {
+			result = append(result, name)
+		}
+	}
+	return result, nil
+}
+
+// preserveAttributes gives the entry at path the mode, times and, when root
+// copies, the owner of source.
+func (fs *FileSystem) preserveAttributes(path string, source *inode.Inode) error {
+	if err := fs.copyUp(path); err != nil {
+		return err
+	}
+	fileInode, inodeIndex, err := fs.statPath(path)
+	if err != nil {
+		return err
+	}
+
+	permissions := source.GetPermissions()
+	currentUser := fs.userManager.Current
+	if currentUser == nil || currentUser.UserId == 0 {
+		fs.quotaManager.Transfer(fileInode.UserId, source.UserId, fs.blockUsage(fileInode), 1)
+		fileInode.UserId = source.UserId
+		fileInode.GroupId = source.GroupId
+	} else {
+		permissions &^= inode.SetUserIdBit | inode.SetGroupIdBit
+	}
+
+	fileInode.SetPermissions(permissions)
+	fileInode.CreationTime = source.CreationTime
+	fileInode.ModificationTime = source.ModificationTime
+	return fs.inodeManager.SaveInode(fileInode, inodeIndex)
+}
@@ -0,0 +1,210 @@
+package filesystem
+
+import (
+	"context"
+	"errors"
+	"file-system/internal/errs"
+	"file-system/internal/filesystem/directory/record"
+	"file-system/internal/filesystem/managers/directorymanager"
+	"fmt"
+)
+
+// DefragReport summarizes a defragmentation run. Extents are maximal runs
+// of consecutive blocks of a single file.
+type DefragReport struct {
+	Files   int
+	Moved   int
+	Skipped int
+
+	ExtentsBefore int
+	ExtentsAfter  int
+
+	FreeFragmentationBefore float64
+	FreeFragmentationAfter  float64
+}
+
+// Defragment moves the data blocks of every file and directory under path
+// into contiguous runs. Each file is copied to its new place first and the
+// old blocks are released only after the inode points at the copy. A file
+// that fails to move keeps its old blocks and the new ones are released,
+// so every file stays readable and no block is lost. Cancelling ctx stops
+// between two files. Only root may defragment.
+func (fs *FileSystem) Defragment(ctx context.Context, path string) (*DefragReport, error) {
+	return fs.session.Defragment(ctx, path)
+}
+
+func (fs *FileSystem) defragmentLocked(ctx context.Context, path string) (*DefragReport, error) {
+	target, path := fs.resolveMount(path)
+	if target != nil {
+		return target.Defragment(ctx, path)
+	}
+
+	if fs.userManager.Current != nil && fs.userManager.Current.UserId != 0 {
+		return nil, errs.ErrPermissionDenied
+	}
+	if err := fs.checkWritable(path); err != nil {
+		return nil, err
+	}
+
+	inodeIndices, err := fs.collectInodes(path)
+	if err != nil {
+		return nil, err
+	}
+
+	report := &DefragReport{Files: len(inodeIndices)}
+	_, _, report.FreeFragmentationBefore = fs.freeSpaceFragmentation()
+
+	for _, inodeIndex := range inodeIndices {
+		if err := ctx.Err(); err != nil {
+			_, _, report.FreeFragmentationAfter = fs.freeSpaceFragmentation()
+			return report, err
+		}
+
+		before, after, err := fs.defragmentInode(inodeIndex)
+		if errors.Is(err, errs.ErrNoSpaceLeft) {
+			report.Skipped++
+		} else if err != nil {
+			return report, err
+		} else if after < before {
+			report.Moved++
+		}
+		report.ExtentsBefore += before
+		report.ExtentsAfter += after
+	}
+
+	_, _, report.FreeFragmentationAfter = fs.freeSpaceFragmentation()
+	return report, nil
+}
+
+// defragmentInode moves the data of the inode into a single run and returns
+// its extent count before and after.
+func (fs *FileSystem) defragmentInode(inodeIndex uint32) (int, int, error) {
+	fileInode, err := fs.inodeManager.ReadInode(inodeIndex)
+	if err != nil {
+		return 0, 0, err
+	}
+	if fileInode.IsDevice() || fileInode.FileSize == 0 {
+		return 0, 0, nil
+	}
+	unlock := fs.inodeLocks.lock(inodeIndex)
+	defer unlock()
+
+	oldBlocks, err := fs.blockManager.GetBlockIndices(fileInode)
+	if err != nil {
+		return 0, 0, err
+	}
+	extents := countExtents(oldBlocks)
+	if extents <= 1 {
+		return extents, extents, nil
+	}
+
+	newBlocks, err := fs.blockAllocator.AllocateContiguous(0, fileInode.FileSize)
+	if err != nil {
+		return extents, extents, err
+	}
+	fs.superblock.FreeBlockCount -= fileInode.FileSize
+	fs.saveAllocationState()
+
+	// abandon points the entries moved so far back at their old blocks and
+	// releases the new ones
+	abandon := func(moved int, err error) (int, int, error) {
+		for i := 0; i < moved; i++ {
+			fs.blockManager.SetBlockIndex(fileInode, uint32(i), oldBlocks[i], fs.takeFreeBlock)
+		}
+		for _, newBlock := range newBlocks {
+			fs.freeBlock(newBlock)
+		}
+		fs.saveAllocationState()
+		return extents, extents, err
+	}
+
+	for i, oldBlock := range oldBlocks {
+		data, err := fs.blockManager.ReadBlock(oldBlock)
+		if err != nil {
+			return abandon(0, err)
+		}
+		if err := fs.blockManager.WriteBlock(newBlocks[i], data); err != nil {
+			return abandon(0, err)
+		}
+	}
+
+	for i, newBlock := range newBlocks {
+		if err := fs.blockManager.SetBlockIndex(fileInode, uint32(i), newBlock, fs.takeFreeBlock); err != nil {
+			return abandon(i, err)
+		}
+	}
+	fs.inodeManager.SaveInode(fileInode, inodeIndex)
+
+	var result error
+	for _, oldBlock := range oldBlocks {
+		if err := fs.freeBlock(oldBlock); err != nil && result == nil {
+			result = err
+		}
+	}
+	fs.saveAllocationState()
+
+	return extents, 1, result
+}
+
+// collectInodes returns the inode at path and, for a directory, every
+// inode below it.
+func (fs *FileSystem) collectInodes(path string) ([]uint32, error) {
+	nd, err := fs.lookup(path)
+	if err != nil {
+		return nil, err
+	}
+	if nd.entry.IsFile() {
+		return []uint32{nd.entryIndex}, nil
+	}
+
+	var result []uint32
+	dir, err := fs.directoryManager.OpenDirectory(nd.entry, nd.entryIndex)
+	if err != nil {
+		return nil, err
+	}
+	err = fs.collectDirectoryInodes(dir, &result)
+	return result, err
+}
+
+func (fs *FileSystem) collectDirectoryInodes(dir *directorymanager.Handle, result *[]uint32) error {
+	*result = append(*result, dir.InodeIndex)
+
+	records, err := fs.directoryManager.Records(dir)
+	if err != nil {
+		return err
+	}
+
+	for _, r := range records {
+		if r.Name == "." || r.Name == ".." {
+			continue
+		}
+		if r.Type() != record.TypeDirectory {
+			*result = append(*result, r.Inode)
+			continue
+		}
+
+		dirInode, err := fs.inodeManager.ReadInode(r.Inode)
+		if err != nil {
+			return fmt.Errorf("%w - %s", err, r.Name)
+		}
+		subdirectory, err := fs.directoryManager.OpenDirectory(dirInode, r.Inode)
+		if err != nil {
+			return fmt.Errorf("%w - %s", err, r.Name)
+		}
+		if err := fs.collectDirectoryInodes(subdirectory, result); err != nil {
+			return err
+		}
+	}
+
+	return nil
+}
+
+func countExtents(blockIndices []uint32) int {
+	var result int
+	for i, blockIndex := range blockIndices {
+		if i == 0 || blockIndex != blockIndices[i-1]+1 {
+			result++
+		}
+	}
+	return result
+}
@@ -0,0 +1,101 @@
+package device
+
+import (
+	"crypto/rand"
+	"file-system/internal/errs"
+	"fmt"
+	"io"
+)
+
+// Device is a character device driver. Offsets are accepted for symmetry
+// with regular files, but none of the built-in devices is seekable.
+type Device interface {
+	ReadAt(p []byte, offset int64) (int, error)
+	WriteAt(p []byte, offset int64) (int, error)
+}
+
+type Node struct {
+	Name   string
+	Number uint32
+}
+
+var (
+	Null    = MakeDeviceNumber(1, 3)
+	Zero    = MakeDeviceNumber(1, 5)
+	Full    = MakeDeviceNumber(1, 7)
+	URandom = MakeDeviceNumber(1, 9)
+)
+
+// StandardNodes lists the device nodes created in /dev on format.
+var StandardNodes = []Node{
+	{"null", Null},
+	{"zero", Zero},
+	{"full", Full},
+	{"urandom", URandom},
+}
+
+var drivers = map[uint32]Device{
+	Null:    nullDevice{},
+	Zero:    zeroDevice{},
+	Full:    fullDevice{},
+	URandom: randomDevice{},
+}
+
+func MakeDeviceNumber(major, minor uint8) uint32 {
+	return uint32(major)<<8 | uint32(minor)
+}
+
+func SplitDeviceNumber(number uint32) (uint8, uint8) {
+	return uint8(number >> 8), uint8(number)
+}
+
+func Lookup(number uint32) (Device, error) {
+	driver, ok := drivers[number]
+	if !ok {
+		major, minor := SplitDeviceNumber(number)
+		return nil, fmt.Errorf("%w - %d:%d", errs.ErrNoSuchDevice, major, minor)
+	}
+	return driver, nil
+}
+
+type nullDevice struct{}
+
+func (nullDevice) ReadAt(p []byte, offset int64) (int, error) {
+	return 0, io.EOF
+}
+
+func (nullDevice) WriteAt(p []byte, offset int64) (int, error) {
+	return len(p), nil
+}
+
+type zeroDevice struct{}
+
+func (zeroDevice) ReadAt(p []byte, offset int64) (int, error) {
+	clear(p)
+	return len(p), nil
+}
+
+func (zeroDevice) WriteAt(p []byte, offset int64) (int, error) {
+	return len(p), nil
+}
+
+type fullDevice struct{}
+
+func (fullDevice) ReadAt(p []byte, offset int64) (int, error) {
+	clear(p)
+	return len(p), nil
+}
+
+func (fullDevice) WriteAt(p []byte, offset int64) (int, error) {
+	return 0, errs.ErrNoSpaceLeft
+}
+
+type randomDevice struct{}
+
+func (randomDevice) ReadAt(p []byte, offset int64) (int, error) {
+	return rand.Read(p)
+}
+
+func (randomDevice) WriteAt(p []byte, offset int64) (int, error) {
+	return len(p), nil
+}
@@ -0,0 +1,130 @@
+package filesystem
+
+import (
+	"errors"
+	"file-system/internal/errs"
+	"file-system/internal/filesystem/device"
+	"file-system/internal/filesystem/inode"
+	"fmt"
+	"io"
+)
+
+const devicePermissions = 666
+
+// CreateDeviceNode creates a character device inode at path (mknod).
+// Only root may create device nodes.
+func (fs *FileSystem) CreateDeviceNode(path string, deviceNumber uint32) error {
+	return fs.session.CreateDeviceNode(path, deviceNumber)
+}
+
+func (fs *FileSystem) createDeviceNodeLocked(path string, deviceNumber uint32) error {
+	target, path := fs.resolveMount(path)
+	if target != nil {
+		return target.CreateDeviceNode(path, deviceNumber)
+	}
+
+	if err := fs.checkWritable(path); err != nil {
+		return err
+	}
+
+	if fs.userManager.Current != nil && fs.userManager.Current.UserId != 0 {
+		return errs.ErrPermissionDenied
+	}
+	if fs.lower != nil {
+		return fs.createInOverlay(path, false, func() error {
+			return fs.createDeviceNode(path, deviceNumber, false)
+		})
+	}
+
+	return fs.createDeviceNode(path, deviceNumber, false)
+}
+
+// createDeviceNode creates the device inode in the current image. Hidden
+// nodes serve as overlay whiteouts.
+func (fs *FileSystem) createDeviceNode(path string, deviceNumber uint32, hidden bool) (err error) {
+	nd, err := fs.namei(path)
+	if err != nil {
+		return err
+	}
+	name := nd.name
+
+	if err := validateName(name); err != nil {
+		return err
+	}
+
+	if nd.entry != nil {
+		return fmt.Errorf("%w - %s", errs.ErrRecordAlreadyExists, name)
+	}
+
+	if err := fs.quotaManager.Charge(0, 0, 1); err != nil {
+		return err
+	}
+
+	inodeIndex, err := fs.takeFreeInode()
+	if err != nil {
+		fs.quotaManager.Release(0, 0, 1)
+		return err
+	}
+	defer func() {
+		if err != nil {
+			fs.abandonInode(inodeIndex, nil, 0)
+		}
+	}()
+
+	fs.superblock.Save()
+	fs.inodeBitmap.Save()
+
+	deviceInode, err := inode.NewDeviceInode(devicePermissions, 0, 0, deviceNumber)
+	if err != nil {
+		return err
+	}
+	deviceInode.SetHidden(hidden)
+	if err := fs.inodeManager.SaveInode(deviceInode, inodeIndex); err != nil {
+		return err
+	}
+
+	return fs.addDirectoryRecord(nd.parent, inodeIndex, deviceInode, name)
+}
+
+func (fs *FileSystem) createStandardDevices() error {
+	if err := fs.createDirectoryLocked("/dev"); err != nil {
+		return err
+	}
+	for _, node := range device.StandardNodes {
+		if err := fs.createDeviceNodeLocked("/dev/"+node.Name, node.Number); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// readContent returns the content of a regular file or, for device inodes,
+// one block worth of data produced by the driver.
+func (fs *FileSystem) readContent(fileInode *inode.Inode, name string) (string, error) {
+	if !fileInode.IsDevice() {
+		return fs.blockManager.ReadBlocks(fileInode, name)
+	}
+
+	driver, err := device.Lookup(fileInode.GetDeviceNumber())
+	if err != nil {
+		return "", err
+	}
+
+	data := make([]byte, fs.superblock.BlockSize)
+	n, err := driver.ReadAt(data, 0)
+	if err != nil && !errors.Is(err, io.EOF) {
+		return "", err
+	}
+
+	return string(data[:n]), nil
+}
+
+func (fs *FileSystem) writeDevice(fileInode *inode.Inode, content string) error {
+	driver, err := device.Lookup(fileInode.GetDeviceNumber())
+	if err != nil {
+		return err
+	}
+
+	_, err = driver.WriteAt([]byte(content), 0)
+	return err
+}
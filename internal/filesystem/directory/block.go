@@ -0,0 +1,142 @@
+package directory
+
+import (
+	"encoding/binary"
+	"file-system/internal/filesystem/directory/record"
+)
+
+// Directory blocks follow ext2: records never cross a block boundary and
+// the record lengths of a block add up to the block size. A record with an
+// empty name is unused space. Inode 0 is the root directory here, so it
+// can't mark free records like in ext2.
+
+// DecodeBlock returns the used records of a directory block.
+func DecodeBlock(data []byte) []record.Record {
+	var result []record.Record
+	for offset := 0; offset < len(data); {
+		r, ok := record.ReadRecordAt(data, offset)
+		if !ok {
+			break
+		}
+		if r.NameLength != 0 {
+			result = append(result, r)
+		}
+		offset += int(r.RecordLength)
+	}
+	return result
+}
+
+// EncodeBlock packs the records into one block, giving the remaining space
+// to the last record. It reports false if they don't fit.
+func EncodeBlock(records []record.Record, blockSize uint32) ([]byte, bool) {
+	data := make([]byte, blockSize)
+	offset := 0
+	for i, r := range records {
+		r.RecordLength = r.Size()
+		if offset+int(r.RecordLength) > int(blockSize) {
+			return nil, false
+		}
+		if i == len(records)-1 {
+			r.RecordLength = uint16(int(blockSize) - offset)
+		}
+		copy(data[offset:], r.Encode())
+		offset += int(r.RecordLength)
+	}
+	return data, true
+}
+
+// InsertIntoBlock stores the record in the first gap large enough for it,
+// splitting the slack off the record that owns it. It reports false if the
+// block has no such gap.
+func InsertIntoBlock(data []byte, newRecord record.Record) bool {
+	needed := newRecord.Size()
+
+	if _, ok := record.ReadRecordAt(data, 0); !ok {
+		newRecord.RecordLength = uint16(len(data))
+		copy(data, newRecord.Encode())
+		return true
+	}
+
+	for offset := 0; offset < len(data); {
+		r, ok := record.ReadRecordAt(data, offset)
+		if !ok {
+			break
+		}
+
+		if r.NameLength == 0 && r.RecordLength >= needed {
+			newRecord.RecordLength = r.RecordLength
+			copy(data[offset:], newRecord.Encode())
+			return true
+		}
+
+		if used := r.Size(); r.NameLength != 0 && r.RecordLength-used >= needed {
+			newRecord.RecordLength = r.RecordLength - used
+			setRecordLength(data, offset, used)
+			copy(data[offset+int(used):], newRecord.Encode())
+			return true
+		}
+
+		offset += int(r.RecordLength)
+	}
+
+	return false
+}
+
+// DeleteFromBlock removes the named record. Its space is merged into the
+// preceding record, or marked unused if it's the first one in the block.
+// The freed bytes are cleared. It reports false if the name is not here.
+func DeleteFromBlock(data []byte, name string) bool {
+	previous := -1
+	for offset := 0; offset < len(data); {
+		r, ok := record.ReadRecordAt(data, offset)
+		if !ok {
+			break
+		}
+
+		if r.NameLength != 0 && r.Name == name {
+			end := offset + int(r.RecordLength)
+			if previous == -1 {
+				clear(data[offset:end])
+				setRecordLength(data, offset, r.RecordLength)
+			} else {
+				clear(data[offset:end])
+				previousRecord, _ := record.ReadRecordAt(data, previous)
+				setRecordLength(data, previous, previousRecord.RecordLength+r.RecordLength)
+			}
+			return true
+		}
+
+		previous = offset
+		offset += int(r.RecordLength)
+	}
+	return false
+}
+
+// ReplaceInBlock points the named record at another inode in place. It
+// reports false if the name is not here.
+func ReplaceInBlock(data []byte, name string, inode uint32, fileType uint8) bool {
+	for offset := 0; offset < len(data); {
+		r, ok := record.ReadRecordAt(data, offset)
+		if !ok {
+			break
+		}
+
+		if r.NameLength != 0 && r.Name == name {
+			r.Inode, r.FileType = inode, fileType
+			copy(data[offset:], r.Encode())
+			return true
+		}
+
+		offset += int(r.RecordLength)
+	}
+	return false
+}
+
+// IsBlockEmpty reports whether the block holds no used records.
+func IsBlockEmpty(data []byte) bool {
+	return len(DecodeBlock(data)) == 0
+}
+
+func setRecordLength(data []byte, offset int, recordLength uint16) {
+	binary.BigEndian.PutUint16(data[offset+4:offset+6], recordLength)
+}
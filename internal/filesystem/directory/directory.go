@@ -1,106 +1,132 @@
 package directory
 
 import (
-	"encoding/binary"
 	"file-system/internal/errs"
 	"file-system/internal/filesystem/directory/record"
 	"fmt"
 )
 
+// FoldFunc maps a name to the key it is compared by. A nil FoldFunc
+// compares names exactly.
+type FoldFunc func(name string) string
+
 type Directory struct {
 	records map[string]record.Record
 	keys    []string
+	fold    FoldFunc
 }
 
-func NewDirectory(inode uint32, parentInode uint32) *Directory {
-	currDir := record.NewRecord(inode, ".")
-	parentDir := record.NewRecord(parentInode, "..")
-
-	records := make(map[string]record.Record)
-	records[currDir.Name] = currDir
-	records[parentDir.Name] = parentDir
-
-	return &Directory{
-		records: records,
-		keys:    []string{".", ".."},
+func NewDirectory(inode uint32, parentInode uint32, fold FoldFunc) *Directory {
+	directory := &Directory{
+		records: make(map[string]record.Record),
+		fold:    fold,
 	}
+	directory.AddFile(inode, ".", record.TypeDirectory)
+	directory.AddFile(parentInode, "..", record.TypeDirectory)
+
+	return directory
 }
 
-func ReadDirectoryFromBytes(data []byte) (*Directory, error) {
+func ReadDirectoryFromBytes(data []byte, blockSize uint32, fold FoldFunc) (*Directory, error) {
 	directory := Directory{
 		records: make(map[string]record.Record),
+		fold:    fold,
 	}
-	offset := 0
-	for {
-		if len(data) < offset+4 {
-			break
-		}
-		inodeData := data[offset : offset+4]
-		inode := binary.BigEndian.Uint32(inodeData)
-		offset += 4
-
-		recordLengthData := data[offset : offset+2]
-		recordLength := binary.BigEndian.Uint16(recordLengthData)
-		if recordLength == 0 {
-			break // Empty record was read
+	for start := 0; start < len(data); start += int(blockSize) {
+		end := min(start+int(blockSize), len(data))
+		for _, record := range DecodeBlock(data[start:end]) {
+			directory.addRecord(record)
 		}
-		offset += 2
-
-		nameLength := data[offset]
-		offset += 1
-
-		nameData := data[offset : offset+int(nameLength)]
-		name := string(nameData)
-		offset += int(nameLength)
-
-		record := record.Record{
-			Inode:        inode,
-			RecordLength: recordLength,
-			NameLength:   nameLength,
-			Name:         name,
-		}
-		directory.records[record.Name] = record
-		directory.keys = append(directory.keys, record.Name)
 	}
 
 	return &directory, nil
 }
 
-func (d *Directory) AddFile(inode uint32, name string) {
-	record := record.NewRecord(inode, name)
-	d.records[record.Name] = record
-	d.keys = append(d.keys, record.Name)
+func (d *Directory) AddFile(inode uint32, name string, fileType uint8) {
+	d.addRecord(record.NewRecord(inode, name, fileType))
 }
 
 func (d *Directory) DeleteFile(name string) {
-	delete(d.records, name)
+	key := d.key(name)
+	delete(d.records, key)
 
 	var newKeys []string
 	for _, v := range d.keys {
-		if v != name {
+		if v != key {
 			newKeys = append(newKeys, v)
 		}
 	}
 	d.keys = newKeys
 }
 
-func (d Directory) Encode() []byte {
+// ReplaceFile points the record of the name at another inode.
+func (d *Directory) ReplaceFile(inode uint32, name string, fileType uint8) {
+	key := d.key(name)
+	if r, ok := d.records[key]; ok {
+		r.Inode, r.FileType = inode, fileType
+		d.records[key] = r
+	}
+}
+
+// Encode packs the records into as many blocks as needed.
+func (d Directory) Encode(blockSize uint32) []byte {
 	data := make([]byte, 0)
+	var blockRecords []record.Record
 	for _, key := range d.keys {
-		bytes := d.records[key].Encode()
-		data = append(data, bytes...)
+		candidate := append(blockRecords, d.records[key])
+		if _, ok := EncodeBlock(candidate, blockSize); ok {
+			blockRecords = candidate
+			continue
+		}
+		block, _ := EncodeBlock(blockRecords, blockSize)
+		data = append(data, block...)
+		blockRecords = []record.Record{d.records[key]}
 	}
-	return data
+	block, _ := EncodeBlock(blockRecords, blockSize)
+	return append(data, block...)
 }
 
 func (d Directory) GetRecords() []string {
-	return d.keys
+	result := make([]string, 0, len(d.keys))
+	for _, key := range d.keys {
+		result = append(result, d.records[key].Name)
+	}
+	return result
 }
 
-func (d Directory) GetInode(recordName string) (uint32, error) {
-	record, exist := d.records[recordName]
+// GetRecord returns the record matching the name. The stored name may
+// differ from the given one when names are folded.
+func (d Directory) GetRecord(recordName string) (record.Record, error) {
+	record, exist := d.records[d.key(recordName)]
 	if exist {
-		return record.Inode, nil
+		return record, nil
+	}
+	return record, fmt.Errorf("%w - %s", errs.ErrRecordNotFound, recordName)
+}
+
+func (d Directory) GetInode(recordName string) (uint32, error) {
+	record, err := d.GetRecord(recordName)
+	return record.Inode, err
+}
+
+// Records returns the records in the order they are stored.
+func (d Directory) Records() []record.Record {
+	result := make([]record.Record, 0, len(d.keys))
+	for _, key := range d.keys {
+		result = append(result, d.records[key])
+	}
+	return result
+}
+
+func (d *Directory) addRecord(r record.Record) {
+	key := d.key(r.Name)
+	d.records[key] = r
+	d.keys = append(d.keys, key)
+}
+
+func (d Directory) key(name string) string {
+	if d.fold == nil {
+		return name
 	}
-	return 0, fmt.Errorf("%w - %s", errs.ErrRecordNotFound, recordName)
+	return d.fold(name)
 }
@@ -0,0 +1,172 @@
+package htree
+
+import (
+	"encoding/binary"
+	"file-system/internal/errs"
+	"file-system/internal/filesystem/directory/record"
+	"fmt"
+	"hash/fnv"
+	"sort"
+)
+
+// An indexed directory keeps its root in logical block 0. The root holds
+// the "." and ".." inodes and the top level of a B+tree keyed by name hash.
+// Interior index nodes hold sorted (hash, block) entries, and leaves are
+// ordinary directory blocks. Entry i covers hashes from its own hash up to
+// the hash of entry i+1.
+const (
+	rootMagic = 0x4854
+	nodeMagic = 0x4849
+
+	rootHeaderSize = 14
+	nodeHeaderSize = 4
+	entrySize      = 8
+)
+
+type Entry struct {
+	Hash  uint32
+	Block uint32
+}
+
+type Root struct {
+	Depth       uint8
+	DotInode    uint32
+	DotDotInode uint32
+	Entries     []Entry
+}
+
+type Node struct {
+	Entries []Entry
+}
+
+func Hash(name string) uint32 {
+	h := fnv.New32a()
+	h.Write([]byte(name))
+	return h.Sum32()
+}
+
+func RootCapacity(blockSize uint32) int {
+	return int(blockSize-rootHeaderSize) / entrySize
+}
+
+func NodeCapacity(blockSize uint32) int {
+	return int(blockSize-nodeHeaderSize) / entrySize
+}
+
+func (r Root) Encode(blockSize uint32) []byte {
+	data := make([]byte, blockSize)
+	binary.BigEndian.PutUint16(data[0:2], rootMagic)
+	data[2] = r.Depth
+	binary.BigEndian.PutUint32(data[4:8], r.DotInode)
+	binary.BigEndian.PutUint32(data[8:12], r.DotDotInode)
+	binary.BigEndian.PutUint16(data[12:14], uint16(len(r.Entries)))
+	encodeEntries(data[rootHeaderSize:], r.Entries)
+	return data
+}
+
+func DecodeRoot(data []byte) (*Root, error) {
+	if binary.BigEndian.Uint16(data[0:2]) != rootMagic {
+		return nil, fmt.Errorf("%w - bad index root", errs.ErrCorruptedDirectory)
+	}
+	count := int(binary.BigEndian.Uint16(data[12:14]))
+	entries, err := decodeEntries(data[rootHeaderSize:], count)
+	if err != nil {
+		return nil, err
+	}
+	return &Root{
+		Depth:       data[2],
+		DotInode:    binary.BigEndian.Uint32(data[4:8]),
+		DotDotInode: binary.BigEndian.Uint32(data[8:12]),
+		Entries:     entries,
+	}, nil
+}
+
+func (n Node) Encode(blockSize uint32) []byte {
+	data := make([]byte, blockSize)
+	binary.BigEndian.PutUint16(data[0:2], nodeMagic)
+	binary.BigEndian.PutUint16(data[2:4], uint16(len(n.Entries)))
+	encodeEntries(data[nodeHeaderSize:], n.Entries)
+	return data
+}
+
+func DecodeNode(data []byte) (*Node, error) {
+	if binary.BigEndian.Uint16(data[0:2]) != nodeMagic {
+		return nil, fmt.Errorf("%w - bad index node", errs.ErrCorruptedDirectory)
+	}
+	count := int(binary.BigEndian.Uint16(data[2:4]))
+	entries, err := decodeEntries(data[nodeHeaderSize:], count)
+	if err != nil {
+		return nil, err
+	}
+	return &Node{entries}, nil
+}
+
+// Find returns the position of the entry covering hash.
+func Find(entries []Entry, hash uint32) int {
+	position := sort.Search(len(entries), func(i int) bool {
+		return entries[i].Hash > hash
+	})
+	return max(position-1, 0)
+}
+
+// Insert places entry right after position.
+func Insert(entries []Entry, position int, entry Entry) []Entry {
+	result := make([]Entry, 0, len(entries)+1)
+	result = append(result, entries[:position+1]...)
+	result = append(result, entry)
+	return append(result, entries[position+1:]...)
+}
+
+// SplitLeaf sorts the records by hash and divides them roughly in half by
+// size. Records with equal hashes always stay together, so a lookup only
+// ever has to visit one leaf.
+func SplitLeaf(records []record.Record, hash func(name string) uint32) ([]record.Record, []record.Record, error) {
+	sorted := make([]record.Record, len(records))
+	copy(sorted, records)
+	sort.SliceStable(sorted, func(i, j int) bool {
+		return hash(sorted[i].Name) < hash(sorted[j].Name)
+	})
+
+	var total, half int
+	for _, r := range sorted {
+		total += int(r.RecordLength)
+	}
+	middle := 0
+	for middle < len(sorted) && half < total/2 {
+		half += int(sorted[middle].RecordLength)
+		middle++
+	}
+
+	isBoundary := func(i int) bool {
+		return i > 0 && i < len(sorted) && hash(sorted[i-1].Name) != hash(sorted[i].Name)
+	}
+	for offset := 0; offset < len(sorted); offset++ {
+		if isBoundary(middle + offset) {
+			return sorted[:middle+offset], sorted[middle+offset:], nil
+		}
+		if isBoundary(middle - offset) {
+			return sorted[:middle-offset], sorted[middle-offset:], nil
+		}
+	}
+
+	return nil, nil, fmt.Errorf("%w - too many hash collisions", errs.ErrNoSpaceLeft)
+}
+
+func encodeEntries(data []byte, entries []Entry) {
+	for i, e := range entries {
+		binary.BigEndian.PutUint32(data[i*entrySize:], e.Hash)
+		binary.BigEndian.PutUint32(data[i*entrySize+4:], e.Block)
+	}
+}
+
+func decodeEntries(data []byte, count int) ([]Entry, error) {
+	if count*entrySize > len(data) {
+		return nil, fmt.Errorf("%w - bad index entry count", errs.ErrCorruptedDirectory)
+	}
+	entries := make([]Entry, count)
+	for i := range entries {
+		entries[i].Hash = binary.BigEndian.Uint32(data[i*entrySize:])
+		entries[i].Block = binary.BigEndian.Uint32(data[i*entrySize+4:])
+	}
+	return entries, nil
+}
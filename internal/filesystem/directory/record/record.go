@@ -4,31 +4,89 @@ import (
 	"encoding/binary"
 )
 
+const headerSize = 4 + 2 + 1 + 1
+
+// File types use the ext2 numbering. The hidden flag is an addition so
+// that listings can skip hidden entries without reading their inodes.
+const (
+	TypeUnknown    uint8 = 0
+	TypeRegular    uint8 = 1
+	TypeDirectory  uint8 = 2
+	TypeCharDevice uint8 = 3
+	TypeSymlink    uint8 = 7
+
+	TypeHiddenFlag uint8 = 0x80
+)
+
 type Record struct {
 	Inode        uint32
 	RecordLength uint16
 	NameLength   uint8
+	FileType     uint8
 	Name         string
 }
 
-func NewRecord(inode uint32, name string) Record {
+func NewRecord(inode uint32, name string, fileType uint8) Record {
 	recordInstance := Record{}
 
 	recordInstance.Inode = inode
-	recordInstance.RecordLength = uint16(len(name)) + 4 + 2 + 1
 	recordInstance.NameLength = uint8(len(name))
+	recordInstance.FileType = fileType
 	recordInstance.Name = name
+	recordInstance.RecordLength = recordInstance.Size()
 
 	return recordInstance
 }
 
+// Size is the space the record needs, aligned to 4 bytes like in ext2.
+// RecordLength may be larger when the record owns slack after it.
+func (value Record) Size() uint16 {
+	return (headerSize + uint16(value.NameLength) + 3) &^ 3
+}
+
 func (value Record) Encode() []byte {
 	data := make([]byte, value.RecordLength)
 
 	binary.BigEndian.PutUint32(data[0:4], value.Inode)
 	binary.BigEndian.PutUint16(data[4:6], value.RecordLength)
 	data[6] = value.NameLength
-	copy(data[7:7+value.NameLength], value.Name)
+	data[7] = value.FileType
+	copy(data[headerSize:headerSize+int(value.NameLength)], value.Name)
 
 	return data
 }
+
+// Type returns the file type without the hidden flag.
+func (value Record) Type() uint8 {
+	return value.FileType &^ TypeHiddenFlag
+}
+
+func (value Record) IsHidden() bool {
+	return value.FileType&TypeHiddenFlag != 0
+}
+
+// ReadRecordAt decodes the record at offset. It reports false for a zero
+// record length, which marks a block that has never been written, and for
+// a record that does not fit into data or whose name does not fit into it.
+func ReadRecordAt(data []byte, offset int) (Record, bool) {
+	if len(data) < offset+headerSize {
+		return Record{}, false
+	}
+	recordLength := binary.BigEndian.Uint16(data[offset+4 : offset+6])
+	if recordLength == 0 {
+		return Record{}, false
+	}
+	nameLength := data[offset+6]
+	nameStart := offset + headerSize
+	if headerSize+int(nameLength) > int(recordLength) || offset+int(recordLength) > len(data) {
+		return Record{}, false
+	}
+
+	return Record{
+		Inode:        binary.BigEndian.Uint32(data[offset : offset+4]),
+		RecordLength: recordLength,
+		NameLength:   nameLength,
+		FileType:     data[offset+7],
+		Name:         string(data[nameStart : nameStart+int(nameLength)]),
+	}, true
+}
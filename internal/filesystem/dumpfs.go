@@ -0,0 +1,105 @@
+package filesystem
+
+import "math/bits"
+
+// spaceReportRegions is the number of equal parts the block bitmap is split
+// into for the utilisation table.
+const spaceReportRegions = 8
+
+// FreeExtentBucket counts free extents with a length in [Min, Max].
+type FreeExtentBucket struct {
+	Min     uint32
+	Max     uint32
+	Extents int
+	Blocks  uint32
+}
+
+// RegionUsage is the number of used blocks in [Start, End).
+type RegionUsage struct {
+	Start uint32
+	End   uint32
+	Used  uint32
+}
+
+// SpaceReport describes free space of the image as seen by the bitmaps,
+// next to the counters cached in the superblock. A difference between the
+// two means leaked or doubly freed blocks or inodes.
+type SpaceReport struct {
+	BlockSize  uint32
+	BlockCount uint32
+	InodeCount uint32
+
+	SuperblockFreeBlocks uint32
+	SuperblockFreeInodes uint32
+	FreeBlocks           uint32
+	FreeInodes           uint32
+
+	FreeExtents       int
+	LargestFreeExtent uint32
+	Histogram         []FreeExtentBucket
+	Regions           []RegionUsage
+}
+
+// InodeUsage returns the share of used inodes in percent.
+func (r SpaceReport) InodeUsage() float64 {
+	if r.InodeCount == 0 {
+		return 0
+	}
+	return 100 * float64(r.InodeCount-r.FreeInodes) / float64(r.InodeCount)
+}
+
+// Utilisation returns the share of used blocks of the region in percent.
+func (r RegionUsage) Utilisation() float64 {
+	if r.End == r.Start {
+		return 0
+	}
+	return 100 * float64(r.Used) / float64(r.End-r.Start)
+}
+
+// GetSpaceReport recomputes the free space statistics from the bitmaps.
+func (fs *FileSystem) GetSpaceReport() *SpaceReport {
+	fs.mu.Lock()
+	defer fs.mu.Unlock()
+
+	return fs.getSpaceReportLocked()
+}
+
+func (fs *FileSystem) getSpaceReportLocked() *SpaceReport {
+	sb := fs.superblock
+	report := &SpaceReport{
+		BlockSize:            sb.BlockSize,
+		BlockCount:           sb.BlockCount,
+		InodeCount:           sb.InodeCount,
+		SuperblockFreeBlocks: sb.FreeBlockCount,
+		SuperblockFreeInodes: sb.FreeInodeCount,
+		FreeBlocks:           fs.blockBitmap.Count(0),
+		FreeInodes:           fs.inodeBitmap.Count(0),
+	}
+
+	for _, run := range fs.blockBitmap.RunLengths(0) {
+		report.FreeExtents++
+		report.LargestFreeExtent = max(report.LargestFreeExtent, run)
+
+		// Buckets are powers of two: 1, 2-3, 4-7 and so on
+		bucket := bits.Len32(run) - 1
+		for len(report.Histogram) <= bucket {
+			low := uint32(1) << len(report.Histogram)
+			report.Histogram = append(report.Histogram, FreeExtentBucket{Min: low, Max: 2*low - 1})
+		}
+		report.Histogram[bucket].Extents++
+		report.Histogram[bucket].Blocks += run
+	}
+
+	regionSize := (sb.BlockCount + spaceReportRegions - 1) / spaceReportRegions
+	for start := uint32(0); start < sb.BlockCount && regionSize > 0; start += regionSize {
+		region := RegionUsage{Start: start, End: min(start+regionSize, sb.BlockCount)}
+		for i := region.Start; i < region.End; i++ {
+			if bit, _ := fs.blockBitmap.GetBit(i); bit == 1 {
+				region.Used++
+			}
+		}
+		report.Regions = append(report.Regions, region)
+	}
+
+	return report
+}
@@ -0,0 +1,246 @@
+package filesystem
+
+import (
+	"file-system/internal/errs"
+	"fmt"
+	"math"
+	"sync"
+)
+
+// LockType is the kind of an advisory lock.
+type LockType int
+
+const (
+	// LockShared may be held by any number of open files at once
+	LockShared LockType = iota + 1
+	// LockExclusive conflicts with every other lock
+	LockExclusive
+	// Unlock releases what is held
+	Unlock
+)
+
+// ByteRangeLock is a byte-range lock of SetLock and GetLock. A zero Length
+// reaches to the end of the file, however far it grows.
+type ByteRangeLock struct {
+	Type   LockType
+	Start  int64
+	Length int64
+}
+
+// Advisory locks follow Linux open file description locks: they belong to
+// the open file rather than the session, a descriptor never conflicts with
+// itself and closing it releases everything it holds. Whole-file flock
+// locks and byte-range locks are independent of each other. Nothing stops
+// reads or writes of a locked file; the locks only serve processes that
+// take them.
+
+// Flock takes or releases a lock of the whole file, like flock(2). Without
+// wait a conflicting lock makes it fail with ErrWouldBlock. Changing the
+// type of a held lock first releases it, so it may be lost to a waiter.
+func (fs *FileSystem) Flock(fd int, lockType LockType, wait bool) error {
+	return fs.session.Flock(fd, lockType, wait)
+}
+
+// SetLock takes or releases a byte-range lock, like fcntl(2) with F_OFD_SETLK
+// or, with wait, F_OFD_SETLKW. A shared lock needs a descriptor open for
+// reading and an exclusive one for writing. Locking a range the descriptor
+// holds already changes the type of that part.
+func (fs *FileSystem) SetLock(fd int, lock ByteRangeLock, wait bool) error {
+	return fs.session.SetLock(fd, lock, wait)
+}
+
+// GetLock returns a lock that would conflict with lock, or one of type
+// Unlock if it could be taken, like fcntl(2) with F_OFD_GETLK.
+func (fs *FileSystem) GetLock(fd int, lock ByteRangeLock) (ByteRangeLock, error) {
+	return fs.session.GetLock(fd, lock)
+}
+
+// fileLock is a lock held by an open file on the bytes from start up to
+// end, which is math.MaxInt64 for locks up to the end of the file.
+type fileLock struct {
+	owner      *openFile
+	flock      bool
+	lockType   LockType
+	start, end int64
+}
+
+func (l *fileLock) conflicts(other *fileLock) bool {
+	return l.owner != other.owner && l.flock == other.flock &&
+		(l.lockType == LockExclusive || other.lockType == LockExclusive) &&
+		l.start < other.end && other.start < l.end
+}
+
+// fileLockTable holds the advisory locks of the files of one image. Its
+// lock is the last one taken and waiting for a lock releases it.
+type fileLockTable struct {
+	mu    sync.Mutex
+	cond  *sync.Cond
+	locks map[uint32][]*fileLock
+}
+
+// lock applies want for its owner, waiting for conflicting locks to go if
+// wait is set.
+func (t *fileLockTable) lock(want *fileLock, wait bool) error {
+	t.mu.Lock()
+	defer t.mu.Unlock()
+	if t.cond == nil {
+		t.cond = sync.NewCond(&t.mu)
+		t.locks = make(map[uint32][]*fileLock)
+	}
+
+	of := want.owner
+	if want.flock {
+		t.remove(want)
+	}
+	if want.lockType != Unlock {
+		for conflict := t.conflict(want); conflict != nil; conflict = t.conflict(want) {
+			if !wait {
+				return fmt.Errorf("%w - %s", errs.ErrWouldBlock, of.name)
+			}
+			t.cond.Wait()
+		}
+	}
+	if of.closed {
+		return fmt.Errorf("%w - %s", errs.ErrBadDescriptor, of.name)
+	}
+
+	t.remove(want)
+	if want.lockType != Unlock {
+		t.locks[of.inodeIndex] = append(t.locks[of.inodeIndex], want)
+	}
+	if len(t.locks[of.inodeIndex]) == 0 {
+		delete(t.locks, of.inodeIndex)
+	}
+	return nil
+}
+
+// conflict returns a lock standing in the way of want. An open file that
+// was closed meanwhile has nothing to wait for.
+func (t *fileLockTable) conflict(want *fileLock) *fileLock {
+	if want.owner.closed {
+		return nil
+	}
+	for _, held := range t.locks[want.owner.inodeIndex] {
+		if held.conflicts(want) {
+			return held
+		}
+	}
+	return nil
+}
+
+// remove drops the part of the locks of the owner of l of the same kind
+// that l covers, splitting ranges reaching past it, and wakes up waiters.
+func (t *fileLockTable) remove(l *fileLock) {
+	var result []*fileLock
+	for _, held := range t.locks[l.owner.inodeIndex] {
+		if held.owner != l.owner || held.flock != l.flock || held.end <= l.start || l.end <= held.start {
+			result = append(result, held)
+			continue
+		}
+		if held.start < l.start {
+			before := *held
+			before.end = l.start
+			result = append(result, &before)
+		}
+		if l.end < held.end {
+			after := *held
+			after.start = l.end
+			result = append(result, &after)
+		}
+	}
+	t.locks[l.owner.inodeIndex] = result
+	t.cond.Broadcast()
+}
+
+// test returns a lock conflicting with want without waiting.
+func (t *fileLockTable) test(want *fileLock) *fileLock {
+	t.mu.Lock()
+	defer t.mu.Unlock()
+	return t.conflict(want)
+}
+
+// close marks the open file closed and releases its locks.
+func (t *fileLockTable) close(of *openFile) {
+	t.mu.Lock()
+	defer t.mu.Unlock()
+
+	of.closed = true
+	if t.cond == nil {
+		return
+	}
+	t.remove(&fileLock{owner: of, flock: true, end: math.MaxInt64})
+	t.remove(&fileLock{owner: of, end: math.MaxInt64})
+	if len(t.locks[of.inodeIndex]) == 0 {
+		delete(t.locks, of.inodeIndex)
+	}
+}
+
+func (s *Session) Flock(fd int, lockType LockType, wait bool) error {
+	of, err := s.lockedDescriptor(fd)
+	if err != nil {
+		return err
+	}
+	if lockType < LockShared || lockType > Unlock {
+		return fmt.Errorf("%w - lock type %d", errs.ErrIllegalArgument, lockType)
+	}
+	return of.fs.fileLocks.lock(&fileLock{owner: of, flock: true, lockType: lockType, end: math.MaxInt64}, wait)
+}
+
+func (s *Session) SetLock(fd int, lock ByteRangeLock, wait bool) error {
+	of, err := s.lockedDescriptor(fd)
+	if err != nil {
+		return err
+	}
+	want, err := rangeLock(of, lock)
+	if err != nil {
+		return err
+	}
+	if lock.Type == LockShared && !of.readable() || lock.Type == LockExclusive && !of.writable() {
+		return fmt.Errorf("%w - %d", errs.ErrBadDescriptor, fd)
+	}
+	return of.fs.fileLocks.lock(want, wait)
+}
+
+func (s *Session) GetLock(fd int, lock ByteRangeLock) (ByteRangeLock, error) {
+	of, err := s.lockedDescriptor(fd)
+	if err != nil {
+		return ByteRangeLock{}, err
+	}
+	want, err := rangeLock(of, lock)
+	if err != nil {
+		return ByteRangeLock{}, err
+	}
+	if lock.Type == Unlock {
+		return ByteRangeLock{}, fmt.Errorf("%w - lock type %d", errs.ErrIllegalArgument, lock.Type)
+	}
+
+	conflict := of.fs.fileLocks.test(want)
+	if conflict == nil {
+		return ByteRangeLock{Type: Unlock, Start: lock.Start, Length: lock.Length}, nil
+	}
+	result := ByteRangeLock{Type: conflict.lockType, Start: conflict.start}
+	if conflict.end != math.MaxInt64 {
+		result.Length = conflict.end - conflict.start
+	}
+	return result, nil
+}
+
+// lockedDescriptor returns the open file of fd. Locks are waited for
+// without holding fs.mu, so a descriptor closed meanwhile is noticed by
+// the lock table.
+func (s *Session) lockedDescriptor(fd int) (*openFile, error) {
+	unlock := s.lock()
+	defer unlock()
+	return s.descriptor(fd)
+}
+
+func rangeLock(of *openFile, lock ByteRangeLock) (*fileLock, error) {
+	if lock.Type < LockShared || lock.Type > Unlock || lock.Start < 0 || lock.Length < 0 {
+		return nil, fmt.Errorf("%w - lock %d at %d+%d", errs.ErrIllegalArgument, lock.Type, lock.Start, lock.Length)
+	}
+	end := int64(math.MaxInt64)
+	if lock.Length > 0 && lock.Length <= math.MaxInt64-lock.Start {
+		end = lock.Start + lock.Length
+	}
+	return &fileLock{owner: of, lockType: lock.Type, start: lock.Start, end: end}, nil
+}
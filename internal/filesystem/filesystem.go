@@ -2,39 +2,76 @@ package filesystem
 
 import (
 	"file-system/internal/errs"
+	"file-system/internal/filesystem/allocator"
 	"file-system/internal/filesystem/bitmap"
+	"file-system/internal/filesystem/blockdevice"
+	"file-system/internal/filesystem/cache"
+	"file-system/internal/filesystem/directory"
+	"file-system/internal/filesystem/directory/record"
+	"file-system/internal/filesystem/group"
 	"file-system/internal/filesystem/inode"
 	"file-system/internal/filesystem/managers/blockmanager"
 	"file-system/internal/filesystem/managers/directorymanager"
+	"file-system/internal/filesystem/managers/groupmanager"
 	"file-system/internal/filesystem/managers/inodemanager"
+	"file-system/internal/filesystem/managers/quotamanager"
 	"file-system/internal/filesystem/managers/usermanager"
+	"file-system/internal/filesystem/quota"
 	"file-system/internal/filesystem/superblock"
 	"file-system/internal/filesystem/user"
 	"file-system/internal/utils"
 	"fmt"
-	"os"
+	pathpkg "path"
+	"strconv"
 	"strings"
+	"sync"
 	"time"
 )
 
 type Config struct {
-	FileName     string
-	FileSize     uint32
-	BlockSize    uint32
-	RootUsername string
-	RootPassword string
+	// Image file opened by the shell
+	FileName         string
+	FileSize         uint32
+	BlockSize        uint32
+	RootUsername     string
+	RootPassword     string
+	QuotaGracePeriod time.Duration
+	// Directories larger than this many blocks are converted to hash
+	// trees. Zero keeps every directory linear.
+	DirectoryIndexThreshold uint32
+	// Name handling is fixed at format time and kept in the superblock
+	NormalizeNames       bool
+	CaseInsensitiveNames bool
+	// Blocks reserved in memory after the end of a growing file
+	PreallocationWindow uint32
+	// Pages of the buffer cache and whether changes stay there until Sync
+	CachePages     int
+	CacheWriteBack bool
 }
 
 var FSConfig = Config{
-	FileName:     "filesystem.data",
-	FileSize:     1 * 1024 * 1024,
-	BlockSize:    1024,
-	RootUsername: "root",
-	RootPassword: "root",
+	FileName:         "filesystem.data",
+	FileSize:         1 * 1024 * 1024,
+	BlockSize:        1024,
+	RootUsername:     "root",
+	RootPassword:     "root",
+	QuotaGracePeriod: 7 * 24 * time.Hour,
+
+	DirectoryIndexThreshold: 2,
+	PreallocationWindow:     8,
+	CachePages:              256,
 }
 
+const (
+	defaultFilePermissions      = 666
+	defaultDirectoryPermissions = 777
+	cachePageSize               = 4096
+)
+
 type FileSystem struct {
-	dataFile         *os.File
+	device           blockdevice.BlockDevice
+	cache            *cache.Cache
+	readOnly         bool
 	superblock       *superblock.Superblock
 	blockBitmap      *bitmap.Bitmap
 	inodeBitmap      *bitmap.Bitmap
@@ -42,35 +79,76 @@ type FileSystem struct {
 	blockManager     *blockmanager.BlockManager
 	directoryManager *directorymanager.DirectoryManager
 	userManager      *usermanager.UserManager
+	groupManager     *groupmanager.GroupManager
+	quotaManager     *quotamanager.QuotaManager
+	blockAllocator   *allocator.Allocator
+	inodeAllocator   *allocator.Allocator
+	procMounted      bool
+
+	// Inode of the working directory and the path it was reached by. In
+	// /proc only the path is virtual and the inode is the mount point.
+	cwdInode uint32
+	cwdPath  string
+	// Generation the inode of the working directory had when it was
+	// entered. The generation of an inode counts how often it was freed,
+	// so a directory removed and its inode reused is told apart.
+	cwdGeneration uint32
+	// Images attached at absolute paths and the one holding the working
+	// directory, if any
+	mounts   map[string]*FileSystem
+	cwdMount string
+	// Read-only image under this one when it is an overlay
+	lower *FileSystem
+
+	// Taken by every exported method, see locks.go
+	mu         sync.RWMutex
+	inodeLocks inodeLocks
+	// Guards the free counts of the superblock, the inode generations and
+	// the saving of both bitmaps, which operations holding fs.mu shared
+	// change side by side
+	allocation       sync.Mutex
+	inodeGenerations map[uint32]uint32
+	// Number of open file descriptions of each inode and their advisory
+	// locks, see openfiles.go and filelocks.go
+	openFiles map[uint32]int
+	fileLocks fileLockTable
+	// Session of the methods of FileSystem and the one whose user and
+	// working directory are installed
+	session *Session
+	active  *Session
 }
 
-func OpenFilesystem() (*FileSystem, error) {
-	fs := FileSystem{}
+// OpenFilesystem opens the image stored on device. A read-only device gives
+// a file system rejecting all changes. Options may stack it over another
+// image as an overlay.
+func OpenFilesystem(device blockdevice.BlockDevice, opts ...Option) (*FileSystem, error) {
+	fs := FileSystem{device: device, readOnly: blockdevice.IsReadOnly(device)}
 
 	var err error
-	fs.dataFile, err = os.OpenFile(FSConfig.FileName, os.O_RDWR, 0666)
+	fs.cache, err = newCache(device)
 	if err != nil {
 		return nil, err
 	}
 
-	fs.superblock, err = superblock.ReadSuperblockAt(fs.dataFile, 0)
+	fs.superblock, err = superblock.ReadSuperblockAt(fs.cache, 0)
 	if err != nil {
 		return nil, err
 	}
 
 	blockBitmapOffset := fs.superblock.Size()
 	fs.blockBitmap, err = bitmap.ReadBitmapAt(
-		fs.dataFile,
+		fs.cache,
 		blockBitmapOffset,
 		fs.superblock.BlockCount,
 	)
 	if err != nil {
 		return nil, err
 	}
+	fs.reserveNullBlock()
 
 	inodeBitmapOffset := blockBitmapOffset + fs.blockBitmap.Size()
 	fs.inodeBitmap, err = bitmap.ReadBitmapAt(
-		fs.dataFile,
+		fs.cache,
 		inodeBitmapOffset,
 		fs.superblock.InodeCount,
 	)
@@ -80,40 +158,60 @@ func OpenFilesystem() (*FileSystem, error) {
 
 	fs.InitializeManagers()
 
-	rootDirInode, err := fs.inodeManager.ReadInode(0)
-	if err != nil {
+	fs.cwdPath = "/"
+	fs.session = newSession(&fs)
+	fs.active = fs.session
+
+	if err = fs.LoadGroupManagerData(); err != nil {
 		return nil, err
 	}
 
-	if err = fs.directoryManager.OpenDirectory(rootDirInode, 0, "/"); err != nil {
+	if err = fs.changeUserLocked(FSConfig.RootUsername, FSConfig.RootPassword); err != nil {
 		return nil, err
 	}
 
-	if err = fs.ChangeUser(FSConfig.RootUsername, FSConfig.RootPassword); err != nil {
+	if err = fs.LoadUserManagerData(); err != nil {
 		return nil, err
 	}
 
-	if err = fs.LoadUserManagerData(); err != nil {
+	if err = fs.LoadQuotaManagerData(); err != nil {
+		return nil, err
+	}
+	fs.procMounted = true
+
+	if err = fs.applyOptions(opts); err != nil {
 		return nil, err
 	}
 
 	return &fs, nil
 }
 
-func FormatFilesystem(sizeInBytes uint32, blockSize uint32) (*FileSystem, error) {
-	fs := FileSystem{}
+// FormatFilesystem writes a new image to device, which is expected to be
+// empty.
+func FormatFilesystem(device blockdevice.BlockDevice, sizeInBytes uint32, blockSize uint32) (*FileSystem, error) {
+	fs := FileSystem{device: device}
+	if blockdevice.IsReadOnly(device) {
+		return nil, errs.ErrReadOnlyFileSystem
+	}
 
 	var err error
-	fs.dataFile, err = os.Create(FSConfig.FileName)
+	fs.cache, err = newCache(device)
 	if err != nil {
 		return nil, err
 	}
 
-	fs.superblock = superblock.NewSuperblock(sizeInBytes, blockSize, fs.dataFile)
+	fs.superblock = superblock.NewSuperblock(sizeInBytes, blockSize, fs.cache)
+	if FSConfig.NormalizeNames {
+		fs.superblock.Flags |= superblock.FlagNormalizeNames
+	}
+	if FSConfig.CaseInsensitiveNames {
+		fs.superblock.Flags |= superblock.FlagCaseInsensitiveNames
+	}
 	blockBitmapOffset := fs.superblock.Size()
-	fs.blockBitmap = bitmap.NewBitmap(fs.superblock.BlockCount, fs.dataFile, blockBitmapOffset)
+	fs.blockBitmap = bitmap.NewBitmap(fs.superblock.BlockCount, fs.cache, blockBitmapOffset)
 	inodeBitmapOffset := blockBitmapOffset + fs.blockBitmap.Size()
-	fs.inodeBitmap = bitmap.NewBitmap(fs.superblock.InodeCount, fs.dataFile, inodeBitmapOffset)
+	fs.inodeBitmap = bitmap.NewBitmap(fs.superblock.InodeCount, fs.cache, inodeBitmapOffset)
+	fs.reserveNullBlock()
 
 	fs.superblock.Save()
 	fs.blockBitmap.Save()
@@ -124,17 +222,35 @@ func FormatFilesystem(sizeInBytes uint32, blockSize uint32) (*FileSystem, error)
 	fs.inodeManager.ReserveInodeTableSpace(fs.superblock.InodeCount)
 	fs.blockManager.ReserveBlocksSpace(fs.superblock.BlockCount)
 
-	fs.directoryManager.Path = "/"
-	if err := fs.CreateDirectory("/"); err != nil {
+	fs.cwdPath = "/"
+	fs.session = newSession(&fs)
+	fs.active = fs.session
+	if err := fs.createDirectoryLocked("/"); err != nil {
+		return nil, err
+	}
+	if err := fs.createHiddenDirectoryLocked(".users"); err != nil {
+		return nil, err
+	}
+	if err := fs.createHiddenDirectoryLocked(".groups"); err != nil {
 		return nil, err
 	}
-	if err := fs.CreateHiddenDirectory(".users"); err != nil {
+	if err := fs.createHiddenDirectoryLocked(".quotas"); err != nil {
 		return nil, err
 	}
-	if err := fs.AddUser(FSConfig.RootUsername, FSConfig.RootPassword); err != nil {
+	if err := fs.createStandardDevices(); err != nil {
 		return nil, err
 	}
-	if err := fs.ChangeUser(FSConfig.RootUsername, FSConfig.RootPassword); err != nil {
+	if err := fs.createDirectoryLocked(procRoot); err != nil {
+		return nil, err
+	}
+	if err := fs.changeModeLocked(procRoot, "555"); err != nil {
+		return nil, err
+	}
+	fs.procMounted = true
+	if err := fs.addUserLocked(FSConfig.RootUsername, FSConfig.RootPassword); err != nil {
+		return nil, err
+	}
+	if err := fs.changeUserLocked(FSConfig.RootUsername, FSConfig.RootPassword); err != nil {
 		return nil, err
 	}
 
@@ -145,25 +261,40 @@ func (fs *FileSystem) InitializeManagers() {
 	inodeTableOffset := fs.superblock.Size() + fs.blockBitmap.Size() + fs.inodeBitmap.Size()
 	blocksOffset := inodeTableOffset + fs.superblock.InodeCount*fs.superblock.InodeSize
 
-	fs.inodeManager = inodemanager.NewInodeManager(fs.dataFile, fs.superblock.InodeSize, inodeTableOffset)
-	fs.blockManager = blockmanager.NewBlockManager(fs.dataFile, fs.superblock.BlockSize, blocksOffset)
-	fs.directoryManager = directorymanager.NewDirectoryManager(fs.dataFile, fs.superblock.BlockSize, blocksOffset)
+	fs.inodeManager = inodemanager.NewInodeManager(fs.cache, fs.superblock.InodeSize, inodeTableOffset)
+	fs.blockManager = blockmanager.NewBlockManager(fs.cache, fs.superblock.BlockSize, blocksOffset)
+
+	var fold directory.FoldFunc
+	if fs.superblock.HasFlag(superblock.FlagCaseInsensitiveNames) {
+		fold = foldName
+	}
+	fs.directoryManager = directorymanager.NewDirectoryManager(
+		fs.blockManager,
+		fs.superblock.BlockSize,
+		FSConfig.DirectoryIndexThreshold,
+		fs.RevalidateFileSize,
+		fold,
+	)
 	fs.userManager = usermanager.NewUserManager()
+	fs.blockAllocator = allocator.NewAllocator(fs.blockBitmap, FSConfig.PreallocationWindow)
+	fs.inodeAllocator = allocator.NewAllocator(fs.inodeBitmap, 0)
+	fs.groupManager = groupmanager.NewGroupManager()
+	fs.quotaManager = quotamanager.NewQuotaManager(FSConfig.QuotaGracePeriod)
 }
 
 func (fs *FileSystem) LoadUserManagerData() error {
-	var err error
-	if err = fs.ChangeDirectory(".users"); err != nil {
+	records, err := fs.listDirectory("/.users", false)
+	if err != nil {
 		return err
 	}
 
 	users := make(map[uint16]string)
-	for _, name := range fs.GetCurrentDirectoryRecords(false) {
+	for _, name := range records {
 		if name == "." || name == ".." {
 			continue
 		}
 
-		content, err := fs.ReadFile(fmt.Sprintf("/.users/%s", name))
+		content, err := fs.readUserRecord(name)
 		if err != nil {
 			return err
 		}
@@ -175,603 +306,1793 @@ func (fs *FileSystem) LoadUserManagerData() error {
 	}
 	fs.userManager.LoadUsers(users)
 
-	if err = fs.ChangeDirectory(".."); err != nil {
-		return err
-	}
 	return nil
 }
 
-func (fs *FileSystem) AddUser(username, password string) error {
-	newUser := fs.userManager.CreateNewUser(username, password)
-
-	if err := fs.CreateFileWithContent(fmt.Sprintf("/.users/%s", username), newUser.GetUserString()); err != nil {
+func (fs *FileSystem) LoadGroupManagerData() error {
+	records, err := fs.listDirectory("/.groups", false)
+	if err != nil {
 		return err
 	}
 
-	if newUser.UserId != 0 {
-		userDirPath := fmt.Sprintf("/%s", username)
+	groups := make(map[uint16]*group.Group)
+	for _, name := range records {
+		if name == "." || name == ".." {
+			continue
+		}
 
-		if err := fs.CreateDirectory(userDirPath); err != nil {
+		content, err := fs.readFileLocked(fmt.Sprintf("/.groups/%s", name))
+		if err != nil {
 			return err
 		}
-
-		if err := fs.ChangeOwner(userDirPath, username); err != nil {
+		g, err := group.ReadGroupFromString(content)
+		if err != nil {
 			return err
 		}
+		groups[g.GroupId] = g
 	}
+	fs.groupManager.LoadGroups(groups)
 
 	return nil
 }
 
-func (fs *FileSystem) ChangeUser(username, password string) error {
-	content, err := fs.ReadFile(fmt.Sprintf("/.users/%s", username))
-	if err != nil {
-		return err
+// LoadQuotaManagerData recomputes the usage of every user from the inode
+// table and loads the limits stored in /.quotas.
+func (fs *FileSystem) LoadQuotaManagerData() error {
+	for i := uint32(0); i < fs.superblock.InodeCount; i++ {
+		bit, err := fs.inodeBitmap.GetBit(i)
+		if err != nil {
+			return err
+		}
+		if bit == 0 {
+			continue
+		}
+
+		fileInode, err := fs.inodeManager.ReadInode(i)
+		if err != nil {
+			return err
+		}
+		fs.quotaManager.Account(fileInode.UserId, fs.blockUsage(fileInode), 1)
 	}
 
-	u, err := user.ReadUserFromString(content, password)
+	records, err := fs.listDirectory("/.quotas", false)
 	if err != nil {
 		return err
 	}
 
-	fs.ChangeDirectory("/")
-	fs.userManager.Current = u
+	quotas := make(map[uint16]*quota.Quota)
+	for _, name := range records {
+		if name == "." || name == ".." {
+			continue
+		}
 
-	if u.UserId != 0 {
-		userDirPath := fmt.Sprintf("/%s", username)
-		if err := fs.ChangeDirectory(userDirPath); err != nil {
+		content, err := fs.readFileLocked(fmt.Sprintf("/.quotas/%s", name))
+		if err != nil {
+			return err
+		}
+		q, err := quota.ReadQuotaFromString(content)
+		if err != nil {
 			return err
 		}
+		quotas[q.UserId] = q
 	}
+	fs.quotaManager.LoadQuotas(quotas)
 
 	return nil
 }
 
-func (fs *FileSystem) DeleteUser(username string) error {
-	if fs.userManager.Current.UserId != 0 {
-		return errs.ErrPermissionDenied
-	}
+func (fs *FileSystem) AddUser(username, password string) error {
+	return fs.session.AddUser(username, password)
+}
 
-	content, err := fs.ReadFile(fmt.Sprintf("/.users/%s", username))
+func (fs *FileSystem) addUserLocked(username, password string) error {
+	recordPath, err := userRecordPath(username)
 	if err != nil {
 		return err
 	}
-	userId, err := user.GetUserIdFromString(content)
+	userGroup, err := fs.createGroup(username)
 	if err != nil {
-		return nil
+		return err
 	}
 
-	fs.userManager.DeleteUser(userId)
+	newUser := fs.userManager.CreateNewUser(username, password, userGroup.GroupId)
 
-	if err := fs.DeleteFile(fmt.Sprintf("/.users/%s", username)); err != nil {
+	if err := fs.createFileWithContentLocked(recordPath, newUser.GetUserString()); err != nil {
 		return err
 	}
 
-	if err := fs.DeleteFile(fmt.Sprintf("/%s", username)); err != nil {
-		return err
+	if newUser.UserId != 0 {
+		userDirPath := fmt.Sprintf("/%s", username)
+
+		if err := fs.createDirectoryLocked(userDirPath); err != nil {
+			return err
+		}
+
+		if err := fs.changeOwnerLocked(userDirPath, username); err != nil {
+			return err
+		}
+
+		if err := fs.changeGroupLocked(userDirPath, username); err != nil {
+			return err
+		}
 	}
 
 	return nil
 }
 
-func (fs *FileSystem) ChangeOwner(path string, username string) error {
-	fs.directoryManager.SaveCurrentState()
-	defer fs.directoryManager.LoadLastState()
-
-	fileName, err := fs.evaluatePath(path)
-	if err != nil {
-		return err
+// userRecordPath returns the path of the record of the user in /.users.
+// Usernames reach here from logins over the network too, so only valid
+// names are accepted and none can lead out of /.users.
+func userRecordPath(username string) (string, error) {
+	if err := validateName(username); err != nil {
+		return "", err
 	}
+	return fmt.Sprintf("/.users/%s", username), nil
+}
 
-	inodeIndex, err := fs.directoryManager.Current.GetInode(fileName)
+// readUserRecord returns the record of the user.
+func (fs *FileSystem) readUserRecord(username string) (string, error) {
+	recordPath, err := userRecordPath(username)
 	if err != nil {
-		return err
+		return "", err
 	}
+	return fs.readFileLocked(recordPath)
+}
 
-	fileInode, err := fs.inodeManager.ReadInode(inodeIndex)
-	if err != nil {
-		return err
-	}
+func (fs *FileSystem) ChangeUser(username, password string) error {
+	return fs.session.ChangeUser(username, password)
+}
 
-	content, err := fs.ReadFile(fmt.Sprintf("/.users/%s", username))
+func (fs *FileSystem) changeUserLocked(username, password string) error {
+	content, err := fs.readUserRecord(username)
 	if err != nil {
 		return err
 	}
 
-	fileInode.UserId, err = user.GetUserIdFromString(content)
+	u, err := user.ReadUserFromString(content, password)
 	if err != nil {
 		return err
 	}
 
-	fs.inodeManager.SaveInode(fileInode, inodeIndex)
+	u.Groups = fs.groupManager.GetMemberGroupIds(username)
 
+	fs.setCurrentUser(u)
+	fs.active.env["USER"] = u.Username
+	fs.active.env["HOME"] = homeDirectory(u)
 	return nil
 }
 
-func (fs *FileSystem) CreateEmptyFile(path string) error {
-	return fs.CreateEntity(path, true, "", false)
-}
-
-func (fs *FileSystem) CreateFileWithContent(path, content string) error {
-	return fs.CreateEntity(path, true, content, false)
-}
-
-func (fs *FileSystem) CreateDirectory(path string) error {
-	return fs.CreateEntity(path, false, "", false)
+// setCurrentUser makes u the user of fs and of the images under it.
+func (fs *FileSystem) setCurrentUser(u *user.User) {
+	fs.userManager.Current = u
+	for _, mounted := range fs.mounts {
+		mounted.useIdentityOf(u)
+	}
+	if fs.lower != nil {
+		fs.lower.useIdentityOf(u)
+	}
 }
 
-func (fs *FileSystem) CreateHiddenDirectory(path string) error {
-	return fs.CreateEntity(path, false, "", true)
+func (fs *FileSystem) DeleteUser(username string) error {
+	return fs.session.DeleteUser(username)
 }
 
-func (fs *FileSystem) CreateEntity(path string, isFile bool, content string, hidden bool) error {
-	fs.directoryManager.SaveCurrentState()
-	defer fs.directoryManager.LoadLastState()
+func (fs *FileSystem) deleteUserLocked(username string) error {
+	if fs.userManager.Current.UserId != 0 {
+		return errs.ErrPermissionDenied
+	}
 
-	name, err := fs.evaluatePath(path)
+	recordPath, err := userRecordPath(username)
 	if err != nil {
 		return err
 	}
-
-	if path != "/" {
-		if _, err := fs.directoryManager.Current.GetInode(name); err == nil {
-			return fmt.Errorf("%w - %s", errs.ErrRecordAlreadyExists, name)
-		}
-
-		if fs.userManager.Current != nil && !fs.directoryManager.CurrentInode.HasWritePermission(*fs.userManager.Current) {
-			return fmt.Errorf("%w - %s", errs.ErrPermissionDenied, name)
-		}
+	content, err := fs.readFileLocked(recordPath)
+	if err != nil {
+		return err
 	}
-
-	blockCount := (len(content)-1)/int(fs.superblock.BlockSize) + 1
-	blockIndeces := make([]uint32, blockCount)
-	for i := 0; i < blockCount; i++ {
-		blockIndeces[i], err = fs.blockBitmap.TakeFreeBit()
-		if err != nil {
-			return err
-		}
-		fs.superblock.FreeBlockCount--
+	userId, err := user.GetUserIdFromString(content)
+	if err != nil {
+		return nil
 	}
 
-	inodeIndex, err := fs.inodeBitmap.TakeFreeBit()
+	groupId, err := user.GetGroupIdFromString(content)
 	if err != nil {
 		return err
 	}
-	fs.superblock.FreeInodeCount--
 
-	fs.superblock.Save()
-	fs.blockBitmap.Save()
-	fs.inodeBitmap.Save()
+	fs.userManager.DeleteUser(userId)
 
-	var userId uint16
-	if fs.userManager != nil && fs.userManager.Current != nil {
-		userId = fs.userManager.Current.UserId
+	if err := fs.deleteFileLocked(recordPath); err != nil {
+		return err
 	}
 
-	fileInode, err := inode.NewInode(isFile, hidden, 64, userId, blockIndeces)
-	if err != nil {
+	if err := fs.deleteFileLocked(fmt.Sprintf("/%s", username)); err != nil {
 		return err
 	}
 
-	fs.inodeManager.SaveInode(fileInode, inodeIndex)
-
-	if isFile {
-		if len(content) > 0 {
-			err := fs.blockManager.WriteBlocks(fileInode, content)
-			if err != nil {
-				return err
-			}
+	if _, ok := fs.quotaManager.GetQuota(userId); ok {
+		if err := fs.deleteFileLocked(fmt.Sprintf("/.quotas/%s", username)); err != nil {
+			return err
 		}
-	} else {
-		newDir, _ := fs.directoryManager.CreateNewDirectory(fileInode, inodeIndex)
-		if path == "/" {
-			fs.directoryManager.Current = newDir
-			fs.directoryManager.CurrentInode = fileInode
-			fs.directoryManager.CurrentInodeIndex = inodeIndex
+	}
+	fs.quotaManager.DeleteQuota(userId)
+
+	for _, id := range fs.groupManager.GetMemberGroupIds(username) {
+		g, _ := fs.groupManager.GetGroupById(id)
+		g.RemoveMember(username)
+		if err := fs.saveGroup(g); err != nil {
+			return err
 		}
 	}
 
-	if path != "/" {
-		fs.directoryManager.Current.AddFile(inodeIndex, name)
-		fs.RevalidateFileSize(fs.directoryManager.CurrentInode, len(fs.directoryManager.Current.Encode()))
-		fs.directoryManager.CurrentInode.ModificationTime = uint32(time.Now().Unix())
-		fs.inodeManager.SaveInode(fs.directoryManager.CurrentInode, fs.directoryManager.CurrentInodeIndex)
-		fs.directoryManager.SaveCurrentDirectory()
+	if g, ok := fs.groupManager.GetGroupById(groupId); ok && g.Name == username {
+		if err := fs.deleteGroupLocked(username); err != nil {
+			return err
+		}
 	}
 
 	return nil
 }
 
-func (fs *FileSystem) DeleteFile(path string) error {
-	if strings.Contains(path, "/") {
-		fs.directoryManager.SaveCurrentState()
-		defer fs.directoryManager.LoadLastState()
-	}
+func (fs *FileSystem) AddGroup(name string) error {
+	return fs.session.AddGroup(name)
+}
 
-	name, err := fs.evaluatePath(path)
-	if err != nil {
-		return err
+func (fs *FileSystem) addGroupLocked(name string) error {
+	if fs.userManager.Current.UserId != 0 {
+		return errs.ErrPermissionDenied
 	}
 
-	if name == "." || name == ".." {
-		return fmt.Errorf("%w - %s", errs.ErrIllegalArgument, name)
-	}
+	_, err := fs.createGroup(name)
+	return err
+}
 
-	inodeIndex, err := fs.directoryManager.Current.GetInode(name)
-	if err != nil {
-		return err
-	}
+func (fs *FileSystem) DeleteGroup(name string) error {
+	return fs.session.DeleteGroup(name)
+}
 
-	fileInode, err := fs.inodeManager.ReadInode(inodeIndex)
-	if err != nil {
-		return err
+func (fs *FileSystem) deleteGroupLocked(name string) error {
+	if fs.userManager.Current.UserId != 0 {
+		return errs.ErrPermissionDenied
 	}
 
-	if !fileInode.HasWritePermission(*fs.userManager.Current) {
-		return fmt.Errorf("%w - %s", errs.ErrPermissionDenied, name)
+	g, ok := fs.groupManager.GetGroup(name)
+	if !ok {
+		return fmt.Errorf("%w - %s", errs.ErrGroupNotFound, name)
 	}
 
-	if !fileInode.IsFile() {
-		fs.ChangeDirectory(name)
-		for _, name := range fs.directoryManager.Current.GetRecords() {
-			if name == "." || name == ".." {
-				continue
-			}
-			err := fs.DeleteFile(name)
-			if err != nil {
-				return err
-			}
+	for _, username := range fs.userManager.GetUsernames() {
+		content, err := fs.readUserRecord(username)
+		if err != nil {
+			return err
+		}
+		groupId, err := user.GetGroupIdFromString(content)
+		if err != nil {
+			return err
+		}
+		if groupId == g.GroupId {
+			return fmt.Errorf("%w - %s", errs.ErrGroupInUse, username)
 		}
-		fs.ChangeDirectory("..")
 	}
 
-	fs.directoryManager.Current.DeleteFile(name)
-
-	for i := 0; i < int(fileInode.FileSize); i++ {
-		fs.blockBitmap.SetBit(fileInode.Blocks[i], 0)
-		fs.superblock.FreeBlockCount++
+	if err := fs.deleteFileLocked(fmt.Sprintf("/.groups/%s", name)); err != nil {
+		return err
 	}
-
-	fs.inodeBitmap.SetBit(inodeIndex, 0)
-	fs.superblock.FreeInodeCount++
-
-	fs.blockManager.ResetBlocks(fileInode)
-	fs.inodeManager.ResetInode(inodeIndex)
-
-	fs.RevalidateFileSize(fs.directoryManager.CurrentInode, len(fs.directoryManager.Current.Encode()))
-	fs.directoryManager.CurrentInode.ModificationTime = uint32(time.Now().Unix())
-	fs.inodeManager.SaveInode(fs.directoryManager.CurrentInode, fs.directoryManager.CurrentInodeIndex)
-	fs.directoryManager.SaveCurrentDirectory()
-
-	fs.blockBitmap.Save()
-	fs.inodeBitmap.Save()
-	fs.superblock.Save()
+	fs.groupManager.DeleteGroup(g.GroupId)
+	fs.refreshCurrentUserGroups()
 
 	return nil
 }
 
-func (fs *FileSystem) ChangeDirectory(path string) error {
-	path = strings.TrimSuffix(path, "/")
-	dirs := strings.Split(path, "/")
-
-	for i, dirName := range dirs {
-		var inodeIndex uint32
-		var err error
-
-		if dirName != "" {
-			inodeIndex, err = fs.directoryManager.Current.GetInode(dirName)
-			if err != nil {
-				return err
-			}
-		} else if i != 0 {
-			return fmt.Errorf("incorrect path - %s", path)
-		}
-
-		dirInode, err := fs.inodeManager.ReadInode(inodeIndex)
-		if err != nil {
-			return err
-		}
+func (fs *FileSystem) AddUserToGroup(username, groupName string) error {
+	return fs.session.AddUserToGroup(username, groupName)
+}
 
-		if fs.userManager.Current != nil && !dirInode.HasReadPermission(*fs.userManager.Current) {
-			return fmt.Errorf("%w - cd %s", errs.ErrPermissionDenied, dirName)
-		}
+func (fs *FileSystem) addUserToGroupLocked(username, groupName string) error {
+	if fs.userManager.Current.UserId != 0 {
+		return errs.ErrPermissionDenied
+	}
 
-		if dirInode.IsFile() {
-			return fmt.Errorf("%w - %s", errs.ErrRecordIsNotDirectory, dirName)
-		}
+	if _, err := fs.readUserRecord(username); err != nil {
+		return err
+	}
 
-		if dirName == "" {
-			dirName = "/"
-		}
+	g, ok := fs.groupManager.GetGroup(groupName)
+	if !ok {
+		return fmt.Errorf("%w - %s", errs.ErrGroupNotFound, groupName)
+	}
 
-		if err = fs.directoryManager.OpenDirectory(dirInode, inodeIndex, dirName); err != nil {
-			return err
-		}
+	g.AddMember(username)
+	if err := fs.saveGroup(g); err != nil {
+		return err
 	}
+	fs.refreshCurrentUserGroups()
 
 	return nil
 }
 
-func (fs FileSystem) GetCurrentDirectoryRecords(long bool) []string {
-	recordNames := fs.directoryManager.Current.GetRecords()
-
-	result := make([]string, 0, len(recordNames))
-	for _, name := range recordNames {
-		recordInodeIndex, _ := fs.directoryManager.Current.GetInode(name)
-		recordInode, _ := fs.inodeManager.ReadInode(recordInodeIndex)
+// GetUserGroups returns the names of the primary group of the user followed
+// by its supplementary groups.
+func (fs *FileSystem) GetUserGroups(username string) ([]string, error) {
+	return fs.session.GetUserGroups(username)
+}
 
-		if recordInode.IsHidden() {
-			continue
-		}
+func (fs *FileSystem) getUserGroupsLocked(username string) ([]string, error) {
+	content, err := fs.readUserRecord(username)
+	if err != nil {
+		return nil, err
+	}
+	groupId, err := user.GetGroupIdFromString(content)
+	if err != nil {
+		return nil, err
+	}
 
-		if !long {
-			result = append(result, name)
-			continue
+	result := []string{fs.groupManager.GetGroupName(groupId)}
+	for _, id := range fs.groupManager.GetMemberGroupIds(username) {
+		if id != groupId {
+			result = append(result, fs.groupManager.GetGroupName(id))
 		}
-
-		tapString := recordInode.GetTypeAndPermissionString()
-		ownerUsername := fs.userManager.GetUsername(recordInode.UserId)
-		fileSizeInBytes := recordInode.FileSize * fs.superblock.BlockSize
-		modificationTime := time.Unix(int64(recordInode.ModificationTime), 0)
-		modificationTimeString := modificationTime.Format("Jan 2 15:04")
-
-		result = append(result, fmt.Sprintf("%s\t%s\t%d\t%s\t%s", tapString, ownerUsername, fileSizeInBytes, modificationTimeString, name))
 	}
 
-	return result
+	return result, nil
 }
 
-func (fs FileSystem) ReadFile(path string) (string, error) {
-	fs.directoryManager.SaveCurrentState()
-	defer fs.directoryManager.LoadLastState()
+func (fs *FileSystem) ChangeGroup(path string, groupName string) error {
+	return fs.session.ChangeGroup(path, groupName)
+}
 
-	name, err := fs.evaluatePath(path)
-	if err != nil {
-		return "", err
+func (fs *FileSystem) changeGroupLocked(path string, groupName string) error {
+	target, path := fs.resolveMount(path)
+	if target != nil {
+		return target.ChangeGroup(path, groupName)
 	}
 
-	inodeIndex, err := fs.directoryManager.Current.GetInode(name)
-	if err != nil {
-		return "", err
+	if err := fs.checkWritable(path); err != nil {
+		return err
 	}
-
-	fileInode, err := fs.inodeManager.ReadInode(inodeIndex)
-	if err != nil {
-		return "", err
+	if err := fs.copyUp(path); err != nil {
+		return err
 	}
 
-	if fs.userManager.Current != nil && !fileInode.HasReadPermission(*fs.userManager.Current) {
-		return "", fmt.Errorf("%w - read %s", errs.ErrPermissionDenied, name)
+	g, ok := fs.groupManager.GetGroup(groupName)
+	if !ok {
+		return fmt.Errorf("%w - %s", errs.ErrGroupNotFound, groupName)
 	}
 
-	str, err := fs.blockManager.ReadBlocks(fileInode, name)
+	nd, err := fs.lookup(path)
 	if err != nil {
-		return "", err
+		return err
+	}
+	fileName, inodeIndex, fileInode := nd.name, nd.entryIndex, nd.entry
+
+	currentUser := fs.userManager.Current
+	if currentUser != nil && currentUser.UserId != 0 {
+		if currentUser.UserId != fileInode.UserId || !currentUser.IsMemberOf(g.GroupId) {
+			return fmt.Errorf("%w - chgrp %s", errs.ErrPermissionDenied, fileName)
+		}
 	}
 
-	return str, nil
+	fileInode.GroupId = g.GroupId
+	fs.inodeManager.SaveInode(fileInode, inodeIndex)
+
+	return nil
 }
 
-func (fs FileSystem) EditFile(path string, content string) error {
-	fs.directoryManager.SaveCurrentState()
-	defer fs.directoryManager.LoadLastState()
+func (fs *FileSystem) createGroup(name string) (*group.Group, error) {
+	if _, exists := fs.groupManager.GetGroup(name); exists {
+		return nil, fmt.Errorf("%w - %s", errs.ErrRecordAlreadyExists, name)
+	}
 
-	name, err := fs.evaluatePath(path)
-	if err != nil {
-		return err
+	newGroup := fs.groupManager.CreateNewGroup(name)
+	if err := fs.createFileWithContentLocked(fmt.Sprintf("/.groups/%s", name), newGroup.GetGroupString()); err != nil {
+		fs.groupManager.DeleteGroup(newGroup.GroupId)
+		return nil, err
 	}
 
-	inodeIndex, err := fs.directoryManager.Current.GetInode(name)
-	if err != nil {
+	return newGroup, nil
+}
+
+func (fs *FileSystem) saveGroup(g *group.Group) error {
+	return fs.editFileLocked(fmt.Sprintf("/.groups/%s", g.Name), g.GetGroupString())
+}
+
+func (fs *FileSystem) refreshCurrentUserGroups() {
+	if fs.userManager.Current != nil {
+		fs.userManager.Current.Groups = fs.groupManager.GetMemberGroupIds(fs.userManager.Current.Username)
+	}
+}
+
+func (fs *FileSystem) ChangeOwner(path string, username string) error {
+	return fs.session.ChangeOwner(path, username)
+}
+
+func (fs *FileSystem) changeOwnerLocked(path string, username string) error {
+	target, path := fs.resolveMount(path)
+	if target != nil {
+		return target.ChangeOwner(path, username)
+	}
+
+	if err := fs.checkWritable(path); err != nil {
+		return err
+	}
+	if err := fs.copyUp(path); err != nil {
 		return err
 	}
 
-	fileInode, err := fs.inodeManager.ReadInode(inodeIndex)
+	nd, err := fs.lookup(path)
 	if err != nil {
 		return err
 	}
+	inodeIndex, fileInode := nd.entryIndex, nd.entry
 
-	if !fileInode.HasWritePermission(*fs.userManager.Current) {
-		return fmt.Errorf("%w - %s", errs.ErrPermissionDenied, name)
+	content, err := fs.readUserRecord(username)
+	if err != nil {
+		return err
 	}
 
-	if !fileInode.IsFile() {
-		return fmt.Errorf("%w - %s", errs.ErrRecordIsNotFile, name)
+	userId, err := user.GetUserIdFromString(content)
+	if err != nil {
+		return err
 	}
 
-	fs.blockManager.ResetBlocks(fileInode)
-	fs.RevalidateFileSize(fileInode, len(content))
-	fs.blockManager.WriteBlocks(fileInode, content)
+	fs.quotaManager.Transfer(fileInode.UserId, userId, fs.blockUsage(fileInode), 1)
+	fileInode.UserId = userId
 
-	fileInode.ModificationTime = uint32(time.Now().Unix())
 	fs.inodeManager.SaveInode(fileInode, inodeIndex)
 
 	return nil
 }
 
-func (fs *FileSystem) RevalidateFileSize(fileInode *inode.Inode, contentSize int) error {
-	var err error
-	newFileSize := (contentSize-1)/int(fs.superblock.BlockSize) + 1
-	oldFileSize := int(fileInode.FileSize)
-	if newFileSize > oldFileSize {
-		for i := oldFileSize; i < newFileSize; i++ {
-			fileInode.Blocks[i], err = fs.blockBitmap.TakeFreeBit()
-			if err != nil {
-				return err
-			}
-			fs.superblock.FreeBlockCount--
+func (fs *FileSystem) CreateEmptyFile(path string) error {
+	return fs.session.CreateEmptyFile(path)
+}
+
+func (fs *FileSystem) createEmptyFileLocked(path string) error {
+	return fs.createEntityLocked(path, true, "", false)
+}
+
+func (fs *FileSystem) CreateFileWithContent(path, content string) error {
+	return fs.session.CreateFileWithContent(path, content)
+}
+
+func (fs *FileSystem) createFileWithContentLocked(path, content string) error {
+	return fs.createEntityLocked(path, true, content, false)
+}
+
+func (fs *FileSystem) CreateDirectory(path string) error {
+	return fs.session.CreateDirectory(path)
+}
+
+func (fs *FileSystem) createDirectoryLocked(path string) error {
+	return fs.createEntityLocked(path, false, "", false)
+}
+
+func (fs *FileSystem) CreateHiddenDirectory(path string) error {
+	return fs.session.CreateHiddenDirectory(path)
+}
+
+func (fs *FileSystem) createHiddenDirectoryLocked(path string) error {
+	return fs.createEntityLocked(path, false, "", true)
+}
+
+func (fs *FileSystem) CreateEntity(path string, isFile bool, content string, hidden bool) error {
+	return fs.session.CreateEntity(path, isFile, content, hidden)
+}
+
+func (fs *FileSystem) createEntityLocked(path string, isFile bool, content string, hidden bool) error {
+	target, path := fs.resolveMount(path)
+	if target != nil {
+		return target.CreateEntity(path, isFile, content, hidden)
+	}
+
+	if err := fs.checkWritable(path); err != nil {
+		return err
+	}
+	if fs.lower != nil {
+		return fs.createInOverlay(path, !isFile, func() error {
+			return fs.createEntity(path, isFile, content, hidden)
+		})
+	}
+
+	return fs.createEntity(path, isFile, content, hidden)
+}
+
+// createEntity creates the entry in this image, holding the write lock of
+// the parent directory. Creating "/" formats the root directory, which has
+// no parent to link into.
+func (fs *FileSystem) createEntity(path string, isFile bool, content string, hidden bool) (err error) {
+	var nd *nameidata
+	if path != "/" {
+		var err error
+		if nd, err = fs.namei(path); err != nil {
+			return err
 		}
-	} else if newFileSize < oldFileSize {
-		for i := newFileSize; i < oldFileSize; i++ {
-			err := fs.blockBitmap.SetBit(fileInode.Blocks[i], 0)
-			if err != nil {
-				return err
-			}
-			fileInode.Blocks[i] = 0
-			fs.superblock.FreeBlockCount++
+
+		if err := validateName(nd.name); err != nil {
+			return err
+		}
+
+		unlock, err := fs.lockParent(nd)
+		if err != nil {
+			return err
+		}
+		defer unlock()
+
+		if nd.entry != nil {
+			return fmt.Errorf("%w - %s", errs.ErrRecordAlreadyExists, nd.name)
+		}
+
+		if isFile && strings.HasSuffix(path, "/") {
+			return fmt.Errorf("%w - %s", errs.ErrRecordIsNotDirectory, nd.name)
+		}
+
+		if fs.userManager.Current != nil && !nd.parent.Inode.HasWritePermission(*fs.userManager.Current) {
+			return fmt.Errorf("%w - %s", errs.ErrPermissionDenied, nd.name)
 		}
 	}
-	fileInode.FileSize = uint32(newFileSize)
-	return nil
-}
 
-func (fs *FileSystem) AppendToFile(path string, content string) error {
-	original, err := fs.ReadFile(path)
+	var userId, groupId uint16
+	if fs.userManager != nil && fs.userManager.Current != nil {
+		userId = fs.userManager.Current.UserId
+		groupId = fs.userManager.Current.GroupId
+	}
+
+	if err := fs.quotaManager.Charge(userId, 0, 1); err != nil {
+		return err
+	}
+
+	inodeIndex, err := fs.takeFreeInode()
 	if err != nil {
+		fs.quotaManager.Release(userId, 0, 1)
 		return err
 	}
-	return fs.EditFile(path, original+content)
-}
+	var fileInode *inode.Inode
+	defer func() {
+		if err != nil {
+			fs.abandonInode(inodeIndex, fileInode, userId)
+		}
+	}()
 
-func (fs *FileSystem) MoveFile(pathFrom string, pathTo string) error {
-	fs.directoryManager.SaveCurrentState()
-	defer fs.directoryManager.LoadLastState()
+	permissions := defaultDirectoryPermissions
+	if isFile {
+		permissions = defaultFilePermissions
+	}
 
-	nameFrom, err := fs.evaluatePath(pathFrom)
+	fileInode, err = inode.NewInode(isFile, hidden, permissions, userId, groupId, nil)
 	if err != nil {
 		return err
 	}
+	fileInode.SetPermissions(fileInode.GetPermissions() &^ fs.active.umask)
 
-	inodeIndex, err := fs.directoryManager.Current.GetInode(nameFrom)
-	if err != nil {
-		return nil
+	if nd != nil && nd.parent.Inode.IsSetGroupId() {
+		fileInode.GroupId = nd.parent.Inode.GroupId
+		if !isFile {
+			fileInode.SetPermissions(fileInode.GetPermissions() | inode.SetGroupIdBit)
+		}
 	}
 
-	fs.directoryManager.Current.DeleteFile(nameFrom)
-	fs.RevalidateFileSize(fs.directoryManager.CurrentInode, len(fs.directoryManager.Current.Encode()))
-	fs.directoryManager.CurrentInode.ModificationTime = uint32(time.Now().Unix())
-	fs.inodeManager.SaveInode(fs.directoryManager.CurrentInode, fs.directoryManager.CurrentInodeIndex)
-	fs.directoryManager.SaveCurrentDirectory()
+	if err := fs.RevalidateFileSize(fileInode, len(content)); err != nil {
+		return err
+	}
 
-	fs.directoryManager.LoadLastState()
+	if isFile {
+		if len(content) > 0 {
+			err := fs.blockManager.WriteBlocks(fileInode, content)
+			if err != nil {
+				return err
+			}
+		}
+	} else {
+		parentInodeIndex := inodeIndex
+		if nd != nil {
+			parentInodeIndex = nd.parent.InodeIndex
+		}
+		if err := fs.directoryManager.CreateNewDirectory(fileInode, inodeIndex, parentInodeIndex); err != nil {
+			return err
+		}
+	}
 
-	nameTo, err := fs.evaluatePath(pathTo)
-	if err != nil {
+	if err := fs.inodeManager.SaveInode(fileInode, inodeIndex); err != nil {
 		return err
 	}
+	fs.saveAllocationState()
 
-	fs.directoryManager.Current.AddFile(inodeIndex, nameTo)
-	fs.RevalidateFileSize(fs.directoryManager.CurrentInode, len(fs.directoryManager.Current.Encode()))
-	fs.directoryManager.CurrentInode.ModificationTime = uint32(time.Now().Unix())
-	fs.inodeManager.SaveInode(fs.directoryManager.CurrentInode, fs.directoryManager.CurrentInodeIndex)
-	fs.directoryManager.SaveCurrentDirectory()
+	if nd != nil {
+		return fs.addDirectoryRecord(nd.parent, inodeIndex, fileInode, nd.name)
+	}
 
 	return nil
 }
 
-func (fs *FileSystem) CopyFile(pathFrom string, pathTo string) error {
-	fs.directoryManager.SaveCurrentState()
-	defer fs.directoryManager.LoadLastState()
+// abandonInode gives back an inode taken for an entry that could not be
+// created, together with its blocks and the quota charged for both.
+// fileInode is nil if the inode has no blocks.
+func (fs *FileSystem) abandonInode(inodeIndex uint32, fileInode *inode.Inode, userId uint16) {
+	if fileInode != nil {
+		fs.releaseBlocks(fileInode)
+	}
+	fs.inodeManager.ResetInode(inodeIndex)
+	fs.freeInode(inodeIndex)
+	fs.quotaManager.Release(userId, 0, 1)
+	fs.saveAllocationState()
+}
 
-	nameFrom, err := fs.evaluatePath(pathFrom)
-	if err != nil {
+func (fs *FileSystem) DeleteFile(path string) error {
+	return fs.session.DeleteFile(path)
+}
+
+func (fs *FileSystem) deleteFileLocked(path string) error {
+	if err := fs.checkNotMountPoint(path); err != nil {
+		return err
+	}
+	target, path := fs.resolveMount(path)
+	if target != nil {
+		return target.DeleteFile(path)
+	}
+
+	if err := fs.checkWritable(path); err != nil {
 		return err
 	}
+	if fs.lower != nil {
+		return fs.deleteFromOverlay(path)
+	}
 
-	inodeIndex, err := fs.directoryManager.Current.GetInode(nameFrom)
+	return fs.deleteFile(path)
+}
+
+func (fs *FileSystem) deleteFile(path string) error {
+	nd, err := fs.namei(path)
 	if err != nil {
-		return nil
+		return err
 	}
 
-	fileInode, err := fs.inodeManager.ReadInode(inodeIndex)
+	if nd.name == "." || nd.name == ".." || nd.name == "/" {
+		return fmt.Errorf("%w - %s", errs.ErrIllegalArgument, nd.name)
+	}
+
+	unlock, err := fs.lockParent(nd)
 	if err != nil {
-		return nil
+		return err
 	}
+	defer unlock()
 
-	if fs.userManager.Current != nil && !fileInode.HasReadPermission(*fs.userManager.Current) {
-		return fmt.Errorf("%w - copy %s", errs.ErrPermissionDenied, nameFrom)
+	if nd.entry == nil {
+		return fmt.Errorf("%w - %s", errs.ErrRecordNotFound, nd.name)
 	}
 
-	var fileContent string
-	var directoryRecordNames []string
+	return fs.deleteEntry(nd.parent, nd.name, nd.entryIndex, nd.entry)
+}
 
-	if fileInode.IsFile() {
-		fileContent, err = fs.blockManager.ReadBlocks(fileInode, nameFrom)
-		if err != nil {
+// deleteEntry unlinks the name from the directory, whose write lock the
+// caller holds, and frees its inode under the write lock of the inode. A
+// directory is emptied first.
+func (fs *FileSystem) deleteEntry(dir *directorymanager.Handle, name string, inodeIndex uint32, fileInode *inode.Inode) error {
+	if err := fs.checkEntryRemoval(dir, name, fileInode); err != nil {
+		return err
+	}
+	if err := fs.checkNotOpen(inodeIndex, name); err != nil {
+		return err
+	}
+
+	unlock := fs.inodeLocks.lock(inodeIndex)
+	defer unlock()
+	// Writers holding only the lock of the inode may have changed it
+	fileInode, err := fs.inodeManager.ReadInode(inodeIndex)
+	if err != nil {
+		return err
+	}
+
+	if !fileInode.IsFile() {
+		if err := fs.checkSearchPermission(fileInode, name); err != nil {
 			return err
 		}
-	} else {
-		if err := fs.ChangeDirectory(nameFrom); err != nil {
+		subdirectory, err := fs.directoryManager.OpenDirectory(fileInode, inodeIndex)
+		if err != nil {
 			return err
 		}
-		directoryRecordNames = fs.directoryManager.Current.GetRecords()
-	}
-
-	fs.directoryManager.LoadLastState()
-
-	if fileInode.IsFile() {
-		if err = fs.CreateFileWithContent(pathTo, fileContent); err != nil {
+		records, err := fs.directoryManager.Records(subdirectory)
+		if err != nil {
 			return err
 		}
-	} else {
-		fs.CreateDirectory(pathTo)
-		for _, name := range directoryRecordNames {
-			if name == "." || name == ".." {
+		for _, r := range records {
+			if r.Name == "." || r.Name == ".." {
 				continue
 			}
-			oldPath := pathFrom + "/" + name
-			newPath := pathTo + "/" + name
-			if err := fs.CopyFile(oldPath, newPath); err != nil {
+			recordInode, err := fs.inodeManager.ReadInode(r.Inode)
+			if err != nil {
+				return err
+			}
+			if err := fs.deleteEntry(subdirectory, r.Name, r.Inode, recordInode); err != nil {
 				return err
 			}
 		}
 	}
 
+	if err := fs.directoryManager.DeleteRecord(dir, name); err != nil {
+		return err
+	}
+
+	if err := fs.freeEntry(inodeIndex, fileInode); err != nil {
+		return err
+	}
+
+	fs.saveDirectoryChanges(dir)
+
 	return nil
 }
 
-func (fs *FileSystem) ChangePermissions(path string, value int) error {
-	fs.directoryManager.SaveCurrentState()
-	defer fs.directoryManager.LoadLastState()
+// releaseInode frees an unlinked inode along with its blocks.
+func (fs *FileSystem) releaseInode(inodeIndex uint32, fileInode *inode.Inode) error {
+	unlock := fs.inodeLocks.lock(inodeIndex)
+	defer unlock()
+	return fs.freeEntry(inodeIndex, fileInode)
+}
 
-	name, err := fs.evaluatePath(path)
-	if err != nil {
+// freeEntry frees an unlinked inode whose write lock the caller holds. The
+// inode is cleared before it is freed, since another operation may take it
+// right away.
+func (fs *FileSystem) freeEntry(inodeIndex uint32, fileInode *inode.Inode) error {
+	if !fileInode.IsDevice() {
+		if err := fs.releaseBlocks(fileInode); err != nil {
+			return err
+		}
+	}
+
+	fs.inodeManager.ResetInode(inodeIndex)
+	fs.freeInode(inodeIndex)
+	fs.quotaManager.Release(fileInode.UserId, 0, 1)
+	fs.saveAllocationState()
+
+	return nil
+}
+
+func (fs *FileSystem) ChangeDirectory(path string) error {
+	return fs.session.ChangeDirectory(path)
+}
+
+func (fs *FileSystem) changeDirectoryLocked(path string) error {
+	target, path := fs.resolveMount(path)
+	if target == nil {
+		if err := fs.copyUpDirectory(path); err != nil {
+			return err
+		}
+		if err := fs.changeWorkingDirectory(path); err != nil {
+			return err
+		}
+		fs.cwdMount = ""
+		return nil
+	}
+
+	if err := target.ChangeDirectory(path); err != nil {
 		return err
 	}
+	for mountPath, mounted := range fs.mounts {
+		if mounted == target {
+			fs.cwdMount = mountPath
+		}
+	}
+	return nil
+}
+
+// changeWorkingDirectory makes the directory at path the working
+// directory of fs. The target itself must be searchable too.
+func (fs *FileSystem) changeWorkingDirectory(path string) error {
+	if absolutePath, ok := fs.procPath(path); ok {
+		return fs.changeProcDirectory(absolutePath)
+	}
 
-	inodeIndex, err := fs.directoryManager.Current.GetInode(name)
+	nd, err := fs.lookup(path)
 	if err != nil {
 		return err
 	}
+	if nd.entry.IsFile() {
+		return fmt.Errorf("%w - %s", errs.ErrRecordIsNotDirectory, nd.name)
+	}
+	if err := fs.checkSearchPermission(nd.entry, nd.name); err != nil {
+		return err
+	}
 
-	fileInode, err := fs.inodeManager.ReadInode(inodeIndex)
+	fs.cwdInode, fs.cwdGeneration = nd.entryIndex, nd.entryGeneration
+	fs.cwdPath = utils.AbsolutePath(fs.cwdPath, fs.normalizePath(path))
+	return nil
+}
+
+func (fs *FileSystem) GetCurrentDirectoryRecords(long bool) ([]string, error) {
+	return fs.session.GetCurrentDirectoryRecords(long)
+}
+
+func (fs *FileSystem) getCurrentDirectoryRecordsLocked(long bool) ([]string, error) {
+	if fs.cwdMount != "" {
+		return fs.mounts[fs.cwdMount].GetCurrentDirectoryRecords(long)
+	}
+
+	return fs.listDirectory(".", long)
+}
+
+// listDirectory returns the names of the visible entries of the directory
+// at path, or ls -l style lines if long is set.
+func (fs *FileSystem) listDirectory(path string, long bool) ([]string, error) {
+	if absolutePath, ok := fs.procPath(path); ok {
+		return fs.listProc(absolutePath, long)
+	}
+
+	dir, err := fs.openDirectory(path)
 	if err != nil {
-		return err
+		return nil, err
 	}
 
-	if !fileInode.HasWritePermission(*fs.userManager.Current) {
-		return fmt.Errorf("%w - chmod %s", errs.ErrPermissionDenied, name)
+	if fs.userManager.Current != nil && !dir.Inode.HasReadPermission(*fs.userManager.Current) {
+		return nil, fmt.Errorf("%w - list %s", errs.ErrPermissionDenied, utils.AbsolutePath(fs.cwdPath, path))
 	}
 
-	err = fileInode.ChangePermissions(value)
+	records, err := fs.directoryManager.Records(dir)
 	if err != nil {
-		return err
+		return nil, err
 	}
 
-	fs.inodeManager.SaveInode(fileInode, inodeIndex)
+	result := make([]string, 0, len(records))
+	for _, r := range records {
+		name := r.Name
+		if r.IsHidden() {
+			continue
+		}
 
-	return nil
-}
+		if !long {
+			result = append(result, name)
+			continue
+		}
+
+		recordInode, _ := fs.inodeManager.ReadInode(r.Inode)
+
+		tapString := recordInode.GetTypeAndPermissionString()
+		ownerUsername := fs.userManager.GetUsername(recordInode.UserId)
+		groupName := fs.groupManager.GetGroupName(recordInode.GroupId)
+		fileSizeInBytes := recordInode.FileSize * fs.superblock.BlockSize
+		modificationTime := time.Unix(int64(recordInode.ModificationTime), 0)
+		modificationTimeString := modificationTime.Format("Jan 2 15:04")
 
-func (fs FileSystem) GetCurrentPath() string {
-	return fs.directoryManager.Path
+		result = append(result, fmt.Sprintf("%s\t%s\t%s\t%d\t%s\t%s", tapString, ownerUsername, groupName, fileSizeInBytes, modificationTimeString, name))
+	}
+
+	if fs.lower != nil {
+		return fs.mergeLowerRecords(fs.overlayPath(path), records, result, long)
+	}
+	return result, nil
 }
 
-func (fs FileSystem) GetCurrentUserName() string {
-	return fs.userManager.Current.Username
+// Find walks the tree below the directory at path and returns the paths of
+// all entries of the given record type, or of any type for
+// record.TypeUnknown. Types are taken from directory records, so only
+// directories are opened on the way.
+func (fs *FileSystem) Find(path string, fileType uint8) ([]string, error) {
+	return fs.session.Find(path, fileType)
 }
 
-func (fs *FileSystem) CloseDataFile() error {
-	return fs.dataFile.Close()
+func (fs *FileSystem) findLocked(path string, fileType uint8) ([]string, error) {
+	target, path := fs.resolveMount(path)
+	if target != nil {
+		return target.Find(path, fileType)
+	}
+	if fs.lower != nil {
+		return fs.findInOverlay(path, fileType)
+	}
+	return fs.find(path, fileType)
 }
 
-func (fs *FileSystem) evaluatePath(path string) (string, error) {
-	pathToFolder, name := utils.SplitPath(path)
-	if pathToFolder != "" {
-		err := fs.ChangeDirectory(pathToFolder)
-		if err != nil {
-			return "", err
-		}
+func (fs *FileSystem) find(path string, fileType uint8) ([]string, error) {
+	dir, err := fs.openDirectory(path)
+	if err != nil {
+		return nil, err
 	}
-	return name, nil
+	if err := fs.checkSearchPermission(dir.Inode, path); err != nil {
+		return nil, err
+	}
+
+	var result []string
+	if err := fs.findInDirectory(dir, path, fileType, &result); err != nil {
+		return nil, err
+	}
+	return result, nil
+}
+
+func (fs *FileSystem) findInDirectory(dir *directorymanager.Handle, dirPath string, fileType uint8, result *[]string) error {
+	if fs.userManager.Current != nil && !dir.Inode.HasReadPermission(*fs.userManager.Current) {
+		return fmt.Errorf("%w - list %s", errs.ErrPermissionDenied, dirPath)
+	}
+
+	records, err := fs.directoryManager.Records(dir)
+	if err != nil {
+		return err
+	}
+
+	for _, r := range records {
+		if r.Name == "." || r.Name == ".." || r.IsHidden() {
+			continue
+		}
+
+		entryPath := pathpkg.Join(dirPath, r.Name)
+		if fileType == record.TypeUnknown || r.Type() == fileType {
+			*result = append(*result, entryPath)
+		}
+
+		if r.Type() != record.TypeDirectory {
+			continue
+		}
+		subdirectory, err := fs.walk(dir, dirPath, r.Name)
+		if err != nil {
+			return err
+		}
+		if err := fs.checkSearchPermission(subdirectory.Inode, entryPath); err != nil {
+			return err
+		}
+		if err := fs.findInDirectory(subdirectory, entryPath, fileType, result); err != nil {
+			return err
+		}
+	}
+
+	return nil
+}
+
+// ReadFile returns the content of the file. Only the lookup holds fs.mu;
+// the blocks of a regular file are copied under its inode read lock.
+func (fs *FileSystem) ReadFile(path string) (string, error) {
+	return fs.session.ReadFile(path)
+}
+
+func (fs *FileSystem) readFileLocked(path string) (string, error) {
+	content, file, err := fs.openFileLocked(path)
+	if err != nil || file == nil {
+		return content, err
+	}
+	defer file.release()
+	return fs.blockManager.ReadBlocks(file.inode, file.name)
+}
+
+// openedFile is a regular file found by openFileLocked, whose inode read
+// lock is held until release is called.
+type openedFile struct {
+	inode   *inode.Inode
+	name    string
+	release func()
+}
+
+// openFileLocked looks up a file for reading. Anything but a regular file
+// of fs itself, such as a device, a /proc entry or a file of another
+// image, is read right away and returned as content with a nil file.
+func (fs *FileSystem) openFileLocked(path string) (string, *openedFile, error) {
+	target, path := fs.resolveMount(path)
+	if target != nil {
+		content, err := target.ReadFile(path)
+		return content, nil, err
+	}
+	if fs.lower != nil {
+		absolutePath := fs.overlayPath(path)
+		switch fs.layerOf(absolutePath) {
+		case layerNone:
+			return "", nil, fmt.Errorf("%w - %s", errs.ErrRecordNotFound, pathpkg.Base(absolutePath))
+		case layerLower:
+			content, err := fs.lower.ReadFile(absolutePath)
+			return content, nil, err
+		}
+	}
+
+	if absolutePath, ok := fs.procPath(path); ok {
+		content, err := fs.readProc(absolutePath)
+		return content, nil, err
+	}
+
+	nd, err := fs.lookup(path)
+	if err != nil {
+		return "", nil, err
+	}
+	release, err := fs.rlockEntry(nd)
+	if err != nil {
+		return "", nil, err
+	}
+	name, fileInode := nd.name, nd.entry
+
+	if fs.userManager.Current != nil && !fileInode.HasReadPermission(*fs.userManager.Current) {
+		release()
+		return "", nil, fmt.Errorf("%w - read %s", errs.ErrPermissionDenied, name)
+	}
+
+	if !fileInode.IsFile() || fileInode.IsDevice() {
+		defer release()
+		content, err := fs.readContent(fileInode, name)
+		return content, nil, err
+	}
+	return "", &openedFile{fileInode, name, release}, nil
+}
+
+func (fs *FileSystem) EditFile(path string, content string) error {
+	return fs.session.EditFile(path, content)
+}
+
+func (fs *FileSystem) editFileLocked(path string, content string) error {
+	target, path := fs.resolveMount(path)
+	if target != nil {
+		return target.EditFile(path, content)
+	}
+
+	if err := fs.checkWritable(path); err != nil {
+		return err
+	}
+	if err := fs.copyUp(path); err != nil {
+		return err
+	}
+
+	nd, err := fs.lookup(path)
+	if err != nil {
+		return err
+	}
+	name, inodeIndex, fileInode := nd.name, nd.entryIndex, nd.entry
+
+	if currentUser := fs.userManager.Current; currentUser != nil && !fileInode.HasWritePermission(*currentUser) {
+		return fmt.Errorf("%w - %s", errs.ErrPermissionDenied, name)
+	}
+
+	if !fileInode.IsFile() {
+		return fmt.Errorf("%w - %s", errs.ErrRecordIsNotFile, name)
+	}
+
+	if fileInode.IsDevice() {
+		return fs.writeDevice(fileInode, content)
+	}
+	return fs.writeContent(inodeIndex, fileInode, content)
+}
+
+// writeContent replaces the content of the regular file under its inode
+// lock.
+func (fs *FileSystem) writeContent(inodeIndex uint32, fileInode *inode.Inode, content string) error {
+	unlock := fs.inodeLocks.lock(inodeIndex)
+	defer unlock()
+
+	if err := fs.RevalidateFileSize(fileInode, len(content)); err != nil {
+		return err
+	}
+	if err := fs.blockManager.WriteBlocks(fileInode, content); err != nil {
+		return err
+	}
+
+	fileInode.ModificationTime = uint32(time.Now().Unix())
+	fs.inodeManager.SaveInode(fileInode, inodeIndex)
+	fs.saveAllocationState()
+
+	return nil
+}
+
+// RevalidateFileSize grows or shrinks the inode to fit contentSize bytes
+// and charges the difference, pointer blocks included, to its owner. Quota
+// limits are enforced for regular files and new directories only, so an
+// existing directory never ends up half-updated. Freed blocks are cleared.
+func (fs *FileSystem) RevalidateFileSize(fileInode *inode.Inode, contentSize int) error {
+	newFileSize := uint32((contentSize-1)/int(fs.superblock.BlockSize) + 1)
+	oldFileSize := fileInode.FileSize
+	if newFileSize > fs.blockManager.MaxFileBlocks() {
+		return fmt.Errorf("%w - %d bytes", errs.ErrFileTooLarge, contentSize)
+	}
+
+	oldUsage := oldFileSize + fs.blockManager.IndirectBlockCount(oldFileSize)
+	newUsage := newFileSize + fs.blockManager.IndirectBlockCount(newFileSize)
+
+	if newFileSize > oldFileSize {
+		if fileInode.IsFile() || oldFileSize == 0 {
+			if err := fs.quotaManager.Charge(fileInode.UserId, newUsage-oldUsage, 0); err != nil {
+				return err
+			}
+		} else {
+			fs.quotaManager.Account(fileInode.UserId, newUsage-oldUsage, 0)
+		}
+		// The owner gets back the charge for blocks the inode did not get
+		releaseUnused := func() {
+			usage := fileInode.FileSize + fs.blockManager.IndirectBlockCount(fileInode.FileSize)
+			fs.quotaManager.Release(fileInode.UserId, newUsage-usage, 0)
+		}
+
+		goal := uint32(allocator.NoGoal)
+		if oldFileSize > 0 {
+			lastBlock, err := fs.blockManager.GetBlockIndex(fileInode, oldFileSize-1)
+			if err != nil {
+				releaseUnused()
+				return err
+			}
+			goal = lastBlock + 1
+		}
+
+		blockIndices, err := fs.blockAllocator.AllocateRun(goal, newFileSize-oldFileSize, true)
+		if err != nil {
+			releaseUnused()
+			return err
+		}
+		fs.allocation.Lock()
+		fs.superblock.FreeBlockCount -= uint32(len(blockIndices))
+		fs.allocation.Unlock()
+
+		for i, blockIndex := range blockIndices {
+			logical := oldFileSize + uint32(i)
+			if err := fs.blockManager.SetBlockIndex(fileInode, logical, blockIndex, fs.takeFreeBlock); err != nil {
+				for _, unused := range blockIndices[i:] {
+					fs.freeBlock(unused)
+				}
+				releaseUnused()
+				return err
+			}
+			fileInode.FileSize = logical + 1
+		}
+	} else if newFileSize < oldFileSize {
+		blockIndices, err := fs.blockManager.GetBlockIndices(fileInode)
+		if err != nil {
+			return err
+		}
+		for _, blockIndex := range blockIndices[newFileSize:] {
+			if err := fs.freeBlock(blockIndex); err != nil {
+				return err
+			}
+		}
+		if err := fs.blockManager.TruncateBlockMap(fileInode, newFileSize, fs.freeBlock); err != nil {
+			return err
+		}
+		fs.quotaManager.Release(fileInode.UserId, oldUsage-newUsage, 0)
+	}
+	fileInode.FileSize = newFileSize
+	return nil
+}
+
+// releaseBlocks frees every data and pointer block of the inode.
+func (fs *FileSystem) releaseBlocks(fileInode *inode.Inode) error {
+	blockIndices, err := fs.blockManager.GetBlockIndices(fileInode)
+	if err != nil {
+		return err
+	}
+	for _, blockIndex := range blockIndices {
+		if err := fs.freeBlock(blockIndex); err != nil {
+			return err
+		}
+	}
+	if err := fs.blockManager.TruncateBlockMap(fileInode, 0, fs.freeBlock); err != nil {
+		return err
+	}
+
+	fs.quotaManager.Release(fileInode.UserId, fs.blockUsage(fileInode), 0)
+	fileInode.FileSize = 0
+
+	return nil
+}
+
+// blockUsage counts the data and pointer blocks occupied by the inode.
+func (fs *FileSystem) blockUsage(fileInode *inode.Inode) uint32 {
+	return fileInode.FileSize + fs.blockManager.IndirectBlockCount(fileInode.FileSize)
+}
+
+func (fs *FileSystem) takeFreeBlock() (uint32, error) {
+	blockIndex, err := fs.blockAllocator.Allocate(allocator.NoGoal)
+	if err != nil {
+		return 0, err
+	}
+	fs.allocation.Lock()
+	fs.superblock.FreeBlockCount--
+	fs.allocation.Unlock()
+	return blockIndex, nil
+}
+
+// nullBlock is never handed out, as block maps use 0 for a missing
+// pointer block.
+const nullBlock = 0
+
+// reserveNullBlock marks the null block used. Images formatted before it
+// was reserved may hold data in it, which then keeps it once released.
+func (fs *FileSystem) reserveNullBlock() {
+	if bit, err := fs.blockBitmap.GetBit(nullBlock); err == nil && bit == 0 {
+		fs.blockBitmap.SetBit(nullBlock, 1)
+		fs.superblock.FreeBlockCount--
+	}
+}
+
+func (fs *FileSystem) freeBlock(blockIndex uint32) error {
+	if blockIndex == nullBlock {
+		return fs.blockManager.WriteBlock(blockIndex, nil)
+	}
+	fs.blockAllocator.Free(blockIndex)
+	fs.allocation.Lock()
+	fs.superblock.FreeBlockCount++
+	fs.allocation.Unlock()
+	return fs.blockManager.WriteBlock(blockIndex, nil)
+}
+
+func (fs *FileSystem) takeFreeInode() (uint32, error) {
+	inodeIndex, err := fs.inodeAllocator.Allocate(allocator.NoGoal)
+	if err != nil {
+		return 0, err
+	}
+	fs.allocation.Lock()
+	fs.superblock.FreeInodeCount--
+	fs.allocation.Unlock()
+	return inodeIndex, nil
+}
+
+func (fs *FileSystem) freeInode(inodeIndex uint32) {
+	fs.inodeAllocator.Free(inodeIndex)
+
+	fs.allocation.Lock()
+	defer fs.allocation.Unlock()
+	fs.superblock.FreeInodeCount++
+	if fs.inodeGenerations == nil {
+		fs.inodeGenerations = make(map[uint32]uint32)
+	}
+	fs.inodeGenerations[inodeIndex]++
+}
+
+// generation returns how often the inode has been freed. It only changes
+// under the write lock of the inode.
+func (fs *FileSystem) generation(inodeIndex uint32) uint32 {
+	fs.allocation.Lock()
+	defer fs.allocation.Unlock()
+	return fs.inodeGenerations[inodeIndex]
+}
+
+func (fs *FileSystem) saveAllocationState() {
+	fs.allocation.Lock()
+	defer fs.allocation.Unlock()
+
+	fs.superblock.Save()
+	fs.blockAllocator.Save()
+	fs.inodeAllocator.Save()
+}
+
+func (fs *FileSystem) AppendToFile(path string, content string) error {
+	return fs.session.AppendToFile(path, content)
+}
+
+func (fs *FileSystem) appendToFileLocked(path string, content string) error {
+	original, err := fs.readFileLocked(path)
+	if err != nil {
+		return err
+	}
+	return fs.editFileLocked(path, original+content)
+}
+
+// MoveFile renames the entry like rename(2), replacing an existing file or
+// empty directory at pathTo.
+func (fs *FileSystem) MoveFile(pathFrom string, pathTo string) error {
+	return fs.session.MoveFile(pathFrom, pathTo)
+}
+
+func (fs *FileSystem) moveFileLocked(pathFrom string, pathTo string) error {
+	return fs.renameLocked(pathFrom, pathTo, false)
+}
+
+// MoveFileNoReplace renames the entry but fails if pathTo exists.
+func (fs *FileSystem) MoveFileNoReplace(pathFrom string, pathTo string) error {
+	return fs.session.MoveFileNoReplace(pathFrom, pathTo)
+}
+
+func (fs *FileSystem) moveFileNoReplaceLocked(pathFrom string, pathTo string) error {
+	return fs.renameLocked(pathFrom, pathTo, true)
+}
+
+func (fs *FileSystem) renameLocked(pathFrom string, pathTo string, noReplace bool) error {
+	if err := fs.checkNotMountPoint(pathFrom); err != nil {
+		return err
+	}
+	targetFrom, pathFrom := fs.resolveMount(pathFrom)
+	targetTo, pathTo := fs.resolveMount(pathTo)
+	if targetFrom != targetTo {
+		return fmt.Errorf("%w - %s", errs.ErrCrossDevice, pathTo)
+	}
+	if targetFrom != nil {
+		if noReplace {
+			return targetFrom.MoveFileNoReplace(pathFrom, pathTo)
+		}
+		return targetFrom.MoveFile(pathFrom, pathTo)
+	}
+
+	if err := fs.checkWritable(pathFrom); err != nil {
+		return err
+	}
+	if err := fs.checkWritable(pathTo); err != nil {
+		return err
+	}
+	if fs.lower != nil {
+		return fs.moveInOverlay(pathFrom, pathTo, noReplace)
+	}
+	return fs.moveFile(pathFrom, pathTo, noReplace)
+}
+
+// moveFile links the entry at pathTo before unlinking it at pathFrom. An
+// existing target is replaced in place and freed afterwards. A directory
+// moving to another parent gets its ".." record pointed there.
+func (fs *FileSystem) moveFile(pathFrom string, pathTo string, noReplace bool) error {
+	_, targetName := utils.SplitPath(fs.normalizePath(pathTo))
+	if err := validateName(targetName); err != nil {
+		return err
+	}
+
+	from, err := fs.lookup(pathFrom)
+	if err != nil {
+		return err
+	}
+	if from.name == "." || from.name == ".." || from.name == "/" {
+		return fmt.Errorf("%w - %s", errs.ErrIllegalArgument, from.name)
+	}
+	to, err := fs.namei(pathTo)
+	if err != nil {
+		return err
+	}
+
+	// Changes through one handle would leave the other one stale
+	sameParent := to.parent.InodeIndex == from.parent.InodeIndex
+	if sameParent {
+		to.parent = from.parent
+	}
+
+	if to.entry != nil && to.entryIndex == from.entryIndex {
+		// Only the spelling may differ on a case-insensitive image
+		if to.name == from.name {
+			return nil
+		}
+		if err := fs.checkEntryRemoval(from.parent, from.name, from.entry); err != nil {
+			return err
+		}
+		if err := fs.directoryManager.DeleteRecord(from.parent, from.name); err != nil {
+			return err
+		}
+		return fs.addDirectoryRecord(from.parent, from.entryIndex, from.entry, to.name)
+	}
+
+	if err := fs.checkRename(from, to, sameParent, noReplace); err != nil {
+		return err
+	}
+
+	if to.entry != nil {
+		err = fs.directoryManager.ReplaceRecord(to.parent, to.name, from.entryIndex, recordType(from.entry))
+		fs.saveDirectoryChanges(to.parent)
+	} else {
+		err = fs.addDirectoryRecord(to.parent, from.entryIndex, from.entry, to.name)
+	}
+	if err != nil {
+		return err
+	}
+
+	if err := fs.directoryManager.DeleteRecord(from.parent, from.name); err != nil {
+		return err
+	}
+	fs.saveDirectoryChanges(from.parent)
+
+	if !from.entry.IsFile() && !sameParent {
+		moved, err := fs.directoryManager.OpenDirectory(from.entry, from.entryIndex)
+		if err != nil {
+			return err
+		}
+		if err := fs.directoryManager.ReplaceRecord(moved, "..", to.parent.InodeIndex, record.TypeDirectory); err != nil {
+			return err
+		}
+		fs.saveDirectoryChanges(moved)
+	}
+
+	if to.entry != nil {
+		return fs.releaseInode(to.entryIndex, to.entry)
+	}
+	return nil
+}
+
+// checkRename verifies that the entry may be renamed to the target. Both
+// parents must be writable, and so must be a directory changing its parent.
+// A directory can't move below itself, and only replaces an empty one.
+func (fs *FileSystem) checkRename(from, to *nameidata, sameParent, noReplace bool) error {
+	if err := fs.checkEntryRemoval(from.parent, from.name, from.entry); err != nil {
+		return err
+	}
+	currentUser := fs.userManager.Current
+	if currentUser != nil && !to.parent.Inode.HasWritePermission(*currentUser) {
+		return fmt.Errorf("%w - %s", errs.ErrPermissionDenied, to.name)
+	}
+
+	isDirectory := !from.entry.IsFile()
+	if isDirectory && !sameParent {
+		if currentUser != nil && !from.entry.HasWritePermission(*currentUser) {
+			return fmt.Errorf("%w - %s", errs.ErrPermissionDenied, from.name)
+		}
+		below, err := fs.isBelow(to.parent.InodeIndex, from.entryIndex)
+		if err != nil {
+			return err
+		}
+		if below {
+			return fmt.Errorf("%w - %s into itself", errs.ErrIllegalArgument, from.name)
+		}
+	}
+
+	if to.entry == nil {
+		return nil
+	}
+	if noReplace {
+		return fmt.Errorf("%w - %s", errs.ErrRecordAlreadyExists, to.name)
+	}
+	if err := fs.checkEntryRemoval(to.parent, to.name, to.entry); err != nil {
+		return err
+	}
+	if err := fs.checkNotOpen(to.entryIndex, to.name); err != nil {
+		return err
+	}
+	switch {
+	case isDirectory && to.entry.IsFile():
+		return fmt.Errorf("%w - %s", errs.ErrRecordIsNotDirectory, to.name)
+	case !isDirectory && !to.entry.IsFile():
+		return fmt.Errorf("%w - %s", errs.ErrRecordIsNotFile, to.name)
+	case isDirectory:
+		target, err := fs.directoryManager.OpenDirectory(to.entry, to.entryIndex)
+		if err != nil {
+			return err
+		}
+		records, err := fs.directoryManager.Records(target)
+		if err != nil {
+			return err
+		}
+		if len(records) > 2 {
+			return fmt.Errorf("%w - %s", errs.ErrDirectoryNotEmpty, to.name)
+		}
+	}
+	return nil
+}
+
+// isBelow reports whether the directory is the ancestor or lies somewhere
+// below it, following the ".." records up to the root.
+func (fs *FileSystem) isBelow(dirIndex, ancestorIndex uint32) (bool, error) {
+	for dirIndex != ancestorIndex {
+		if dirIndex == 0 {
+			return false, nil
+		}
+		dirInode, err := fs.inodeManager.ReadInode(dirIndex)
+		if err != nil {
+			return false, err
+		}
+		dir, err := fs.directoryManager.OpenDirectory(dirInode, dirIndex)
+		if err != nil {
+			return false, err
+		}
+		if dirIndex, err = fs.directoryManager.Lookup(dir, ".."); err != nil {
+			return false, err
+		}
+	}
+	return true, nil
+}
+
+// CopyFile copies a file or a directory tree. Without options only the
+// contents are copied and an existing target file is an error; see
+// CopyOption for the others. Errors of single entries do not stop the copy
+// and are returned together.
+func (fs *FileSystem) CopyFile(pathFrom string, pathTo string, opts ...CopyOption) error {
+	return fs.session.CopyFile(pathFrom, pathTo, opts...)
+}
+
+func (fs *FileSystem) copyFileLocked(pathFrom string, pathTo string, opts ...CopyOption) error {
+	targetFrom, pathFrom := fs.resolveMount(pathFrom)
+	targetTo, pathTo := fs.resolveMount(pathTo)
+	if targetFrom != nil && targetFrom == targetTo {
+		return targetFrom.CopyFile(pathFrom, pathTo, opts...)
+	}
+
+	// The copier uses the Locked methods of both sides, so the images it
+	// reaches through mount points are locked as well, after fs.mu
+	from, to := fs, fs
+	if targetFrom != nil {
+		from = targetFrom
+		unlock := from.session.lock()
+		defer unlock()
+	}
+	if targetTo != nil {
+		to = targetTo
+		unlock := to.session.lock()
+		defer unlock()
+	}
+
+	c := newCopier(from, to, opts)
+	c.copy(pathFrom, pathTo)
+	return c.err()
+}
+
+func (fs *FileSystem) ChangePermissions(path string, value int) error {
+	return fs.session.ChangePermissions(path, value)
+}
+
+func (fs *FileSystem) changePermissionsLocked(path string, value int) error {
+	return fs.changeModeLocked(path, strconv.Itoa(value))
+}
+
+// ChangeMode applies an octal or symbolic chmod mode to the file at path.
+// Only the owner of the file and root may change its mode.
+func (fs *FileSystem) ChangeMode(path string, mode string) error {
+	return fs.session.ChangeMode(path, mode)
+}
+
+func (fs *FileSystem) changeModeLocked(path string, mode string) error {
+	target, path := fs.resolveMount(path)
+	if target != nil {
+		return target.ChangeMode(path, mode)
+	}
+
+	if err := fs.checkWritable(path); err != nil {
+		return err
+	}
+	if err := fs.copyUp(path); err != nil {
+		return err
+	}
+
+	nd, err := fs.lookup(path)
+	if err != nil {
+		return err
+	}
+	name, inodeIndex, fileInode := nd.name, nd.entryIndex, nd.entry
+
+	currentUser := fs.userManager.Current
+	isRoot := currentUser == nil || currentUser.UserId == 0
+	if !isRoot && currentUser.UserId != fileInode.UserId {
+		return fmt.Errorf("%w - chmod %s", errs.ErrPermissionDenied, name)
+	}
+
+	permissions, err := inode.ParseMode(mode, fileInode.GetPermissions())
+	if err != nil {
+		return err
+	}
+
+	if !isRoot && !currentUser.IsMemberOf(fileInode.GroupId) {
+		permissions &^= inode.SetGroupIdBit
+	}
+
+	fileInode.SetPermissions(permissions)
+	fs.inodeManager.SaveInode(fileInode, inodeIndex)
+
+	return nil
+}
+
+func (fs *FileSystem) SetQuota(username string, blockSoft, blockHard, inodeSoft, inodeHard uint32) error {
+	return fs.session.SetQuota(username, blockSoft, blockHard, inodeSoft, inodeHard)
+}
+
+func (fs *FileSystem) setQuotaLocked(username string, blockSoft, blockHard, inodeSoft, inodeHard uint32) error {
+	if fs.userManager.Current.UserId != 0 {
+		return errs.ErrPermissionDenied
+	}
+
+	content, err := fs.readUserRecord(username)
+	if err != nil {
+		return err
+	}
+	userId, err := user.GetUserIdFromString(content)
+	if err != nil {
+		return err
+	}
+
+	q := quota.NewQuota(userId, blockSoft, blockHard, inodeSoft, inodeHard)
+	quotaPath := fmt.Sprintf("/.quotas/%s", username)
+
+	if _, exists := fs.quotaManager.GetQuota(userId); exists {
+		err = fs.editFileLocked(quotaPath, q.GetQuotaString())
+	} else {
+		err = fs.createFileWithContentLocked(quotaPath, q.GetQuotaString())
+	}
+	if err != nil {
+		return err
+	}
+
+	fs.quotaManager.SetQuota(q)
+
+	return nil
+}
+
+// saveQuotaGrace stores the quotas whose grace starts changed, so that
+// reopening the image does not restart their grace periods. The records
+// are written without permission checks and without touching the user of
+// the session, since the writes of any user may start one. Quotas that
+// could not be stored are tried again after the next operation.
+func (fs *FileSystem) saveQuotaGrace() {
+	changed := fs.quotaManager.TakeChanged()
+	if len(changed) == 0 || fs.readOnly {
+		return
+	}
+
+	// The records are written for the file system rather than the user of
+	// the session, who may not even see /.quotas
+	for _, q := range changed {
+		quotaPath := fmt.Sprintf("/.quotas/%s", fs.userManager.GetUsername(q.UserId))
+		inodeIndex, quotaInode, err := fs.systemLookup(quotaPath)
+		if err == nil {
+			err = fs.writeContent(inodeIndex, quotaInode, q.GetQuotaString())
+		}
+		if err != nil {
+			fs.quotaManager.MarkChanged(q.UserId)
+		}
+	}
+}
+
+// GetQuotaReport describes the usage and limits of a single user. Users
+// other than root may only query themselves.
+func (fs *FileSystem) GetQuotaReport(username string) (string, error) {
+	return fs.session.GetQuotaReport(username)
+}
+
+func (fs *FileSystem) getQuotaReportLocked(username string) (string, error) {
+	currentUser := fs.userManager.Current
+	if currentUser.UserId != 0 && currentUser.Username != username {
+		return "", errs.ErrPermissionDenied
+	}
+
+	content, err := fs.readUserRecord(username)
+	if err != nil {
+		return "", err
+	}
+	userId, err := user.GetUserIdFromString(content)
+	if err != nil {
+		return "", err
+	}
+
+	return fs.formatQuotaReport(userId), nil
+}
+
+func (fs *FileSystem) GetQuotaReports() ([]string, error) {
+	return fs.session.GetQuotaReports()
+}
+
+func (fs *FileSystem) getQuotaReportsLocked() ([]string, error) {
+	if fs.userManager.Current.UserId != 0 {
+		return nil, errs.ErrPermissionDenied
+	}
+
+	userIds := fs.quotaManager.GetUserIds()
+	result := make([]string, 0, len(userIds))
+	for _, userId := range userIds {
+		result = append(result, fs.formatQuotaReport(userId))
+	}
+
+	return result, nil
+}
+
+func (fs *FileSystem) formatQuotaReport(userId uint16) string {
+	usage := fs.quotaManager.GetUsage(userId)
+	q, ok := fs.quotaManager.GetQuota(userId)
+	if !ok {
+		q = quota.NewQuota(userId, 0, 0, 0, 0)
+	}
+
+	username := fs.userManager.GetUsername(userId)
+	if username == "" {
+		username = strconv.Itoa(int(userId))
+	}
+
+	return fmt.Sprintf(
+		"%s\t%d\t%d\t%d\t%s\t%d\t%d\t%d\t%s",
+		username,
+		usage.Blocks, q.BlockSoftLimit, q.BlockHardLimit, fs.formatGrace(usage.BlockGraceStart),
+		usage.Inodes, q.InodeSoftLimit, q.InodeHardLimit, fs.formatGrace(usage.InodeGraceStart),
+	)
+}
+
+func (fs *FileSystem) formatGrace(graceStart time.Time) string {
+	if graceStart.IsZero() {
+		return "-"
+	}
+	left := time.Until(graceStart.Add(fs.quotaManager.GetGracePeriod()))
+	if left <= 0 {
+		return "none"
+	}
+	return left.Truncate(time.Second).String()
+}
+
+// addDirectoryRecord links the inode into the directory under the given
+// name and saves the directory.
+func (fs *FileSystem) addDirectoryRecord(dir *directorymanager.Handle, inodeIndex uint32, fileInode *inode.Inode, name string) error {
+	err := fs.directoryManager.AddRecord(dir, inodeIndex, name, recordType(fileInode))
+	fs.saveDirectoryChanges(dir)
+	return err
+}
+
+// recordType returns the directory record file type matching the inode.
+func recordType(fileInode *inode.Inode) uint8 {
+	var fileType uint8
+	switch {
+	case fileInode.IsDevice():
+		fileType = record.TypeCharDevice
+	case fileInode.IsFile():
+		fileType = record.TypeRegular
+	default:
+		fileType = record.TypeDirectory
+	}
+	if fileInode.IsHidden() {
+		fileType |= record.TypeHiddenFlag
+	}
+	return fileType
+}
+
+// saveDirectoryChanges stores the inode of the directory and the
+// allocation state after its records were changed.
+func (fs *FileSystem) saveDirectoryChanges(dir *directorymanager.Handle) {
+	dir.Inode.ModificationTime = uint32(time.Now().Unix())
+	fs.inodeManager.SaveInode(dir.Inode, dir.InodeIndex)
+	fs.saveAllocationState()
+}
+
+func (fs *FileSystem) GetCurrentPath() string {
+	return fs.session.GetCurrentPath()
+}
+
+func (fs *FileSystem) getCurrentPathLocked() string {
+	if fs.cwdMount != "" {
+		return pathpkg.Join(fs.cwdMount, fs.mounts[fs.cwdMount].GetCurrentPath())
+	}
+	return fs.cwdPath
+}
+
+func (fs *FileSystem) GetCurrentUserName() string {
+	return fs.session.GetCurrentUserName()
+}
+
+func (fs *FileSystem) getCurrentUserNameLocked() string {
+	return fs.userManager.Current.Username
+}
+
+// Sync writes everything held in the buffer cache to the image file, for
+// mounted images too.
+func (fs *FileSystem) Sync() error {
+	fs.mu.Lock()
+	defer fs.mu.Unlock()
+
+	return fs.syncLocked()
+}
+
+func (fs *FileSystem) syncLocked() error {
+	for _, mounted := range fs.mounts {
+		if err := mounted.Sync(); err != nil {
+			return err
+		}
+	}
+	return fs.cache.Sync()
+}
+
+// CloseDataFile syncs the cache and closes the device. Mounted images are
+// closed first.
+func (fs *FileSystem) CloseDataFile() error {
+	fs.mu.Lock()
+	defer fs.mu.Unlock()
+
+	return fs.closeDataFileLocked()
+}
+
+func (fs *FileSystem) closeDataFileLocked() error {
+	for mountPath, mounted := range fs.mounts {
+		mounted.CloseDataFile()
+		delete(fs.mounts, mountPath)
+	}
+	if fs.lower != nil {
+		fs.lower.CloseDataFile()
+	}
+	return fs.cache.Close()
+}
+
+func newCache(device blockdevice.BlockDevice) (*cache.Cache, error) {
+	policy := cache.WriteThrough
+	if FSConfig.CacheWriteBack {
+		policy = cache.WriteBack
+	}
+	return cache.NewCache(device, cachePageSize, FSConfig.CachePages, policy)
+}
+
+// checkEntryRemoval verifies that the current user may remove or rename
+// the entry from the directory. In a sticky directory only the owner of the
+// entry, the owner of the directory and root are allowed to.
+func (fs *FileSystem) checkEntryRemoval(dir *directorymanager.Handle, name string, entryInode *inode.Inode) error {
+	currentUser := fs.userManager.Current
+	if currentUser == nil {
+		return nil
+	}
+
+	dirInode := dir.Inode
+	if !dirInode.HasWritePermission(*currentUser) {
+		return fmt.Errorf("%w - %s", errs.ErrPermissionDenied, name)
+	}
+
+	if dirInode.IsSticky() && currentUser.UserId != 0 &&
+		currentUser.UserId != entryInode.UserId && currentUser.UserId != dirInode.UserId {
+		return fmt.Errorf("%w - sticky %s", errs.ErrPermissionDenied, name)
+	}
+
+	return nil
 }
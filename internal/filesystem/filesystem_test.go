@@ -1,12 +1,26 @@
 package filesystem
 
 import (
+	"context"
 	"errors"
 	"file-system/internal/errs"
+	"file-system/internal/filesystem/allocator"
+	"file-system/internal/filesystem/blockdevice"
+	"file-system/internal/filesystem/device"
+	"file-system/internal/filesystem/directory/record"
+	"file-system/internal/filesystem/quota"
+	"file-system/internal/filesystem/user"
 	"fmt"
+	"io"
+	iofs "io/fs"
 	"os"
+	"strconv"
 	"strings"
+	"sync"
 	"testing"
+	"testing/fstest"
+	"text/template"
+	"time"
 )
 
 func TestFilesystemIntegration(t *testing.T) {
@@ -82,12 +96,12 @@ func TestDataFileSimpleIdempotency(t *testing.T) {
 	fs, cleanup := setupFilesystem(t)
 	t.Cleanup(cleanup)
 
-	savedContent, _ := os.ReadFile(fs.dataFile.Name())
+	savedContent := imageContent(fs)
 
 	fs.CreateFileWithContent("file", "file content")
 	fs.DeleteFile("file")
 
-	currentContent, _ := os.ReadFile(fs.dataFile.Name())
+	currentContent := imageContent(fs)
 
 	diffIndex := findFirstDifference(savedContent, currentContent)
 
@@ -102,7 +116,7 @@ func TestDataFileComplexIdempotency(t *testing.T) {
 	fs, cleanup := setupFilesystem(t)
 	t.Cleanup(cleanup)
 
-	savedContent, _ := os.ReadFile(fs.dataFile.Name())
+	savedContent := imageContent(fs)
 
 	fs.CreateDirectory("dir")
 	fs.CreateFileWithContent("file", "file content")
@@ -113,7 +127,7 @@ func TestDataFileComplexIdempotency(t *testing.T) {
 	fs.DeleteFile("dir")
 	fs.DeleteFile("file")
 
-	currentContent, _ := os.ReadFile(fs.dataFile.Name())
+	currentContent := imageContent(fs)
 
 	diffIndex := findFirstDifference(savedContent, currentContent)
 
@@ -159,6 +173,83 @@ func TestMoveFile(t *testing.T) {
 	}
 }
 
+func TestRename(t *testing.T) {
+	fs, cleanup := setupFilesystem(t)
+	t.Cleanup(cleanup)
+
+	fs.CreateFileWithContent("a", "first")
+	fs.CreateFileWithContent("b", "second")
+	freeInodes := fs.superblock.FreeInodeCount
+
+	if err := fs.MoveFileNoReplace("a", "b"); !errors.Is(err, errs.ErrRecordAlreadyExists) {
+		t.Errorf("MoveFileNoReplace onto existing file: expected ErrRecordAlreadyExists, got %v", err)
+	}
+	if err := fs.MoveFile("a", "b"); err != nil {
+		t.Fatalf("MoveFile onto existing file error: %v", err)
+	}
+	if content, _ := fs.ReadFile("b"); content != "first" {
+		t.Errorf("Replaced file content mismatch: expected \"first\", got \"%s\"", content)
+	}
+	if fs.superblock.FreeInodeCount != freeInodes+1 {
+		t.Errorf("Replaced inode was not freed: expected %d free inodes, got %d", freeInodes+1, fs.superblock.FreeInodeCount)
+	}
+	if err := fs.MoveFile("a", "c"); !errors.Is(err, errs.ErrRecordNotFound) {
+		t.Errorf("MoveFile of missing file: expected ErrRecordNotFound, got %v", err)
+	}
+
+	fs.CreateDirectory("full")
+	fs.CreateEmptyFile("full/file")
+	fs.CreateDirectory("empty")
+	fs.CreateDirectory("dir")
+	for i := 0; i < 200; i++ {
+		fs.CreateEmptyFile(fmt.Sprintf("dir/file%d", i))
+	}
+	if dir, _ := fs.lookup("dir"); !dir.entry.IsIndexed() {
+		t.Fatalf("Directory with 200 files was not indexed")
+	}
+
+	tests := []struct {
+		from, to string
+		err      error
+	}{
+		{"dir", "full", errs.ErrDirectoryNotEmpty},
+		{"dir", "b", errs.ErrRecordIsNotDirectory},
+		{"b", "empty", errs.ErrRecordIsNotFile},
+		{"full", "full/sub", errs.ErrIllegalArgument},
+		{"/", "x", errs.ErrIllegalArgument},
+	}
+	for _, test := range tests {
+		if err := fs.MoveFile(test.from, test.to); !errors.Is(err, test.err) {
+			t.Errorf("MoveFile(%q, %q): expected %v, got %v", test.from, test.to, test.err, err)
+		}
+	}
+
+	if err := fs.MoveFile("dir", "empty"); err != nil {
+		t.Fatalf("MoveFile onto empty directory error: %v", err)
+	}
+	if err := fs.MoveFile("empty", "full/dir"); err != nil {
+		t.Fatalf("MoveFile of indexed directory error: %v", err)
+	}
+	parent, _ := fs.lookup("/full/dir/..")
+	full, _ := fs.lookup("/full")
+	if parent.entryIndex != full.entryIndex {
+		t.Errorf(".. of moved directory mismatch: expected inode %d, got %d", full.entryIndex, parent.entryIndex)
+	}
+	fs.ChangeDirectory("/full/dir")
+	if records, _ := fs.GetCurrentDirectoryRecords(false); len(records) != 202 {
+		t.Errorf("Moved directory records mismatch: expected 202, got %d", len(records))
+	}
+	fs.ChangeDirectory("/")
+
+	fs.AddUser("user", "password")
+	fs.ChangeUser("user", "password")
+	fs.ChangeDirectory("/user")
+	fs.CreateEmptyFile("mine")
+	if err := fs.MoveFile("mine", "/full/mine"); !errors.Is(err, errs.ErrPermissionDenied) {
+		t.Errorf("MoveFile into directory without write permission: expected ErrPermissionDenied, got %v", err)
+	}
+}
+
 func TestCopyFileSimple(t *testing.T) {
 	fs, cleanup := setupFilesystem(t)
 	t.Cleanup(cleanup)
@@ -288,6 +379,125 @@ func TestCopyFileComplex(t *testing.T) {
 	}
 }
 
+func TestCopyArchive(t *testing.T) {
+	fs, cleanup := setupFilesystem(t)
+	t.Cleanup(cleanup)
+
+	fs.AddUser("user", "password")
+	fs.CreateDirectory("dir")
+	fs.CreateFileWithContent("dir/file", "content")
+	fs.CreateEntity("dir/.hidden", true, "hidden content", true)
+	fs.ChangeMode("dir/file", "4640")
+	fs.ChangeOwner("dir/file", "user")
+	fs.ChangeMode("dir", "750")
+
+	_, fileIndex, _ := fs.statPath("dir/file")
+	_, dirIndex, _ := fs.statPath("dir")
+	restoreModificationTime(fs, fileIndex, 1000)
+	restoreModificationTime(fs, dirIndex, 2000)
+
+	if err := fs.CopyFile("dir", "copy", CopyArchive()); err != nil {
+		t.Fatalf("CopyFile archive error: %v", err)
+	}
+
+	source, sourceIndex, _ := fs.statPath("dir/file")
+	copied, copiedIndex, _ := fs.statPath("copy/file")
+	if copiedIndex == sourceIndex {
+		t.Errorf("Archive copy shares inode %d with its source", sourceIndex)
+	}
+	if copied.GetPermissions() != source.GetPermissions() || copied.UserId != source.UserId || copied.ModificationTime != 1000 {
+		t.Errorf("Archive copy of file: expected mode %o, uid %d, mtime 1000, got mode %o, uid %d, mtime %d",
+			source.GetPermissions(), source.UserId, copied.GetPermissions(), copied.UserId, copied.ModificationTime)
+	}
+	copiedDir, _, _ := fs.statPath("copy")
+	if copiedDir.GetPermissions() != 0o750 || copiedDir.ModificationTime != 2000 {
+		t.Errorf("Archive copy of directory: expected mode 750, mtime 2000, got mode %o, mtime %d", copiedDir.GetPermissions(), copiedDir.ModificationTime)
+	}
+	if hidden, _, err := fs.statPath("copy/.hidden"); err != nil || !hidden.IsHidden() {
+		t.Errorf("Archive copy lost the hidden file or its flag: %v", err)
+	}
+
+	fs.CopyFile("dir", "plain")
+	if plain, _, _ := fs.statPath("plain/file"); plain.GetPermissions() == source.GetPermissions() || plain.UserId != 0 {
+		t.Errorf("Plain copy expected default mode and root owner, got mode %o, uid %d", plain.GetPermissions(), plain.UserId)
+	}
+
+	fs.ChangeMode("dir", "755")
+	fs.ChangeMode("dir/file", "6644")
+	fs.ChangeUser("user", "password")
+	if err := fs.ChangeDirectory("/user"); err != nil {
+		t.Fatalf("ChangeDirectory to the home of user error: %v", err)
+	}
+	if err := fs.CopyFile("/dir/file", "file", CopyArchive()); err != nil {
+		t.Fatalf("CopyFile archive as user error: %v", err)
+	}
+	copied, _, _ = fs.statPath("file")
+	if copied.UserId == 0 || copied.GetPermissions() != 0o644 {
+		t.Errorf("Archive copy by user: expected own file with mode 644, got uid %d, mode %o", copied.UserId, copied.GetPermissions())
+	}
+}
+
+func TestCopyExisting(t *testing.T) {
+	fs, cleanup := setupFilesystem(t)
+	t.Cleanup(cleanup)
+
+	fs.CreateFileWithContent("new", "new")
+	fs.CreateFileWithContent("old", "old")
+	_, oldIndex, _ := fs.statPath("old")
+	restoreModificationTime(fs, oldIndex, 1000)
+
+	if err := fs.CopyFile("missing", "copy"); !errors.Is(err, errs.ErrRecordNotFound) {
+		t.Errorf("CopyFile of missing source: expected ErrRecordNotFound, got %v", err)
+	}
+
+	fs.CreateFileWithContent("target", "target")
+	if err := fs.CopyFile("new", "target"); !errors.Is(err, errs.ErrRecordAlreadyExists) {
+		t.Errorf("CopyFile onto existing file: expected ErrRecordAlreadyExists, got %v", err)
+	}
+	if err := fs.CopyFile("new", "target", CopyNoClobber()); err != nil {
+		t.Errorf("CopyFile no-clobber error: %v", err)
+	}
+	if content, _ := fs.ReadFile("target"); content != "target" {
+		t.Errorf("CopyFile no-clobber replaced content: got \"%s\"", content)
+	}
+
+	fs.CopyFile("old", "target", CopyUpdate())
+	if content, _ := fs.ReadFile("target"); content != "target" {
+		t.Errorf("CopyFile update replaced a newer file: got \"%s\"", content)
+	}
+	_, targetIndex, _ := fs.statPath("target")
+	restoreModificationTime(fs, targetIndex, 500)
+	fs.CopyFile("old", "target", CopyUpdate())
+	if content, _ := fs.ReadFile("target"); content != "old" {
+		t.Errorf("CopyFile update content mismatch: expected \"old\", got \"%s\"", content)
+	}
+
+	if err := fs.CopyFile("new", "target", CopyOverwrite()); err != nil {
+		t.Errorf("CopyFile overwrite error: %v", err)
+	}
+	if content, _ := fs.ReadFile("target"); content != "new" {
+		t.Errorf("CopyFile overwrite content mismatch: expected \"new\", got \"%s\"", content)
+	}
+
+	fs.CreateDirectory("dir")
+	fs.CreateFileWithContent("dir/secret", "secret")
+	fs.CreateFileWithContent("dir/public", "public")
+	fs.ChangeMode("dir/secret", "600")
+	fs.AddUser("user", "password")
+	fs.ChangeUser("user", "password")
+	if err := fs.ChangeDirectory("/user"); err != nil {
+		t.Fatalf("ChangeDirectory to the home of user error: %v", err)
+	}
+
+	err := fs.CopyFile("/dir", "dir")
+	if !errors.Is(err, errs.ErrPermissionDenied) || !strings.Contains(err.Error(), "secret") {
+		t.Errorf("CopyFile with unreadable file: expected ErrPermissionDenied for secret, got %v", err)
+	}
+	if content, _ := fs.ReadFile("dir/public"); content != "public" {
+		t.Errorf("CopyFile stopped at the unreadable file: got \"%s\"", content)
+	}
+}
+
 func TestReadLargeFile(t *testing.T) {
 	fs, cleanup := setupFilesystem(t)
 	t.Cleanup(cleanup)
@@ -309,7 +519,7 @@ func TestDataFileIdempotencyWithLargeFile(t *testing.T) {
 	fs, cleanup := setupFilesystem(t)
 	t.Cleanup(cleanup)
 
-	savedContent, _ := os.ReadFile(fs.dataFile.Name())
+	savedContent := imageContent(fs)
 
 	blockCount := 10
 	fileContent := strings.Repeat("#", blockCount*int(FSConfig.BlockSize))
@@ -318,7 +528,7 @@ func TestDataFileIdempotencyWithLargeFile(t *testing.T) {
 	fs.CreateFileWithContent(fileName, fileContent)
 	fs.DeleteFile(fileName)
 
-	currentContent, _ := os.ReadFile(fs.dataFile.Name())
+	currentContent := imageContent(fs)
 
 	diffIndex := findFirstDifference(savedContent, currentContent)
 
@@ -343,22 +553,1973 @@ func TestReadLargeDirectory(t *testing.T) {
 	fs.ChangeDirectory("..")
 	fs.ChangeDirectory("dir")
 
-	currentRecords := fs.GetCurrentDirectoryRecords(false)
+	currentRecords, _ := fs.GetCurrentDirectoryRecords(false)
 	currentFileCount := len(currentRecords) - 2
 	if currentFileCount != fileCount {
 		t.Errorf("Directory records count mismatch: expected %d, got %d", fileCount, currentFileCount)
 	}
 }
 
-func setupFilesystem(t *testing.T) (*FileSystem, func()) {
-	fs, _ := FormatFilesystem(FSConfig.FileSize, FSConfig.BlockSize)
+func TestGroups(t *testing.T) {
+	fs, cleanup := setupFilesystem(t)
+	t.Cleanup(cleanup)
 
-	cleanup := func() {
-		fs.CloseDataFile()
-		os.Remove(fs.dataFile.Name())
+	fileContent := "Test string"
+
+	fs.CreateFileWithContent("file", fileContent)
+	fs.ChangePermissions("file", 640)
+	fs.AddUser("member", "password")
+	fs.AddUser("outsider", "password")
+	fs.AddGroup("developers")
+	fs.AddUserToGroup("member", "developers")
+	fs.ChangeGroup("file", "developers")
+
+	groups, err := fs.GetUserGroups("member")
+	if err != nil || strings.Join(groups, " ") != "member developers" {
+		t.Errorf("GetUserGroups mismatch: expected \"member developers\", got \"%v\" (%v)", groups, err)
 	}
 
-	return fs, cleanup
+	fs.ChangeUser("member", "password")
+	content, _ := fs.ReadFile("/file")
+	if content != fileContent {
+		t.Errorf("ReadFile by group member content mismatch: expected \"%s\", got \"%s\"", fileContent, content)
+	}
+	err = fs.EditFile("/file", "new content")
+	if !errors.Is(err, errs.ErrPermissionDenied) {
+		t.Errorf("EditFile by group member error mismatch: expected \"%v\", got \"%v\"", errs.ErrPermissionDenied, err)
+	}
+
+	fs.ChangeUser("outsider", "password")
+	_, err = fs.ReadFile("/file")
+	if !errors.Is(err, errs.ErrPermissionDenied) {
+		t.Errorf("ReadFile by outsider error mismatch: expected \"%v\", got \"%v\"", errs.ErrPermissionDenied, err)
+	}
+
+	fs.ChangeUser(FSConfig.RootUsername, FSConfig.RootPassword)
+	err = fs.DeleteGroup("member")
+	if !errors.Is(err, errs.ErrGroupInUse) {
+		t.Errorf("DeleteGroup of primary group error mismatch: expected \"%v\", got \"%v\"", errs.ErrGroupInUse, err)
+	}
+	if err := fs.DeleteGroup("developers"); err != nil {
+		t.Errorf("DeleteGroup error: %v", err)
+	}
+}
+
+func TestPathResolution(t *testing.T) {
+	fs, cleanup := setupFilesystem(t)
+	t.Cleanup(cleanup)
+
+	fileContent := "Test string"
+
+	fs.CreateDirectory("a")
+	if err := fs.CreateDirectory("a/b/"); err != nil {
+		t.Fatalf("CreateDirectory with trailing slash error: %v", err)
+	}
+	fs.CreateFileWithContent("a/b/file", fileContent)
+
+	for _, path := range []string{"a//b/./file", "/a/b/../b/file", "/../../a/b/file", "./a/b/file"} {
+		if content, err := fs.ReadFile(path); content != fileContent {
+			t.Errorf("ReadFile(%q) mismatch: expected \"%s\", got \"%s\" (%v)", path, fileContent, content, err)
+		}
+	}
+
+	if _, err := fs.ReadFile("a/b/file/"); !errors.Is(err, errs.ErrRecordIsNotDirectory) {
+		t.Errorf("ReadFile with trailing slash on a file: expected ErrRecordIsNotDirectory, got %v", err)
+	}
+	if _, err := fs.ReadFile("a/b/file/x"); !errors.Is(err, errs.ErrRecordIsNotDirectory) {
+		t.Errorf("ReadFile through a file: expected ErrRecordIsNotDirectory, got %v", err)
+	}
+	if err := fs.CreateEmptyFile("a/new/"); !errors.Is(err, errs.ErrRecordIsNotDirectory) {
+		t.Errorf("CreateEmptyFile with trailing slash: expected ErrRecordIsNotDirectory, got %v", err)
+	}
+	for _, path := range []string{".", "..", "/", "a/b/.."} {
+		if err := fs.DeleteFile(path); !errors.Is(err, errs.ErrIllegalArgument) {
+			t.Errorf("DeleteFile(%q): expected ErrIllegalArgument, got %v", path, err)
+		}
+	}
+
+	nd, err := fs.namei("a/b/../b/file")
+	if err != nil || nd.name != "file" || nd.entry == nil {
+		t.Fatalf("namei mismatch: got %+v (%v)", nd, err)
+	}
+	b, _ := fs.lookup("/a/b")
+	if nd.parent.InodeIndex != b.entryIndex {
+		t.Errorf("namei parent mismatch: expected inode %d, got %d", b.entryIndex, nd.parent.InodeIndex)
+	}
+
+	fs.ChangeDirectory("a/b/")
+	if path := fs.GetCurrentPath(); path != "/a/b" {
+		t.Errorf("GetCurrentPath mismatch: expected /a/b, got %s", path)
+	}
+	fs.ReadFile("../../a/b/file")
+	fs.CreateDirectory("/c")
+	fs.MoveFile("file", "/c/file")
+	if err := fs.ChangeDirectory("../missing/x"); !errors.Is(err, errs.ErrRecordNotFound) {
+		t.Errorf("ChangeDirectory to missing path: expected ErrRecordNotFound, got %v", err)
+	}
+	if path := fs.GetCurrentPath(); path != "/a/b" {
+		t.Errorf("Working directory changed by operations on other paths: got %s", path)
+	}
+	if records, _ := fs.GetCurrentDirectoryRecords(false); len(records) != 2 {
+		t.Errorf("Working directory records mismatch: expected only . and .., got %v", records)
+	}
+	if content, _ := fs.ReadFile("../../c/file"); content != fileContent {
+		t.Errorf("ReadFile of moved file mismatch: expected \"%s\", got \"%s\"", fileContent, content)
+	}
+}
+
+func TestSearchPermission(t *testing.T) {
+	fs, cleanup := setupFilesystem(t)
+	t.Cleanup(cleanup)
+
+	fileContent := "Test string"
+
+	fs.CreateDirectory("private")
+	fs.CreateFileWithContent("private/file", fileContent)
+	fs.ChangePermissions("private", 700)
+	fs.CreateDirectory("dropbox")
+	fs.CreateFileWithContent("dropbox/file", fileContent)
+	fs.ChangePermissions("dropbox", 711)
+
+	fs.AddUser("user", "password")
+	fs.ChangeUser("user", "password")
+
+	_, err := fs.ReadFile("/private/file")
+	if !errors.Is(err, errs.ErrPermissionDenied) || !strings.Contains(err.Error(), "private") {
+		t.Errorf("ReadFile through directory without search permission error mismatch: expected \"%v\", got \"%v\"", errs.ErrPermissionDenied, err)
+	}
+
+	err = fs.ChangeDirectory("/private")
+	if !errors.Is(err, errs.ErrPermissionDenied) {
+		t.Errorf("ChangeDirectory without search permission error mismatch: expected \"%v\", got \"%v\"", errs.ErrPermissionDenied, err)
+	}
+
+	content, _ := fs.ReadFile("/dropbox/file")
+	if content != fileContent {
+		t.Errorf("ReadFile through searchable directory content mismatch: expected \"%s\", got \"%s\"", fileContent, content)
+	}
+
+	fs.ChangeDirectory("/dropbox")
+	_, err = fs.GetCurrentDirectoryRecords(false)
+	if !errors.Is(err, errs.ErrPermissionDenied) {
+		t.Errorf("GetCurrentDirectoryRecords without read permission error mismatch: expected \"%v\", got \"%v\"", errs.ErrPermissionDenied, err)
+	}
+}
+
+func TestStickyDirectory(t *testing.T) {
+	fs, cleanup := setupFilesystem(t)
+	t.Cleanup(cleanup)
+
+	fs.CreateDirectory("tmp")
+	fs.ChangeMode("tmp", "1777")
+	fs.AddUser("user1", "password")
+	fs.AddUser("user2", "password")
+
+	fs.ChangeUser("user1", "password")
+	fs.CreateEmptyFile("/tmp/file1")
+	fs.ChangeMode("/tmp/file1", "666")
+
+	fs.ChangeUser("user2", "password")
+	err := fs.DeleteFile("/tmp/file1")
+	if !errors.Is(err, errs.ErrPermissionDenied) {
+		t.Errorf("DeleteFile of other user's file in sticky directory error mismatch: expected \"%v\", got \"%v\"", errs.ErrPermissionDenied, err)
+	}
+	err = fs.MoveFile("/tmp/file1", "/tmp/file2")
+	if !errors.Is(err, errs.ErrPermissionDenied) {
+		t.Errorf("MoveFile of other user's file in sticky directory error mismatch: expected \"%v\", got \"%v\"", errs.ErrPermissionDenied, err)
+	}
+
+	fs.ChangeUser("user1", "password")
+	if err := fs.DeleteFile("/tmp/file1"); err != nil {
+		t.Errorf("DeleteFile of own file in sticky directory error: %v", err)
+	}
+}
+
+func TestSetGroupIdDirectory(t *testing.T) {
+	fs, cleanup := setupFilesystem(t)
+	t.Cleanup(cleanup)
+
+	fs.AddGroup("project")
+	fs.CreateDirectory("shared")
+	fs.ChangeGroup("shared", "project")
+	fs.ChangeMode("shared", "g+s")
+	fs.CreateEmptyFile("shared/file")
+	fs.CreateDirectory("shared/subdir")
+
+	fs.ChangeDirectory("shared")
+	records, _ := fs.GetCurrentDirectoryRecords(true)
+	for _, record := range records {
+		if strings.HasSuffix(record, "\tfile") && !strings.Contains(record, "\tproject\t") {
+			t.Errorf("File in setgid directory did not inherit group: %s", record)
+		}
+		if strings.HasSuffix(record, "\tsubdir") && !strings.HasPrefix(record, "drwxr-sr-x") {
+			t.Errorf("Directory in setgid directory did not inherit setgid bit: %s", record)
+		}
+	}
+}
+
+func TestQuota(t *testing.T) {
+	fs, cleanup := setupFilesystem(t)
+	t.Cleanup(cleanup)
+
+	fs.AddUser("user", "password")
+	if err := fs.SetQuota("user", 0, 4, 0, 3); err != nil {
+		t.Fatalf("SetQuota error: %v", err)
+	}
+
+	fs.ChangeUser("user", "password")
+	fs.ChangeDirectory("/user")
+
+	// The home directory already takes one block and one inode
+	if err := fs.CreateFileWithContent("file1", "content"); err != nil {
+		t.Errorf("CreateFileWithContent within quota error: %v", err)
+	}
+	err := fs.CreateFileWithContent("file2", strings.Repeat("#", 2*int(FSConfig.BlockSize)+1))
+	var quotaErr quota.ExceededError
+	if !errors.Is(err, errs.ErrQuotaExceeded) || !errors.As(err, &quotaErr) || quotaErr.Resource != "block" {
+		t.Errorf("CreateFileWithContent over block quota error mismatch: expected \"%v\", got \"%v\"", errs.ErrQuotaExceeded, err)
+	}
+
+	fs.CreateEmptyFile("file3")
+	err = fs.CreateEmptyFile("file4")
+	if !errors.Is(err, errs.ErrQuotaExceeded) {
+		t.Errorf("CreateEmptyFile over inode quota error mismatch: expected \"%v\", got \"%v\"", errs.ErrQuotaExceeded, err)
+	}
+
+	fs.DeleteFile("file3")
+	if err := fs.EditFile("file1", strings.Repeat("#", int(FSConfig.BlockSize)+1)); err != nil {
+		t.Errorf("EditFile within quota error: %v", err)
+	}
+	err = fs.EditFile("file1", strings.Repeat("#", 4*int(FSConfig.BlockSize)))
+	if !errors.Is(err, errs.ErrQuotaExceeded) {
+		t.Errorf("EditFile over block quota error mismatch: expected \"%v\", got \"%v\"", errs.ErrQuotaExceeded, err)
+	}
+
+	report, _ := fs.GetQuotaReport("user")
+	if !strings.HasPrefix(report, "user\t3\t0\t4\t-\t2\t") {
+		t.Errorf("GetQuotaReport mismatch: got \"%s\"", report)
+	}
+}
+
+func TestQuotaGracePersisted(t *testing.T) {
+	fs, cleanup := setupFilesystem(t)
+	t.Cleanup(cleanup)
+
+	fs.AddUser("user", "password")
+	fs.SetQuota("user", 2, 0, 0, 0)
+	session, _ := fs.NewSession("user", "password")
+	if err := session.CreateFileWithContent("/user/file", strings.Repeat("#", 2*int(FSConfig.BlockSize))); err != nil {
+		t.Fatalf("CreateFileWithContent over soft limit error: %v", err)
+	}
+
+	record, _ := fs.ReadFile("/.quotas/user")
+	fields := strings.Fields(record)
+	if len(fields) != 7 || fields[5] == "0" {
+		t.Fatalf("Quota record without grace start: \"%s\"", record)
+	}
+	if err := session.CreateEmptyFile("/root-only"); !errors.Is(err, errs.ErrPermissionDenied) {
+		t.Errorf("Storing the grace start changed the user of the session: %v", err)
+	}
+
+	// A grace period that ran out before the image was closed stays over
+	expired := uint32(time.Now().Add(-FSConfig.QuotaGracePeriod - time.Hour).Unix())
+	fs.EditFile("/.quotas/user", strings.Join(append(fields[:5], strconv.Itoa(int(expired)), "0"), " "))
+	fs.CloseDataFile()
+
+	reopened, err := OpenFilesystem(fs.device)
+	if err != nil {
+		t.Fatalf("OpenFilesystem error: %v", err)
+	}
+	session, _ = reopened.NewSession("user", "password")
+	err = session.CreateEmptyFile("/user/other")
+	var quotaErr quota.ExceededError
+	if !errors.As(err, &quotaErr) || !quotaErr.Soft {
+		t.Errorf("CreateEmptyFile after expired grace error mismatch: expected soft limit, got \"%v\"", err)
+	}
+
+	// Dropping below the soft limit clears the stored grace start
+	session.EditFile("/user/file", "")
+	record, _ = reopened.ReadFile("/.quotas/user")
+	if fields := strings.Fields(record); len(fields) != 7 || fields[5] != "0" {
+		t.Errorf("Quota record kept grace start: \"%s\"", record)
+	}
+}
+
+func TestQuotaReleasedOnFailedAllocation(t *testing.T) {
+	fs, cleanup := setupFilesystem(t)
+	t.Cleanup(cleanup)
+
+	fs.AddUser("user", "password")
+	session, _ := fs.NewSession("user", "password")
+	session.CreateEmptyFile("/user/file")
+	before, _ := fs.GetQuotaReport("user")
+
+	err := session.EditFile("/user/file", strings.Repeat("#", int(FSConfig.FileSize)))
+	if !errors.Is(err, errs.ErrNoSpaceLeft) {
+		t.Fatalf("EditFile larger than the image error mismatch: expected \"%v\", got \"%v\"", errs.ErrNoSpaceLeft, err)
+	}
+	if after, _ := fs.GetQuotaReport("user"); after != before {
+		t.Errorf("Failed allocation stayed charged: \"%s\" -> \"%s\"", before, after)
+	}
+}
+
+func TestFailedCreateReleasesInode(t *testing.T) {
+	window := FSConfig.PreallocationWindow
+	FSConfig.PreallocationWindow = 0
+	t.Cleanup(func() { FSConfig.PreallocationWindow = window })
+	fs, cleanup := setupFilesystem(t)
+	t.Cleanup(cleanup)
+
+	fs.AddUser("user", "password")
+	fs.CreateDirectory("/fill")
+	fs.CreateFileWithContent("/fill/big", strings.Repeat("#", int(fs.superblock.FreeBlockCount-40)*int(FSConfig.BlockSize)))
+	for i := 0; fs.CreateFileWithContent(fmt.Sprintf("/fill/%d", i), "#") == nil; i++ {
+	}
+
+	// Device nodes take no blocks, so they fill the directory until it
+	// needs one for the next record
+	var err error
+	freeInodes := fs.superblock.FreeInodeCount
+	for i := 0; err == nil; i++ {
+		freeInodes = fs.superblock.FreeInodeCount
+		err = fs.CreateDeviceNode(fmt.Sprintf("/user/null%d", i), device.Null)
+	}
+	if !errors.Is(err, errs.ErrNoSpaceLeft) {
+		t.Fatalf("CreateDeviceNode in a full directory: expected ErrNoSpaceLeft, got %v", err)
+	}
+	if fs.superblock.FreeInodeCount != freeInodes {
+		t.Errorf("Failed device node kept its inode: %d -> %d free", freeInodes, fs.superblock.FreeInodeCount)
+	}
+
+	// A file gets the last block but its record finds no room
+	fs.DeleteFile("/fill/0")
+	session, _ := fs.NewSession("user", "password")
+	before, _ := fs.GetQuotaReport("user")
+	freeInodes, freeBlocks := fs.superblock.FreeInodeCount, fs.superblock.FreeBlockCount
+	if err := session.CreateFileWithContent("/user/file", "#"); !errors.Is(err, errs.ErrNoSpaceLeft) {
+		t.Fatalf("CreateFileWithContent in a full directory: expected ErrNoSpaceLeft, got %v", err)
+	}
+	after, _ := fs.GetQuotaReport("user")
+	if after != before || fs.superblock.FreeInodeCount != freeInodes || fs.superblock.FreeBlockCount != freeBlocks {
+		t.Errorf("Failed create kept its inode or blocks: %d -> %d free inodes, %d -> %d free blocks, \"%s\" -> \"%s\"",
+			freeInodes, fs.superblock.FreeInodeCount, freeBlocks, fs.superblock.FreeBlockCount, before, after)
+	}
+}
+
+func TestDevices(t *testing.T) {
+	fs, cleanup := setupFilesystem(t)
+	t.Cleanup(cleanup)
+
+	if err := fs.EditFile("/dev/null", "discarded"); err != nil {
+		t.Errorf("EditFile on /dev/null error: %v", err)
+	}
+	content, _ := fs.ReadFile("/dev/null")
+	if content != "" {
+		t.Errorf("ReadFile on /dev/null content mismatch: expected empty, got \"%s\"", content)
+	}
+
+	content, _ = fs.ReadFile("/dev/zero")
+	if content != strings.Repeat("\x00", int(FSConfig.BlockSize)) {
+		t.Errorf("ReadFile on /dev/zero returned non-zero content")
+	}
+
+	first, _ := fs.ReadFile("/dev/urandom")
+	second, _ := fs.ReadFile("/dev/urandom")
+	if len(first) != int(FSConfig.BlockSize) || first == second {
+		t.Errorf("ReadFile on /dev/urandom returned unexpected content")
+	}
+
+	err := fs.AppendToFile("/dev/full", "data")
+	if !errors.Is(err, errs.ErrNoSpaceLeft) {
+		t.Errorf("AppendToFile on /dev/full error mismatch: expected \"%v\", got \"%v\"", errs.ErrNoSpaceLeft, err)
+	}
+
+	// Descriptors of devices go to the drivers too
+	fs.AddUser("user", "password")
+	session, _ := fs.NewSession("user", "password")
+	null, err := session.OpenFile("/dev/null", os.O_RDWR|os.O_TRUNC)
+	if err != nil {
+		t.Fatalf("OpenFile on /dev/null error: %v", err)
+	}
+	if n, err := session.Write(null, "discarded"); n != 9 || err != nil {
+		t.Errorf("Write on /dev/null: expected 9 bytes, got %d (%v)", n, err)
+	}
+	if data, err := session.Read(null, 10); data != "" || err != io.EOF {
+		t.Errorf("Read on /dev/null: expected io.EOF, got %q (%v)", data, err)
+	}
+	session.CloseFile(null)
+
+	full, err := session.OpenFile("/dev/full", os.O_RDWR)
+	if err != nil {
+		t.Fatalf("OpenFile on /dev/full error: %v", err)
+	}
+	if _, err := session.Write(full, "data"); !errors.Is(err, errs.ErrNoSpaceLeft) {
+		t.Errorf("Write on /dev/full: expected ErrNoSpaceLeft, got %v", err)
+	}
+	if data, err := session.Read(full, 3); data != "\x00\x00\x00" || err != nil {
+		t.Errorf("Read on /dev/full: expected three zero bytes, got %q (%v)", data, err)
+	}
+	if _, err := session.Seek(full, 0, io.SeekEnd); err != nil {
+		t.Errorf("Seek on /dev/full error: %v", err)
+	}
+	session.CloseFile(full)
+}
+
+func TestProc(t *testing.T) {
+	fs, cleanup := setupFilesystem(t)
+	t.Cleanup(cleanup)
+
+	stats, err := fs.ReadFile("/proc/fs/stats")
+	expected := fmt.Sprintf("free_blocks %d\n", fs.superblock.FreeBlockCount)
+	if err != nil || !strings.Contains(stats, expected) {
+		t.Errorf("ReadFile on /proc/fs/stats mismatch: expected to contain \"%s\", got \"%s\" (%v)", expected, stats, err)
+	}
+
+	if err := fs.ChangeDirectory("/proc/fs"); err != nil {
+		t.Fatalf("ChangeDirectory to /proc/fs error: %v", err)
+	}
+	records, _ := fs.GetCurrentDirectoryRecords(false)
+	if strings.Join(records, " ") != ". .. fragmentation stats" {
+		t.Errorf("GetCurrentDirectoryRecords in /proc/fs mismatch: got %v", records)
+	}
+	if content, _ := fs.ReadFile("stats"); content != stats {
+		t.Errorf("ReadFile on relative proc path mismatch: expected \"%s\", got \"%s\"", stats, content)
+	}
+
+	fs.ChangeDirectory("../self")
+	status, _ := fs.ReadFile("status")
+	if !strings.Contains(status, "user root\n") || !strings.Contains(status, "cwd /proc/self\n") {
+		t.Errorf("ReadFile on /proc/self/status mismatch: got \"%s\"", status)
+	}
+
+	err = fs.CreateEmptyFile("file")
+	if !errors.Is(err, errs.ErrReadOnlyFileSystem) {
+		t.Errorf("CreateEmptyFile in /proc error mismatch: expected \"%v\", got \"%v\"", errs.ErrReadOnlyFileSystem, err)
+	}
+
+	fs.ChangeDirectory("../..")
+	if fs.GetCurrentPath() != "/" {
+		t.Errorf("ChangeDirectory out of /proc path mismatch: expected \"/\", got \"%s\"", fs.GetCurrentPath())
+	}
+
+	rootInode, _ := fs.ReadFile("/proc/inodes/0")
+	if !strings.Contains(rootInode, "mode drwxr-xr-x\n") {
+		t.Errorf("ReadFile on /proc/inodes/0 mismatch: got \"%s\"", rootInode)
+	}
+
+	// Users see the inodes they may read, and each session has its own
+	// status
+	fs.AddUser("user", "password")
+	fs.CreateFileWithContent("/secret", "secret")
+	fs.ChangeMode("/secret", "600")
+	_, secretIndex, _ := fs.statPath("/secret")
+	session, _ := fs.NewSession("user", "password")
+	other, _ := fs.NewSession("user", "password")
+	if _, err := session.ReadFile(fmt.Sprintf("/proc/inodes/%d", secretIndex)); !errors.Is(err, errs.ErrPermissionDenied) {
+		t.Errorf("ReadFile on /proc/inodes of an unreadable file: expected ErrPermissionDenied, got %v", err)
+	}
+	if _, err := session.ReadFile("/proc/inodes/0"); err != nil {
+		t.Errorf("ReadFile on /proc/inodes/0 as user error: %v", err)
+	}
+	first, _ := session.ReadFile("/proc/self/status")
+	second, _ := other.ReadFile("/proc/self/status")
+	if !strings.HasPrefix(first, "session ") || first == second {
+		t.Errorf("Sessions of the same user share their status: \"%s\", \"%s\"", first, second)
+	}
+}
+
+func TestIndexedDirectory(t *testing.T) {
+	fs, cleanup := setupFilesystem(t)
+	t.Cleanup(cleanup)
+
+	savedContent := imageContent(fs)
+	rootInode, _ := fs.inodeManager.ReadInode(0)
+
+	fileCount := 400
+
+	fs.CreateDirectory("dir")
+	fs.ChangeDirectory("dir")
+	for i := 0; i < fileCount; i++ {
+		if err := fs.CreateFileWithContent(fmt.Sprintf("file%d", i), fmt.Sprintf("content%d", i)); err != nil {
+			t.Fatalf("CreateFileWithContent error on file%d: %v", i, err)
+		}
+	}
+
+	if dirInode, _ := fs.inodeManager.ReadInode(fs.cwdInode); !dirInode.IsIndexed() {
+		t.Errorf("Directory with %d files was not converted to an index", fileCount)
+	}
+
+	for i := 0; i < fileCount; i += 2 {
+		if err := fs.DeleteFile(fmt.Sprintf("file%d", i)); err != nil {
+			t.Errorf("DeleteFile error on file%d: %v", i, err)
+		}
+	}
+
+	fs.ChangeDirectory("/")
+	for i := 0; i < fileCount; i++ {
+		content, err := fs.ReadFile(fmt.Sprintf("/dir/file%d", i))
+		if i%2 == 0 && !errors.Is(err, errs.ErrRecordNotFound) {
+			t.Errorf("ReadFile on deleted file%d: expected ErrRecordNotFound, got %v", i, err)
+		}
+		if i%2 == 1 && content != fmt.Sprintf("content%d", i) {
+			t.Errorf("ReadFile content mismatch on file%d: got \"%s\" (%v)", i, content, err)
+		}
+	}
+
+	fs.ChangeDirectory("dir")
+	currentRecords, _ := fs.GetCurrentDirectoryRecords(false)
+	if len(currentRecords)-2 != fileCount/2 {
+		t.Errorf("Directory records count mismatch: expected %d, got %d", fileCount/2, len(currentRecords)-2)
+	}
+	fs.ChangeDirectory("..")
+
+	fs.DeleteFile("dir")
+	restoreModificationTime(fs, 0, rootInode.ModificationTime)
+
+	currentContent := imageContent(fs)
+	if diffIndex := findFirstDifference(savedContent, currentContent); diffIndex != -1 {
+		t.Errorf("File content mismatch at byte index %d after deleting indexed directory", diffIndex)
+	}
+}
+
+func TestLinearDirectorySlotReuse(t *testing.T) {
+	threshold := FSConfig.DirectoryIndexThreshold
+	FSConfig.DirectoryIndexThreshold = 0
+	t.Cleanup(func() { FSConfig.DirectoryIndexThreshold = threshold })
+
+	fs, cleanup := setupFilesystem(t)
+	t.Cleanup(cleanup)
+
+	fileCount := 300
+
+	fs.CreateDirectory("dir")
+	fs.ChangeDirectory("dir")
+	for i := 0; i < fileCount; i++ {
+		fs.CreateEmptyFile(fmt.Sprintf("file%d", i))
+	}
+
+	dirInode, _ := fs.inodeManager.ReadInode(fs.cwdInode)
+	if dirInode.IsIndexed() {
+		t.Fatalf("Directory was indexed with indexing disabled")
+	}
+	dirSize := dirInode.FileSize
+
+	blockIndices, _ := fs.blockManager.GetBlockIndices(dirInode)
+	for _, blockIndex := range blockIndices {
+		data, _ := fs.blockManager.ReadBlock(blockIndex)
+		var total int
+		for offset := 0; offset < len(data); {
+			r, ok := record.ReadRecordAt(data, offset)
+			if !ok {
+				break
+			}
+			total += int(r.RecordLength)
+			offset += int(r.RecordLength)
+		}
+		if total != int(FSConfig.BlockSize) {
+			t.Errorf("Record lengths of block %d add up to %d, expected %d", blockIndex, total, FSConfig.BlockSize)
+		}
+	}
+
+	for i := 0; i < fileCount; i += 2 {
+		fs.DeleteFile(fmt.Sprintf("file%d", i))
+	}
+	for i := 0; i < fileCount; i += 2 {
+		fs.CreateEmptyFile(fmt.Sprintf("file%d", i))
+	}
+
+	if dirInode.FileSize != dirSize {
+		t.Errorf("Directory size mismatch after reusing slots: expected %d, got %d", dirSize, dirInode.FileSize)
+	}
+
+	currentRecords, _ := fs.GetCurrentDirectoryRecords(false)
+	if len(currentRecords)-2 != fileCount {
+		t.Errorf("Directory records count mismatch: expected %d, got %d", fileCount, len(currentRecords)-2)
+	}
+}
+
+func TestCorruptDirectoryRecord(t *testing.T) {
+	valid := record.NewRecord(1, "name", record.TypeRegular)
+	data := make([]byte, 32)
+	copy(data, valid.Encode())
+	copy(data[16:], valid.Encode())
+
+	// The name length of the second record reaches past its end, then its
+	// record length past the block
+	data[16+6] = 200
+	if _, ok := record.ReadRecordAt(data, 16); ok {
+		t.Errorf("ReadRecordAt accepted a name past the record")
+	}
+	data[16+6] = valid.NameLength
+	data[16+5] = 64
+	if _, ok := record.ReadRecordAt(data, 16); ok {
+		t.Errorf("ReadRecordAt accepted a record past the block")
+	}
+
+	if r, ok := record.ReadRecordAt(data, 0); !ok || r.Name != "name" {
+		t.Errorf("ReadRecordAt rejected a valid record")
+	}
+}
+
+func TestFind(t *testing.T) {
+	fs, cleanup := setupFilesystem(t)
+	t.Cleanup(cleanup)
+
+	fs.CreateDirectory("dir")
+	fs.CreateDirectory("dir/sub")
+	fs.CreateFileWithContent("dir/file", "content")
+	fs.CreateFileWithContent("dir/sub/other", "content")
+
+	files, err := fs.Find("dir", record.TypeRegular)
+	if err != nil || strings.Join(files, " ") != "dir/sub/other dir/file" {
+		t.Errorf("Find files mismatch: expected \"dir/sub/other dir/file\", got \"%v\" (%v)", files, err)
+	}
+
+	directories, err := fs.Find("dir", record.TypeDirectory)
+	if err != nil || strings.Join(directories, " ") != "dir/sub" {
+		t.Errorf("Find directories mismatch: expected \"dir/sub\", got \"%v\" (%v)", directories, err)
+	}
+
+	devices, err := fs.Find("/", record.TypeCharDevice)
+	if err != nil || strings.Join(devices, " ") != "/dev/null /dev/zero /dev/full /dev/urandom" {
+		t.Errorf("Find devices mismatch: got \"%v\" (%v)", devices, err)
+	}
+
+	if fs.GetCurrentPath() != "/" {
+		t.Errorf("Find changed current path to \"%s\"", fs.GetCurrentPath())
+	}
+
+	rootRecords, _ := fs.GetCurrentDirectoryRecords(false)
+	for _, name := range rootRecords {
+		if name == ".users" {
+			t.Errorf("Hidden directory .users listed")
+		}
+	}
+}
+
+func TestNameValidation(t *testing.T) {
+	fs, cleanup := setupFilesystem(t)
+	t.Cleanup(cleanup)
+
+	fs.CreateFileWithContent("file", "content")
+
+	tests := []struct {
+		name string
+		err  error
+	}{
+		{strings.Repeat("a", 256), errs.ErrNameTooLong},
+		{"bad\xffname", errs.ErrIncorrectFileName},
+		{"nul\x00name", errs.ErrIncorrectFileName},
+		{"..", errs.ErrIncorrectFileName},
+	}
+	for _, test := range tests {
+		if err := fs.CreateEmptyFile(test.name); !errors.Is(err, test.err) {
+			t.Errorf("CreateEmptyFile(%q): expected %v, got %v", test.name, test.err, err)
+		}
+	}
+
+	if err := fs.CreateEmptyFile(strings.Repeat("a", 255)); err != nil {
+		t.Errorf("CreateEmptyFile error on 255 bytes long name: %v", err)
+	}
+
+	if err := fs.MoveFile("file", "dir/"); !errors.Is(err, errs.ErrIncorrectFileName) {
+		t.Errorf("MoveFile to empty name: expected ErrIncorrectFileName, got %v", err)
+	}
+	if content, _ := fs.ReadFile("file"); content != "content" {
+		t.Errorf("File lost after rejected move: got \"%s\"", content)
+	}
+}
+
+func TestNameNormalization(t *testing.T) {
+	config := FSConfig
+	FSConfig.NormalizeNames = true
+	FSConfig.CaseInsensitiveNames = true
+	t.Cleanup(func() { FSConfig = config })
+
+	fs, cleanup := setupFilesystem(t)
+	t.Cleanup(cleanup)
+
+	fs.CreateFileWithContent("Cafe\u0301", "content")
+
+	if content, err := fs.ReadFile("caf\u00e9"); content != "content" {
+		t.Errorf("ReadFile through composed lower case name mismatch: got \"%s\" (%v)", content, err)
+	}
+	if err := fs.CreateEmptyFile("CAF\u00c9"); !errors.Is(err, errs.ErrRecordAlreadyExists) {
+		t.Errorf("CreateEmptyFile on colliding name: expected ErrRecordAlreadyExists, got %v", err)
+	}
+
+	records, _ := fs.GetCurrentDirectoryRecords(false)
+	if !strings.Contains(strings.Join(records, " "), "Caf\u00e9") {
+		t.Errorf("Stored name is not case preserving NFC: got %q", records)
+	}
+
+	fs.CreateDirectory("dir")
+	fs.ChangeDirectory("dir")
+	for i := 0; i < 200; i++ {
+		fs.CreateEmptyFile(fmt.Sprintf("File%d", i))
+	}
+	for i := 0; i < 200; i++ {
+		if _, err := fs.ReadFile(fmt.Sprintf("fILE%d", i)); err != nil {
+			t.Errorf("ReadFile in indexed directory error on fILE%d: %v", i, err)
+		}
+	}
+	if err := fs.DeleteFile("file7"); err != nil {
+		t.Errorf("DeleteFile in indexed directory error: %v", err)
+	}
+	if _, err := fs.ReadFile("File7"); !errors.Is(err, errs.ErrRecordNotFound) {
+		t.Errorf("ReadFile on deleted file: expected ErrRecordNotFound, got %v", err)
+	}
+}
+
+func TestIndirectBlocks(t *testing.T) {
+	fs, cleanup := setupFilesystem(t)
+	t.Cleanup(cleanup)
+
+	savedContent := imageContent(fs)
+	rootInode, _ := fs.inodeManager.ReadInode(0)
+	freeBlocks := fs.superblock.FreeBlockCount
+
+	blockCount := 300
+	fileContent := strings.Repeat("#", blockCount*int(FSConfig.BlockSize))
+
+	if err := fs.CreateFileWithContent("file", fileContent); err != nil {
+		t.Fatalf("CreateFileWithContent error: %v", err)
+	}
+	content, _ := fs.ReadFile("file")
+	if content != fileContent {
+		t.Errorf("ReadFile error on %d blocks long file", blockCount)
+	}
+
+	// Data blocks, one single indirect and two double indirect pointer blocks
+	expectedUsed := uint32(blockCount + 3)
+	if used := freeBlocks - fs.superblock.FreeBlockCount; used != expectedUsed {
+		t.Errorf("Used blocks mismatch: expected %d, got %d", expectedUsed, used)
+	}
+
+	fs.EditFile("file", "short")
+	if used := freeBlocks - fs.superblock.FreeBlockCount; used != 1 {
+		t.Errorf("Used blocks after shrinking mismatch: expected 1, got %d", used)
+	}
+
+	fs.DeleteFile("file")
+	restoreModificationTime(fs, 0, rootInode.ModificationTime)
+
+	currentContent := imageContent(fs)
+	if diffIndex := findFirstDifference(savedContent, currentContent); diffIndex != -1 {
+		t.Errorf("File content mismatch at byte index %d after deleting large file", diffIndex)
+	}
+}
+
+func TestNullBlockReserved(t *testing.T) {
+	window := FSConfig.PreallocationWindow
+	FSConfig.PreallocationWindow = 0
+	t.Cleanup(func() { FSConfig.PreallocationWindow = window })
+
+	fs, cleanup := setupFilesystem(t)
+	t.Cleanup(cleanup)
+
+	if bit, _ := fs.blockBitmap.GetBit(nullBlock); bit != 1 {
+		t.Fatalf("Null block is not reserved")
+	}
+
+	// Spread the blocks of the root directory between those of files, so
+	// that defragmenting moves them
+	block := strings.Repeat("#", int(FSConfig.BlockSize))
+	for i := 0; i < 100; i++ {
+		fs.CreateFileWithContent(fmt.Sprintf("/file%d", i), block)
+	}
+	if _, err := fs.Defragment(context.Background(), "/"); err != nil {
+		t.Fatalf("Defragment error: %v", err)
+	}
+
+	freeBlocks := fs.superblock.FreeBlockCount
+	fs.CreateFileWithContent("/ten", strings.Repeat(block, 11))
+	nd, _ := fs.lookup("/ten")
+	blocks, _ := fs.blockManager.GetBlockIndices(nd.entry)
+	if nd.entry.Blocks[10] == nullBlock || containsBlock(blocks, nullBlock) {
+		t.Errorf("Null block handed out: %v, %v", nd.entry.Blocks, blocks)
+	}
+	fs.DeleteFile("/ten")
+	if fs.superblock.FreeBlockCount != freeBlocks {
+		t.Errorf("Free blocks mismatch after delete: expected %d, got %d", freeBlocks, fs.superblock.FreeBlockCount)
+	}
+	if bit, _ := fs.blockBitmap.GetBit(nullBlock); bit != 1 {
+		t.Errorf("Null block released")
+	}
+}
+
+func containsBlock(blocks []uint32, blockIndex uint32) bool {
+	for _, b := range blocks {
+		if b == blockIndex {
+			return true
+		}
+	}
+	return false
+}
+
+func TestDefragment(t *testing.T) {
+	window := FSConfig.PreallocationWindow
+	FSConfig.PreallocationWindow = 0
+	t.Cleanup(func() { FSConfig.PreallocationWindow = window })
+
+	fs, cleanup := setupFilesystem(t)
+	t.Cleanup(cleanup)
+
+	fs.CreateDirectory("dir")
+	fs.ChangeDirectory("dir")
+	fs.CreateFileWithContent("first", "")
+	fs.CreateFileWithContent("second", "")
+
+	block := int(FSConfig.BlockSize)
+	first, second := "", ""
+	for i := 0; i < 6; i++ {
+		chunk := strings.Repeat(string(rune('a'+i)), block)
+		fs.AppendToFile("first", chunk)
+		fs.AppendToFile("second", strings.ToUpper(chunk))
+		first += chunk
+		second += strings.ToUpper(chunk)
+	}
+	fs.ChangeDirectory("/")
+	freeBlocks := fs.superblock.FreeBlockCount
+
+	report, err := fs.Defragment(context.Background(), "/")
+	if err != nil {
+		t.Fatalf("Defragment error: %v", err)
+	}
+	if report.Moved < 2 || report.ExtentsAfter >= report.ExtentsBefore {
+		t.Errorf("Defragment report mismatch: %+v", report)
+	}
+	if fs.superblock.FreeBlockCount != freeBlocks {
+		t.Errorf("Free blocks mismatch: expected %d, got %d", freeBlocks, fs.superblock.FreeBlockCount)
+	}
+
+	for name, expected := range map[string]string{"dir/first": first, "dir/second": second} {
+		if content, _ := fs.ReadFile(name); content != expected {
+			t.Errorf("Content of %s changed after Defragment", name)
+		}
+		nd, _ := fs.lookup(name)
+		blocks, _ := fs.blockManager.GetBlockIndices(nd.entry)
+		if extents := countExtents(blocks); extents != 1 {
+			t.Errorf("%s has %d extents after Defragment, expected 1", name, extents)
+		}
+	}
+
+	if _, err := fs.Defragment(context.Background(), "dir/first"); err != nil {
+		t.Errorf("Defragment of a single file error: %v", err)
+	}
+	ctx, cancel := context.WithCancel(context.Background())
+	cancel()
+	if _, err := fs.Defragment(ctx, "/"); !errors.Is(err, context.Canceled) {
+		t.Errorf("Expected context.Canceled, got %v", err)
+	}
+}
+
+func TestSpaceReport(t *testing.T) {
+	fs, cleanup := setupFilesystem(t)
+	t.Cleanup(cleanup)
+
+	fs.CreateFileWithContent("file", strings.Repeat("#", 3*int(FSConfig.BlockSize)))
+
+	report := fs.GetSpaceReport()
+	if report.FreeBlocks != report.SuperblockFreeBlocks || report.FreeInodes != report.SuperblockFreeInodes {
+		t.Errorf("Counters mismatch on a consistent image: %+v", report)
+	}
+
+	var histogramBlocks uint32
+	var histogramExtents int
+	for _, bucket := range report.Histogram {
+		if bucket.Extents > 0 && bucket.Blocks < uint32(bucket.Extents)*bucket.Min {
+			t.Errorf("Bucket %d-%d holds too few blocks: %d", bucket.Min, bucket.Max, bucket.Blocks)
+		}
+		histogramBlocks += bucket.Blocks
+		histogramExtents += bucket.Extents
+	}
+	if histogramBlocks != report.FreeBlocks || histogramExtents != report.FreeExtents {
+		t.Errorf("Histogram covers %d blocks in %d extents, expected %d in %d",
+			histogramBlocks, histogramExtents, report.FreeBlocks, report.FreeExtents)
+	}
+
+	var regionUsed uint32
+	for _, region := range report.Regions {
+		regionUsed += region.Used
+	}
+	if regionUsed != report.BlockCount-report.FreeBlocks {
+		t.Errorf("Regions hold %d used blocks, expected %d", regionUsed, report.BlockCount-report.FreeBlocks)
+	}
+
+	// A block taken behind the superblock's back shows up as a mismatch
+	fs.blockBitmap.TakeFreeBit()
+	report = fs.GetSpaceReport()
+	if report.FreeBlocks != report.SuperblockFreeBlocks-1 {
+		t.Errorf("Leaked block not detected: superblock %d, bitmap %d", report.SuperblockFreeBlocks, report.FreeBlocks)
+	}
+}
+
+func TestWriteBackCache(t *testing.T) {
+	writeBack := FSConfig.CacheWriteBack
+	FSConfig.CacheWriteBack = true
+	t.Cleanup(func() { FSConfig.CacheWriteBack = writeBack })
+
+	fs, cleanup := setupFilesystem(t)
+	t.Cleanup(cleanup)
+	fs.Sync()
+
+	savedContent := imageContent(fs)
+	fs.CreateFileWithContent("file", "cached")
+
+	currentContent := imageContent(fs)
+	if findFirstDifference(savedContent, currentContent) != -1 {
+		t.Errorf("Image changed before Sync in write-back mode")
+	}
+
+	if err := fs.Sync(); err != nil {
+		t.Fatalf("Sync error: %v", err)
+	}
+	fs.CloseDataFile()
+
+	reopened, err := OpenFilesystem(fs.device)
+	if err != nil {
+		t.Fatalf("OpenFilesystem error: %v", err)
+	}
+	if content, _ := reopened.ReadFile("file"); content != "cached" {
+		t.Errorf("ReadFile after reopening: expected \"cached\", got \"%s\"", content)
+	}
+}
+
+func TestHostFileDevice(t *testing.T) {
+	name := t.TempDir() + "/" + FSConfig.FileName
+	device, err := blockdevice.CreateFile(name)
+	if err != nil {
+		t.Fatalf("CreateFile error: %v", err)
+	}
+	fs, err := FormatFilesystem(device, FSConfig.FileSize, FSConfig.BlockSize)
+	if err != nil {
+		t.Fatalf("FormatFilesystem error: %v", err)
+	}
+	fs.CreateFileWithContent("file", "on disk")
+	fs.CloseDataFile()
+
+	if info, _ := os.Stat(name); info.Size() < int64(FSConfig.FileSize) {
+		t.Errorf("Image file is %d bytes, expected at least %d", info.Size(), FSConfig.FileSize)
+	}
+
+	device, err = blockdevice.OpenFile(name)
+	if err != nil {
+		t.Fatalf("OpenFile error: %v", err)
+	}
+	fs, err = OpenFilesystem(device)
+	if err != nil {
+		t.Fatalf("OpenFilesystem error: %v", err)
+	}
+	t.Cleanup(func() { fs.CloseDataFile() })
+	if content, _ := fs.ReadFile("file"); content != "on disk" {
+		t.Errorf("ReadFile after reopening: expected \"on disk\", got \"%s\"", content)
+	}
+}
+
+func TestReadOnlyDevice(t *testing.T) {
+	fs, cleanup := setupFilesystem(t)
+	t.Cleanup(cleanup)
+	fs.CreateFileWithContent("file", "content")
+	savedContent := imageContent(fs)
+
+	readOnly, err := OpenFilesystem(blockdevice.NewReadOnly(fs.device))
+	if err != nil {
+		t.Fatalf("OpenFilesystem on a read-only device error: %v", err)
+	}
+	if content, _ := readOnly.ReadFile("file"); content != "content" {
+		t.Errorf("ReadFile on a read-only device: expected \"content\", got \"%s\"", content)
+	}
+	if err := readOnly.CreateFileWithContent("other", ""); !errors.Is(err, errs.ErrReadOnlyFileSystem) {
+		t.Errorf("CreateFileWithContent: expected ErrReadOnlyFileSystem, got %v", err)
+	}
+	if err := readOnly.DeleteFile("file"); !errors.Is(err, errs.ErrReadOnlyFileSystem) {
+		t.Errorf("DeleteFile: expected ErrReadOnlyFileSystem, got %v", err)
+	}
+	if diffIndex := findFirstDifference(savedContent, imageContent(fs)); diffIndex != -1 {
+		t.Errorf("Read-only device changed at byte index %d", diffIndex)
+	}
+}
+
+func TestMounts(t *testing.T) {
+	fs, cleanup := setupFilesystem(t)
+	t.Cleanup(cleanup)
+
+	device := blockdevice.NewMemory(nil)
+	image, _ := FormatFilesystem(device, FSConfig.FileSize, FSConfig.BlockSize)
+	image.CreateDirectory("sub")
+	image.CreateFileWithContent("sub/inner", "mounted")
+	image.CloseDataFile()
+
+	fs.CreateDirectory("data")
+	fs.CreateFileWithContent("data/hidden", "covered")
+	if err := fs.Mount(device, "data"); err != nil {
+		t.Fatalf("Mount error: %v", err)
+	}
+
+	if content, _ := fs.ReadFile("/data/sub/inner"); content != "mounted" {
+		t.Errorf("ReadFile through mount: expected \"mounted\", got \"%s\"", content)
+	}
+	if _, err := fs.ReadFile("data/hidden"); err == nil {
+		t.Errorf("Directory content under the mount point is still visible")
+	}
+
+	if err := fs.ChangeDirectory("/data/sub"); err != nil {
+		t.Fatalf("ChangeDirectory into mount error: %v", err)
+	}
+	if path := fs.GetCurrentPath(); path != "/data/sub" {
+		t.Errorf("Current path mismatch: expected /data/sub, got %s", path)
+	}
+	fs.CreateFileWithContent("created", "new")
+	if records, _ := fs.GetCurrentDirectoryRecords(false); !containsString(records, "created") {
+		t.Errorf("Created file is missing in the mounted directory: %v", records)
+	}
+	if err := fs.Unmount("/data"); !errors.Is(err, errs.ErrBusy) {
+		t.Errorf("Unmount of the working directory: expected ErrBusy, got %v", err)
+	}
+
+	fs.ChangeDirectory("../..")
+	if path := fs.GetCurrentPath(); path != "/" {
+		t.Errorf("Current path after leaving the mount: expected /, got %s", path)
+	}
+	if records, _ := fs.GetCurrentDirectoryRecords(false); !containsString(records, "data") {
+		t.Errorf("Root listing after leaving the mount is missing data: %v", records)
+	}
+
+	if err := fs.MoveFile("data/sub/created", "moved"); !errors.Is(err, errs.ErrCrossDevice) {
+		t.Errorf("MoveFile across images: expected ErrCrossDevice, got %v", err)
+	}
+	if err := fs.CopyFile("data/sub", "copied"); err != nil {
+		t.Errorf("CopyFile across images error: %v", err)
+	}
+	if content, _ := fs.ReadFile("copied/created"); content != "new" {
+		t.Errorf("Copied file content mismatch: expected \"new\", got \"%s\"", content)
+	}
+	if err := fs.DeleteFile("data"); !errors.Is(err, errs.ErrBusy) {
+		t.Errorf("DeleteFile of a mount point: expected ErrBusy, got %v", err)
+	}
+
+	mounts, _ := fs.ReadFile("/proc/mounts")
+	if !strings.Contains(mounts, "memory /data emufs") {
+		t.Errorf("/proc/mounts does not list the mount:\n%s", mounts)
+	}
+
+	if err := fs.Unmount("data"); err != nil {
+		t.Fatalf("Unmount error: %v", err)
+	}
+	if content, _ := fs.ReadFile("data/hidden"); content != "covered" {
+		t.Errorf("Covered file after Unmount: expected \"covered\", got \"%s\"", content)
+	}
+
+	reopened, _ := OpenFilesystem(device)
+	if content, _ := reopened.ReadFile("/sub/created"); content != "new" {
+		t.Errorf("File created through the mount is missing in the image")
+	}
+}
+
+func TestNestedMounts(t *testing.T) {
+	fs, cleanup := setupFilesystem(t)
+	t.Cleanup(cleanup)
+
+	outer := blockdevice.NewMemory(nil)
+	image, _ := FormatFilesystem(outer, FSConfig.FileSize, FSConfig.BlockSize)
+	image.CreateDirectory("b")
+	image.CreateFileWithContent("x", "outer")
+	image.CloseDataFile()
+	inner := blockdevice.NewMemory(nil)
+	image, _ = FormatFilesystem(inner, FSConfig.FileSize, FSConfig.BlockSize)
+	image.CreateFileWithContent("x", "inner")
+	image.CloseDataFile()
+
+	fs.CreateDirectory("/a")
+	fs.CreateDirectory("/a/b")
+	if err := fs.Mount(inner, "/a/b"); err != nil {
+		t.Fatalf("Mount error: %v", err)
+	}
+	if err := fs.Mount(outer, "/a"); !errors.Is(err, errs.ErrBusy) {
+		t.Errorf("Mount over a mount point: expected ErrBusy, got %v", err)
+	}
+	if err := fs.Unmount("/a/b"); err != nil {
+		t.Fatalf("Unmount error: %v", err)
+	}
+
+	// A mount below another one goes into the outer image
+	if err := fs.Mount(outer, "/a"); err != nil {
+		t.Fatalf("Mount error: %v", err)
+	}
+	if err := fs.Mount(inner, "/a/b"); err != nil {
+		t.Fatalf("Mount inside a mounted image error: %v", err)
+	}
+	for path, expected := range map[string]string{"/a/x": "outer", "/a/b/x": "inner"} {
+		if content, err := fs.ReadFile(path); content != expected {
+			t.Errorf("ReadFile %s: expected %q, got %q (%v)", path, expected, content, err)
+		}
+	}
+	if mounts := fs.Mounts(); strings.Join(mounts, " ") != "/a /a/b" {
+		t.Errorf("Mounts mismatch: got %v", mounts)
+	}
+}
+
+func TestCopyIntoMountedImage(t *testing.T) {
+	fs, cleanup := setupFilesystem(t)
+	t.Cleanup(cleanup)
+
+	device := blockdevice.NewMemory(nil)
+	image, _ := FormatFilesystem(device, FSConfig.FileSize, FSConfig.BlockSize)
+	image.AddUser("user", "password")
+	image.CloseDataFile()
+	fs.CreateDirectory("data")
+	if err := fs.Mount(device, "data"); err != nil {
+		t.Fatalf("Mount error: %v", err)
+	}
+	fs.CreateFileWithContent("source", "copied")
+	session, err := fs.mounts["/data"].NewSession("user", "password")
+	if err != nil {
+		t.Fatalf("NewSession error: %v", err)
+	}
+
+	// Another session of the image works in it while the copier does
+	var wg sync.WaitGroup
+	wg.Add(2)
+	go func() {
+		defer wg.Done()
+		for i := 0; i < 20; i++ {
+			if err := fs.CopyFile("source", fmt.Sprintf("data/copy%d", i), CopyArchive()); err != nil {
+				t.Errorf("CopyFile into the image error: %v", err)
+			}
+		}
+	}()
+	go func() {
+		defer wg.Done()
+		for i := 0; i < 20; i++ {
+			if err := session.CreateFileWithContent(fmt.Sprintf("own%d", i), "own"); err != nil {
+				t.Errorf("CreateFileWithContent in the image error: %v", err)
+			}
+		}
+	}()
+	wg.Wait()
+
+	for i := 0; i < 20; i++ {
+		if content, _ := fs.ReadFile(fmt.Sprintf("data/copy%d", i)); content != "copied" {
+			t.Errorf("Copy %d content mismatch: expected \"copied\", got \"%s\"", i, content)
+		}
+		if content, _ := session.ReadFile(fmt.Sprintf("own%d", i)); content != "own" {
+			t.Errorf("File %d of the image content mismatch: expected \"own\", got \"%s\"", i, content)
+		}
+	}
+}
+
+func TestMountBehindPrivateDirectory(t *testing.T) {
+	fs, cleanup := setupFilesystem(t)
+	t.Cleanup(cleanup)
+
+	device := blockdevice.NewMemory(nil)
+	image, _ := FormatFilesystem(device, FSConfig.FileSize, FSConfig.BlockSize)
+	image.CreateFileWithContent("secret", "mounted")
+	image.CloseDataFile()
+
+	fs.AddUser("user", "password")
+	fs.CreateDirectory("/private")
+	fs.CreateDirectory("/private/mnt")
+	fs.CreateFileWithContent("/private/plain", "plain")
+	fs.ChangeMode("/private", "700")
+	if err := fs.Mount(device, "/private/mnt"); err != nil {
+		t.Fatalf("Mount error: %v", err)
+	}
+
+	session, _ := fs.NewSession("user", "password")
+	if _, err := session.ReadFile("/private/plain"); !errors.Is(err, errs.ErrPermissionDenied) {
+		t.Errorf("ReadFile beside the mount point: expected ErrPermissionDenied, got %v", err)
+	}
+	if _, err := session.ReadFile("/private/mnt/secret"); !errors.Is(err, errs.ErrPermissionDenied) {
+		t.Errorf("ReadFile through the mount point: expected ErrPermissionDenied, got %v", err)
+	}
+	if err := session.ChangeDirectory("/private/mnt"); !errors.Is(err, errs.ErrPermissionDenied) {
+		t.Errorf("ChangeDirectory to the mount point: expected ErrPermissionDenied, got %v", err)
+	}
+	if _, err := session.Stat("/private/mnt/secret"); !errors.Is(err, errs.ErrPermissionDenied) {
+		t.Errorf("Stat through the mount point: expected ErrPermissionDenied, got %v", err)
+	}
+
+	if content, _ := fs.ReadFile("/private/mnt/secret"); content != "mounted" {
+		t.Errorf("ReadFile through the mount point as root: expected \"mounted\", got \"%s\"", content)
+	}
+	fs.ChangeMode("/private", "755")
+	if content, err := session.ReadFile("/private/mnt/secret"); content != "mounted" {
+		t.Errorf("ReadFile through a searchable mount point: expected \"mounted\", got \"%s\" (%v)", content, err)
+	}
+}
+
+func TestOverlay(t *testing.T) {
+	lowerDevice := blockdevice.NewMemory(nil)
+	lower, _ := FormatFilesystem(lowerDevice, FSConfig.FileSize, FSConfig.BlockSize)
+	lower.CreateDirectory("base")
+	lower.CreateFileWithContent("base/file", "lower")
+	lower.CreateFileWithContent("base/keep", "kept")
+	lower.CreateDirectory("base/dir")
+	lower.CreateFileWithContent("base/dir/nested", "nested")
+	lower.CloseDataFile()
+	lowerContent := lowerDevice.Bytes()
+
+	upperDevice := blockdevice.NewMemory(nil)
+	upper, _ := FormatFilesystem(upperDevice, FSConfig.FileSize, FSConfig.BlockSize)
+	upper.CloseDataFile()
+
+	fs, err := OpenFilesystem(upperDevice, WithLowerLayer(lowerDevice))
+	if err != nil {
+		t.Fatalf("OpenFilesystem with a lower layer error: %v", err)
+	}
+	t.Cleanup(func() { fs.CloseDataFile() })
+
+	if content, _ := fs.ReadFile("base/dir/nested"); content != "nested" {
+		t.Errorf("ReadFile from the lower layer: expected \"nested\", got \"%s\"", content)
+	}
+
+	if err := fs.EditFile("base/file", "upper"); err != nil {
+		t.Fatalf("EditFile of a lower file error: %v", err)
+	}
+	if content, _ := fs.ReadFile("base/file"); content != "upper" {
+		t.Errorf("ReadFile after copy-up: expected \"upper\", got \"%s\"", content)
+	}
+
+	if err := fs.DeleteFile("base/keep"); err != nil {
+		t.Fatalf("DeleteFile of a lower file error: %v", err)
+	}
+	if _, err := fs.ReadFile("base/keep"); !errors.Is(err, errs.ErrRecordNotFound) {
+		t.Errorf("ReadFile of a whited out file: expected ErrRecordNotFound, got %v", err)
+	}
+
+	fs.ChangeDirectory("base")
+	records, _ := fs.GetCurrentDirectoryRecords(false)
+	if !containsString(records, "file") || !containsString(records, "dir") || containsString(records, "keep") {
+		t.Errorf("Merged listing mismatch: %v", records)
+	}
+	fs.ChangeDirectory("/")
+
+	if err := fs.CreateFileWithContent("base/keep", "again"); err != nil {
+		t.Errorf("CreateFileWithContent over a whiteout error: %v", err)
+	}
+	if content, _ := fs.ReadFile("base/keep"); content != "again" {
+		t.Errorf("ReadFile of a re-created file: expected \"again\", got \"%s\"", content)
+	}
+
+	fs.DeleteFile("base/dir")
+	fs.CreateDirectory("base/dir")
+	if paths, _ := fs.Find("base/dir", record.TypeUnknown); len(paths) != 0 {
+		t.Errorf("Re-created directory is not opaque: %v", paths)
+	}
+
+	if err := fs.MoveFile("base/file", "moved"); err != nil {
+		t.Errorf("MoveFile error: %v", err)
+	}
+	paths, _ := fs.Find("/base", record.TypeUnknown)
+	expected := []string{"/base/keep", "/base/dir"}
+	if len(paths) != len(expected) || !containsString(paths, expected[0]) || !containsString(paths, expected[1]) {
+		t.Errorf("Find in overlay mismatch: expected %v, got %v", expected, paths)
+	}
+
+	if diffIndex := findFirstDifference(lowerContent, lowerDevice.Bytes()); diffIndex != -1 {
+		t.Errorf("Lower image changed at byte index %d", diffIndex)
+	}
+
+	mountDevice := blockdevice.NewMemory(nil)
+	image, _ := FormatFilesystem(mountDevice, FSConfig.FileSize, FSConfig.BlockSize)
+	image.CloseDataFile()
+	fs.CreateDirectory("mnt")
+	if err := fs.Mount(mountDevice, "mnt", WithLowerLayer(lowerDevice)); err != nil {
+		t.Fatalf("Mount of an overlay error: %v", err)
+	}
+	if content, _ := fs.ReadFile("/mnt/base/file"); content != "lower" {
+		t.Errorf("ReadFile through an overlay mount: expected \"lower\", got \"%s\"", content)
+	}
+}
+
+// TestConcurrentOperations is meant to run with -race: workers churn files
+// in their own directories while readers keep reading a shared one.
+func TestConcurrentOperations(t *testing.T) {
+	fs, cleanup := setupFilesystem(t)
+	t.Cleanup(cleanup)
+
+	const workers = 6
+	const rounds = 15
+	shared := strings.Repeat("shared ", 300)
+	if err := fs.CreateFileWithContent("/shared", shared); err != nil {
+		t.Fatal(err)
+	}
+	before := fs.GetSpaceReport()
+
+	var wg sync.WaitGroup
+	done := make(chan struct{})
+	for i := 0; i < workers; i++ {
+		directory := fmt.Sprintf("/w%d", i)
+		if err := fs.CreateDirectory(directory); err != nil {
+			t.Fatal(err)
+		}
+
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			for j := 0; j < rounds; j++ {
+				from := fmt.Sprintf("%s/f%d", directory, j)
+				to := fmt.Sprintf("%s/g%d", directory, j)
+				content := strings.Repeat(from, j*20+1)
+
+				if err := fs.CreateFileWithContent(from, "new"); err != nil {
+					t.Errorf("CreateFileWithContent %s: %v", from, err)
+					return
+				}
+				if err := fs.EditFile(from, content); err != nil {
+					t.Errorf("EditFile %s: %v", from, err)
+					return
+				}
+				if err := fs.MoveFile(from, to); err != nil {
+					t.Errorf("MoveFile %s: %v", from, err)
+					return
+				}
+				if got, err := fs.ReadFile(to); err != nil || got != content {
+					t.Errorf("ReadFile %s: got %d bytes (%v), expected %d", to, len(got), err, len(content))
+					return
+				}
+				if err := fs.DeleteFile(to); err != nil {
+					t.Errorf("DeleteFile %s: %v", to, err)
+					return
+				}
+			}
+		}()
+	}
+
+	var readers sync.WaitGroup
+	for i := 0; i < 3; i++ {
+		readers.Add(1)
+		go func() {
+			defer readers.Done()
+			for {
+				select {
+				case <-done:
+					return
+				default:
+				}
+				if got, err := fs.ReadFile("/shared"); err != nil || got != shared {
+					t.Errorf("ReadFile /shared: got %d bytes (%v)", len(got), err)
+					return
+				}
+				if _, err := fs.Find("/", record.TypeRegular); err != nil {
+					t.Errorf("Find: %v", err)
+					return
+				}
+			}
+		}()
+	}
+
+	wg.Wait()
+	close(done)
+	readers.Wait()
+
+	for i := 0; i < workers; i++ {
+		if err := fs.DeleteFile(fmt.Sprintf("/w%d", i)); err != nil {
+			t.Fatal(err)
+		}
+	}
+	if path := fs.GetCurrentPath(); path != "/" {
+		t.Errorf("Working directory changed to %s", path)
+	}
+
+	after := fs.GetSpaceReport()
+	if after.FreeBlocks != after.SuperblockFreeBlocks || after.FreeInodes != after.SuperblockFreeInodes {
+		t.Errorf("Counters mismatch after concurrent changes: %+v", after)
+	}
+	if after.FreeInodes != before.FreeInodes {
+		t.Errorf("Inodes leaked: %d free before, %d after", before.FreeInodes, after.FreeInodes)
+	}
+}
+
+// TestDirectoryLocks checks that a change waits only for the lock of its
+// own directory, not for changes elsewhere in the tree.
+func TestDirectoryLocks(t *testing.T) {
+	fs, cleanup := setupFilesystem(t)
+	t.Cleanup(cleanup)
+
+	fs.CreateDirectory("/busy")
+	fs.CreateDirectory("/free")
+	_, busyIndex, _ := fs.statPath("/busy")
+	unlock := fs.inodeLocks.lock(busyIndex)
+
+	blocked := make(chan error, 1)
+	go func() {
+		blocked <- fs.CreateFileWithContent("/busy/file", "busy")
+	}()
+	select {
+	case <-blocked:
+		t.Fatalf("CreateFileWithContent did not wait for the lock of its directory")
+	case <-time.After(50 * time.Millisecond):
+	}
+
+	done := make(chan error)
+	go func() {
+		if err := fs.CreateFileWithContent("/free/file", "free"); err != nil {
+			done <- err
+			return
+		}
+		_, err := fs.ReadFile("/free/file")
+		done <- err
+	}()
+	select {
+	case err := <-done:
+		if err != nil {
+			t.Errorf("Change in another directory error: %v", err)
+		}
+	case <-time.After(5 * time.Second):
+		t.Fatalf("Change in another directory waited for the lock of /busy")
+	}
+
+	unlock()
+	if err := <-blocked; err != nil {
+		t.Errorf("CreateFileWithContent after the lock was released error: %v", err)
+	}
+	if content, _ := fs.ReadFile("/busy/file"); content != "busy" {
+		t.Errorf("File created after waiting: expected \"busy\", got \"%s\"", content)
+	}
+}
+
+// TestConcurrentCreateAndDelete is meant to run with -race: workers create
+// entries in a directory that others keep removing and creating again.
+func TestConcurrentCreateAndDelete(t *testing.T) {
+	fs, cleanup := setupFilesystem(t)
+	t.Cleanup(cleanup)
+
+	before := fs.GetSpaceReport()
+	expected := func(err error) bool {
+		return err == nil || errors.Is(err, errs.ErrRecordNotFound) || errors.Is(err, errs.ErrRecordAlreadyExists)
+	}
+
+	var wg sync.WaitGroup
+	for i := 0; i < 4; i++ {
+		sub := fmt.Sprintf("/d/sub%d", i)
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			for j := 0; j < 30; j++ {
+				path := fmt.Sprintf("%s/f%d", sub, j)
+				for _, err := range []error{
+					fs.CreateDirectory("/d"),
+					fs.CreateDirectory(sub),
+					fs.CreateFileWithContent(path, path),
+					fs.MoveFile(path, path+"-moved"),
+				} {
+					if !expected(err) {
+						t.Errorf("Change below /d: %v", err)
+						return
+					}
+				}
+				if content, err := fs.ReadFile(path + "-moved"); err == nil && content != path {
+					t.Errorf("ReadFile %s-moved: expected %q, got %q", path, path, content)
+					return
+				}
+			}
+		}()
+	}
+	wg.Add(1)
+	go func() {
+		defer wg.Done()
+		for j := 0; j < 30; j++ {
+			if err := fs.DeleteFile("/d"); !expected(err) {
+				t.Errorf("DeleteFile /d: %v", err)
+				return
+			}
+		}
+	}()
+	wg.Wait()
+
+	if err := fs.DeleteFile("/d"); !expected(err) {
+		t.Fatal(err)
+	}
+	after := fs.GetSpaceReport()
+	if after.FreeBlocks != after.SuperblockFreeBlocks || after.FreeInodes != after.SuperblockFreeInodes {
+		t.Errorf("Counters mismatch after concurrent changes: %+v", after)
+	}
+	if after.FreeInodes != before.FreeInodes || after.FreeBlocks != before.FreeBlocks {
+		t.Errorf("Space leaked: %+v before, %+v after", before, after)
+	}
+}
+
+func TestSessions(t *testing.T) {
+	fs, cleanup := setupFilesystem(t)
+	t.Cleanup(cleanup)
+
+	fs.AddUser("alice", "password")
+	fs.AddUser("bob", "password")
+	fs.CreateDirectory("/tmp")
+	fs.ChangePermissions("/tmp", 777)
+
+	alice, err := fs.NewSession("alice", "password")
+	if err != nil {
+		t.Fatalf("NewSession error: %v", err)
+	}
+	bob, err := fs.NewSession("bob", "password")
+	if err != nil {
+		t.Fatalf("NewSession error: %v", err)
+	}
+	if _, err := fs.NewSession("bob", "wrong"); !errors.Is(err, errs.ErrIncorrectPassword) {
+		t.Errorf("NewSession with a wrong password: expected ErrIncorrectPassword, got %v", err)
+	}
+
+	if path := alice.GetCurrentPath(); path != "/alice" {
+		t.Errorf("Session expected to start at home /alice, got %s", path)
+	}
+	if err := bob.ChangeDirectory("/tmp"); err != nil {
+		t.Fatal(err)
+	}
+	if path, user := fs.GetCurrentPath(), fs.GetCurrentUserName(); path != "/" || user != FSConfig.RootUsername {
+		t.Errorf("Default session changed to %s@%s", user, path)
+	}
+
+	// Relative paths resolve against the working directory of each session
+	alice.CreateFileWithContent("note", "alice")
+	bob.CreateFileWithContent("note", "bob")
+	if content, _ := fs.ReadFile("/alice/note"); content != "alice" {
+		t.Errorf("Expected /alice/note to hold \"alice\", got %q", content)
+	}
+	if content, _ := fs.ReadFile("/tmp/note"); content != "bob" {
+		t.Errorf("Expected /tmp/note to hold \"bob\", got %q", content)
+	}
+	if err := bob.EditFile("/alice/note", "bob"); !errors.Is(err, errs.ErrPermissionDenied) {
+		t.Errorf("Editing a file of another user: expected ErrPermissionDenied, got %v", err)
+	}
+
+	bob.SetUmask(0o077)
+	bob.CreateFileWithContent("private", "secret")
+	alice.CreateFileWithContent("/tmp/shared", "open")
+	fs.ChangeDirectory("/tmp")
+	records, _ := fs.GetCurrentDirectoryRecords(true)
+	for _, r := range records {
+		fields := strings.Split(r, "\t")
+		name := fields[len(fields)-1]
+		if name == "private" && fields[0] != "-rw-------" || name == "shared" && fields[0] != "-rw-r--r--" {
+			t.Errorf("Unexpected permissions of %s: %s", name, fields[0])
+		}
+	}
+
+	if home := alice.Getenv("HOME"); home != "/alice" || alice.Getenv("USER") != "alice" {
+		t.Errorf("Unexpected environment of alice: %v", alice.Environ())
+	}
+	bob.Setenv("EDITOR", "ed")
+	if alice.Getenv("EDITOR") != "" || !containsString(bob.Environ(), "EDITOR=ed") {
+		t.Errorf("Environment shared between sessions: %v, %v", alice.Environ(), bob.Environ())
+	}
+
+	// A working directory renamed by another session is kept, and one
+	// removed by it is left empty
+	alice.CreateDirectory("work")
+	alice.ChangeDirectory("work")
+	alice.CreateFileWithContent("draft", "draft")
+	_, workIndex, _ := fs.statPath("/alice/work")
+	fs.MoveFile("/alice/work", "/alice/moved")
+	if content, err := alice.ReadFile("draft"); content != "draft" {
+		t.Errorf("ReadFile in a renamed working directory: expected \"draft\", got %q (%v)", content, err)
+	}
+	fs.DeleteFile("/alice/moved/draft")
+	fs.DeleteFile("/alice/moved")
+	if path := alice.GetCurrentPath(); path != "/alice/work" {
+		t.Errorf("Expected a deleted working directory to stay /alice/work, got %s", path)
+	}
+	if err := alice.CreateEmptyFile("orphan"); !errors.Is(err, errs.ErrRecordNotFound) {
+		t.Errorf("CreateEmptyFile in a deleted working directory: expected ErrRecordNotFound, got %v", err)
+	}
+	// Not even once the inode holds a new directory. A new allocator searches from the
+	// first inode on, so the freed one comes up soon.
+	fs.CreateDirectory("/reuse")
+	fs.inodeAllocator = allocator.NewAllocator(fs.inodeBitmap, 0)
+	for i := 0; ; i++ {
+		_, index, err := fs.statPath(fmt.Sprintf("/reuse/%d", i-1))
+		if err == nil && index == workIndex {
+			break
+		}
+		if err := fs.CreateDirectory(fmt.Sprintf("/reuse/%d", i)); err != nil {
+			t.Fatalf("Inode of the deleted working directory not reused: %v", err)
+		}
+	}
+	if err := alice.CreateEmptyFile("orphan"); !errors.Is(err, errs.ErrRecordNotFound) {
+		t.Errorf("CreateEmptyFile in a deleted working directory with its inode reused: expected ErrRecordNotFound, got %v", err)
+	}
+
+	// Changing the user keeps the working directory
+	if err := alice.ChangeUser("bob", "password"); err != nil {
+		t.Fatal(err)
+	}
+	if path := alice.GetCurrentPath(); path != "/alice/work" {
+		t.Errorf("ChangeUser moved the session to %s", path)
+	}
+	alice.ChangeUser("alice", "password")
+
+	var wg sync.WaitGroup
+	for _, s := range []*Session{alice, bob} {
+		wg.Add(1)
+		go func(s *Session) {
+			defer wg.Done()
+			home := s.Getenv("HOME")
+			for i := 0; i < 20; i++ {
+				if err := s.ChangeDirectory(home); err != nil {
+					t.Error(err)
+					return
+				}
+				name := fmt.Sprintf("file%d", i)
+				if err := s.CreateFileWithContent(name, home); err != nil {
+					t.Error(err)
+					return
+				}
+				if content, err := s.ReadFile(home + "/" + name); err != nil || content != home {
+					t.Errorf("ReadFile %s/%s: %q (%v)", home, name, content, err)
+					return
+				}
+			}
+		}(s)
+	}
+	wg.Wait()
+}
+
+func TestUsernameTraversal(t *testing.T) {
+	fs, cleanup := setupFilesystem(t)
+	t.Cleanup(cleanup)
+
+	fs.AddUser("bob", "password")
+	bob, _ := fs.NewSession("bob", "password")
+	fake := user.NewUser(FSConfig.RootUsername, 0, 0, "x")
+	bob.CreateFileWithContent("/bob/fake", fake.GetUserString())
+
+	if _, err := fs.NewSession("../bob/fake", "x"); !errors.Is(err, errs.ErrIncorrectFileName) {
+		t.Errorf("NewSession with a path as username: expected ErrIncorrectFileName, got %v", err)
+	}
+	if err := bob.ChangeUser("../bob/fake", "x"); !errors.Is(err, errs.ErrIncorrectFileName) {
+		t.Errorf("ChangeUser with a path as username: expected ErrIncorrectFileName, got %v", err)
+	}
+	if name := bob.GetCurrentUserName(); name != "bob" {
+		t.Errorf("Session changed its user to %s", name)
+	}
+	if err := fs.AddUser("../escape", "password"); !errors.Is(err, errs.ErrIncorrectFileName) {
+		t.Errorf("AddUser with a path as username: expected ErrIncorrectFileName, got %v", err)
+	}
+}
+
+func TestOpenFiles(t *testing.T) {
+	fs, cleanup := setupFilesystem(t)
+	t.Cleanup(cleanup)
+
+	fd, err := fs.OpenFile("file", os.O_RDWR|os.O_CREATE|os.O_EXCL)
+	if err != nil {
+		t.Fatalf("OpenFile error: %v", err)
+	}
+	if _, err := fs.OpenFile("file", os.O_RDWR|os.O_CREATE|os.O_EXCL); !errors.Is(err, errs.ErrRecordAlreadyExists) {
+		t.Errorf("OpenFile with O_EXCL of an existing file: expected ErrRecordAlreadyExists, got %v", err)
+	}
+
+	fs.Write(fd, "hello world")
+	fs.Seek(fd, 0, io.SeekStart)
+	if data, _ := fs.Read(fd, 5); data != "hello" {
+		t.Errorf("Read mismatch: expected \"hello\", got \"%s\"", data)
+	}
+	if data, _ := fs.Read(fd, 100); data != " world" {
+		t.Errorf("Read mismatch: expected \" world\", got \"%s\"", data)
+	}
+	if _, err := fs.Read(fd, 1); err != io.EOF {
+		t.Errorf("Read at the end: expected io.EOF, got %v", err)
+	}
+	fs.Seek(fd, -5, io.SeekEnd)
+	fs.Write(fd, "there")
+	if content, _ := fs.ReadFile("file"); content != "hello there" {
+		t.Errorf("Write at offset mismatch: expected \"hello there\", got \"%s\"", content)
+	}
+	fs.Seek(fd, 20, io.SeekStart)
+	if _, err := fs.Write(fd, "!"); !errors.Is(err, errs.ErrIllegalArgument) {
+		t.Errorf("Write past the end: expected ErrIllegalArgument, got %v", err)
+	}
+
+	appendFd, _ := fs.OpenFile("file", os.O_WRONLY|os.O_APPEND)
+	fs.Write(appendFd, "!")
+	if content, _ := fs.ReadFile("file"); content != "hello there!" {
+		t.Errorf("Write with O_APPEND mismatch: expected \"hello there!\", got \"%s\"", content)
+	}
+	if _, err := fs.Read(appendFd, 1); !errors.Is(err, errs.ErrBadDescriptor) {
+		t.Errorf("Read of a write-only descriptor: expected ErrBadDescriptor, got %v", err)
+	}
+
+	if err := fs.DeleteFile("file"); !errors.Is(err, errs.ErrBusy) {
+		t.Errorf("DeleteFile of an open file: expected ErrBusy, got %v", err)
+	}
+	fs.CreateFileWithContent("other", "other")
+	if err := fs.MoveFile("other", "file"); !errors.Is(err, errs.ErrBusy) {
+		t.Errorf("MoveFile over an open file: expected ErrBusy, got %v", err)
+	}
+	fs.CloseFile(fd)
+	fs.CloseFile(appendFd)
+	if err := fs.CloseFile(fd); !errors.Is(err, errs.ErrBadDescriptor) {
+		t.Errorf("CloseFile twice: expected ErrBadDescriptor, got %v", err)
+	}
+
+	fd, _ = fs.OpenFile("file", os.O_WRONLY|os.O_TRUNC)
+	if content, _ := fs.ReadFile("file"); content != "" {
+		t.Errorf("OpenFile with O_TRUNC left \"%s\"", content)
+	}
+	if fd != 0 {
+		t.Errorf("OpenFile expected the lowest free descriptor 0, got %d", fd)
+	}
+	fs.CloseFile(fd)
+	if err := fs.DeleteFile("file"); err != nil {
+		t.Errorf("DeleteFile after close error: %v", err)
+	}
+
+	if _, err := fs.OpenFile("/", os.O_RDONLY); !errors.Is(err, errs.ErrRecordIsNotFile) {
+		t.Errorf("OpenFile of a directory: expected ErrRecordIsNotFile, got %v", err)
+	}
+	fs.CreateFileWithContent("private", "secret")
+	fs.ChangeMode("private", "600")
+	fs.AddUser("user", "password")
+	fs.ChangeUser("user", "password")
+	if _, err := fs.OpenFile("/private", os.O_RDONLY); !errors.Is(err, errs.ErrPermissionDenied) {
+		t.Errorf("OpenFile without read permission: expected ErrPermissionDenied, got %v", err)
+	}
+}
+
+func TestFileLocks(t *testing.T) {
+	fs, cleanup := setupFilesystem(t)
+	t.Cleanup(cleanup)
+
+	fs.CreateFileWithContent("file", "0123456789")
+	fs.ChangeMode("file", "666")
+	fs.AddUser("alice", "password")
+	fs.AddUser("bob", "password")
+	alice, _ := fs.NewSession("alice", "password")
+	bob, _ := fs.NewSession("bob", "password")
+	aliceFd, _ := alice.OpenFile("/file", os.O_RDWR)
+	bobFd, _ := bob.OpenFile("/file", os.O_RDWR)
+
+	if err := alice.Flock(aliceFd, LockExclusive, false); err != nil {
+		t.Fatalf("Flock error: %v", err)
+	}
+	if err := bob.Flock(bobFd, LockShared, false); !errors.Is(err, errs.ErrWouldBlock) {
+		t.Errorf("Flock over an exclusive lock: expected ErrWouldBlock, got %v", err)
+	}
+	if err := bob.SetLock(bobFd, ByteRangeLock{Type: LockExclusive}, false); err != nil {
+		t.Errorf("SetLock expected to be independent of Flock, got %v", err)
+	}
+	bob.SetLock(bobFd, ByteRangeLock{Type: Unlock}, false)
+
+	acquired := make(chan error)
+	go func() {
+		acquired <- bob.Flock(bobFd, LockShared, true)
+	}()
+	alice.Flock(aliceFd, Unlock, false)
+	if err := <-acquired; err != nil {
+		t.Errorf("Flock waiting for the lock error: %v", err)
+	}
+	if err := alice.Flock(aliceFd, LockShared, false); err != nil {
+		t.Errorf("Flock of a second shared lock error: %v", err)
+	}
+
+	alice.SetLock(aliceFd, ByteRangeLock{Type: LockExclusive, Start: 0, Length: 5}, false)
+	if err := bob.SetLock(bobFd, ByteRangeLock{Type: LockShared, Start: 5, Length: 5}, false); err != nil {
+		t.Errorf("SetLock of an adjacent range error: %v", err)
+	}
+	if err := bob.SetLock(bobFd, ByteRangeLock{Type: LockShared, Start: 4, Length: 1}, false); !errors.Is(err, errs.ErrWouldBlock) {
+		t.Errorf("SetLock of an overlapping range: expected ErrWouldBlock, got %v", err)
+	}
+	conflict, _ := bob.GetLock(bobFd, ByteRangeLock{Type: LockShared, Start: 2})
+	if conflict != (ByteRangeLock{Type: LockExclusive, Start: 0, Length: 5}) {
+		t.Errorf("GetLock expected the exclusive lock 0+5, got %+v", conflict)
+	}
+
+	// Unlocking the middle splits the range
+	alice.SetLock(aliceFd, ByteRangeLock{Type: Unlock, Start: 2, Length: 1}, false)
+	if conflict, _ := bob.GetLock(bobFd, ByteRangeLock{Type: LockExclusive, Start: 2, Length: 1}); conflict.Type != Unlock {
+		t.Errorf("GetLock of an unlocked byte expected no conflict, got %+v", conflict)
+	}
+	if conflict, _ := bob.GetLock(bobFd, ByteRangeLock{Type: LockExclusive, Start: 3, Length: 1}); conflict.Type != LockExclusive {
+		t.Errorf("GetLock after splitting expected the rest of the range, got %+v", conflict)
+	}
+
+	go func() {
+		acquired <- bob.SetLock(bobFd, ByteRangeLock{Type: LockExclusive, Start: 0, Length: 2}, true)
+	}()
+	alice.CloseFile(aliceFd)
+	if err := <-acquired; err != nil {
+		t.Errorf("SetLock waiting for a closed descriptor error: %v", err)
+	}
+
+	aliceFd, _ = alice.OpenFile("/file", os.O_RDWR)
+	go func() {
+		acquired <- alice.SetLock(aliceFd, ByteRangeLock{Type: LockExclusive}, true)
+	}()
+	// Closing before or while the lock is waited for fails it alike
+	alice.CloseFile(aliceFd)
+	if err := <-acquired; !errors.Is(err, errs.ErrBadDescriptor) {
+		t.Errorf("SetLock on a descriptor closed while waiting: expected ErrBadDescriptor, got %v", err)
+	}
+
+	// Closing a session closes all its descriptors and their locks
+	bob.OpenFile("/file", os.O_RDONLY)
+	if err := bob.Close(); err != nil {
+		t.Fatalf("Close error: %v", err)
+	}
+	if _, err := bob.Read(bobFd, 1); !errors.Is(err, errs.ErrBadDescriptor) {
+		t.Errorf("Read after Close: expected ErrBadDescriptor, got %v", err)
+	}
+	aliceFd, _ = alice.OpenFile("/file", os.O_RDWR)
+	if err := alice.SetLock(aliceFd, ByteRangeLock{Type: LockExclusive}, false); err != nil {
+		t.Errorf("SetLock after the session holding the lock closed: %v", err)
+	}
+	alice.Close()
+	if err := fs.DeleteFile("/file"); err != nil {
+		t.Errorf("DeleteFile after all sessions closed: %v", err)
+	}
+}
+
+func TestStat(t *testing.T) {
+	fs, cleanup := setupFilesystem(t)
+	defer cleanup()
+
+	fs.CreateDirectory("/dir")
+	fs.CreateFileWithContent("/dir/b", "hello")
+	fs.CreateFileWithContent("/dir/a", "")
+	fs.ChangeMode("/dir/b", "640")
+
+	info, err := fs.Stat("/dir/b")
+	if err != nil {
+		t.Fatalf("stat failed: %v", err)
+	}
+	if info.Name() != "b" || info.Size() != 5 || info.IsDir() || info.Mode().Perm() != 0o640 {
+		t.Errorf("unexpected info %s %d %v", info.Name(), info.Size(), info.Mode())
+	}
+	if info.Owner() != FSConfig.RootUsername {
+		t.Errorf("expected owner %s, got %s", FSConfig.RootUsername, info.Owner())
+	}
+	if info, _ := fs.Stat("/dir"); !info.IsDir() || info.Name() != "dir" {
+		t.Errorf("expected directory dir, got %s %v", info.Name(), info.Mode())
+	}
+	if _, err := fs.Stat("/dir/missing"); err == nil {
+		t.Error("stat of a missing file succeeded")
+	}
+
+	infos, err := fs.ReadDirectory("/dir")
+	if err != nil {
+		t.Fatalf("read directory failed: %v", err)
+	}
+	if len(infos) != 2 || infos[0].Name() != "a" || infos[1].Name() != "b" || infos[0].Size() != 0 {
+		t.Errorf("unexpected entries %v", infos)
+	}
+}
+
+func TestIOFS(t *testing.T) {
+	fs, cleanup := setupFilesystem(t)
+	defer cleanup()
+
+	fs.CreateDirectory("/site")
+	fs.CreateDirectory("/site/static")
+	fs.CreateFileWithContent("/site/index.html", "<h1>{{.}}</h1>")
+	fs.CreateFileWithContent("/site/static/style.css", strings.Repeat("body {}\n", 1000))
+	fs.CreateFileWithContent("/site/static/empty", "")
+
+	fsys := fs.FS()
+	zero, err := fsys.Open("dev/zero")
+	if err != nil {
+		t.Fatalf("open of a device failed: %v", err)
+	}
+	buffer := []byte("xxxx")
+	if n, err := zero.Read(buffer); n != 4 || err != nil || string(buffer) != "\x00\x00\x00\x00" {
+		t.Errorf("read of /dev/zero: %d, %q, %v", n, buffer, err)
+	}
+	zero.Close()
+
+	// Devices without an end, or with a different content on every read,
+	// cannot pass fstest
+	for _, name := range []string{"/dev/zero", "/dev/full", "/dev/urandom"} {
+		fs.DeleteFile(name)
+	}
+	if err := fstest.TestFS(fsys, "site/index.html", "site/static/style.css", "dev/null", "proc/mounts"); err != nil {
+		t.Fatal(err)
+	}
+
+	sub, err := iofs.Sub(fsys, "site")
+	if err != nil {
+		t.Fatalf("sub failed: %v", err)
+	}
+	if err := fstest.TestFS(sub, "index.html", "static/style.css", "static/empty"); err != nil {
+		t.Fatal(err)
+	}
+
+	tmpl, err := template.ParseFS(sub, "*.html")
+	if err != nil {
+		t.Fatalf("parse failed: %v", err)
+	}
+	var page strings.Builder
+	tmpl.Execute(&page, "title")
+	if page.String() != "<h1>title</h1>" {
+		t.Errorf("unexpected page %q", page.String())
+	}
+
+	info, err := iofs.Stat(sub, "static/style.css")
+	if err != nil || info.Size() != 8000 || !info.Mode().IsRegular() {
+		t.Errorf("unexpected info %v, %v", info, err)
+	}
+	if _, err := iofs.Stat(sub, "missing"); !errors.Is(err, iofs.ErrNotExist) {
+		t.Errorf("expected fs.ErrNotExist, got %v", err)
+	}
+	if _, err := fsys.Open("/site"); !errors.Is(err, iofs.ErrInvalid) {
+		t.Errorf("expected fs.ErrInvalid, got %v", err)
+	}
+
+	// Open files pin their inodes like descriptors do
+	file, _ := sub.Open("index.html")
+	if err := fs.DeleteFile("/site/index.html"); !errors.Is(err, errs.ErrBusy) {
+		t.Errorf("expected ErrBusy, got %v", err)
+	}
+	file.Close()
+	if err := fs.DeleteFile("/site/index.html"); err != nil {
+		t.Errorf("delete failed after close: %v", err)
+	}
+
+	fs.AddUser("user", "password")
+	fs.ChangeMode("/site/static/style.css", "600")
+	session, _ := fs.NewSession("user", "password")
+	if _, err := iofs.ReadFile(session.FS(), "site/static/style.css"); !errors.Is(err, iofs.ErrPermission) {
+		t.Errorf("expected fs.ErrPermission, got %v", err)
+	}
+}
+
+func containsString(values []string, value string) bool {
+	for _, v := range values {
+		if v == value {
+			return true
+		}
+	}
+	return false
+}
+
+func setupFilesystem(t *testing.T) (*FileSystem, func()) {
+	fs, _ := FormatFilesystem(blockdevice.NewMemory(nil), FSConfig.FileSize, FSConfig.BlockSize)
+
+	cleanup := func() {
+		fs.CloseDataFile()
+	}
+
+	return fs, cleanup
+}
+
+// imageContent returns the bytes written to the device of the file system.
+func imageContent(fs *FileSystem) []byte {
+	size, _ := fs.device.Size()
+	data := make([]byte, size)
+	fs.device.ReadAt(data, 0)
+	return data
+}
+
+// restoreModificationTime sets the modification time of the inode without
+// touching anything else. Tests use it to give files known time stamps,
+// for example older or newer sources and targets of a copy, and to undo
+// the change of a directory time stamp, so slow tests can compare images
+// across a second boundary.
+func restoreModificationTime(fs *FileSystem, inodeIndex uint32, modificationTime uint32) {
+	fileInode, _ := fs.inodeManager.ReadInode(inodeIndex)
+	fileInode.ModificationTime = modificationTime
+	fs.inodeManager.SaveInode(fileInode, inodeIndex)
 }
 
 func findFirstDifference(slice1, slice2 []byte) int {
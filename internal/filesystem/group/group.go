@@ -0,0 +1,69 @@
+package group
+
+import (
+	"fmt"
+	"strconv"
+	"strings"
+)
+
+type Group struct {
+	Name    string
+	GroupId uint16
+	Members []string
+}
+
+func NewGroup(name string, groupId uint16) *Group {
+	return &Group{
+		Name:    name,
+		GroupId: groupId,
+	}
+}
+
+func ReadGroupFromString(str string) (*Group, error) {
+	parts := strings.Fields(str)
+
+	if len(parts) < 2 {
+		return nil, fmt.Errorf("invalid input format")
+	}
+
+	groupId, err := strconv.ParseUint(parts[1], 10, 16)
+	if err != nil {
+		return nil, fmt.Errorf("error parsing GroupId: %v", err)
+	}
+
+	return &Group{
+		Name:    parts[0],
+		GroupId: uint16(groupId),
+		Members: parts[2:],
+	}, nil
+}
+
+func (g Group) GetGroupString() string {
+	parts := append([]string{g.Name, strconv.Itoa(int(g.GroupId))}, g.Members...)
+	return strings.Join(parts, " ")
+}
+
+func (g Group) HasMember(username string) bool {
+	for _, member := range g.Members {
+		if member == username {
+			return true
+		}
+	}
+	return false
+}
+
+func (g *Group) AddMember(username string) {
+	if !g.HasMember(username) {
+		g.Members = append(g.Members, username)
+	}
+}
+
+func (g *Group) RemoveMember(username string) {
+	var members []string
+	for _, member := range g.Members {
+		if member != username {
+			members = append(members, member)
+		}
+	}
+	g.Members = members
+}
@@ -2,17 +2,33 @@ package inode
 
 import (
 	"encoding/binary"
+	"file-system/internal/filesystem/blockdevice"
 	"file-system/internal/filesystem/user"
 	"file-system/internal/utils"
-	"io"
-	"os"
 	"strconv"
 	"time"
 )
 
+const (
+	SetUserIdBit  = 0o4000
+	SetGroupIdBit = 0o2000
+	StickyBit     = 0o1000
+
+	fileTypeBit     = 0b1000000000000000
+	hiddenBit       = 0b0100000000000000
+	charDeviceBit   = 0b0010000000000000
+	indexedBit      = 0b0001000000000000
+	permissionsMask = 0o7777
+
+	readBit    = 0b100
+	writeBit   = 0b010
+	executeBit = 0b001
+)
+
 type Inode struct {
-	TypeAndPermissions uint8
+	TypeAndPermissions uint16
 	UserId             uint16
+	GroupId            uint16
 	FileSize           uint32
 	CreationTime       uint32
 	ModificationTime   uint32
@@ -24,6 +40,7 @@ func NewInode(
 	isHidden bool,
 	numericPermissions int,
 	userId uint16,
+	groupId uint16,
 	dataBlocks []uint32,
 ) (*Inode, error) {
 	var blocks [12]uint32
@@ -41,7 +58,8 @@ func NewInode(
 
 	return &Inode{
 		TypeAndPermissions: tap,
-		UserId:             uint16(userId),
+		UserId:             userId,
+		GroupId:            groupId,
 		FileSize:           uint32(len(dataBlocks)),
 		CreationTime:       uint32(time.Now().Unix()),
 		ModificationTime:   uint32(time.Now().Unix()),
@@ -49,19 +67,44 @@ func NewInode(
 	}, nil
 }
 
-func getTapValue(isFile bool, isHidden bool, numericPermissions int) (uint8, error) {
+// NewDeviceInode creates a character device inode. Like ext2, the device
+// number is kept in the first block pointer and no data blocks are used.
+func NewDeviceInode(
+	numericPermissions int,
+	userId uint16,
+	groupId uint16,
+	deviceNumber uint32,
+) (*Inode, error) {
+	tap, err := getTapValue(true, false, numericPermissions)
+	if err != nil {
+		return nil, err
+	}
+
+	deviceInode := &Inode{
+		TypeAndPermissions: tap | charDeviceBit,
+		UserId:             userId,
+		GroupId:            groupId,
+		CreationTime:       uint32(time.Now().Unix()),
+		ModificationTime:   uint32(time.Now().Unix()),
+	}
+	deviceInode.Blocks[0] = deviceNumber
+
+	return deviceInode, nil
+}
+
+func getTapValue(isFile bool, isHidden bool, numericPermissions int) (uint16, error) {
 	strNumber := strconv.FormatInt(int64(numericPermissions), 10)
-	decimalNumber, err := strconv.ParseUint(strNumber, 8, 8)
+	decimalNumber, err := strconv.ParseUint(strNumber, 8, 12)
 	if err != nil {
 		return 0, err
 	}
 
-	value := uint8(decimalNumber)
+	value := uint16(decimalNumber)
 	if isFile {
-		value |= 0b10000000
+		value |= fileTypeBit
 	}
 	if isHidden {
-		value |= 0b01000000
+		value |= hiddenBit
 	}
 
 	return value, nil
@@ -73,14 +116,9 @@ func GetInodeSize() uint32 {
 	return size
 }
 
-func ReadInodeAt(file *os.File, offset uint32) (*Inode, error) {
-	_, err := file.Seek(int64(offset), io.SeekStart)
-	if err != nil {
-		return nil, err
-	}
-
+func ReadInodeAt(file blockdevice.BlockDevice, offset uint32) (*Inode, error) {
 	data := make([]byte, GetInodeSize())
-	_, err = file.Read(data)
+	_, err := file.ReadAt(data, int64(offset))
 	if err != nil {
 		return nil, err
 	}
@@ -91,14 +129,15 @@ func ReadInodeAt(file *os.File, offset uint32) (*Inode, error) {
 func decodeInode(data []byte) *Inode {
 	inode := Inode{}
 
-	inode.TypeAndPermissions = data[0]
-	inode.UserId = binary.BigEndian.Uint16(data[1:3])
-	inode.FileSize = binary.BigEndian.Uint32(data[3:7])
-	inode.CreationTime = binary.BigEndian.Uint32(data[7:11])
-	inode.ModificationTime = binary.BigEndian.Uint32(data[11:15])
+	inode.TypeAndPermissions = binary.BigEndian.Uint16(data[0:2])
+	inode.UserId = binary.BigEndian.Uint16(data[2:4])
+	inode.GroupId = binary.BigEndian.Uint16(data[4:6])
+	inode.FileSize = binary.BigEndian.Uint32(data[6:10])
+	inode.CreationTime = binary.BigEndian.Uint32(data[10:14])
+	inode.ModificationTime = binary.BigEndian.Uint32(data[14:18])
 
 	for i := 0; i < 12; i++ {
-		offset := 15 + i*4
+		offset := 18 + i*4
 		inode.Blocks[i] = binary.BigEndian.Uint32(data[offset : offset+4])
 	}
 
@@ -108,58 +147,127 @@ func decodeInode(data []byte) *Inode {
 func (inode Inode) GetTypeAndPermissionString() string {
 	permissions := "rwx"
 
-	result := []byte("-------")
+	result := []byte("----------")
 	if !inode.IsFile() {
 		result[0] = 'd'
+	} else if inode.IsDevice() {
+		result[0] = 'c'
 	}
 
-	for i := 0; i < 6; i++ {
-		if int(inode.TypeAndPermissions)>>(5-i)&1 == 1 {
+	for i := 0; i < 9; i++ {
+		if int(inode.TypeAndPermissions)>>(8-i)&1 == 1 {
 			result[i+1] = permissions[i%3]
 		}
 	}
 
+	setSpecialBit(result, 3, inode.TypeAndPermissions&SetUserIdBit != 0, 's')
+	setSpecialBit(result, 6, inode.TypeAndPermissions&SetGroupIdBit != 0, 's')
+	setSpecialBit(result, 9, inode.TypeAndPermissions&StickyBit != 0, 't')
+
 	return string(result)
 }
 
-func (inode *Inode) ChangePermissions(value int) error {
-	tap, err := getTapValue(inode.IsFile(), inode.IsHidden(), value)
-	if err != nil {
-		return err
+// setSpecialBit renders a special bit over the execute position the way ls
+// does: lowercase when execute is also set, uppercase otherwise.
+func setSpecialBit(result []byte, index int, isSet bool, letter byte) {
+	if !isSet {
+		return
+	}
+	if result[index] == 'x' {
+		result[index] = letter
+	} else {
+		result[index] = letter - 'a' + 'A'
 	}
-	inode.TypeAndPermissions = tap
-	return nil
 }
 
-func (inode Inode) HasReadPermission(user user.User) bool {
-	if user.UserId == 0 {
-		return true
-	}
-	ownerReadAccess := inode.TypeAndPermissions&0b00100000 != 0
-	usersReadAccess := inode.TypeAndPermissions&0b00000100 != 0
+func (inode Inode) GetPermissions() uint16 {
+	return inode.TypeAndPermissions & permissionsMask
+}
+
+func (inode *Inode) SetPermissions(permissions uint16) {
+	inode.TypeAndPermissions = inode.TypeAndPermissions&^permissionsMask | permissions&permissionsMask
+}
+
+func (inode Inode) IsSticky() bool {
+	return inode.TypeAndPermissions&StickyBit != 0
+}
+
+func (inode Inode) IsSetGroupId() bool {
+	return inode.TypeAndPermissions&SetGroupIdBit != 0
+}
 
-	return usersReadAccess || user.UserId == inode.UserId && ownerReadAccess
+func (inode Inode) HasReadPermission(user user.User) bool {
+	return inode.hasPermission(user, readBit)
 }
 
 func (inode Inode) HasWritePermission(user user.User) bool {
+	return inode.hasPermission(user, writeBit)
+}
+
+// HasExecutePermission reports whether the user may execute the file or,
+// for directories, search it during path resolution.
+func (inode Inode) HasExecutePermission(user user.User) bool {
+	return inode.hasPermission(user, executeBit)
+}
+
+func (inode Inode) hasPermission(user user.User, bit uint16) bool {
 	if user.UserId == 0 {
 		return true
 	}
-	ownerWriteAccess := inode.TypeAndPermissions&0b00010000 != 0
-	usersWriteAccess := inode.TypeAndPermissions&0b00000010 != 0
+	return inode.TypeAndPermissions>>inode.permissionShift(user)&bit != 0
+}
 
-	return usersWriteAccess || user.UserId == inode.UserId && ownerWriteAccess
+// permissionShift selects the owner, group or other triad the same way
+// POSIX does: only the first matching class is consulted.
+func (inode Inode) permissionShift(user user.User) uint16 {
+	if user.UserId == inode.UserId {
+		return 6
+	}
+	if user.IsMemberOf(inode.GroupId) {
+		return 3
+	}
+	return 0
 }
 
 func (inode Inode) IsFile() bool {
-	return inode.TypeAndPermissions&0b10000000 != 0
+	return inode.TypeAndPermissions&fileTypeBit != 0
+}
+
+func (inode Inode) IsDevice() bool {
+	return inode.TypeAndPermissions&charDeviceBit != 0
+}
+
+func (inode Inode) GetDeviceNumber() uint32 {
+	return inode.Blocks[0]
+}
+
+// IsIndexed reports whether the directory is stored as a hash tree instead
+// of a linear list of records.
+func (inode Inode) IsIndexed() bool {
+	return inode.TypeAndPermissions&indexedBit != 0
+}
+
+func (inode *Inode) SetIndexed(indexed bool) {
+	if indexed {
+		inode.TypeAndPermissions |= indexedBit
+	} else {
+		inode.TypeAndPermissions &^= indexedBit
+	}
 }
 
 func (inode Inode) IsHidden() bool {
-	return inode.TypeAndPermissions&0b01000000 != 0
+	return inode.TypeAndPermissions&hiddenBit != 0
+}
+
+func (inode *Inode) SetHidden(hidden bool) {
+	if hidden {
+		inode.TypeAndPermissions |= hiddenBit
+	} else {
+		inode.TypeAndPermissions &^= hiddenBit
+	}
 }
 
-func (inode Inode) WriteAt(file *os.File, offset uint32) error {
+func (inode Inode) WriteAt(file blockdevice.BlockDevice, offset uint32) error {
 	data := inode.encode()
 
 	_, err := file.WriteAt(data, int64(offset))
@@ -173,14 +281,15 @@ func (inode Inode) WriteAt(file *os.File, offset uint32) error {
 func (inode Inode) encode() []byte {
 	data := make([]byte, GetInodeSize())
 
-	data[0] = inode.TypeAndPermissions
-	binary.BigEndian.PutUint16(data[1:3], inode.UserId)
-	binary.BigEndian.PutUint32(data[3:7], inode.FileSize)
-	binary.BigEndian.PutUint32(data[7:11], inode.CreationTime)
-	binary.BigEndian.PutUint32(data[11:15], inode.ModificationTime)
+	binary.BigEndian.PutUint16(data[0:2], inode.TypeAndPermissions)
+	binary.BigEndian.PutUint16(data[2:4], inode.UserId)
+	binary.BigEndian.PutUint16(data[4:6], inode.GroupId)
+	binary.BigEndian.PutUint32(data[6:10], inode.FileSize)
+	binary.BigEndian.PutUint32(data[10:14], inode.CreationTime)
+	binary.BigEndian.PutUint32(data[14:18], inode.ModificationTime)
 
 	for i := 0; i < 12; i++ {
-		offset := 15 + i*4
+		offset := 18 + i*4
 		binary.BigEndian.PutUint32(data[offset:offset+4], inode.Blocks[i])
 	}
 
@@ -1,6 +1,7 @@
 package inode
 
 import (
+	"file-system/internal/filesystem/user"
 	"testing"
 )
 
@@ -11,21 +12,51 @@ func TestGetTypeAndPermissionString(t *testing.T) {
 	}{
 		{
 			i: Inode{
-				TypeAndPermissions: 0b00111111,
+				TypeAndPermissions: 0b0000000111111111,
 			},
-			expected: "drwxrwx",
+			expected: "drwxrwxrwx",
 		},
 		{
 			i: Inode{
-				TypeAndPermissions: 0b10101101,
+				TypeAndPermissions: 0b1000000101101101,
 			},
-			expected: "-r-xr-x",
+			expected: "-r-xr-xr-x",
 		},
 		{
 			i: Inode{
-				TypeAndPermissions: 0b10111000,
+				TypeAndPermissions: 0b1000000111000000,
 			},
-			expected: "-rwx---",
+			expected: "-rwx------",
+		},
+		{
+			i: Inode{
+				TypeAndPermissions: 0b1000000110100100,
+			},
+			expected: "-rw-r--r--",
+		},
+		{
+			i: Inode{
+				TypeAndPermissions: fileTypeBit | SetUserIdBit | 0o755,
+			},
+			expected: "-rwsr-xr-x",
+		},
+		{
+			i: Inode{
+				TypeAndPermissions: fileTypeBit | SetGroupIdBit | 0o644,
+			},
+			expected: "-rw-r-Sr--",
+		},
+		{
+			i: Inode{
+				TypeAndPermissions: StickyBit | 0o777,
+			},
+			expected: "drwxrwxrwt",
+		},
+		{
+			i: Inode{
+				TypeAndPermissions: fileTypeBit | charDeviceBit | 0o666,
+			},
+			expected: "crw-rw-rw-",
 		},
 	}
 
@@ -36,3 +67,21 @@ func TestGetTypeAndPermissionString(t *testing.T) {
 		}
 	}
 }
+
+func TestGroupPermissions(t *testing.T) {
+	fileInode, _ := NewInode(true, false, 640, 1, 5, nil)
+
+	owner := user.User{UserId: 1, GroupId: 1}
+	member := user.User{UserId: 2, GroupId: 2, Groups: []uint16{5}}
+	other := user.User{UserId: 3, GroupId: 3}
+
+	if !fileInode.HasWritePermission(owner) {
+		t.Errorf("Owner should have write permission on 640 file")
+	}
+	if !fileInode.HasReadPermission(member) || fileInode.HasWritePermission(member) {
+		t.Errorf("Group member should have only read permission on 640 file")
+	}
+	if fileInode.HasReadPermission(other) {
+		t.Errorf("Other user should not have read permission on 640 file")
+	}
+}
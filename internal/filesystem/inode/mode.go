@@ -0,0 +1,101 @@
+package inode
+
+import (
+	"file-system/internal/errs"
+	"fmt"
+	"strconv"
+	"strings"
+)
+
+// ParseMode interprets a chmod mode argument relative to the current
+// permissions. Both octal ("644", "4755") and symbolic ("u+s,g+s,+t",
+// "go-w", "a=rx") notations are accepted.
+func ParseMode(mode string, current uint16) (uint16, error) {
+	if mode == "" {
+		return 0, fmt.Errorf("%w - %s", errs.ErrIllegalArgument, mode)
+	}
+
+	if strings.Trim(mode, "01234567") == "" {
+		if len(mode) > 4 {
+			return 0, fmt.Errorf("%w - %s", errs.ErrIllegalArgument, mode)
+		}
+		value, err := strconv.ParseUint(mode, 8, 12)
+		if err != nil {
+			return 0, fmt.Errorf("%w - %s", errs.ErrIllegalArgument, mode)
+		}
+		return uint16(value), nil
+	}
+
+	result := current & permissionsMask
+	for _, clause := range strings.Split(mode, ",") {
+		var err error
+		result, err = applySymbolicClause(result, clause)
+		if err != nil {
+			return 0, fmt.Errorf("%w - %s", errs.ErrIllegalArgument, mode)
+		}
+	}
+
+	return result, nil
+}
+
+func applySymbolicClause(mode uint16, clause string) (uint16, error) {
+	var whoMask uint16
+	i := 0
+	for ; i < len(clause) && strings.IndexByte("ugoa", clause[i]) != -1; i++ {
+		switch clause[i] {
+		case 'u':
+			whoMask |= SetUserIdBit | 0o700
+		case 'g':
+			whoMask |= SetGroupIdBit | 0o070
+		case 'o':
+			whoMask |= StickyBit | 0o007
+		case 'a':
+			whoMask |= permissionsMask
+		}
+	}
+	if whoMask == 0 {
+		whoMask = permissionsMask
+	}
+
+	if i == len(clause) {
+		return 0, errs.ErrIllegalArgument
+	}
+
+	for i < len(clause) {
+		op := clause[i]
+		if op != '+' && op != '-' && op != '=' {
+			return 0, errs.ErrIllegalArgument
+		}
+		i++
+
+		var bits uint16
+		for ; i < len(clause) && strings.IndexByte("+-=", clause[i]) == -1; i++ {
+			switch clause[i] {
+			case 'r':
+				bits |= 0o444
+			case 'w':
+				bits |= 0o222
+			case 'x':
+				bits |= 0o111
+			case 's':
+				bits |= SetUserIdBit | SetGroupIdBit
+			case 't':
+				bits |= StickyBit
+			default:
+				return 0, errs.ErrIllegalArgument
+			}
+		}
+		bits &= whoMask
+
+		switch op {
+		case '+':
+			mode |= bits
+		case '-':
+			mode &^= bits
+		case '=':
+			mode = mode&^whoMask | bits
+		}
+	}
+
+	return mode, nil
+}
@@ -0,0 +1,41 @@
+package inode
+
+import (
+	"testing"
+)
+
+func TestParseMode(t *testing.T) {
+	testCases := []struct {
+		mode     string
+		current  uint16
+		expected uint16
+	}{
+		{"755", 0o644, 0o755},
+		{"4755", 0o644, 0o4755},
+		{"1777", 0o755, 0o1777},
+		{"u+s,g+s,+t", 0o755, 0o7755},
+		{"+t", 0o777, 0o1777},
+		{"g+s", 0o755, 0o2755},
+		{"go-w", 0o666, 0o644},
+		{"a=rx", 0o4777, 0o555},
+		{"u=rwx,g=rx,o=", 0o000, 0o750},
+		{"u+x-w", 0o644, 0o544},
+	}
+
+	for _, testCase := range testCases {
+		result, err := ParseMode(testCase.mode, testCase.current)
+		if err != nil {
+			t.Errorf("ParseMode(%s) error: %v", testCase.mode, err)
+			continue
+		}
+		if result != testCase.expected {
+			t.Errorf("ParseMode(%s, %o) expected: %o, got: %o", testCase.mode, testCase.current, testCase.expected, result)
+		}
+	}
+
+	for _, mode := range []string{"", "99", "77777", "u", "u+q", "z+r"} {
+		if _, err := ParseMode(mode, 0o644); err == nil {
+			t.Errorf("ParseMode(%s) expected error", mode)
+		}
+	}
+}
@@ -0,0 +1,264 @@
+package filesystem
+
+import (
+	"errors"
+	"file-system/internal/errs"
+	"io"
+	iofs "io/fs"
+	"os"
+	pathpkg "path"
+	"strings"
+)
+
+// FS presents a directory of the image to code taking an fs.FS, such as
+// fs.WalkDir, template.ParseFS or http.FS. It implements fs.ReadDirFS,
+// fs.ReadFileFS, fs.StatFS and fs.SubFS and acts with the permissions of
+// its session. Regular files and devices are read through descriptors,
+// so reads of a device go to its driver, and files of /proc are read once
+// on open. ReadFile of a device returns what a single read of one block
+// gives.
+type FS struct {
+	session *Session
+	dir     string
+}
+
+// FS returns the adapter for the whole image as seen by the default
+// session.
+func (fs *FileSystem) FS() *FS {
+	return fs.session.FS()
+}
+
+func (s *Session) FS() *FS {
+	return &FS{session: s, dir: "/"}
+}
+
+func (f *FS) Open(name string) (iofs.File, error) {
+	path, err := f.path("open", name)
+	if err != nil {
+		return nil, err
+	}
+	info, err := f.stat("open", name, path)
+	if err != nil {
+		return nil, err
+	}
+
+	if info.IsDir() {
+		return &dirFile{fs: f, name: name, path: path, info: info}, nil
+	}
+
+	fd, err := f.session.OpenFile(path, os.O_RDONLY)
+	if errors.Is(err, errs.ErrRecordIsNotFile) {
+		content, err := f.session.ReadFile(path)
+		if err != nil {
+			return nil, pathError("open", name, err)
+		}
+		return &contentFile{Reader: strings.NewReader(content), info: info}, nil
+	}
+	if err != nil {
+		return nil, pathError("open", name, err)
+	}
+	return &file{session: f.session, fd: fd, name: name, info: info}, nil
+}
+
+func (f *FS) ReadDir(name string) ([]iofs.DirEntry, error) {
+	path, err := f.path("readdir", name)
+	if err != nil {
+		return nil, err
+	}
+	return f.readDir(name, path)
+}
+
+func (f *FS) ReadFile(name string) ([]byte, error) {
+	path, err := f.path("readfile", name)
+	if err != nil {
+		return nil, err
+	}
+	info, err := f.stat("readfile", name, path)
+	if err != nil {
+		return nil, err
+	}
+
+	if info.IsDir() {
+		return nil, pathError("readfile", name, errs.ErrRecordIsNotFile)
+	}
+	content, err := f.session.ReadFile(path)
+	if err != nil {
+		return nil, pathError("readfile", name, err)
+	}
+	return []byte(content), nil
+}
+
+func (f *FS) Stat(name string) (iofs.FileInfo, error) {
+	path, err := f.path("stat", name)
+	if err != nil {
+		return nil, err
+	}
+	return f.stat("stat", name, path)
+}
+
+func (f *FS) Sub(dir string) (iofs.FS, error) {
+	path, err := f.path("sub", dir)
+	if err != nil {
+		return nil, err
+	}
+	return &FS{session: f.session, dir: path}, nil
+}
+
+// path returns the path in the image of a name of io/fs.
+func (f *FS) path(op, name string) (string, error) {
+	if !iofs.ValidPath(name) {
+		return "", &iofs.PathError{Op: op, Path: name, Err: iofs.ErrInvalid}
+	}
+	return pathpkg.Join(f.dir, name), nil
+}
+
+// stat describes the file under the last element of its name, which is
+// "." for the directory of f.
+func (f *FS) stat(op, name, path string) (*FileInfo, error) {
+	info, err := f.session.Stat(path)
+	if err != nil {
+		return nil, pathError(op, name, err)
+	}
+	info.name = pathpkg.Base(name)
+	return info, nil
+}
+
+func (f *FS) readDir(name, path string) ([]iofs.DirEntry, error) {
+	infos, err := f.session.ReadDirectory(path)
+	if err != nil {
+		return nil, pathError("readdir", name, err)
+	}
+	result := make([]iofs.DirEntry, len(infos))
+	for i, info := range infos {
+		result[i] = iofs.FileInfoToDirEntry(info)
+	}
+	return result, nil
+}
+
+// file is an open regular file of the image.
+type file struct {
+	session *Session
+	fd      int
+	name    string
+	info    *FileInfo
+}
+
+func (f *file) Stat() (iofs.FileInfo, error) {
+	return f.info, nil
+}
+
+func (f *file) Read(p []byte) (int, error) {
+	if len(p) == 0 {
+		return 0, nil
+	}
+	data, err := f.session.Read(f.fd, len(p))
+	if err != nil && err != io.EOF {
+		return 0, pathError("read", f.name, err)
+	}
+	return copy(p, data), err
+}
+
+func (f *file) Seek(offset int64, whence int) (int64, error) {
+	offset, err := f.session.Seek(f.fd, offset, whence)
+	if err != nil {
+		return 0, pathError("seek", f.name, err)
+	}
+	return offset, nil
+}
+
+func (f *file) Close() error {
+	if err := f.session.CloseFile(f.fd); err != nil {
+		return pathError("close", f.name, err)
+	}
+	return nil
+}
+
+// contentFile is a file whose content was read on open.
+type contentFile struct {
+	*strings.Reader
+	info *FileInfo
+}
+
+func (f *contentFile) Stat() (iofs.FileInfo, error) {
+	return f.info, nil
+}
+
+func (f *contentFile) Close() error {
+	return nil
+}
+
+// dirFile is an open directory. Its entries are listed on the first
+// ReadDir.
+type dirFile struct {
+	fs      *FS
+	name    string
+	path    string
+	info    *FileInfo
+	entries []iofs.DirEntry
+	listed  bool
+}
+
+func (d *dirFile) Stat() (iofs.FileInfo, error) {
+	return d.info, nil
+}
+
+func (d *dirFile) Read([]byte) (int, error) {
+	return 0, pathError("read", d.name, errs.ErrRecordIsNotFile)
+}
+
+func (d *dirFile) Close() error {
+	return nil
+}
+
+// ReadDir returns the next n entries, or all remaining ones if n <= 0.
+func (d *dirFile) ReadDir(n int) ([]iofs.DirEntry, error) {
+	if !d.listed {
+		entries, err := d.fs.readDir(d.name, d.path)
+		if err != nil {
+			return nil, err
+		}
+		d.entries, d.listed = entries, true
+	}
+
+	if n <= 0 {
+		result := d.entries
+		d.entries = nil
+		return result, nil
+	}
+	if len(d.entries) == 0 {
+		return nil, io.EOF
+	}
+	n = min(n, len(d.entries))
+	result := d.entries[:n]
+	d.entries = d.entries[n:]
+	return result, nil
+}
+
+// pathError wraps an error of the image so that errors.Is also matches it
+// against the fs.Err* value of its kind.
+func pathError(op, name string, err error) error {
+	return &iofs.PathError{Op: op, Path: name, Err: &ioError{err: err}}
+}
+
+type ioError struct {
+	err error
+}
+
+func (e *ioError) Error() string {
+	return e.err.Error()
+}
+
+func (e *ioError) Unwrap() []error {
+	result := []error{e.err}
+	switch {
+	case errors.Is(e.err, errs.ErrRecordNotFound):
+		result = append(result, iofs.ErrNotExist)
+	case errors.Is(e.err, errs.ErrPermissionDenied):
+		result = append(result, iofs.ErrPermission)
+	case errors.Is(e.err, errs.ErrRecordAlreadyExists):
+		result = append(result, iofs.ErrExist)
+	case errors.Is(e.err, errs.ErrBadDescriptor):
+		result = append(result, iofs.ErrClosed)
+	}
+	return result
+}
@@ -0,0 +1,107 @@
+package filesystem
+
+import "sync"
+
+// Locking
+//
+// A FileSystem is guarded by the reader/writer lock fs.mu and below it by
+// reader/writer locks of single inodes. The user and the working directory
+// of the active session are installed in fs itself, see activate in
+// session.go, so making another session active takes fs.mu exclusively.
+// Methods ending in Locked expect the caller to hold fs.mu in either mode;
+// internal code only calls those on fs itself.
+//
+// Creating and deleting entries and reading files, see rlock in
+// session.go, hold fs.mu shared as long as their session stays the active
+// one. These operations run side by side and keep out of each other's way
+// with the inode locks:
+//
+//   - a lookup holds the read lock of each directory it reads and gives it
+//     up only once the lock of the next directory is held, see namei
+//   - a change to a directory holds its write lock, see lockParent, and
+//     looks its name up again under it
+//   - an entry is freed under its own write lock, which also guards the
+//     data of a regular file; ReadFile copies the blocks under the read
+//     lock without holding fs.mu
+//   - the generation of an inode changes whenever it is freed, so an entry
+//     found under a lock that was given up since is checked to still be
+//     the same
+//
+// Everything else, renames and copies included, holds fs.mu exclusively
+// and nothing but the copying of file data runs beside it.
+//
+// Locks are always taken in this order:
+//
+//  1. fs.mu of a file system, then of the images mounted in it or lying
+//     under it
+//  2. inode locks, of a directory before those of its entries; ".." is
+//     only locked once the lock of the directory is given up
+//  3. fs.allocation, guarding the free counts and the inode generations,
+//     then the allocator locks guarding the bitmaps
+//  4. the lock of the quota manager
+//  5. the buffer cache lock and the lock of the device under it
+//
+// The advisory lock table of an image, see filelocks.go, is taken last and
+// never held while waiting for anything else. Waiting for an advisory lock
+// happens without fs.mu.
+
+// inodeLocks hands out reader/writer locks by inode index. Entries live
+// only while some goroutine holds or waits for them.
+type inodeLocks struct {
+	mu    sync.Mutex
+	locks map[uint32]*inodeLock
+}
+
+type inodeLock struct {
+	sync.RWMutex
+	references int
+}
+
+// lock takes the write lock of the inode and returns the function that
+// releases it.
+func (l *inodeLocks) lock(inodeIndex uint32) func() {
+	entry := l.acquire(inodeIndex)
+	entry.Lock()
+	return func() {
+		entry.Unlock()
+		l.release(inodeIndex)
+	}
+}
+
+// rlock takes the read lock of the inode and returns the function that
+// releases it.
+func (l *inodeLocks) rlock(inodeIndex uint32) func() {
+	entry := l.acquire(inodeIndex)
+	entry.RLock()
+	return func() {
+		entry.RUnlock()
+		l.release(inodeIndex)
+	}
+}
+
+func (l *inodeLocks) acquire(inodeIndex uint32) *inodeLock {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+
+	if l.locks == nil {
+		l.locks = make(map[uint32]*inodeLock)
+	}
+	entry, ok := l.locks[inodeIndex]
+	if !ok {
+		entry = &inodeLock{}
+		l.locks[inodeIndex] = entry
+	}
+	entry.references++
+	return entry
+}
+
+func (l *inodeLocks) release(inodeIndex uint32) {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+
+	entry := l.locks[inodeIndex]
+	entry.references--
+	if entry.references == 0 {
+		delete(l.locks, inodeIndex)
+	}
+}
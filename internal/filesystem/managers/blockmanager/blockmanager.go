@@ -2,31 +2,44 @@ package blockmanager
 
 import (
 	"bytes"
+	"encoding/binary"
+	"file-system/internal/errs"
+	"file-system/internal/filesystem/blockdevice"
 	"file-system/internal/filesystem/inode"
 	"file-system/internal/utils"
-	"os"
+	"fmt"
+)
+
+// Inode.Blocks holds ten direct pointers followed by a single indirect and
+// a double indirect pointer, like ext2 without the triple indirect one.
+const (
+	directBlockCount   = 10
+	singleIndirectSlot = 10
+	doubleIndirectSlot = 11
+	pointerSize        = 4
 )
 
 type BlockManager struct {
-	file         *os.File
+	file         blockdevice.BlockDevice
 	blockSize    uint32
 	blocksOffset uint32
 }
 
-func NewBlockManager(file *os.File, blockSize, blocksOffset uint32) *BlockManager {
+func NewBlockManager(file blockdevice.BlockDevice, blockSize, blocksOffset uint32) *BlockManager {
 	return &BlockManager{file, blockSize, blocksOffset}
 }
 
 func (bm BlockManager) ReadBlocks(fileInode *inode.Inode, name string) (string, error) {
+	blockIndices, err := bm.GetBlockIndices(fileInode)
+	if err != nil {
+		return "", err
+	}
+
 	data := make([]byte, 0)
 	lastBlockEnd := bm.blockSize
 
-	for i := 0; i < int(fileInode.FileSize); i++ {
-		blockIndex := fileInode.Blocks[i]
-		offset := bm.blocksOffset + blockIndex*bm.blockSize
-
-		tmpData := make([]byte, bm.blockSize)
-		_, err := bm.file.ReadAt(tmpData, int64(offset))
+	for _, blockIndex := range blockIndices {
+		tmpData, err := bm.ReadBlock(blockIndex)
 		if err != nil {
 			return "", err
 		}
@@ -44,19 +57,23 @@ func (bm BlockManager) ReadBlocks(fileInode *inode.Inode, name string) (string,
 }
 
 func (bm BlockManager) WriteBlocks(fileInode *inode.Inode, content string) error {
-	for i := 0; i < int(fileInode.FileSize); i++ {
-		blockIndex := fileInode.Blocks[i]
-		offset := bm.blocksOffset + blockIndex*bm.blockSize
+	blockIndices, err := bm.GetBlockIndices(fileInode)
+	if err != nil {
+		return err
+	}
 
+	for i, blockIndex := range blockIndices {
 		sliceStart := int(bm.blockSize) * i
 		sliceEnd := int(bm.blockSize) * (i + 1)
+		if sliceStart > len(content) {
+			sliceStart = len(content)
+		}
 		if sliceEnd > len(content) {
 			sliceEnd = len(content)
 		}
 		tmpData := utils.StringToByteBlock(content[sliceStart:sliceEnd], bm.blockSize)
 
-		_, err := bm.file.WriteAt(tmpData, int64(offset))
-		if err != nil {
+		if err := bm.WriteBlock(blockIndex, tmpData); err != nil {
 			return err
 		}
 	}
@@ -75,16 +92,311 @@ func (bm BlockManager) ReserveBlocksSpace(blockCount uint32) error {
 }
 
 func (bm BlockManager) ResetBlocks(fileInode *inode.Inode) error {
-	for i := 0; i < int(fileInode.FileSize); i++ {
-		blockIndex := fileInode.Blocks[i]
-		data := make([]byte, bm.blockSize)
-		offset := bm.blocksOffset + blockIndex*bm.blockSize
+	blockIndices, err := bm.GetBlockIndices(fileInode)
+	if err != nil {
+		return err
+	}
+
+	for _, blockIndex := range blockIndices {
+		if err := bm.WriteBlock(blockIndex, nil); err != nil {
+			return err
+		}
+	}
 
-		_, err := bm.file.WriteAt(data, int64(offset))
+	return nil
+}
+
+func (bm BlockManager) ReadBlock(blockIndex uint32) ([]byte, error) {
+	data := make([]byte, bm.blockSize)
+	offset := bm.blocksOffset + blockIndex*bm.blockSize
+
+	_, err := bm.file.ReadAt(data, int64(offset))
+	if err != nil {
+		return nil, err
+	}
+
+	return data, nil
+}
+
+// WriteBlock writes data to the block, padding it with zeros to the block
+// size. A nil slice clears the block.
+func (bm BlockManager) WriteBlock(blockIndex uint32, data []byte) error {
+	block := make([]byte, bm.blockSize)
+	copy(block, data)
+	offset := bm.blocksOffset + blockIndex*bm.blockSize
+
+	_, err := bm.file.WriteAt(block, int64(offset))
+	return err
+}
+
+// MaxFileBlocks is the largest number of data blocks an inode can address.
+func (bm BlockManager) MaxFileBlocks() uint32 {
+	pointers := bm.pointersPerBlock()
+	return directBlockCount + pointers + pointers*pointers
+}
+
+// IndirectBlockCount returns how many pointer blocks a file of fileSize data
+// blocks occupies in addition to the data blocks themselves.
+func (bm BlockManager) IndirectBlockCount(fileSize uint32) uint32 {
+	pointers := bm.pointersPerBlock()
+	if fileSize <= directBlockCount {
+		return 0
+	}
+	fileSize -= directBlockCount
+	if fileSize <= pointers {
+		return 1
+	}
+	fileSize -= pointers
+	return 2 + (fileSize+pointers-1)/pointers
+}
+
+// GetBlockIndex maps a logical block of the file to a block of the image.
+func (bm BlockManager) GetBlockIndex(fileInode *inode.Inode, logical uint32) (uint32, error) {
+	pointers := bm.pointersPerBlock()
+
+	if logical < directBlockCount {
+		return fileInode.Blocks[logical], nil
+	}
+	logical -= directBlockCount
+
+	if logical < pointers {
+		return bm.readPointer(fileInode.Blocks[singleIndirectSlot], logical)
+	}
+	logical -= pointers
+
+	if logical < pointers*pointers {
+		middle, err := bm.readPointer(fileInode.Blocks[doubleIndirectSlot], logical/pointers)
+		if err != nil {
+			return 0, err
+		}
+		return bm.readPointer(middle, logical%pointers)
+	}
+
+	return 0, fmt.Errorf("%w - block %d", errs.ErrFileTooLarge, logical)
+}
+
+// GetBlockIndices returns the blocks of the image holding the data of the
+// file in logical order. Every pointer block is read only once.
+func (bm BlockManager) GetBlockIndices(fileInode *inode.Inode) ([]uint32, error) {
+	result := make([]uint32, 0, fileInode.FileSize)
+	remaining := fileInode.FileSize
+
+	direct := min(remaining, directBlockCount)
+	result = append(result, fileInode.Blocks[:direct]...)
+	remaining -= direct
+	if remaining == 0 {
+		return result, nil
+	}
+
+	single, err := bm.readPointers(fileInode.Blocks[singleIndirectSlot])
+	if err != nil {
+		return nil, err
+	}
+	taken := min(remaining, uint32(len(single)))
+	result = append(result, single[:taken]...)
+	remaining -= taken
+	if remaining == 0 {
+		return result, nil
+	}
+
+	middle, err := bm.readPointers(fileInode.Blocks[doubleIndirectSlot])
+	if err != nil {
+		return nil, err
+	}
+	for _, middleIndex := range middle {
+		pointers, err := bm.readPointers(middleIndex)
+		if err != nil {
+			return nil, err
+		}
+		taken := min(remaining, uint32(len(pointers)))
+		result = append(result, pointers[:taken]...)
+		remaining -= taken
+		if remaining == 0 {
+			break
+		}
+	}
+
+	return result, nil
+}
+
+// SetBlockIndex maps a logical block of the file to blockIndex. Missing
+// pointer blocks are taken with allocate and cleared before use.
+func (bm BlockManager) SetBlockIndex(
+	fileInode *inode.Inode,
+	logical uint32,
+	blockIndex uint32,
+	allocate func() (uint32, error),
+) error {
+	pointers := bm.pointersPerBlock()
+
+	if logical < directBlockCount {
+		fileInode.Blocks[logical] = blockIndex
+		return nil
+	}
+	logical -= directBlockCount
+
+	if logical < pointers {
+		single, err := bm.ensurePointerBlock(&fileInode.Blocks[singleIndirectSlot], allocate)
 		if err != nil {
 			return err
 		}
+		return bm.writePointer(single, logical, blockIndex)
+	}
+	logical -= pointers
+
+	if logical < pointers*pointers {
+		double, err := bm.ensurePointerBlock(&fileInode.Blocks[doubleIndirectSlot], allocate)
+		if err != nil {
+			return err
+		}
+		middle, err := bm.readPointer(double, logical/pointers)
+		if err != nil {
+			return err
+		}
+		if middle == 0 {
+			if middle, err = bm.ensurePointerBlock(&middle, allocate); err != nil {
+				return err
+			}
+			if err := bm.writePointer(double, logical/pointers, middle); err != nil {
+				return err
+			}
+		}
+		return bm.writePointer(middle, logical%pointers, blockIndex)
+	}
+
+	return fmt.Errorf("%w - block %d", errs.ErrFileTooLarge, logical)
+}
+
+// TruncateBlockMap clears every pointer past the first fileSize logical
+// blocks and hands pointer blocks that are no longer needed to free. The data
+// blocks themselves must be released by the caller beforehand.
+func (bm BlockManager) TruncateBlockMap(fileInode *inode.Inode, fileSize uint32, free func(uint32) error) error {
+	pointers := bm.pointersPerBlock()
+
+	for i := min(fileSize, directBlockCount); i < directBlockCount; i++ {
+		fileInode.Blocks[i] = 0
+	}
+
+	var singleKeep uint32
+	if fileSize > directBlockCount {
+		singleKeep = min(fileSize-directBlockCount, pointers)
+	}
+	if err := bm.truncatePointerBlock(&fileInode.Blocks[singleIndirectSlot], singleKeep, free); err != nil {
+		return err
+	}
+
+	var doubleKeep uint32
+	if fileSize > directBlockCount+pointers {
+		doubleKeep = fileSize - directBlockCount - pointers
+	}
+	double := fileInode.Blocks[doubleIndirectSlot]
+	if double == 0 {
+		return nil
+	}
+
+	middle, err := bm.readPointers(double)
+	if err != nil {
+		return err
+	}
+	for i, middleIndex := range middle {
+		if middleIndex == 0 {
+			continue
+		}
+		keep := uint32(0)
+		if start := uint32(i) * pointers; doubleKeep > start {
+			keep = min(doubleKeep-start, pointers)
+		}
+		if err := bm.truncatePointerBlock(&middleIndex, keep, free); err != nil {
+			return err
+		}
+		if middleIndex == 0 {
+			if err := bm.writePointer(double, uint32(i), 0); err != nil {
+				return err
+			}
+		}
+	}
+
+	if doubleKeep == 0 {
+		if err := bm.truncatePointerBlock(&fileInode.Blocks[doubleIndirectSlot], 0, free); err != nil {
+			return err
+		}
 	}
 
 	return nil
 }
+
+func (bm BlockManager) truncatePointerBlock(blockIndex *uint32, keep uint32, free func(uint32) error) error {
+	if *blockIndex == 0 {
+		return nil
+	}
+
+	if keep == 0 {
+		if err := free(*blockIndex); err != nil {
+			return err
+		}
+		*blockIndex = 0
+		return nil
+	}
+
+	data, err := bm.ReadBlock(*blockIndex)
+	if err != nil {
+		return err
+	}
+	clear(data[keep*pointerSize:])
+	return bm.WriteBlock(*blockIndex, data)
+}
+
+func (bm BlockManager) ensurePointerBlock(blockIndex *uint32, allocate func() (uint32, error)) (uint32, error) {
+	if *blockIndex != 0 {
+		return *blockIndex, nil
+	}
+
+	newBlock, err := allocate()
+	if err != nil {
+		return 0, err
+	}
+	if err := bm.WriteBlock(newBlock, nil); err != nil {
+		return 0, err
+	}
+
+	*blockIndex = newBlock
+	return newBlock, nil
+}
+
+func (bm BlockManager) readPointer(pointerBlock uint32, slot uint32) (uint32, error) {
+	data := make([]byte, pointerSize)
+	offset := bm.blocksOffset + pointerBlock*bm.blockSize + slot*pointerSize
+
+	_, err := bm.file.ReadAt(data, int64(offset))
+	if err != nil {
+		return 0, err
+	}
+
+	return binary.BigEndian.Uint32(data), nil
+}
+
+func (bm BlockManager) writePointer(pointerBlock uint32, slot uint32, value uint32) error {
+	data := make([]byte, pointerSize)
+	binary.BigEndian.PutUint32(data, value)
+	offset := bm.blocksOffset + pointerBlock*bm.blockSize + slot*pointerSize
+
+	_, err := bm.file.WriteAt(data, int64(offset))
+	return err
+}
+
+func (bm BlockManager) readPointers(pointerBlock uint32) ([]uint32, error) {
+	data, err := bm.ReadBlock(pointerBlock)
+	if err != nil {
+		return nil, err
+	}
+
+	result := make([]uint32, bm.pointersPerBlock())
+	for i := range result {
+		result[i] = binary.BigEndian.Uint32(data[i*pointerSize:])
+	}
+	return result, nil
+}
+
+func (bm BlockManager) pointersPerBlock() uint32 {
+	return bm.blockSize / pointerSize
+}
@@ -1,127 +1,232 @@
 package directorymanager
 
 import (
+	"file-system/internal/errs"
 	"file-system/internal/filesystem/directory"
+	"file-system/internal/filesystem/directory/record"
 	"file-system/internal/filesystem/inode"
-	"file-system/internal/utils"
-	"os"
+	"file-system/internal/filesystem/managers/blockmanager"
+	"fmt"
 )
 
+// ResizeFunc grows or shrinks the directory inode to hold size bytes.
+type ResizeFunc func(dirInode *inode.Inode, size int) error
+
+// Handle is an opened directory. Changes made through it update Inode,
+// which the caller saves afterwards.
+type Handle struct {
+	// Directory is nil for indexed directories, since their records are
+	// only read on demand.
+	Directory  *directory.Directory
+	Inode      *inode.Inode
+	InodeIndex uint32
+}
+
 type DirectoryManager struct {
-	Current           *directory.Directory
-	CurrentInode      *inode.Inode
-	CurrentInodeIndex uint32
-	Path              string
-
-	file         *os.File
-	blockSize    uint32
-	blocksOffset uint32
-
-	savedDirectory  *directory.Directory
-	savedInode      *inode.Inode
-	savedInodeIndex uint32
-	savedPath       string
+	blockManager   *blockmanager.BlockManager
+	blockSize      uint32
+	indexThreshold uint32
+	resize         ResizeFunc
+	fold           directory.FoldFunc
 }
 
-func NewDirectoryManager(file *os.File, blockSize, blocksOffset uint32) *DirectoryManager {
+// NewDirectoryManager creates a manager that converts linear directories to
+// indexed ones once they grow past indexThreshold blocks. A zero threshold
+// disables indexing. Names are compared by their fold keys.
+func NewDirectoryManager(
+	blockManager *blockmanager.BlockManager,
+	blockSize uint32,
+	indexThreshold uint32,
+	resize ResizeFunc,
+	fold directory.FoldFunc,
+) *DirectoryManager {
 	return &DirectoryManager{
-		file:         file,
-		blockSize:    blockSize,
-		blocksOffset: blocksOffset,
+		blockManager:   blockManager,
+		blockSize:      blockSize,
+		indexThreshold: indexThreshold,
+		resize:         resize,
+		fold:           fold,
 	}
 }
 
-func (dm *DirectoryManager) OpenDirectory(dirInode *inode.Inode, inodeIndex uint32, name string) error {
-	var err error
-	data := make([]byte, 0)
+func (dm *DirectoryManager) OpenDirectory(dirInode *inode.Inode, inodeIndex uint32) (*Handle, error) {
+	handle := &Handle{Inode: dirInode, InodeIndex: inodeIndex}
+	if dirInode.IsIndexed() {
+		return handle, nil
+	}
 
-	for i := 0; i < int(dirInode.FileSize); i++ {
-		blockIndex := dirInode.Blocks[i]
-		dirOffset := dm.blocksOffset + blockIndex*dm.blockSize
+	blockIndices, err := dm.blockManager.GetBlockIndices(dirInode)
+	if err != nil {
+		return nil, err
+	}
 
-		tmpData := make([]byte, dm.blockSize)
-		_, err = dm.file.ReadAt(tmpData, int64(dirOffset))
+	data := make([]byte, 0, len(blockIndices)*int(dm.blockSize))
+	for _, blockIndex := range blockIndices {
+		tmpData, err := dm.blockManager.ReadBlock(blockIndex)
 		if err != nil {
-			return err
+			return nil, err
 		}
 		data = append(data, tmpData...)
 	}
 
-	dm.Current, err = directory.ReadDirectoryFromBytes(data)
+	handle.Directory, err = directory.ReadDirectoryFromBytes(data, dm.blockSize, dm.fold)
 	if err != nil {
-		return err
+		return nil, err
 	}
-	dm.Path = utils.ChangeDirectoryPath(dm.Path, name)
-	dm.CurrentInode = dirInode
-	dm.CurrentInodeIndex = inodeIndex
 
-	return nil
+	return handle, nil
 }
 
-func (dm *DirectoryManager) CreateNewDirectory(dirInode *inode.Inode, inodeIndex uint32) (*directory.Directory, error) {
-	var currDirInodeIndex uint32
-	var err error
+// CreateNewDirectory writes an empty directory below the parent. The root
+// directory is its own parent.
+func (dm *DirectoryManager) CreateNewDirectory(dirInode *inode.Inode, inodeIndex uint32, parentInodeIndex uint32) error {
+	newDir := directory.NewDirectory(inodeIndex, parentInodeIndex, dm.fold)
+	return dm.saveDirectory(newDir, dirInode)
+}
+
+func (dm *DirectoryManager) Lookup(dir *Handle, name string) (uint32, error) {
+	if dir.Directory != nil {
+		return dir.Directory.GetInode(name)
+	}
+	return dm.lookupIndexed(dir.Inode, name)
+}
+
+// AddRecord links the inode into the directory. The record goes into the
+// first block with enough free space, and only that block is written back.
+func (dm *DirectoryManager) AddRecord(dir *Handle, inodeIndex uint32, name string, fileType uint8) error {
+	newRecord := record.NewRecord(inodeIndex, name, fileType)
+	if dir.Directory == nil {
+		return dm.insertIndexed(dir.Inode, newRecord)
+	}
+
+	if _, err := dir.Directory.GetInode(name); err == nil {
+		return fmt.Errorf("%w - %s", errs.ErrRecordAlreadyExists, name)
+	}
 
-	if inodeIndex != 0 {
-		currDirInodeIndex, err = dm.Current.GetInode(".")
+	for logical := uint32(0); logical < dir.Inode.FileSize; logical++ {
+		data, err := dm.readLogical(dir.Inode, logical)
 		if err != nil {
-			return nil, err
+			return err
+		}
+		if directory.InsertIntoBlock(data, newRecord) {
+			dir.Directory.AddFile(inodeIndex, name, fileType)
+			return dm.writeLogical(dir.Inode, logical, data)
 		}
 	}
-	newDir := directory.NewDirectory(inodeIndex, currDirInodeIndex)
-	dm.saveDirectory(newDir, dirInode)
 
-	return newDir, nil
-}
+	if dm.indexThreshold != 0 && dir.Inode.FileSize >= dm.indexThreshold {
+		dir.Directory.AddFile(inodeIndex, name, fileType)
+		return dm.convertToIndexed(dir)
+	}
 
-func (dm *DirectoryManager) SaveCurrentDirectory() error {
-	return dm.saveDirectory(dm.Current, dm.CurrentInode)
-}
+	logical, err := dm.appendBlock(dir.Inode)
+	if err != nil {
+		return err
+	}
+	data, _ := directory.EncodeBlock([]record.Record{newRecord}, dm.blockSize)
+	dir.Directory.AddFile(inodeIndex, name, fileType)
 
-func (dm *DirectoryManager) SaveCurrentState() {
-	dm.savedDirectory = dm.Current
-	dm.savedInode = dm.CurrentInode
-	dm.savedInodeIndex = dm.CurrentInodeIndex
-	dm.savedPath = dm.Path
+	return dm.writeLogical(dir.Inode, logical, data)
 }
 
-func (dm *DirectoryManager) LoadLastState() {
-	if dm.savedDirectory != nil && dm.Path != dm.savedPath {
-		dm.Current = dm.savedDirectory
-		dm.CurrentInode = dm.savedInode
-		dm.CurrentInodeIndex = dm.savedInodeIndex
-		dm.Path = dm.savedPath
+// DeleteRecord unlinks the name from the directory in place. Trailing
+// blocks left without records are released.
+func (dm *DirectoryManager) DeleteRecord(dir *Handle, name string) error {
+	if dir.Directory == nil {
+		return dm.deleteIndexed(dir.Inode, name)
 	}
-}
 
-func (dm *DirectoryManager) saveDirectory(dir *directory.Directory, dirInode *inode.Inode) error {
-	data := dir.Encode()
-	data = fitInBlocks(data, dm.blockSize)
+	stored, err := dir.Directory.GetRecord(name)
+	if err != nil {
+		return err
+	}
 
-	for i := 0; i < int(dirInode.FileSize); i++ {
-		offset := dm.blocksOffset + dirInode.Blocks[i]*dm.blockSize
+	for logical := uint32(0); logical < dir.Inode.FileSize; logical++ {
+		data, err := dm.readLogical(dir.Inode, logical)
+		if err != nil {
+			return err
+		}
+		if !directory.DeleteFromBlock(data, stored.Name) {
+			continue
+		}
 
-		sliceStart := int(dm.blockSize) * i
-		sliceEnd := int(dm.blockSize) * (i + 1)
-		if sliceEnd > len(data) {
-			sliceEnd = len(data)
+		dir.Directory.DeleteFile(name)
+		if err := dm.writeLogical(dir.Inode, logical, data); err != nil {
+			return err
 		}
+		return dm.trimEmptyBlocks(dir.Inode)
+	}
+
+	return fmt.Errorf("%w - %s", errs.ErrRecordNotFound, name)
+}
+
+// ReplaceRecord points the existing record of the name at another inode in
+// place, so the name is never missing in between.
+func (dm *DirectoryManager) ReplaceRecord(dir *Handle, name string, inodeIndex uint32, fileType uint8) error {
+	if dir.Directory == nil {
+		return dm.replaceIndexed(dir.Inode, name, inodeIndex, fileType)
+	}
 
-		_, err := dm.file.WriteAt(data[sliceStart:sliceEnd], int64(offset))
+	stored, err := dir.Directory.GetRecord(name)
+	if err != nil {
+		return err
+	}
+
+	for logical := uint32(0); logical < dir.Inode.FileSize; logical++ {
+		data, err := dm.readLogical(dir.Inode, logical)
 		if err != nil {
 			return err
 		}
+		if !directory.ReplaceInBlock(data, stored.Name, inodeIndex, fileType) {
+			continue
+		}
+
+		dir.Directory.ReplaceFile(inodeIndex, name, fileType)
+		return dm.writeLogical(dir.Inode, logical, data)
 	}
 
-	return nil
+	return fmt.Errorf("%w - %s", errs.ErrRecordNotFound, name)
 }
 
-func fitInBlocks(data []byte, blockSize uint32) []byte {
-	currentSize := uint32(len(data))
-	remainder := currentSize % blockSize
+// Records returns all records of the directory, "." and ".." first.
+func (dm *DirectoryManager) Records(dir *Handle) ([]record.Record, error) {
+	if dir.Directory != nil {
+		return dir.Directory.Records(), nil
+	}
+	return dm.indexedRecords(dir.Inode)
+}
 
-	padding := make([]byte, blockSize-remainder)
-	newData := append(data, padding...)
+func (dm *DirectoryManager) saveDirectory(dir *directory.Directory, dirInode *inode.Inode) error {
+	data := dir.Encode(dm.blockSize)
+	if err := dm.resize(dirInode, len(data)); err != nil {
+		return err
+	}
+
+	return dm.blockManager.WriteBlocks(dirInode, string(data))
+}
+
+func (dm *DirectoryManager) key(name string) string {
+	if dm.fold == nil {
+		return name
+	}
+	return dm.fold(name)
+}
 
-	return newData
+func (dm *DirectoryManager) trimEmptyBlocks(dirInode *inode.Inode) error {
+	size := dirInode.FileSize
+	for size > 1 {
+		data, err := dm.readLogical(dirInode, size-1)
+		if err != nil {
+			return err
+		}
+		if !directory.IsBlockEmpty(data) {
+			break
+		}
+		size--
+	}
+
+	if size == dirInode.FileSize {
+		return nil
+	}
+	return dm.resize(dirInode, int(size*dm.blockSize))
 }
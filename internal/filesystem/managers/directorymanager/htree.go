@@ -0,0 +1,370 @@
+package directorymanager
+
+import (
+	"file-system/internal/errs"
+	"file-system/internal/filesystem/directory"
+	"file-system/internal/filesystem/directory/htree"
+	"file-system/internal/filesystem/directory/record"
+	"file-system/internal/filesystem/inode"
+	"fmt"
+)
+
+const rootBlock = 0
+
+// indexStep is an index node visited on the way from the root to a leaf.
+type indexStep struct {
+	logical  uint32
+	node     *htree.Node
+	position int
+}
+
+// indexPath is the route to the leaf covering a hash.
+type indexPath struct {
+	root         *htree.Root
+	rootPosition int
+	steps        []indexStep
+	leaf         uint32
+}
+
+func (dm *DirectoryManager) lookupIndexed(dirInode *inode.Inode, name string) (uint32, error) {
+	root, err := dm.readRoot(dirInode)
+	if err != nil {
+		return 0, err
+	}
+	switch name {
+	case ".":
+		return root.DotInode, nil
+	case "..":
+		return root.DotDotInode, nil
+	}
+
+	path, err := dm.findLeaf(dirInode, root, dm.hash(name))
+	if err != nil {
+		return 0, err
+	}
+	records, err := dm.readLeaf(dirInode, path.leaf)
+	if err != nil {
+		return 0, err
+	}
+
+	for _, r := range records {
+		if dm.key(r.Name) == dm.key(name) {
+			return r.Inode, nil
+		}
+	}
+	return 0, fmt.Errorf("%w - %s", errs.ErrRecordNotFound, name)
+}
+
+func (dm *DirectoryManager) insertIndexed(dirInode *inode.Inode, newRecord record.Record) error {
+	root, err := dm.readRoot(dirInode)
+	if err != nil {
+		return err
+	}
+	path, err := dm.findLeaf(dirInode, root, dm.hash(newRecord.Name))
+	if err != nil {
+		return err
+	}
+	data, err := dm.readLogical(dirInode, path.leaf)
+	if err != nil {
+		return err
+	}
+
+	records := directory.DecodeBlock(data)
+	for _, r := range records {
+		if dm.key(r.Name) == dm.key(newRecord.Name) {
+			return fmt.Errorf("%w - %s", errs.ErrRecordAlreadyExists, newRecord.Name)
+		}
+	}
+
+	if directory.InsertIntoBlock(data, newRecord) {
+		return dm.writeLogical(dirInode, path.leaf, data)
+	}
+
+	records = append(records, newRecord)
+	left, right, err := htree.SplitLeaf(records, dm.hash)
+	if err != nil {
+		return err
+	}
+	leftData, leftOk := directory.EncodeBlock(left, dm.blockSize)
+	rightData, rightOk := directory.EncodeBlock(right, dm.blockSize)
+	if !leftOk || !rightOk {
+		return fmt.Errorf("%w - leaf split", errs.ErrNoSpaceLeft)
+	}
+
+	newLeaf, err := dm.appendBlock(dirInode)
+	if err != nil {
+		return err
+	}
+	if err := dm.writeLogical(dirInode, path.leaf, leftData); err != nil {
+		return err
+	}
+	if err := dm.writeLogical(dirInode, newLeaf, rightData); err != nil {
+		return err
+	}
+
+	return dm.insertIndexEntry(dirInode, path, htree.Entry{Hash: dm.hash(right[0].Name), Block: newLeaf})
+}
+
+// insertIndexEntry adds the entry for a freshly split block to its parent,
+// splitting index nodes up the path as needed. A full root moves its entries
+// into two new index nodes and the tree grows one level.
+func (dm *DirectoryManager) insertIndexEntry(dirInode *inode.Inode, path *indexPath, entry htree.Entry) error {
+	nodeCapacity := htree.NodeCapacity(dm.blockSize)
+
+	for i := len(path.steps) - 1; i >= 0; i-- {
+		step := path.steps[i]
+		entries := htree.Insert(step.node.Entries, step.position, entry)
+		if len(entries) <= nodeCapacity {
+			return dm.writeLogical(dirInode, step.logical, htree.Node{Entries: entries}.Encode(dm.blockSize))
+		}
+
+		middle := len(entries) / 2
+		newNode, err := dm.appendBlock(dirInode)
+		if err != nil {
+			return err
+		}
+		if err := dm.writeLogical(dirInode, step.logical, htree.Node{Entries: entries[:middle]}.Encode(dm.blockSize)); err != nil {
+			return err
+		}
+		if err := dm.writeLogical(dirInode, newNode, htree.Node{Entries: entries[middle:]}.Encode(dm.blockSize)); err != nil {
+			return err
+		}
+		entry = htree.Entry{Hash: entries[middle].Hash, Block: newNode}
+	}
+
+	root := path.root
+	entries := htree.Insert(root.Entries, path.rootPosition, entry)
+	if len(entries) > htree.RootCapacity(dm.blockSize) {
+		middle := len(entries) / 2
+		leftNode, err := dm.appendBlock(dirInode)
+		if err != nil {
+			return err
+		}
+		rightNode, err := dm.appendBlock(dirInode)
+		if err != nil {
+			return err
+		}
+		if err := dm.writeLogical(dirInode, leftNode, htree.Node{Entries: entries[:middle]}.Encode(dm.blockSize)); err != nil {
+			return err
+		}
+		if err := dm.writeLogical(dirInode, rightNode, htree.Node{Entries: entries[middle:]}.Encode(dm.blockSize)); err != nil {
+			return err
+		}
+		entries = []htree.Entry{{Hash: 0, Block: leftNode}, {Hash: entries[middle].Hash, Block: rightNode}}
+		root.Depth++
+	}
+	root.Entries = entries
+
+	return dm.writeLogical(dirInode, rootBlock, root.Encode(dm.blockSize))
+}
+
+// deleteIndexed removes the record from its leaf in place. Leaves are never
+// merged, so the index keeps its shape after deletions.
+func (dm *DirectoryManager) deleteIndexed(dirInode *inode.Inode, name string) error {
+	root, err := dm.readRoot(dirInode)
+	if err != nil {
+		return err
+	}
+	path, err := dm.findLeaf(dirInode, root, dm.hash(name))
+	if err != nil {
+		return err
+	}
+	data, err := dm.readLogical(dirInode, path.leaf)
+	if err != nil {
+		return err
+	}
+
+	for _, r := range directory.DecodeBlock(data) {
+		if dm.key(r.Name) == dm.key(name) {
+			directory.DeleteFromBlock(data, r.Name)
+			return dm.writeLogical(dirInode, path.leaf, data)
+		}
+	}
+	return fmt.Errorf("%w - %s", errs.ErrRecordNotFound, name)
+}
+
+// replaceIndexed rewrites the record in its leaf. The "." and ".." records
+// are kept in the root.
+func (dm *DirectoryManager) replaceIndexed(dirInode *inode.Inode, name string, inodeIndex uint32, fileType uint8) error {
+	root, err := dm.readRoot(dirInode)
+	if err != nil {
+		return err
+	}
+	switch name {
+	case ".":
+		root.DotInode = inodeIndex
+		return dm.writeLogical(dirInode, rootBlock, root.Encode(dm.blockSize))
+	case "..":
+		root.DotDotInode = inodeIndex
+		return dm.writeLogical(dirInode, rootBlock, root.Encode(dm.blockSize))
+	}
+
+	path, err := dm.findLeaf(dirInode, root, dm.hash(name))
+	if err != nil {
+		return err
+	}
+	data, err := dm.readLogical(dirInode, path.leaf)
+	if err != nil {
+		return err
+	}
+
+	for _, r := range directory.DecodeBlock(data) {
+		if dm.key(r.Name) == dm.key(name) {
+			directory.ReplaceInBlock(data, r.Name, inodeIndex, fileType)
+			return dm.writeLogical(dirInode, path.leaf, data)
+		}
+	}
+	return fmt.Errorf("%w - %s", errs.ErrRecordNotFound, name)
+}
+
+func (dm *DirectoryManager) indexedRecords(dirInode *inode.Inode) ([]record.Record, error) {
+	root, err := dm.readRoot(dirInode)
+	if err != nil {
+		return nil, err
+	}
+
+	result := []record.Record{
+		record.NewRecord(root.DotInode, ".", record.TypeDirectory),
+		record.NewRecord(root.DotDotInode, "..", record.TypeDirectory),
+	}
+
+	var walk func(entries []htree.Entry, depth uint8) error
+	walk = func(entries []htree.Entry, depth uint8) error {
+		for _, entry := range entries {
+			if depth == 0 {
+				records, err := dm.readLeaf(dirInode, entry.Block)
+				if err != nil {
+					return err
+				}
+				result = append(result, records...)
+				continue
+			}
+
+			node, err := dm.readNode(dirInode, entry.Block)
+			if err != nil {
+				return err
+			}
+			if err := walk(node.Entries, depth-1); err != nil {
+				return err
+			}
+		}
+		return nil
+	}
+
+	if err := walk(root.Entries, root.Depth); err != nil {
+		return nil, err
+	}
+	return result, nil
+}
+
+// convertToIndexed rewrites the linear directory as a hash tree with a
+// root and a single leaf, then inserts the records one by one.
+func (dm *DirectoryManager) convertToIndexed(handle *Handle) error {
+	dir := handle.Directory
+	dirInode := handle.Inode
+
+	if err := dm.resize(dirInode, 2*int(dm.blockSize)); err != nil {
+		return err
+	}
+
+	selfInode, _ := dir.GetInode(".")
+	parentInode, _ := dir.GetInode("..")
+	root := htree.Root{
+		DotInode:    selfInode,
+		DotDotInode: parentInode,
+		Entries:     []htree.Entry{{Hash: 0, Block: 1}},
+	}
+	if err := dm.writeLogical(dirInode, rootBlock, root.Encode(dm.blockSize)); err != nil {
+		return err
+	}
+	if err := dm.writeLogical(dirInode, 1, nil); err != nil {
+		return err
+	}
+
+	dirInode.SetIndexed(true)
+	handle.Directory = nil
+
+	for _, r := range dir.Records() {
+		if r.Name == "." || r.Name == ".." {
+			continue
+		}
+		if err := dm.insertIndexed(dirInode, r); err != nil {
+			return err
+		}
+	}
+
+	return nil
+}
+
+func (dm *DirectoryManager) findLeaf(dirInode *inode.Inode, root *htree.Root, hash uint32) (*indexPath, error) {
+	path := &indexPath{root: root}
+	path.rootPosition = htree.Find(root.Entries, hash)
+	child := root.Entries[path.rootPosition].Block
+
+	for level := uint8(0); level < root.Depth; level++ {
+		node, err := dm.readNode(dirInode, child)
+		if err != nil {
+			return nil, err
+		}
+		position := htree.Find(node.Entries, hash)
+		path.steps = append(path.steps, indexStep{child, node, position})
+		child = node.Entries[position].Block
+	}
+
+	path.leaf = child
+	return path, nil
+}
+
+func (dm *DirectoryManager) readRoot(dirInode *inode.Inode) (*htree.Root, error) {
+	data, err := dm.readLogical(dirInode, rootBlock)
+	if err != nil {
+		return nil, err
+	}
+	return htree.DecodeRoot(data)
+}
+
+func (dm *DirectoryManager) readNode(dirInode *inode.Inode, logical uint32) (*htree.Node, error) {
+	data, err := dm.readLogical(dirInode, logical)
+	if err != nil {
+		return nil, err
+	}
+	return htree.DecodeNode(data)
+}
+
+func (dm *DirectoryManager) readLeaf(dirInode *inode.Inode, logical uint32) ([]record.Record, error) {
+	data, err := dm.readLogical(dirInode, logical)
+	if err != nil {
+		return nil, err
+	}
+	return directory.DecodeBlock(data), nil
+}
+
+func (dm *DirectoryManager) readLogical(dirInode *inode.Inode, logical uint32) ([]byte, error) {
+	blockIndex, err := dm.blockManager.GetBlockIndex(dirInode, logical)
+	if err != nil {
+		return nil, err
+	}
+	return dm.blockManager.ReadBlock(blockIndex)
+}
+
+func (dm *DirectoryManager) writeLogical(dirInode *inode.Inode, logical uint32, data []byte) error {
+	blockIndex, err := dm.blockManager.GetBlockIndex(dirInode, logical)
+	if err != nil {
+		return err
+	}
+	return dm.blockManager.WriteBlock(blockIndex, data)
+}
+
+// appendBlock grows the directory by one block and returns its logical
+// number.
+func (dm *DirectoryManager) appendBlock(dirInode *inode.Inode) (uint32, error) {
+	logical := dirInode.FileSize
+	if err := dm.resize(dirInode, int(logical+1)*int(dm.blockSize)); err != nil {
+		return 0, err
+	}
+	return logical, nil
+}
+
+func (dm *DirectoryManager) hash(name string) uint32 {
+	return htree.Hash(dm.key(name))
+}
@@ -0,0 +1,71 @@
+package groupmanager
+
+import (
+	"file-system/internal/filesystem/group"
+	"sort"
+)
+
+type GroupManager struct {
+	groups map[uint16]*group.Group
+	nextId uint16
+}
+
+func NewGroupManager() *GroupManager {
+	return &GroupManager{
+		groups: make(map[uint16]*group.Group),
+	}
+}
+
+func (gm *GroupManager) CreateNewGroup(name string) *group.Group {
+	newGroup := group.NewGroup(name, gm.nextId)
+	gm.groups[gm.nextId] = newGroup
+	gm.nextId++
+	return newGroup
+}
+
+func (gm *GroupManager) LoadGroups(groups map[uint16]*group.Group) {
+	gm.groups = groups
+	for key := range groups {
+		if key+1 > gm.nextId {
+			gm.nextId = key + 1
+		}
+	}
+}
+
+func (gm *GroupManager) GetGroupName(groupId uint16) string {
+	if g, ok := gm.groups[groupId]; ok {
+		return g.Name
+	}
+	return ""
+}
+
+func (gm *GroupManager) GetGroupById(groupId uint16) (*group.Group, bool) {
+	g, ok := gm.groups[groupId]
+	return g, ok
+}
+
+func (gm *GroupManager) GetGroup(name string) (*group.Group, bool) {
+	for _, g := range gm.groups {
+		if g.Name == name {
+			return g, true
+		}
+	}
+	return nil, false
+}
+
+// GetMemberGroupIds returns the supplementary groups of the user in
+// ascending order.
+func (gm *GroupManager) GetMemberGroupIds(username string) []uint16 {
+	var result []uint16
+	for id, g := range gm.groups {
+		if g.HasMember(username) {
+			result = append(result, id)
+		}
+	}
+	sort.Slice(result, func(i, j int) bool { return result[i] < result[j] })
+	return result
+}
+
+func (gm *GroupManager) DeleteGroup(groupId uint16) {
+	delete(gm.groups, groupId)
+}
@@ -1,17 +1,17 @@
 package inodemanager
 
 import (
+	"file-system/internal/filesystem/blockdevice"
 	"file-system/internal/filesystem/inode"
-	"os"
 )
 
 type InodeManager struct {
-	file             *os.File
+	file             blockdevice.BlockDevice
 	inodeSize        uint32
 	inodeTableOffset uint32
 }
 
-func NewInodeManager(file *os.File, inodeSize, inodeTableOffset uint32) *InodeManager {
+func NewInodeManager(file blockdevice.BlockDevice, inodeSize, inodeTableOffset uint32) *InodeManager {
 	return &InodeManager{file, inodeSize, inodeTableOffset}
 }
 
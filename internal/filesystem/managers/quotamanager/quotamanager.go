@@ -0,0 +1,272 @@
+package quotamanager
+
+import (
+	"file-system/internal/filesystem/quota"
+	"sort"
+	"sync"
+	"time"
+)
+
+type Usage struct {
+	Blocks          uint32
+	Inodes          uint32
+	BlockGraceStart time.Time
+	InodeGraceStart time.Time
+}
+
+// QuotaManager keeps the quota limits loaded from the image together with
+// the usage of every user. Usage is recomputed from the inode table when the
+// filesystem is opened, while grace starts are kept in the quotas, which
+// are marked changed until the image has stored them. A QuotaManager is
+// safe for concurrent use.
+type QuotaManager struct {
+	mu          sync.Mutex
+	quotas      map[uint16]*quota.Quota
+	usage       map[uint16]*Usage
+	changed     map[uint16]bool
+	gracePeriod time.Duration
+}
+
+func NewQuotaManager(gracePeriod time.Duration) *QuotaManager {
+	return &QuotaManager{
+		quotas:      make(map[uint16]*quota.Quota),
+		usage:       make(map[uint16]*Usage),
+		changed:     make(map[uint16]bool),
+		gracePeriod: gracePeriod,
+	}
+}
+
+// LoadQuotas installs the quotas read from the image and resumes the grace
+// periods they record.
+func (qm *QuotaManager) LoadQuotas(quotas map[uint16]*quota.Quota) {
+	qm.mu.Lock()
+	defer qm.mu.Unlock()
+
+	qm.quotas = quotas
+	for userId, q := range quotas {
+		u := qm.getUsage(userId)
+		u.BlockGraceStart = graceTime(q.BlockGraceStart)
+		u.InodeGraceStart = graceTime(q.InodeGraceStart)
+	}
+	for userId := range qm.usage {
+		qm.updateGrace(userId)
+	}
+}
+
+// TakeChanged returns copies of the quotas whose grace starts changed since
+// the last call, sorted by user.
+func (qm *QuotaManager) TakeChanged() []*quota.Quota {
+	qm.mu.Lock()
+	defer qm.mu.Unlock()
+
+	result := make([]*quota.Quota, 0, len(qm.changed))
+	for userId := range qm.changed {
+		if q, ok := qm.quotas[userId]; ok {
+			copied := *q
+			result = append(result, &copied)
+		}
+	}
+	clear(qm.changed)
+	sort.Slice(result, func(i, j int) bool { return result[i].UserId < result[j].UserId })
+	return result
+}
+
+// MarkChanged makes TakeChanged return the quota of the user again, for
+// one that could not be stored.
+func (qm *QuotaManager) MarkChanged(userId uint16) {
+	qm.mu.Lock()
+	defer qm.mu.Unlock()
+
+	qm.changed[userId] = true
+}
+
+func (qm *QuotaManager) SetQuota(q *quota.Quota) {
+	qm.mu.Lock()
+	defer qm.mu.Unlock()
+
+	qm.quotas[q.UserId] = q
+	qm.updateGrace(q.UserId)
+}
+
+func (qm *QuotaManager) GetQuota(userId uint16) (*quota.Quota, bool) {
+	qm.mu.Lock()
+	defer qm.mu.Unlock()
+
+	q, ok := qm.quotas[userId]
+	return q, ok
+}
+
+func (qm *QuotaManager) DeleteQuota(userId uint16) {
+	qm.mu.Lock()
+	defer qm.mu.Unlock()
+
+	delete(qm.quotas, userId)
+	delete(qm.usage, userId)
+	delete(qm.changed, userId)
+}
+
+func (qm *QuotaManager) GetUsage(userId uint16) Usage {
+	qm.mu.Lock()
+	defer qm.mu.Unlock()
+
+	if u, ok := qm.usage[userId]; ok {
+		return *u
+	}
+	return Usage{}
+}
+
+func (qm *QuotaManager) GetGracePeriod() time.Duration {
+	return qm.gracePeriod
+}
+
+// GetUserIds returns every user that either has a quota or owns something.
+func (qm *QuotaManager) GetUserIds() []uint16 {
+	qm.mu.Lock()
+	defer qm.mu.Unlock()
+
+	ids := make(map[uint16]bool)
+	for id := range qm.quotas {
+		ids[id] = true
+	}
+	for id := range qm.usage {
+		ids[id] = true
+	}
+
+	result := make([]uint16, 0, len(ids))
+	for id := range ids {
+		result = append(result, id)
+	}
+	sort.Slice(result, func(i, j int) bool { return result[i] < result[j] })
+	return result
+}
+
+// Charge adds blocks and inodes to the usage of the user, failing with a
+// quota.ExceededError if a limit does not allow it. Root is never limited.
+func (qm *QuotaManager) Charge(userId uint16, blocks, inodes uint32) error {
+	qm.mu.Lock()
+	defer qm.mu.Unlock()
+
+	u := qm.getUsage(userId)
+	if q, ok := qm.quotas[userId]; ok && userId != 0 {
+		now := time.Now()
+		if err := qm.checkLimit(userId, "block", u.Blocks+blocks, q.BlockSoftLimit, q.BlockHardLimit, u.BlockGraceStart, now); err != nil {
+			return err
+		}
+		if err := qm.checkLimit(userId, "inode", u.Inodes+inodes, q.InodeSoftLimit, q.InodeHardLimit, u.InodeGraceStart, now); err != nil {
+			return err
+		}
+	}
+
+	u.Blocks += blocks
+	u.Inodes += inodes
+	qm.updateGrace(userId)
+
+	return nil
+}
+
+// Account adds blocks and inodes to the usage of the user without checking
+// the limits.
+func (qm *QuotaManager) Account(userId uint16, blocks, inodes uint32) {
+	qm.mu.Lock()
+	defer qm.mu.Unlock()
+
+	qm.account(userId, blocks, inodes)
+}
+
+func (qm *QuotaManager) Release(userId uint16, blocks, inodes uint32) {
+	qm.mu.Lock()
+	defer qm.mu.Unlock()
+
+	qm.release(userId, blocks, inodes)
+}
+
+func (qm *QuotaManager) Transfer(fromUserId, toUserId uint16, blocks, inodes uint32) {
+	qm.mu.Lock()
+	defer qm.mu.Unlock()
+
+	qm.release(fromUserId, blocks, inodes)
+	qm.account(toUserId, blocks, inodes)
+}
+
+func (qm *QuotaManager) account(userId uint16, blocks, inodes uint32) {
+	u := qm.getUsage(userId)
+	u.Blocks += blocks
+	u.Inodes += inodes
+	qm.updateGrace(userId)
+}
+
+func (qm *QuotaManager) release(userId uint16, blocks, inodes uint32) {
+	u := qm.getUsage(userId)
+	u.Blocks -= min(u.Blocks, blocks)
+	u.Inodes -= min(u.Inodes, inodes)
+	qm.updateGrace(userId)
+}
+
+func (qm *QuotaManager) checkLimit(
+	userId uint16,
+	resource string,
+	value, soft, hard uint32,
+	graceStart, now time.Time,
+) error {
+	if hard != 0 && value > hard {
+		return quota.ExceededError{UserId: userId, Resource: resource, Limit: hard}
+	}
+	if soft != 0 && value > soft && !graceStart.IsZero() && now.Sub(graceStart) > qm.gracePeriod {
+		return quota.ExceededError{UserId: userId, Resource: resource, Limit: soft, Soft: true}
+	}
+	return nil
+}
+
+// updateGrace starts the grace period when usage goes over a soft limit and
+// clears it once usage drops back, marking the quota changed if it did.
+func (qm *QuotaManager) updateGrace(userId uint16) {
+	u := qm.getUsage(userId)
+	q, ok := qm.quotas[userId]
+	if !ok {
+		u.BlockGraceStart = time.Time{}
+		u.InodeGraceStart = time.Time{}
+		return
+	}
+
+	u.BlockGraceStart = nextGraceStart(u.BlockGraceStart, u.Blocks, q.BlockSoftLimit)
+	u.InodeGraceStart = nextGraceStart(u.InodeGraceStart, u.Inodes, q.InodeSoftLimit)
+
+	blockGraceStart, inodeGraceStart := graceUnix(u.BlockGraceStart), graceUnix(u.InodeGraceStart)
+	if q.BlockGraceStart != blockGraceStart || q.InodeGraceStart != inodeGraceStart {
+		q.BlockGraceStart, q.InodeGraceStart = blockGraceStart, inodeGraceStart
+		qm.changed[userId] = true
+	}
+}
+
+func graceTime(unix uint32) time.Time {
+	if unix == 0 {
+		return time.Time{}
+	}
+	return time.Unix(int64(unix), 0)
+}
+
+func graceUnix(t time.Time) uint32 {
+	if t.IsZero() {
+		return 0
+	}
+	return uint32(t.Unix())
+}
+
+func nextGraceStart(graceStart time.Time, value, soft uint32) time.Time {
+	if soft == 0 || value <= soft {
+		return time.Time{}
+	}
+	if graceStart.IsZero() {
+		return time.Now()
+	}
+	return graceStart
+}
+
+func (qm *QuotaManager) getUsage(userId uint16) *Usage {
+	u, ok := qm.usage[userId]
+	if !ok {
+		u = &Usage{}
+		qm.usage[userId] = u
+	}
+	return u
+}
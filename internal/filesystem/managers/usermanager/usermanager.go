@@ -1,6 +1,9 @@
 package usermanager
 
-import "file-system/internal/filesystem/user"
+import (
+	"file-system/internal/filesystem/user"
+	"sort"
+)
 
 type UserManager struct {
 	Current *user.User
@@ -14,8 +17,8 @@ func NewUserManager() *UserManager {
 	}
 }
 
-func (um *UserManager) CreateNewUser(username, password string) *user.User {
-	newUser := user.NewUser(username, um.nextId, password)
+func (um *UserManager) CreateNewUser(username, password string, groupId uint16) *user.User {
+	newUser := user.NewUser(username, um.nextId, groupId, password)
 	um.users[um.nextId] = username
 	um.nextId++
 	return newUser
@@ -37,3 +40,12 @@ func (um *UserManager) GetUsername(userId uint16) string {
 func (um *UserManager) DeleteUser(userId uint16) {
 	delete(um.users, userId)
 }
+
+func (um *UserManager) GetUsernames() []string {
+	result := make([]string, 0, len(um.users))
+	for _, name := range um.users {
+		result = append(result, name)
+	}
+	sort.Strings(result)
+	return result
+}
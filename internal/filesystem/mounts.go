@@ -0,0 +1,197 @@
+package filesystem
+
+import (
+	"errors"
+	"file-system/internal/errs"
+	"file-system/internal/filesystem/blockdevice"
+	"file-system/internal/filesystem/user"
+	"file-system/internal/utils"
+	"fmt"
+	pathpkg "path"
+	"sort"
+	"strings"
+)
+
+// Users unknown to a mounted image are mapped to nobody, like root squash
+// on NFS.
+const nobodyId = 65534
+
+// Mount attaches the image on device at the directory path, hiding what the
+// directory holds until Unmount. Mounted images keep their own users: the
+// current user is looked up by name and password in the image and is
+// nobody there if it does not exist. Only root may mount.
+func (fs *FileSystem) Mount(device blockdevice.BlockDevice, path string, opts ...Option) error {
+	return fs.session.Mount(device, path, opts...)
+}
+
+func (fs *FileSystem) mountLocked(device blockdevice.BlockDevice, path string, opts ...Option) error {
+	if target, innerPath := fs.resolveMount(path); target != nil {
+		return target.Mount(device, innerPath, opts...)
+	}
+	if fs.userManager.Current.UserId != 0 {
+		return errs.ErrPermissionDenied
+	}
+	if absolutePath, ok := fs.procPath(path); ok {
+		return fmt.Errorf("%w - %s", errs.ErrBusy, absolutePath)
+	}
+
+	absolutePath := utils.AbsolutePath(fs.getCurrentPathLocked(), fs.normalizePath(path))
+	if absolutePath == "/" {
+		return fmt.Errorf("%w - %s", errs.ErrBusy, absolutePath)
+	}
+	// Images mounted below would be hidden by the new one
+	if err := fs.checkNotMountPoint(absolutePath); err != nil {
+		return err
+	}
+
+	if _, err := fs.openDirectory(absolutePath); err != nil {
+		return err
+	}
+
+	mounted, err := OpenFilesystem(device, opts...)
+	if err != nil {
+		return err
+	}
+	mounted.useIdentityOf(fs.userManager.Current)
+	if mounted.lower != nil {
+		mounted.lower.useIdentityOf(fs.userManager.Current)
+	}
+	mounted.session.umask = fs.active.umask
+
+	if fs.mounts == nil {
+		fs.mounts = make(map[string]*FileSystem)
+	}
+	fs.mounts[absolutePath] = mounted
+	return nil
+}
+
+// Unmount detaches the image mounted at path and closes its device.
+func (fs *FileSystem) Unmount(path string) error {
+	return fs.session.Unmount(path)
+}
+
+func (fs *FileSystem) unmountLocked(path string) error {
+	absolutePath := utils.AbsolutePath(fs.getCurrentPathLocked(), fs.normalizePath(path))
+	mounted, ok := fs.mounts[absolutePath]
+	if !ok {
+		if target, innerPath := fs.resolveMount(path); target != nil {
+			return target.Unmount(innerPath)
+		}
+		return fmt.Errorf("%w - %s", errs.ErrNotMountPoint, absolutePath)
+	}
+	if fs.userManager.Current.UserId != 0 {
+		return errs.ErrPermissionDenied
+	}
+	if fs.cwdMount == absolutePath || len(mounted.mounts) > 0 || len(mounted.openFiles) > 0 {
+		return fmt.Errorf("%w - %s", errs.ErrBusy, absolutePath)
+	}
+
+	delete(fs.mounts, absolutePath)
+	return mounted.CloseDataFile()
+}
+
+// Mounts returns the mount points of all attached images, nested ones
+// included, in sorted order.
+func (fs *FileSystem) Mounts() []string {
+	fs.mu.Lock()
+	defer fs.mu.Unlock()
+
+	return fs.mountsLocked()
+}
+
+func (fs *FileSystem) mountsLocked() []string {
+	var result []string
+	for mountPath, mounted := range fs.mounts {
+		result = append(result, mountPath)
+		for _, nested := range mounted.Mounts() {
+			result = append(result, pathpkg.Join(mountPath, nested))
+		}
+	}
+	sort.Strings(result)
+	return result
+}
+
+// resolveMount returns the mounted file system path leads into together
+// with the path inside it. For paths of fs itself it returns nil and the
+// path to use in fs, which is absolute while the working directory lies
+// in a mounted image.
+func (fs *FileSystem) resolveMount(path string) (*FileSystem, string) {
+	if len(fs.mounts) == 0 {
+		return nil, path
+	}
+
+	absolutePath := utils.AbsolutePath(fs.getCurrentPathLocked(), fs.normalizePath(path))
+	if mountPath, mounted, innerPath := fs.findMount(absolutePath); mounted != nil {
+		// The directories down to the mount point must be searchable. If
+		// they are not, fs walks the path itself and fails on them.
+		if err := fs.checkMountPointReachable(mountPath); err == nil {
+			return mounted, innerPath
+		}
+		return nil, absolutePath
+	}
+
+	if fs.cwdMount != "" {
+		return nil, absolutePath
+	}
+	return nil, path
+}
+
+// findMount returns the nearest mount point at or above the absolute
+// path, the image mounted there and the path inside it, regardless of
+// permissions.
+func (fs *FileSystem) findMount(absolutePath string) (string, *FileSystem, string) {
+	var result string
+	for mountPath := range fs.mounts {
+		if (absolutePath == mountPath || strings.HasPrefix(absolutePath, mountPath+"/")) && len(mountPath) > len(result) {
+			result = mountPath
+		}
+	}
+	if result == "" {
+		return "", nil, absolutePath
+	}
+	return result, fs.mounts[result], "/" + strings.TrimPrefix(absolutePath[len(result):], "/")
+}
+
+// checkMountPointReachable checks search permission on the directories
+// of fs above the mount point. Other lookup errors are left to the
+// mounted image, as the mount point may lie in the lower layer of an
+// overlay.
+func (fs *FileSystem) checkMountPointReachable(mountPath string) error {
+	_, err := fs.lookup(mountPath)
+	if errors.Is(err, errs.ErrPermissionDenied) {
+		return err
+	}
+	return nil
+}
+
+// checkNotMountPoint rejects removing or renaming a directory that has an
+// image mounted on it or below it.
+func (fs *FileSystem) checkNotMountPoint(path string) error {
+	absolutePath := utils.AbsolutePath(fs.getCurrentPathLocked(), fs.normalizePath(path))
+	for mountPath := range fs.mounts {
+		if mountPath == absolutePath || strings.HasPrefix(mountPath, absolutePath+"/") {
+			return fmt.Errorf("%w - %s", errs.ErrBusy, mountPath)
+		}
+	}
+	return nil
+}
+
+// useIdentityOf logs the user of the parent file system in to the mounted
+// one, or makes it nobody if the image has no such user.
+func (fs *FileSystem) useIdentityOf(parentUser *user.User) {
+	if parentUser == nil {
+		fs.userManager.Current = nil
+		return
+	}
+
+	content, err := fs.readUserRecord(parentUser.Username)
+	if err == nil {
+		u, err := user.ReadUserFromPasswordHash(content, parentUser.PasswordHash)
+		if err == nil {
+			u.Groups = fs.groupManager.GetMemberGroupIds(u.Username)
+			fs.userManager.Current = u
+			return
+		}
+	}
+	fs.userManager.Current = &user.User{Username: "nobody", UserId: nobodyId, GroupId: nobodyId}
+}
@@ -0,0 +1,298 @@
+package filesystem
+
+import (
+	"errors"
+	"file-system/internal/errs"
+	"file-system/internal/filesystem/inode"
+	"file-system/internal/filesystem/managers/directorymanager"
+	"file-system/internal/utils"
+	"fmt"
+	"strings"
+)
+
+// nameidata is a resolved path: the directory holding its last component,
+// the component itself and the entry it names, which is nil when there is
+// none yet. The generations the directory and the entry had tell whether
+// they were freed once their locks were given up, see lockParent.
+type nameidata struct {
+	parent           *directorymanager.Handle
+	name             string
+	entry            *inode.Inode
+	entryIndex       uint32
+	parentGeneration uint32
+	entryGeneration  uint32
+}
+
+// namei resolves path without touching the working directory. Absolute
+// paths start at the root and relative ones at the working directory.
+// Empty components and "." are skipped, ".." follows the record of the
+// directory, so the parent of the root is the root itself. Every directory
+// passed must be searchable. A trailing slash requires a directory, and
+// "/" resolves to the root under the name "/".
+//
+// Each directory is read under its read lock, which is only given up once
+// the lock of the next one is held, so the path is resolved against
+// directories no one is changing. No lock is held any more on return.
+func (fs *FileSystem) namei(path string) (*nameidata, error) {
+	path = fs.normalizePath(path)
+	if fs.procMounted && isProcPath(fs.cwdPath) {
+		path = utils.AbsolutePath(fs.cwdPath, path)
+	}
+
+	dirIndex, dirName := fs.cwdInode, fs.cwdPath
+	if strings.HasPrefix(path, "/") {
+		dirIndex, dirName = 0, "/"
+	}
+	unlock := fs.inodeLocks.rlock(dirIndex)
+	defer func() { unlock() }()
+
+	generation := fs.generation(dirIndex)
+	if dirIndex != 0 && generation != fs.cwdGeneration {
+		// The working directory stays where it was when it is removed, by
+		// another session too, and nothing can be found in it any more,
+		// even once its inode holds another directory
+		return nil, fmt.Errorf("%w - %s", errs.ErrRecordNotFound, dirName)
+	}
+	dirInode, err := fs.inodeManager.ReadInode(dirIndex)
+	if err != nil {
+		return nil, err
+	}
+	dir, err := fs.directoryManager.OpenDirectory(dirInode, dirIndex)
+	if err != nil {
+		return nil, err
+	}
+
+	names := pathComponents(path)
+	if len(names) == 0 {
+		if dirIndex == 0 {
+			return &nameidata{parent: dir, name: "/", entry: dirInode, parentGeneration: generation, entryGeneration: generation}, nil
+		}
+		names = []string{"."}
+	}
+
+	for _, name := range names[:len(names)-1] {
+		if err := fs.checkSearchPermission(dir.Inode, dirName); err != nil {
+			return nil, err
+		}
+		if dir, generation, unlock, err = fs.step(dir, name, unlock); err != nil {
+			return nil, err
+		}
+		dirName = name
+	}
+
+	nd := &nameidata{parent: dir, name: names[len(names)-1], parentGeneration: generation}
+	if err := fs.checkSearchPermission(dir.Inode, dirName); err != nil {
+		return nil, err
+	}
+	if err := fs.readEntry(nd); err != nil {
+		return nil, err
+	}
+
+	if nd.entry != nil && strings.HasSuffix(path, "/") && nd.entry.IsFile() {
+		return nil, fmt.Errorf("%w - %s", errs.ErrRecordIsNotDirectory, nd.name)
+	}
+	return nd, nil
+}
+
+// pathComponents splits path into the names to walk. A "." is kept only at
+// the end, where it names the directory itself.
+func pathComponents(path string) []string {
+	var result []string
+	parts := strings.Split(path, "/")
+	for i, name := range parts {
+		if name == "" || name == "." && i != len(parts)-1 {
+			continue
+		}
+		result = append(result, name)
+	}
+	return result
+}
+
+// step moves a lookup from dir, whose read lock release gives up, to the
+// directory name in it. It returns that directory with its generation and
+// the function releasing whichever lock is held then, also on failure.
+// Locks are taken from parent to child, so for ".." the lock of dir is
+// given up first and the generation tells whether the parent was freed in
+// between.
+func (fs *FileSystem) step(dir *directorymanager.Handle, name string, release func()) (*directorymanager.Handle, uint32, func(), error) {
+	inodeIndex, err := fs.directoryManager.Lookup(dir, name)
+	if err != nil {
+		return nil, 0, release, err
+	}
+	generation := fs.generation(inodeIndex)
+
+	unlock := release
+	switch {
+	case inodeIndex == dir.InodeIndex:
+		// ".." of the root
+	case name == "..":
+		release()
+		unlock = fs.inodeLocks.rlock(inodeIndex)
+		if fs.generation(inodeIndex) != generation {
+			return nil, 0, unlock, fmt.Errorf("%w - %s", errs.ErrRecordNotFound, name)
+		}
+	default:
+		unlock = fs.inodeLocks.rlock(inodeIndex)
+		release()
+	}
+
+	dirInode, err := fs.inodeManager.ReadInode(inodeIndex)
+	if err != nil {
+		return nil, 0, unlock, err
+	}
+	if dirInode.IsFile() {
+		return nil, 0, unlock, fmt.Errorf("%w - %s", errs.ErrRecordIsNotDirectory, name)
+	}
+	next, err := fs.directoryManager.OpenDirectory(dirInode, inodeIndex)
+	return next, generation, unlock, err
+}
+
+// readEntry looks up the name of nd in its directory, whose lock the
+// caller holds, and fills in the entry it names, if any.
+func (fs *FileSystem) readEntry(nd *nameidata) error {
+	entryIndex, err := fs.directoryManager.Lookup(nd.parent, nd.name)
+	if errors.Is(err, errs.ErrRecordNotFound) {
+		nd.entry, nd.entryIndex, nd.entryGeneration = nil, 0, 0
+		return nil
+	}
+	if err != nil {
+		return err
+	}
+	entry, err := fs.inodeManager.ReadInode(entryIndex)
+	if err != nil {
+		return err
+	}
+	nd.entry, nd.entryIndex, nd.entryGeneration = entry, entryIndex, fs.generation(entryIndex)
+	return nil
+}
+
+// lockParent takes the write lock of the directory nd was found in and
+// reads the directory and the entry again, as both may have changed since
+// namei gave up its lock. It fails if the directory has been removed
+// meanwhile.
+func (fs *FileSystem) lockParent(nd *nameidata) (func(), error) {
+	dirIndex := nd.parent.InodeIndex
+	unlock := fs.inodeLocks.lock(dirIndex)
+	if fs.generation(dirIndex) != nd.parentGeneration {
+		unlock()
+		return nil, fmt.Errorf("%w - %s", errs.ErrRecordNotFound, nd.name)
+	}
+
+	dirInode, err := fs.inodeManager.ReadInode(dirIndex)
+	if err == nil {
+		nd.parent, err = fs.directoryManager.OpenDirectory(dirInode, dirIndex)
+	}
+	if err == nil {
+		err = fs.readEntry(nd)
+	}
+	if err != nil {
+		unlock()
+		return nil, err
+	}
+	return unlock, nil
+}
+
+// rlockEntry takes the read lock of the entry nd names and reads its inode
+// again under it. It fails if the entry has been removed since the lookup.
+func (fs *FileSystem) rlockEntry(nd *nameidata) (func(), error) {
+	unlock := fs.inodeLocks.rlock(nd.entryIndex)
+	if fs.generation(nd.entryIndex) != nd.entryGeneration {
+		unlock()
+		return nil, fmt.Errorf("%w - %s", errs.ErrRecordNotFound, nd.name)
+	}
+
+	entry, err := fs.inodeManager.ReadInode(nd.entryIndex)
+	if err != nil {
+		unlock()
+		return nil, err
+	}
+	nd.entry = entry
+	return unlock, nil
+}
+
+// walk looks up name in dir and opens it as the next directory of a path.
+func (fs *FileSystem) walk(dir *directorymanager.Handle, dirName, name string) (*directorymanager.Handle, error) {
+	if err := fs.checkSearchPermission(dir.Inode, dirName); err != nil {
+		return nil, err
+	}
+	inodeIndex, err := fs.directoryManager.Lookup(dir, name)
+	if err != nil {
+		return nil, err
+	}
+	dirInode, err := fs.inodeManager.ReadInode(inodeIndex)
+	if err != nil {
+		return nil, err
+	}
+	if dirInode.IsFile() {
+		return nil, fmt.Errorf("%w - %s", errs.ErrRecordIsNotDirectory, name)
+	}
+	return fs.directoryManager.OpenDirectory(dirInode, inodeIndex)
+}
+
+// lookup resolves path to an existing entry.
+func (fs *FileSystem) lookup(path string) (*nameidata, error) {
+	nd, err := fs.namei(path)
+	if err != nil {
+		return nil, err
+	}
+	if nd.entry == nil {
+		return nil, fmt.Errorf("%w - %s", errs.ErrRecordNotFound, nd.name)
+	}
+	return nd, nil
+}
+
+// systemLookup resolves the absolute path to an existing entry of this
+// image on behalf of the file system itself, so no permissions are
+// checked on the way. The directories are locked as in namei.
+func (fs *FileSystem) systemLookup(path string) (uint32, *inode.Inode, error) {
+	unlock := fs.inodeLocks.rlock(0)
+	defer func() { unlock() }()
+
+	rootInode, err := fs.inodeManager.ReadInode(0)
+	if err != nil {
+		return 0, nil, err
+	}
+	names := pathComponents(path)
+	if len(names) == 0 {
+		return 0, rootInode, nil
+	}
+	dir, err := fs.directoryManager.OpenDirectory(rootInode, 0)
+	if err != nil {
+		return 0, nil, err
+	}
+
+	for _, name := range names[:len(names)-1] {
+		if dir, _, unlock, err = fs.step(dir, name, unlock); err != nil {
+			return 0, nil, err
+		}
+	}
+	nd := &nameidata{parent: dir, name: names[len(names)-1]}
+	if err := fs.readEntry(nd); err != nil {
+		return 0, nil, err
+	}
+	if nd.entry == nil {
+		return 0, nil, fmt.Errorf("%w - %s", errs.ErrRecordNotFound, nd.name)
+	}
+	return nd.entryIndex, nd.entry, nil
+}
+
+// openDirectory resolves path to a directory and opens it.
+func (fs *FileSystem) openDirectory(path string) (*directorymanager.Handle, error) {
+	nd, err := fs.lookup(path)
+	if err != nil {
+		return nil, err
+	}
+	if nd.entry.IsFile() {
+		return nil, fmt.Errorf("%w - %s", errs.ErrRecordIsNotDirectory, nd.name)
+	}
+	return fs.directoryManager.OpenDirectory(nd.entry, nd.entryIndex)
+}
+
+// checkSearchPermission verifies that the current user may look up entries
+// in the directory.
+func (fs *FileSystem) checkSearchPermission(dirInode *inode.Inode, dirName string) error {
+	if fs.userManager.Current != nil && !dirInode.HasExecutePermission(*fs.userManager.Current) {
+		return fmt.Errorf("%w - search %s", errs.ErrPermissionDenied, dirName)
+	}
+	return nil
+}
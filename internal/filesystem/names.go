@@ -0,0 +1,52 @@
+package filesystem
+
+import (
+	"file-system/internal/errs"
+	"file-system/internal/filesystem/superblock"
+	"fmt"
+	"strings"
+	"unicode/utf8"
+
+	"golang.org/x/text/cases"
+	"golang.org/x/text/unicode/norm"
+)
+
+// maxNameLength is the longest name a directory record can hold.
+const maxNameLength = 255
+
+var caseFolder = cases.Fold()
+
+// validateName checks a name for a new directory entry.
+func validateName(name string) error {
+	switch {
+	case name == "":
+		return fmt.Errorf("%w - empty name", errs.ErrIncorrectFileName)
+	case name == "." || name == "..":
+		return fmt.Errorf("%w - %s", errs.ErrIncorrectFileName, name)
+	case len(name) > maxNameLength:
+		return fmt.Errorf("%w - %d bytes", errs.ErrNameTooLong, len(name))
+	case !utf8.ValidString(name):
+		return fmt.Errorf("%w - invalid UTF-8 %q", errs.ErrIncorrectFileName, name)
+	case strings.ContainsRune(name, 0):
+		return fmt.Errorf("%w - NUL in %q", errs.ErrIncorrectFileName, name)
+	case strings.ContainsRune(name, '/'):
+		return fmt.Errorf("%w - slash in %q", errs.ErrIncorrectFileName, name)
+	}
+	return nil
+}
+
+// normalizePath brings a path to NFC when the filesystem was formatted
+// with name normalization. "/" is a starter, so normalizing the whole path
+// is the same as normalizing every component.
+func (fs *FileSystem) normalizePath(path string) string {
+	if fs.superblock.HasFlag(superblock.FlagNormalizeNames) && utf8.ValidString(path) {
+		return norm.NFC.String(path)
+	}
+	return path
+}
+
+// foldName is the directory key of a name on case-insensitive
+// filesystems.
+func foldName(name string) string {
+	return caseFolder.String(norm.NFC.String(name))
+}
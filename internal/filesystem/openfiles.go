@@ -0,0 +1,409 @@
+package filesystem
+
+import (
+	"errors"
+	"file-system/internal/errs"
+	"file-system/internal/filesystem/device"
+	"fmt"
+	"io"
+	"os"
+	"time"
+)
+
+// accessMode masks the O_RDONLY, O_WRONLY and O_RDWR part of open flags.
+const accessMode = os.O_RDONLY | os.O_WRONLY | os.O_RDWR
+
+// openFile is an open file description: a regular file or a device, the
+// flags it was opened with and the offset reads and writes through its
+// descriptor move. It is bound to the inode rather than the path, and the
+// inode cannot be deleted or replaced while it is open. The offset is guarded by fs.mu of
+// the file system the descriptor was opened in.
+type openFile struct {
+	// Image holding the file, which is a mounted one or the lower layer
+	// of an overlay if the path led there
+	fs         *FileSystem
+	inodeIndex uint32
+	name       string
+	flag       int
+	offset     int64
+	// Driver of a device inode, which reads and writes go to instead of
+	// blocks
+	device device.Device
+	// Set on close under the lock of the advisory lock table
+	closed bool
+}
+
+func (of *openFile) readable() bool {
+	return of.flag&accessMode != os.O_WRONLY
+}
+
+func (of *openFile) writable() bool {
+	return of.flag&accessMode != os.O_RDONLY
+}
+
+// OpenFile opens the regular file or device at path and returns its
+// descriptor, the lowest number not in use by the session. The flags are
+// those of os.OpenFile: an access mode and any of O_APPEND, O_CREATE,
+// O_EXCL and O_TRUNC. Permissions are checked here only, like in Unix.
+// Reads and writes of a device go to its driver.
+func (fs *FileSystem) OpenFile(path string, flag int) (int, error) {
+	return fs.session.OpenFile(path, flag)
+}
+
+// Read reads up to n bytes at the offset of the descriptor and advances
+// it. At the end of the file it returns io.EOF.
+func (fs *FileSystem) Read(fd int, n int) (string, error) {
+	return fs.session.Read(fd, n)
+}
+
+// Write writes data at the offset of the descriptor, or at the end of the
+// file if it was opened with O_APPEND, and advances the offset. Files have
+// no holes, so the offset may not lie past the end.
+func (fs *FileSystem) Write(fd int, data string) (int, error) {
+	return fs.session.Write(fd, data)
+}
+
+// Seek sets the offset of the descriptor like io.Seeker.
+func (fs *FileSystem) Seek(fd int, offset int64, whence int) (int64, error) {
+	return fs.session.Seek(fd, offset, whence)
+}
+
+// CloseFile closes the descriptor and releases its advisory locks.
+func (fs *FileSystem) CloseFile(fd int) error {
+	return fs.session.CloseFile(fd)
+}
+
+// openLocked resolves path to the image holding the file and opens it
+// there.
+func (fs *FileSystem) openLocked(path string, flag int) (*openFile, error) {
+	target, path := fs.resolveMount(path)
+	if target != nil {
+		return target.openIn(path, flag)
+	}
+	if absolutePath, ok := fs.procPath(path); ok {
+		return nil, fmt.Errorf("%w - %s", errs.ErrRecordIsNotFile, absolutePath)
+	}
+
+	writing := flag&accessMode != os.O_RDONLY || flag&os.O_TRUNC != 0
+	_, err := fs.statLocked(path)
+	exists := err == nil
+	if err != nil && !(errors.Is(err, errs.ErrRecordNotFound) && flag&os.O_CREATE != 0) {
+		return nil, err
+	}
+
+	switch {
+	case exists && flag&os.O_CREATE != 0 && flag&os.O_EXCL != 0:
+		return nil, fmt.Errorf("%w - %s", errs.ErrRecordAlreadyExists, path)
+	case !exists:
+		if err := fs.createEntityLocked(path, true, "", false); err != nil {
+			return nil, err
+		}
+	case writing:
+		if err := fs.checkWritable(path); err != nil {
+			return nil, err
+		}
+		if err := fs.copyUp(path); err != nil {
+			return nil, err
+		}
+	case fs.lower != nil && fs.layerOf(fs.overlayPath(path)) == layerLower:
+		return fs.lower.openIn(fs.overlayPath(path), flag)
+	}
+
+	return fs.open(path, flag)
+}
+
+// openIn opens the file in another image under its own lock.
+func (fs *FileSystem) openIn(path string, flag int) (*openFile, error) {
+	unlock := fs.session.lock()
+	defer unlock()
+	return fs.openLocked(path, flag)
+}
+
+// open opens an existing file of this image.
+func (fs *FileSystem) open(path string, flag int) (*openFile, error) {
+	nd, err := fs.lookup(path)
+	if err != nil {
+		return nil, err
+	}
+	if !nd.entry.IsFile() {
+		return nil, fmt.Errorf("%w - %s", errs.ErrRecordIsNotFile, nd.name)
+	}
+
+	of := &openFile{fs: fs, inodeIndex: nd.entryIndex, name: nd.name, flag: flag}
+	if nd.entry.IsDevice() {
+		if of.device, err = device.Lookup(nd.entry.GetDeviceNumber()); err != nil {
+			return nil, err
+		}
+	}
+	if currentUser := fs.userManager.Current; currentUser != nil {
+		if of.readable() && !nd.entry.HasReadPermission(*currentUser) ||
+			of.writable() && !nd.entry.HasWritePermission(*currentUser) {
+			return nil, fmt.Errorf("%w - open %s", errs.ErrPermissionDenied, nd.name)
+		}
+	}
+
+	if flag&os.O_TRUNC != 0 && of.writable() && of.device == nil {
+		if err := fs.updateOpenFile(of, func(string) (string, error) { return "", nil }); err != nil {
+			return nil, err
+		}
+	}
+
+	if fs.openFiles == nil {
+		fs.openFiles = make(map[uint32]int)
+	}
+	fs.openFiles[of.inodeIndex]++
+	return of, nil
+}
+
+// readOpenFile returns the content of the open file.
+func (fs *FileSystem) readOpenFile(of *openFile) (string, error) {
+	unlock := fs.inodeLocks.rlock(of.inodeIndex)
+	defer unlock()
+
+	fileInode, err := fs.inodeManager.ReadInode(of.inodeIndex)
+	if err != nil {
+		return "", err
+	}
+	return fs.blockManager.ReadBlocks(fileInode, of.name)
+}
+
+// updateOpenFile replaces the content of the open file with what update
+// makes of it, holding the inode lock in between.
+func (fs *FileSystem) updateOpenFile(of *openFile, update func(content string) (string, error)) error {
+	unlock := fs.inodeLocks.lock(of.inodeIndex)
+	defer unlock()
+
+	fileInode, err := fs.inodeManager.ReadInode(of.inodeIndex)
+	if err != nil {
+		return err
+	}
+	content, err := fs.blockManager.ReadBlocks(fileInode, of.name)
+	if err != nil {
+		return err
+	}
+	if content, err = update(content); err != nil {
+		return err
+	}
+
+	if err := fs.RevalidateFileSize(fileInode, len(content)); err != nil {
+		return err
+	}
+	if err := fs.blockManager.WriteBlocks(fileInode, content); err != nil {
+		return err
+	}
+
+	fileInode.ModificationTime = uint32(time.Now().Unix())
+	fs.inodeManager.SaveInode(fileInode, of.inodeIndex)
+	fs.saveAllocationState()
+
+	return nil
+}
+
+// readDevice reads up to n bytes from the driver of the open device. None
+// of the devices is seekable, so the offset stays where it is.
+func readDevice(of *openFile, n int) (string, error) {
+	if n <= 0 {
+		return "", nil
+	}
+	data := make([]byte, n)
+	read, err := of.device.ReadAt(data, of.offset)
+	if read > 0 {
+		return string(data[:read]), nil
+	}
+	if err == nil {
+		err = io.EOF
+	}
+	return "", err
+}
+
+// closeOpenFile unpins the inode of the open file and drops its locks.
+func (fs *FileSystem) closeOpenFile(of *openFile) {
+	if fs.openFiles[of.inodeIndex]--; fs.openFiles[of.inodeIndex] == 0 {
+		delete(fs.openFiles, of.inodeIndex)
+	}
+	fs.fileLocks.close(of)
+}
+
+// checkNotOpen rejects deleting or replacing a file that is open.
+func (fs *FileSystem) checkNotOpen(inodeIndex uint32, name string) error {
+	if fs.openFiles[inodeIndex] > 0 {
+		return fmt.Errorf("%w - %s", errs.ErrBusy, name)
+	}
+	return nil
+}
+
+func (s *Session) OpenFile(path string, flag int) (int, error) {
+	unlock := s.lock()
+	defer unlock()
+
+	of, err := s.fs.openLocked(path, flag)
+	if err != nil {
+		return 0, err
+	}
+
+	fd := 0
+	for s.files[fd] != nil {
+		fd++
+	}
+	s.files[fd] = of
+	return fd, nil
+}
+
+func (s *Session) Read(fd int, n int) (string, error) {
+	unlock := s.lock()
+	defer unlock()
+
+	of, err := s.descriptor(fd)
+	if err != nil {
+		return "", err
+	}
+	if !of.readable() {
+		return "", fmt.Errorf("%w - %d", errs.ErrBadDescriptor, fd)
+	}
+
+	if of.device != nil {
+		return readDevice(of, n)
+	}
+
+	unlockHolder := s.lockHolder(of)
+	content, err := of.fs.readOpenFile(of)
+	unlockHolder()
+	if err != nil {
+		return "", err
+	}
+
+	if of.offset >= int64(len(content)) {
+		return "", io.EOF
+	}
+	end := min(of.offset+int64(n), int64(len(content)))
+	result := content[of.offset:end]
+	of.offset = end
+	return result, nil
+}
+
+func (s *Session) Write(fd int, data string) (int, error) {
+	unlock := s.lock()
+	defer unlock()
+
+	of, err := s.descriptor(fd)
+	if err != nil {
+		return 0, err
+	}
+	if !of.writable() {
+		return 0, fmt.Errorf("%w - %d", errs.ErrBadDescriptor, fd)
+	}
+
+	if of.device != nil {
+		return of.device.WriteAt([]byte(data), of.offset)
+	}
+
+	offset := of.offset
+	unlockHolder := s.lockHolder(of)
+	err = of.fs.updateOpenFile(of, func(content string) (string, error) {
+		if of.flag&os.O_APPEND != 0 {
+			offset = int64(len(content))
+		}
+		if offset > int64(len(content)) {
+			return "", fmt.Errorf("%w - offset %d past the end of %s", errs.ErrIllegalArgument, offset, of.name)
+		}
+		result := content[:offset] + data
+		if end := offset + int64(len(data)); end < int64(len(content)) {
+			result += content[end:]
+		}
+		return result, nil
+	})
+	unlockHolder()
+	if err != nil {
+		return 0, err
+	}
+
+	of.offset = offset + int64(len(data))
+	return len(data), nil
+}
+
+func (s *Session) Seek(fd int, offset int64, whence int) (int64, error) {
+	unlock := s.lock()
+	defer unlock()
+
+	of, err := s.descriptor(fd)
+	if err != nil {
+		return 0, err
+	}
+
+	switch whence {
+	case io.SeekStart:
+	case io.SeekCurrent:
+		offset += of.offset
+	case io.SeekEnd:
+		// Devices have no end, and their offset is kept for the drivers
+		// only
+		if of.device != nil {
+			break
+		}
+		unlockHolder := s.lockHolder(of)
+		content, err := of.fs.readOpenFile(of)
+		unlockHolder()
+		if err != nil {
+			return 0, err
+		}
+		offset += int64(len(content))
+	default:
+		return 0, fmt.Errorf("%w - whence %d", errs.ErrIllegalArgument, whence)
+	}
+	if offset < 0 {
+		return 0, fmt.Errorf("%w - offset %d", errs.ErrIllegalArgument, offset)
+	}
+
+	of.offset = offset
+	return offset, nil
+}
+
+func (s *Session) CloseFile(fd int) error {
+	unlock := s.lock()
+	defer unlock()
+
+	of, err := s.descriptor(fd)
+	if err != nil {
+		return err
+	}
+	delete(s.files, fd)
+
+	unlockHolder := s.lockHolder(of)
+	defer unlockHolder()
+	of.fs.closeOpenFile(of)
+	return nil
+}
+
+// Close closes every descriptor of the session and releases their
+// advisory locks. The session itself stays usable.
+func (s *Session) Close() error {
+	unlock := s.lock()
+	defer unlock()
+
+	for fd, of := range s.files {
+		delete(s.files, fd)
+		unlockHolder := s.lockHolder(of)
+		of.fs.closeOpenFile(of)
+		unlockHolder()
+	}
+	return nil
+}
+
+// descriptor returns the open file of fd. The caller holds fs.mu.
+func (s *Session) descriptor(fd int) (*openFile, error) {
+	of, ok := s.files[fd]
+	if !ok {
+		return nil, fmt.Errorf("%w - %d", errs.ErrBadDescriptor, fd)
+	}
+	return of, nil
+}
+
+// lockHolder takes the lock of the image holding the open file unless it
+// is the one of the session, whose lock the caller holds.
+func (s *Session) lockHolder(of *openFile) func() {
+	if of.fs == s.fs {
+		return func() {}
+	}
+	of.fs.mu.Lock()
+	return of.fs.unlock
+}
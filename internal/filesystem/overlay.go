@@ -0,0 +1,407 @@
+package filesystem
+
+import (
+	"errors"
+	"file-system/internal/errs"
+	"file-system/internal/filesystem/blockdevice"
+	"file-system/internal/filesystem/device"
+	"file-system/internal/filesystem/directory/record"
+	"file-system/internal/filesystem/inode"
+	"file-system/internal/utils"
+	"fmt"
+	pathpkg "path"
+	"strings"
+)
+
+// Overlays follow overlayfs: a whiteout is a hidden character device 0:0
+// hiding the lower entry of the same name, and a directory holding the
+// opaque marker hides the lower directory of the same path completely.
+const opaqueMarker = ".wh..wh..opq"
+
+var whiteoutDevice = device.MakeDeviceNumber(0, 0)
+
+type layer int
+
+const (
+	layerNone layer = iota
+	layerUpper
+	layerLower
+)
+
+// Option configures OpenFilesystem and Mount.
+type Option func(*options)
+
+type options struct {
+	lower blockdevice.BlockDevice
+}
+
+// WithLowerLayer opens the image as the writable upper layer of an overlay
+// on top of the image on lower, which is never written to. Lookups fall
+// through to the lower image, changed files are copied up first and
+// deletions leave whiteouts.
+func WithLowerLayer(lower blockdevice.BlockDevice) Option {
+	return func(o *options) {
+		o.lower = lower
+	}
+}
+
+func (fs *FileSystem) applyOptions(opts []Option) error {
+	var o options
+	for _, opt := range opts {
+		opt(&o)
+	}
+
+	if o.lower != nil {
+		lower, err := OpenFilesystem(blockdevice.NewReadOnly(o.lower))
+		if err != nil {
+			return err
+		}
+		lower.useIdentityOf(fs.userManager.Current)
+		fs.lower = lower
+	}
+	return nil
+}
+
+func (fs *FileSystem) overlayPath(path string) string {
+	return utils.AbsolutePath(fs.cwdPath, fs.normalizePath(path))
+}
+
+// layerOf tells which layer serves the absolute path.
+func (fs *FileSystem) layerOf(absolutePath string) layer {
+	if fs.procMounted && isProcPath(absolutePath) {
+		return layerUpper
+	}
+
+	entry, _, err := fs.statPath(absolutePath)
+	if err == nil && !isWhiteout(entry) {
+		return layerUpper
+	}
+	if err != nil && !errors.Is(err, errs.ErrRecordNotFound) {
+		// Let the upper layer report the problem
+		return layerUpper
+	}
+
+	if fs.lowerShowsThrough(absolutePath) {
+		if _, _, err := fs.lower.statPath(absolutePath); err == nil {
+			return layerLower
+		}
+	}
+	return layerNone
+}
+
+// lowerShowsThrough reports whether the lower layer is visible at the
+// absolute path, that is no whiteout, file or opaque directory of the upper
+// layer covers it.
+func (fs *FileSystem) lowerShowsThrough(absolutePath string) bool {
+	prefix := "/"
+	for _, name := range strings.Split(strings.Trim(absolutePath, "/"), "/") {
+		prefix = pathpkg.Join(prefix, name)
+		entry, _, err := fs.statPath(prefix)
+		if err != nil {
+			return true
+		}
+		if isWhiteout(entry) || entry.IsFile() || fs.isOpaque(prefix) {
+			return false
+		}
+	}
+	return !fs.isOpaque(absolutePath)
+}
+
+func (fs *FileSystem) isOpaque(absolutePath string) bool {
+	_, _, err := fs.statPath(pathpkg.Join(absolutePath, opaqueMarker))
+	return err == nil
+}
+
+func isWhiteout(entry *inode.Inode) bool {
+	return entry.IsDevice() && entry.IsHidden() && entry.GetDeviceNumber() == whiteoutDevice
+}
+
+// statPath looks up the inode at path in this image only.
+func (fs *FileSystem) statPath(path string) (*inode.Inode, uint32, error) {
+	nd, err := fs.lookup(path)
+	if err != nil {
+		return nil, 0, err
+	}
+	return nd.entry, nd.entryIndex, nil
+}
+
+// asOverlay runs f with the rights of the overlay itself rather than of the
+// current user, as copy-up and whiteouts are not the user's own changes.
+func (fs *FileSystem) asOverlay(f func() error) error {
+	currentUser, lowerUser := fs.userManager.Current, fs.lower.userManager.Current
+	fs.userManager.Current, fs.lower.userManager.Current = nil, nil
+	defer func() {
+		fs.userManager.Current, fs.lower.userManager.Current = currentUser, lowerUser
+	}()
+	return f()
+}
+
+// copyUp copies the entry at path and the directories above it from the
+// lower layer, so that it can be changed in the upper one.
+func (fs *FileSystem) copyUp(path string) error {
+	if fs.lower == nil {
+		return nil
+	}
+	absolutePath := fs.overlayPath(path)
+	switch fs.layerOf(absolutePath) {
+	case layerNone:
+		return fmt.Errorf("%w - %s", errs.ErrRecordNotFound, pathpkg.Base(absolutePath))
+	case layerUpper:
+		return nil
+	}
+	return fs.copyUpEntry(absolutePath)
+}
+
+func (fs *FileSystem) copyUpEntry(absolutePath string) error {
+	if err := fs.copyUp(pathpkg.Dir(absolutePath)); err != nil {
+		return err
+	}
+
+	lowerInode, _, err := fs.lower.statPath(absolutePath)
+	if err != nil {
+		return err
+	}
+
+	return fs.asOverlay(func() error {
+		var err error
+		switch {
+		case lowerInode.IsDevice():
+			err = fs.createDeviceNode(absolutePath, lowerInode.GetDeviceNumber(), lowerInode.IsHidden())
+		case lowerInode.IsFile():
+			var content string
+			if content, err = fs.lower.ReadFile(absolutePath); err == nil {
+				err = fs.createEntity(absolutePath, true, content, lowerInode.IsHidden())
+			}
+		default:
+			err = fs.createEntity(absolutePath, false, "", lowerInode.IsHidden())
+		}
+		if err != nil {
+			return err
+		}
+
+		upperInode, inodeIndex, err := fs.statPath(absolutePath)
+		if err != nil {
+			return err
+		}
+		fs.quotaManager.Transfer(upperInode.UserId, lowerInode.UserId, fs.blockUsage(upperInode), 1)
+		upperInode.UserId = lowerInode.UserId
+		upperInode.GroupId = lowerInode.GroupId
+		upperInode.SetPermissions(lowerInode.GetPermissions())
+		upperInode.CreationTime = lowerInode.CreationTime
+		upperInode.ModificationTime = lowerInode.ModificationTime
+		return fs.inodeManager.SaveInode(upperInode, inodeIndex)
+	})
+}
+
+// copyUpDirectory copies up a directory of the lower layer before it
+// becomes the working directory, as new entries go to the upper layer.
+func (fs *FileSystem) copyUpDirectory(path string) error {
+	if fs.lower == nil {
+		return nil
+	}
+	absolutePath := fs.overlayPath(path)
+	switch fs.layerOf(absolutePath) {
+	case layerNone:
+		return fmt.Errorf("%w - %s", errs.ErrRecordNotFound, pathpkg.Base(absolutePath))
+	case layerUpper:
+		return nil
+	}
+	lowerInode, _, err := fs.lower.statPath(absolutePath)
+	if err != nil {
+		return err
+	}
+	if lowerInode.IsFile() {
+		return fmt.Errorf("%w - %s", errs.ErrRecordIsNotDirectory, pathpkg.Base(absolutePath))
+	}
+	return fs.copyUpEntry(absolutePath)
+}
+
+// createInOverlay runs create for a new entry at path after copying up its
+// directory and removing a whiteout in the way. A directory created over a
+// whiteout is made opaque, so the deleted lower content stays hidden.
+func (fs *FileSystem) createInOverlay(path string, directory bool, create func() error) error {
+	absolutePath := fs.overlayPath(path)
+	if fs.layerOf(absolutePath) == layerLower {
+		return fmt.Errorf("%w - %s", errs.ErrRecordAlreadyExists, pathpkg.Base(absolutePath))
+	}
+	if err := fs.copyUp(pathpkg.Dir(absolutePath)); err != nil {
+		return err
+	}
+
+	entry, _, err := fs.statPath(absolutePath)
+	whiteout := err == nil && isWhiteout(entry)
+	if whiteout {
+		if err := fs.asOverlay(func() error { return fs.deleteFile(absolutePath) }); err != nil {
+			return err
+		}
+	}
+
+	if err := create(); err != nil {
+		if whiteout {
+			fs.createWhiteout(absolutePath)
+		}
+		return err
+	}
+
+	if whiteout && directory {
+		return fs.asOverlay(func() error {
+			return fs.createEntity(pathpkg.Join(absolutePath, opaqueMarker), true, "", true)
+		})
+	}
+	return nil
+}
+
+func (fs *FileSystem) createWhiteout(absolutePath string) error {
+	return fs.asOverlay(func() error {
+		return fs.createDeviceNode(absolutePath, whiteoutDevice, true)
+	})
+}
+
+// deleteFromOverlay removes the entry from the upper layer and leaves a
+// whiteout if the lower layer would show through.
+func (fs *FileSystem) deleteFromOverlay(path string) error {
+	if _, name := utils.SplitPath(path); name == "." || name == ".." {
+		return fmt.Errorf("%w - %s", errs.ErrIllegalArgument, name)
+	}
+
+	absolutePath := fs.overlayPath(path)
+	switch fs.layerOf(absolutePath) {
+	case layerNone:
+		return fmt.Errorf("%w - %s", errs.ErrRecordNotFound, pathpkg.Base(absolutePath))
+	case layerUpper:
+		if err := fs.deleteFile(absolutePath); err != nil {
+			return err
+		}
+		if fs.layerOf(absolutePath) != layerLower {
+			return nil
+		}
+	case layerLower:
+		if err := fs.copyUp(pathpkg.Dir(absolutePath)); err != nil {
+			return err
+		}
+		if err := fs.checkOverlayRemoval(absolutePath); err != nil {
+			return err
+		}
+	}
+
+	return fs.createWhiteout(absolutePath)
+}
+
+func (fs *FileSystem) checkOverlayRemoval(absolutePath string) error {
+	lowerInode, _, err := fs.lower.statPath(absolutePath)
+	if err != nil {
+		return err
+	}
+
+	nd, err := fs.namei(absolutePath)
+	if err != nil {
+		return err
+	}
+	return fs.checkEntryRemoval(nd.parent, nd.name, lowerInode)
+}
+
+// moveInOverlay renames within the upper layer after copying the source
+// up. Like overlayfs without redirects, directories of the lower layer
+// cannot be renamed.
+func (fs *FileSystem) moveInOverlay(pathFrom, pathTo string, noReplace bool) error {
+	absoluteFrom, absoluteTo := fs.overlayPath(pathFrom), fs.overlayPath(pathTo)
+
+	switch fs.layerOf(absoluteFrom) {
+	case layerNone:
+		return fmt.Errorf("%w - %s", errs.ErrRecordNotFound, pathpkg.Base(absoluteFrom))
+	case layerLower:
+		lowerInode, _, err := fs.lower.statPath(absoluteFrom)
+		if err != nil {
+			return err
+		}
+		if !lowerInode.IsFile() {
+			return fmt.Errorf("%w - %s", errs.ErrCrossDevice, absoluteFrom)
+		}
+		if err := fs.copyUpEntry(absoluteFrom); err != nil {
+			return err
+		}
+	}
+
+	movedInode, _, err := fs.statPath(absoluteFrom)
+	if err != nil {
+		return err
+	}
+	if !noReplace && fs.layerOf(absoluteTo) == layerLower {
+		// A file of the lower layer is replaced through its copy
+		if lowerInode, _, err := fs.lower.statPath(absoluteTo); err == nil && lowerInode.IsFile() {
+			if err := fs.copyUpEntry(absoluteTo); err != nil {
+				return err
+			}
+		}
+	}
+	err = fs.createInOverlay(absoluteTo, !movedInode.IsFile(), func() error {
+		return fs.moveFile(absoluteFrom, absoluteTo, noReplace)
+	})
+	if err != nil {
+		return err
+	}
+
+	if fs.layerOf(absoluteFrom) == layerLower {
+		return fs.createWhiteout(absoluteFrom)
+	}
+	return nil
+}
+
+// mergeLowerRecords adds the entries of the lower directory at the
+// absolute path that the records of the upper one do not cover.
+func (fs *FileSystem) mergeLowerRecords(dirPath string, upperRecords []record.Record, result []string, long bool) ([]string, error) {
+	if !fs.lowerShowsThrough(dirPath) {
+		return result, nil
+	}
+
+	covered := make(map[string]bool, len(upperRecords))
+	for _, r := range upperRecords {
+		covered[r.Name] = true
+	}
+
+	if _, err := fs.lower.openDirectory(dirPath); err != nil {
+		return result, nil
+	}
+	lowerRecords, err := fs.lower.listDirectory(dirPath, long)
+	if err != nil {
+		return nil, err
+	}
+
+	for _, line := range lowerRecords {
+		if !covered[line[strings.LastIndex(line, "\t")+1:]] {
+			result = append(result, line)
+		}
+	}
+	return result, nil
+}
+
+// findInOverlay merges the results of Find in both layers.
+func (fs *FileSystem) findInOverlay(path string, fileType uint8) ([]string, error) {
+	absolutePath := fs.overlayPath(path)
+
+	var result []string
+	switch fs.layerOf(absolutePath) {
+	case layerNone:
+		return nil, fmt.Errorf("%w - %s", errs.ErrRecordNotFound, pathpkg.Base(absolutePath))
+	case layerUpper:
+		upperResult, err := fs.find(path, fileType)
+		if err != nil {
+			return nil, err
+		}
+		result = upperResult
+		if !fs.lowerShowsThrough(absolutePath) {
+			return result, nil
+		}
+	}
+
+	lowerResult, err := fs.lower.Find(absolutePath, fileType)
+	if err != nil && result == nil {
+		return nil, err
+	}
+	for _, entry := range lowerResult {
+		if fs.layerOf(entry) == layerLower {
+			result = append(result, pathpkg.Join(path, strings.TrimPrefix(entry, absolutePath)))
+		}
+	}
+	return result, nil
+}
@@ -0,0 +1,273 @@
+package filesystem
+
+import (
+	"file-system/internal/errs"
+	"file-system/internal/filesystem/blockdevice"
+	"file-system/internal/utils"
+	"fmt"
+	"strconv"
+	"strings"
+	"time"
+)
+
+const procRoot = "/proc"
+
+// procEntry is a node of the synthetic /proc tree. Files have read set,
+// directories have list set. Nothing in the tree is stored in the image.
+type procEntry struct {
+	read func(fs *FileSystem) (string, error)
+	list func(fs *FileSystem) []string
+}
+
+var procTree map[string]procEntry
+
+// The tree is filled in at init since its handlers lead back to lookupProc.
+func init() {
+	procTree = map[string]procEntry{
+		"/proc":                  {list: procNames("fs", "inodes", "mounts", "self")},
+		"/proc/fs":               {list: procNames("fragmentation", "stats")},
+		"/proc/fs/stats":         {read: (*FileSystem).procStats},
+		"/proc/fs/fragmentation": {read: (*FileSystem).procFragmentation},
+		"/proc/mounts":           {read: (*FileSystem).procMounts},
+		"/proc/self":             {list: procNames("status")},
+		"/proc/self/status":      {read: (*FileSystem).procSelfStatus},
+		"/proc/inodes":           {list: (*FileSystem).procInodeNames},
+	}
+}
+
+func procNames(names ...string) func(fs *FileSystem) []string {
+	return func(fs *FileSystem) []string {
+		return names
+	}
+}
+
+func isProcPath(absolutePath string) bool {
+	return absolutePath == procRoot || strings.HasPrefix(absolutePath, procRoot+"/")
+}
+
+// procPath returns the absolute form of path if it points into the mounted
+// /proc tree.
+func (fs *FileSystem) procPath(path string) (string, bool) {
+	if !fs.procMounted {
+		return "", false
+	}
+	absolutePath := utils.AbsolutePath(fs.cwdPath, path)
+	return absolutePath, isProcPath(absolutePath)
+}
+
+// checkWritable rejects modifications of a read-only image and of anything
+// inside /proc, including the mount point itself.
+func (fs *FileSystem) checkWritable(path string) error {
+	if fs.readOnly {
+		return fmt.Errorf("%w - %s", errs.ErrReadOnlyFileSystem, path)
+	}
+	if absolutePath, ok := fs.procPath(path); ok {
+		return fmt.Errorf("%w - %s", errs.ErrReadOnlyFileSystem, absolutePath)
+	}
+	return nil
+}
+
+func (fs *FileSystem) lookupProc(absolutePath string) (procEntry, error) {
+	if entry, ok := procTree[absolutePath]; ok {
+		return entry, nil
+	}
+
+	dir, name := utils.SplitPath(absolutePath)
+	if dir == "/proc/inodes" {
+		inodeIndex, err := strconv.ParseUint(name, 10, 32)
+		if err == nil && fs.isInodeUsed(uint32(inodeIndex)) {
+			return procEntry{read: func(fs *FileSystem) (string, error) {
+				return fs.procInode(uint32(inodeIndex))
+			}}, nil
+		}
+	}
+
+	return procEntry{}, fmt.Errorf("%w - %s", errs.ErrRecordNotFound, absolutePath)
+}
+
+func (fs *FileSystem) readProc(absolutePath string) (string, error) {
+	entry, err := fs.lookupProc(absolutePath)
+	if err != nil {
+		return "", err
+	}
+	if entry.read == nil {
+		return "", fmt.Errorf("%w - %s", errs.ErrRecordIsNotFile, absolutePath)
+	}
+	return entry.read(fs)
+}
+
+func (fs *FileSystem) listProc(absolutePath string, long bool) ([]string, error) {
+	entry, err := fs.lookupProc(absolutePath)
+	if err != nil {
+		return nil, err
+	}
+
+	names := append([]string{".", ".."}, entry.list(fs)...)
+	if !long {
+		return names, nil
+	}
+
+	modificationTimeString := time.Now().Format("Jan 2 15:04")
+	result := make([]string, 0, len(names))
+	for _, name := range names {
+		tapString := "-r--r--r--"
+		if child, err := fs.lookupProc(utils.AbsolutePath(absolutePath, name)); err != nil || child.list != nil {
+			tapString = "dr-xr-xr-x"
+		}
+		result = append(result, fmt.Sprintf("%s\t%s\t%s\t%d\t%s\t%s", tapString, FSConfig.RootUsername, FSConfig.RootUsername, 0, modificationTimeString, name))
+	}
+	return result, nil
+}
+
+// changeProcDirectory makes a /proc directory current. The real mount point
+// is the working directory and only the path is virtual.
+func (fs *FileSystem) changeProcDirectory(absolutePath string) error {
+	entry, err := fs.lookupProc(absolutePath)
+	if err != nil {
+		return err
+	}
+	if entry.list == nil {
+		return fmt.Errorf("%w - %s", errs.ErrRecordIsNotDirectory, absolutePath)
+	}
+
+	nd, err := fs.lookup(procRoot)
+	if err != nil {
+		return err
+	}
+	if err := fs.checkSearchPermission(nd.entry, procRoot); err != nil {
+		return err
+	}
+	fs.cwdInode, fs.cwdGeneration = nd.entryIndex, nd.entryGeneration
+	fs.cwdPath = absolutePath
+
+	return nil
+}
+
+func (fs *FileSystem) isInodeUsed(inodeIndex uint32) bool {
+	bit, err := fs.inodeBitmap.GetBit(inodeIndex)
+	return err == nil && bit == 1
+}
+
+func (fs *FileSystem) procStats() (string, error) {
+	sb := fs.superblock
+	return fmt.Sprintf(
+		"block_size %d\nblock_count %d\nfree_blocks %d\ninode_size %d\ninode_count %d\nfree_inodes %d\n",
+		sb.BlockSize, sb.BlockCount, sb.FreeBlockCount, sb.InodeSize, sb.InodeCount, sb.FreeInodeCount,
+	), nil
+}
+
+func (fs *FileSystem) procFragmentation() (string, error) {
+	freeExtents, largestFreeExtent, fragmentation := fs.freeSpaceFragmentation()
+	usedRuns := fs.blockBitmap.RunLengths(1)
+
+	return fmt.Sprintf(
+		"free_extents %d\nlargest_free_extent %d\nused_extents %d\nfragmentation %.2f%%\n",
+		freeExtents, largestFreeExtent, len(usedRuns), fragmentation,
+	), nil
+}
+
+// freeSpaceFragmentation returns the number of free extents, the longest
+// one and the share of free space outside of it in percent.
+func (fs *FileSystem) freeSpaceFragmentation() (int, uint32, float64) {
+	freeRuns := fs.blockBitmap.RunLengths(0)
+
+	var freeBlocks, largestFreeRun uint32
+	for _, run := range freeRuns {
+		freeBlocks += run
+		largestFreeRun = max(largestFreeRun, run)
+	}
+
+	var fragmentation float64
+	if freeBlocks > 0 {
+		fragmentation = 100 * float64(freeBlocks-largestFreeRun) / float64(freeBlocks)
+	}
+
+	return len(freeRuns), largestFreeRun, fragmentation
+}
+
+func (fs *FileSystem) procMounts() (string, error) {
+	var result strings.Builder
+	fs.writeMountLine(&result, "/")
+	fmt.Fprintf(&result, "proc %s proc ro 0 0\n", procRoot)
+	for _, mountPath := range fs.mountsLocked() {
+		_, mounted, innerPath := fs.findMount(mountPath)
+		for innerPath != "/" {
+			_, mounted, innerPath = mounted.findMount(innerPath)
+		}
+		mounted.writeMountLine(&result, mountPath)
+	}
+	return result.String(), nil
+}
+
+func (fs *FileSystem) writeMountLine(result *strings.Builder, mountPath string) {
+	mode := "rw"
+	if fs.readOnly {
+		mode = "ro"
+	}
+	fmt.Fprintf(
+		result, "%s %s emufs %s,quota,blocksize=%d 0 0\n",
+		blockdevice.Name(fs.device), mountPath, mode, fs.superblock.BlockSize,
+	)
+}
+
+func (fs *FileSystem) procSelfStatus() (string, error) {
+	currentUser := fs.userManager.Current
+	groups := make([]string, 0, len(currentUser.Groups))
+	for _, groupId := range currentUser.Groups {
+		groups = append(groups, strconv.Itoa(int(groupId)))
+	}
+
+	return fmt.Sprintf(
+		"session %d\nuser %s\nuid %d\ngid %d\ngroups %s\ncwd %s\n",
+		fs.active.id, currentUser.Username, currentUser.UserId, currentUser.GroupId, strings.Join(groups, " "), fs.cwdPath,
+	), nil
+}
+
+func (fs *FileSystem) procInodeNames() []string {
+	var result []uint32
+	for i := uint32(0); i < fs.superblock.InodeCount; i++ {
+		if fs.isInodeUsed(i) {
+			result = append(result, i)
+		}
+	}
+
+	names := make([]string, len(result))
+	for i, inodeIndex := range result {
+		names[i] = strconv.Itoa(int(inodeIndex))
+	}
+	return names
+}
+
+// procInode describes the inode to root and to users who may read it.
+// Others could otherwise learn about files in directories they cannot
+// search.
+func (fs *FileSystem) procInode(inodeIndex uint32) (string, error) {
+	fileInode, err := fs.inodeManager.ReadInode(inodeIndex)
+	if err != nil {
+		return "", err
+	}
+	if currentUser := fs.userManager.Current; currentUser != nil && currentUser.UserId != 0 && !fileInode.HasReadPermission(*currentUser) {
+		return "", fmt.Errorf("%w - %s/inodes/%d", errs.ErrPermissionDenied, procRoot, inodeIndex)
+	}
+
+	blockIndices, err := fs.blockManager.GetBlockIndices(fileInode)
+	if err != nil {
+		return "", err
+	}
+	blocks := make([]string, 0, len(blockIndices))
+	for _, blockIndex := range blockIndices {
+		blocks = append(blocks, strconv.Itoa(int(blockIndex)))
+	}
+
+	return fmt.Sprintf(
+		"inode %d\nmode %s\nuid %d\ngid %d\nsize_blocks %d\ncreated %d\nmodified %d\nblocks %s\n",
+		inodeIndex,
+		fileInode.GetTypeAndPermissionString(),
+		fileInode.UserId,
+		fileInode.GroupId,
+		fileInode.FileSize,
+		fileInode.CreationTime,
+		fileInode.ModificationTime,
+		strings.Join(blocks, " "),
+	), nil
+}
@@ -0,0 +1,99 @@
+package quota
+
+import (
+	"file-system/internal/errs"
+	"fmt"
+	"strconv"
+	"strings"
+)
+
+// Quota holds the block and inode limits of a single user. A zero limit
+// means that the resource is not limited. The grace starts are Unix times
+// of the moment usage went over a soft limit, zero while it is not.
+type Quota struct {
+	UserId          uint16
+	BlockSoftLimit  uint32
+	BlockHardLimit  uint32
+	InodeSoftLimit  uint32
+	InodeHardLimit  uint32
+	BlockGraceStart uint32
+	InodeGraceStart uint32
+}
+
+func NewQuota(userId uint16, blockSoft, blockHard, inodeSoft, inodeHard uint32) *Quota {
+	return &Quota{
+		UserId:         userId,
+		BlockSoftLimit: blockSoft,
+		BlockHardLimit: blockHard,
+		InodeSoftLimit: inodeSoft,
+		InodeHardLimit: inodeHard,
+	}
+}
+
+// ReadQuotaFromString parses a quota record. Records written before grace
+// starts were stored end after the limits.
+func ReadQuotaFromString(str string) (*Quota, error) {
+	parts := strings.Fields(str)
+
+	if len(parts) != 5 && len(parts) != 7 {
+		return nil, fmt.Errorf("invalid input format")
+	}
+
+	values := make([]uint64, 7)
+	for i, part := range parts {
+		bitSize := 32
+		if i == 0 {
+			bitSize = 16
+		}
+		value, err := strconv.ParseUint(part, 10, bitSize)
+		if err != nil {
+			return nil, fmt.Errorf("error parsing quota: %v", err)
+		}
+		values[i] = value
+	}
+
+	q := NewQuota(
+		uint16(values[0]),
+		uint32(values[1]),
+		uint32(values[2]),
+		uint32(values[3]),
+		uint32(values[4]),
+	)
+	q.BlockGraceStart = uint32(values[5])
+	q.InodeGraceStart = uint32(values[6])
+	return q, nil
+}
+
+func (q Quota) GetQuotaString() string {
+	return fmt.Sprintf(
+		"%d %d %d %d %d %d %d",
+		q.UserId,
+		q.BlockSoftLimit,
+		q.BlockHardLimit,
+		q.InodeSoftLimit,
+		q.InodeHardLimit,
+		q.BlockGraceStart,
+		q.InodeGraceStart,
+	)
+}
+
+// ExceededError is returned when an allocation would exceed a hard limit or
+// a soft limit whose grace period has expired.
+type ExceededError struct {
+	UserId   uint16
+	Resource string
+	Limit    uint32
+	Soft     bool
+}
+
+func (e ExceededError) Error() string {
+	kind := "hard"
+	if e.Soft {
+		kind = "soft"
+	}
+	return fmt.Sprintf("%v - %s %s limit %d for user %d", errs.ErrQuotaExceeded, e.Resource, kind, e.Limit, e.UserId)
+}
+
+func (e ExceededError) Unwrap() error {
+	return errs.ErrQuotaExceeded
+}
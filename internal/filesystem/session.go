@@ -0,0 +1,478 @@
+package filesystem
+
+import (
+	"context"
+	"file-system/internal/filesystem/blockdevice"
+	"file-system/internal/filesystem/user"
+	"fmt"
+	"sort"
+	"sync/atomic"
+)
+
+// defaultUmask gives the 644 files and 755 directories the image always had.
+const defaultUmask = 0o022
+
+// lastSessionId numbers the sessions of all file systems of the process.
+var lastSessionId atomic.Uint64
+
+// Session is one user working with the file system: an identity, a working
+// directory, a file creation mask and environment variables. Sessions of
+// one FileSystem are independent and may be used from different
+// goroutines. Their methods behave like the FileSystem methods of the same
+// name, which act on the default session of the file system.
+type Session struct {
+	fs    *FileSystem
+	id    uint64
+	user  *user.User
+	cwd   workingDirectory
+	umask uint16
+	env   map[string]string
+	// Open file descriptions by descriptor, guarded by fs.mu
+	files map[int]*openFile
+}
+
+func newSession(fs *FileSystem) *Session {
+	return &Session{fs: fs, id: lastSessionId.Add(1), cwd: workingDirectory{path: "/"}, umask: defaultUmask, env: make(map[string]string), files: make(map[int]*openFile)}
+}
+
+// NewSession logs the user in to a new session starting in the home
+// directory of the user.
+func (fs *FileSystem) NewSession(username, password string) (*Session, error) {
+	s := newSession(fs)
+	unlock := s.lock()
+	defer unlock()
+
+	if err := fs.changeUserLocked(username, password); err != nil {
+		// Nothing of the failed session may stay installed
+		fs.active = nil
+		return nil, err
+	}
+	if err := fs.changeDirectoryLocked(homeDirectory(fs.userManager.Current)); err != nil {
+		fs.active = nil
+		return nil, err
+	}
+	return s, nil
+}
+
+// DefaultSession returns the session the methods of fs itself use.
+func (fs *FileSystem) DefaultSession() *Session {
+	return fs.session
+}
+
+// lock takes the lock of the file system and makes s its active session.
+func (s *Session) lock() func() {
+	s.fs.mu.Lock()
+	s.fs.activate(s)
+	return s.fs.unlock
+}
+
+// unlock stores the grace periods the operation started or ended and
+// releases the lock of the file system.
+func (fs *FileSystem) unlock() {
+	fs.saveQuotaGrace()
+	fs.mu.Unlock()
+}
+
+// rlock takes the lock of the file system shared if s is its active
+// session already, so that lookups and changes to different directories of
+// the session run side by side under the inode locks, see locks.go. Making
+// another session active, and any operation of an overlay, which copies
+// entries up across layers, takes it exclusively as lock does.
+func (s *Session) rlock() func() {
+	if s.fs.lower == nil {
+		s.fs.mu.RLock()
+		if s.fs.active == s {
+			return s.fs.runlock
+		}
+		s.fs.mu.RUnlock()
+	}
+	return s.lock()
+}
+
+// runlock is unlock for the shared lock.
+func (fs *FileSystem) runlock() {
+	fs.saveQuotaGrace()
+	fs.mu.RUnlock()
+}
+
+// activate installs the user and the working directory of s in fs after
+// saving those of the session active so far. The working directory is
+// installed as it was saved, without looking its path up again, so it
+// stays where it was even if another session removed or renamed it.
+func (fs *FileSystem) activate(s *Session) {
+	if fs.active == s {
+		return
+	}
+	if previous := fs.active; previous != nil {
+		previous.user = fs.userManager.Current
+		previous.cwd = fs.workingDirectory()
+	}
+
+	fs.active = s
+	fs.setCurrentUser(s.user)
+	fs.inheritUmask(s.umask)
+	fs.setWorkingDirectory(s.cwd)
+}
+
+// workingDirectory is the working directory of a session as installed in
+// fs and, if it lies in a mounted image, in that image.
+type workingDirectory struct {
+	inode      uint32
+	generation uint32
+	path       string
+	mount      string
+	mounted    *FileSystem
+	inner      *workingDirectory
+}
+
+func (fs *FileSystem) workingDirectory() workingDirectory {
+	wd := workingDirectory{inode: fs.cwdInode, generation: fs.cwdGeneration, path: fs.cwdPath, mount: fs.cwdMount}
+	if mounted := fs.mounts[fs.cwdMount]; fs.cwdMount != "" && mounted != nil {
+		inner := mounted.workingDirectory()
+		wd.mounted, wd.inner = mounted, &inner
+	}
+	return wd
+}
+
+// setWorkingDirectory installs wd in fs and the images mounted in it. A
+// directory in an image that has been unmounted since is replaced by the
+// mount point, or by / if that cannot be entered either.
+func (fs *FileSystem) setWorkingDirectory(wd workingDirectory) {
+	fs.cwdInode, fs.cwdGeneration, fs.cwdPath, fs.cwdMount = wd.inode, wd.generation, wd.path, wd.mount
+	if wd.mount == "" {
+		return
+	}
+	if mounted := fs.mounts[wd.mount]; mounted != nil && mounted == wd.mounted {
+		mounted.setWorkingDirectory(*wd.inner)
+		return
+	}
+
+	fs.cwdMount = ""
+	if err := fs.changeWorkingDirectory(wd.mount); err != nil {
+		fs.cwdInode, fs.cwdGeneration, fs.cwdPath = 0, fs.generation(0), "/"
+	}
+}
+
+// homeDirectory is the directory AddUser creates for the user.
+func homeDirectory(u *user.User) string {
+	if u.UserId == 0 {
+		return "/"
+	}
+	return fmt.Sprintf("/%s", u.Username)
+}
+
+// Umask returns the mask cleared from the permissions of new files and
+// directories.
+func (s *Session) Umask() uint16 {
+	s.fs.mu.Lock()
+	defer s.fs.mu.Unlock()
+	return s.umask
+}
+
+// SetUmask replaces the mask and returns the previous one.
+func (s *Session) SetUmask(mask uint16) uint16 {
+	s.fs.mu.Lock()
+	defer s.fs.mu.Unlock()
+
+	previous := s.umask
+	s.umask = mask & 0o777
+	if s.fs.active == s {
+		s.fs.inheritUmask(s.umask)
+	}
+	return previous
+}
+
+// inheritUmask passes the mask of the active session on to the mounted
+// images, which are only ever used through their default sessions.
+func (fs *FileSystem) inheritUmask(mask uint16) {
+	for _, mounted := range fs.mounts {
+		mounted.session.umask = mask
+		mounted.inheritUmask(mask)
+	}
+}
+
+func (s *Session) Getenv(name string) string {
+	s.fs.mu.Lock()
+	defer s.fs.mu.Unlock()
+	return s.env[name]
+}
+
+// Setenv sets a variable; an empty value removes it.
+func (s *Session) Setenv(name, value string) {
+	s.fs.mu.Lock()
+	defer s.fs.mu.Unlock()
+
+	if value == "" {
+		delete(s.env, name)
+	} else {
+		s.env[name] = value
+	}
+}
+
+// Environ returns the variables as sorted name=value pairs.
+func (s *Session) Environ() []string {
+	s.fs.mu.Lock()
+	defer s.fs.mu.Unlock()
+
+	result := make([]string, 0, len(s.env))
+	for name, value := range s.env {
+		result = append(result, name+"="+value)
+	}
+	sort.Strings(result)
+	return result
+}
+
+func (s *Session) ReadFile(path string) (string, error) {
+	unlock := s.rlock()
+	if _, ok := s.fs.procPath(path); ok {
+		// /proc reports state that operations under the shared lock change
+		unlock()
+		unlock = s.lock()
+	}
+	content, file, err := s.fs.openFileLocked(path)
+	unlock()
+	if err != nil || file == nil {
+		return content, err
+	}
+	defer file.release()
+
+	return s.fs.blockManager.ReadBlocks(file.inode, file.name)
+}
+
+func (s *Session) Defragment(ctx context.Context, path string) (*DefragReport, error) {
+	unlock := s.lock()
+	defer unlock()
+
+	return s.fs.defragmentLocked(ctx, path)
+}
+
+func (s *Session) CreateDeviceNode(path string, deviceNumber uint32) error {
+	unlock := s.lock()
+	defer unlock()
+
+	return s.fs.createDeviceNodeLocked(path, deviceNumber)
+}
+
+func (s *Session) AddUser(username, password string) error {
+	unlock := s.lock()
+	defer unlock()
+
+	return s.fs.addUserLocked(username, password)
+}
+
+func (s *Session) ChangeUser(username, password string) error {
+	unlock := s.lock()
+	defer unlock()
+
+	return s.fs.changeUserLocked(username, password)
+}
+
+func (s *Session) DeleteUser(username string) error {
+	unlock := s.lock()
+	defer unlock()
+
+	return s.fs.deleteUserLocked(username)
+}
+
+func (s *Session) AddGroup(name string) error {
+	unlock := s.lock()
+	defer unlock()
+
+	return s.fs.addGroupLocked(name)
+}
+
+func (s *Session) DeleteGroup(name string) error {
+	unlock := s.lock()
+	defer unlock()
+
+	return s.fs.deleteGroupLocked(name)
+}
+
+func (s *Session) AddUserToGroup(username, groupName string) error {
+	unlock := s.lock()
+	defer unlock()
+
+	return s.fs.addUserToGroupLocked(username, groupName)
+}
+
+func (s *Session) GetUserGroups(username string) ([]string, error) {
+	unlock := s.lock()
+	defer unlock()
+
+	return s.fs.getUserGroupsLocked(username)
+}
+
+func (s *Session) ChangeGroup(path string, groupName string) error {
+	unlock := s.lock()
+	defer unlock()
+
+	return s.fs.changeGroupLocked(path, groupName)
+}
+
+func (s *Session) ChangeOwner(path string, username string) error {
+	unlock := s.lock()
+	defer unlock()
+
+	return s.fs.changeOwnerLocked(path, username)
+}
+
+func (s *Session) CreateEmptyFile(path string) error {
+	unlock := s.rlock()
+	defer unlock()
+
+	return s.fs.createEmptyFileLocked(path)
+}
+
+func (s *Session) CreateFileWithContent(path, content string) error {
+	unlock := s.rlock()
+	defer unlock()
+
+	return s.fs.createFileWithContentLocked(path, content)
+}
+
+func (s *Session) CreateDirectory(path string) error {
+	unlock := s.rlock()
+	defer unlock()
+
+	return s.fs.createDirectoryLocked(path)
+}
+
+func (s *Session) CreateHiddenDirectory(path string) error {
+	unlock := s.rlock()
+	defer unlock()
+
+	return s.fs.createHiddenDirectoryLocked(path)
+}
+
+func (s *Session) CreateEntity(path string, isFile bool, content string, hidden bool) error {
+	unlock := s.rlock()
+	defer unlock()
+
+	return s.fs.createEntityLocked(path, isFile, content, hidden)
+}
+
+func (s *Session) DeleteFile(path string) error {
+	unlock := s.rlock()
+	defer unlock()
+
+	return s.fs.deleteFileLocked(path)
+}
+
+func (s *Session) ChangeDirectory(path string) error {
+	unlock := s.lock()
+	defer unlock()
+
+	return s.fs.changeDirectoryLocked(path)
+}
+
+func (s *Session) GetCurrentDirectoryRecords(long bool) ([]string, error) {
+	unlock := s.lock()
+	defer unlock()
+
+	return s.fs.getCurrentDirectoryRecordsLocked(long)
+}
+
+func (s *Session) Find(path string, fileType uint8) ([]string, error) {
+	unlock := s.lock()
+	defer unlock()
+
+	return s.fs.findLocked(path, fileType)
+}
+
+func (s *Session) EditFile(path string, content string) error {
+	unlock := s.lock()
+	defer unlock()
+
+	return s.fs.editFileLocked(path, content)
+}
+
+func (s *Session) AppendToFile(path string, content string) error {
+	unlock := s.lock()
+	defer unlock()
+
+	return s.fs.appendToFileLocked(path, content)
+}
+
+func (s *Session) MoveFile(pathFrom string, pathTo string) error {
+	unlock := s.lock()
+	defer unlock()
+
+	return s.fs.moveFileLocked(pathFrom, pathTo)
+}
+
+func (s *Session) MoveFileNoReplace(pathFrom string, pathTo string) error {
+	unlock := s.lock()
+	defer unlock()
+
+	return s.fs.moveFileNoReplaceLocked(pathFrom, pathTo)
+}
+
+func (s *Session) CopyFile(pathFrom string, pathTo string, opts ...CopyOption) error {
+	unlock := s.lock()
+	defer unlock()
+
+	return s.fs.copyFileLocked(pathFrom, pathTo, opts...)
+}
+
+func (s *Session) ChangePermissions(path string, value int) error {
+	unlock := s.lock()
+	defer unlock()
+
+	return s.fs.changePermissionsLocked(path, value)
+}
+
+func (s *Session) ChangeMode(path string, mode string) error {
+	unlock := s.lock()
+	defer unlock()
+
+	return s.fs.changeModeLocked(path, mode)
+}
+
+func (s *Session) SetQuota(username string, blockSoft, blockHard, inodeSoft, inodeHard uint32) error {
+	unlock := s.lock()
+	defer unlock()
+
+	return s.fs.setQuotaLocked(username, blockSoft, blockHard, inodeSoft, inodeHard)
+}
+
+func (s *Session) GetQuotaReport(username string) (string, error) {
+	unlock := s.lock()
+	defer unlock()
+
+	return s.fs.getQuotaReportLocked(username)
+}
+
+func (s *Session) GetQuotaReports() ([]string, error) {
+	unlock := s.lock()
+	defer unlock()
+
+	return s.fs.getQuotaReportsLocked()
+}
+
+func (s *Session) GetCurrentPath() string {
+	unlock := s.lock()
+	defer unlock()
+
+	return s.fs.getCurrentPathLocked()
+}
+
+func (s *Session) GetCurrentUserName() string {
+	unlock := s.lock()
+	defer unlock()
+
+	return s.fs.getCurrentUserNameLocked()
+}
+
+func (s *Session) Mount(device blockdevice.BlockDevice, path string, opts ...Option) error {
+	unlock := s.lock()
+	defer unlock()
+
+	return s.fs.mountLocked(device, path, opts...)
+}
+
+func (s *Session) Unmount(path string) error {
+	unlock := s.lock()
+	defer unlock()
+
+	return s.fs.unmountLocked(path)
+}
@@ -0,0 +1,216 @@
+package filesystem
+
+import (
+	"bytes"
+	"file-system/internal/filesystem/inode"
+	"file-system/internal/utils"
+	iofs "io/fs"
+	pathpkg "path"
+	"sort"
+	"time"
+)
+
+// FileInfo describes an entry of the image. It implements fs.FileInfo.
+type FileInfo struct {
+	name       string
+	size       int64
+	mode       iofs.FileMode
+	modTime    time.Time
+	inodeIndex uint32
+	owner      string
+	group      string
+}
+
+func (fi *FileInfo) Name() string        { return fi.name }
+func (fi *FileInfo) Size() int64         { return fi.size }
+func (fi *FileInfo) Mode() iofs.FileMode { return fi.mode }
+func (fi *FileInfo) ModTime() time.Time  { return fi.modTime }
+func (fi *FileInfo) IsDir() bool         { return fi.mode.IsDir() }
+func (fi *FileInfo) Sys() any            { return nil }
+func (fi *FileInfo) Inode() uint32       { return fi.inodeIndex }
+func (fi *FileInfo) Owner() string       { return fi.owner }
+func (fi *FileInfo) Group() string       { return fi.group }
+
+// Stat describes the entry at path. The size of a regular file is that of
+// its content in bytes, the one of a directory that of its blocks.
+func (fs *FileSystem) Stat(path string) (*FileInfo, error) {
+	return fs.session.Stat(path)
+}
+
+// ReadDirectory describes the visible entries of the directory at path,
+// sorted by name and without "." and "..".
+func (fs *FileSystem) ReadDirectory(path string) ([]*FileInfo, error) {
+	return fs.session.ReadDirectory(path)
+}
+
+func (fs *FileSystem) statInfoLocked(path string) (*FileInfo, error) {
+	name := pathpkg.Base(utils.AbsolutePath(fs.getCurrentPathLocked(), fs.normalizePath(path)))
+
+	var info *FileInfo
+	var err error
+	target, innerPath := fs.resolveMount(path)
+	switch absolutePath, isProc := fs.procPath(path); {
+	case target != nil:
+		info, err = target.Stat(innerPath)
+	case isProc:
+		info, err = fs.statProc(absolutePath)
+	case fs.lower != nil && fs.layerOf(fs.overlayPath(path)) == layerLower:
+		info, err = fs.lower.Stat(fs.overlayPath(path))
+	default:
+		var nd *nameidata
+		if nd, err = fs.lookup(path); err == nil {
+			info, err = fs.fileInfo(nd.entryIndex, nd.entry)
+		}
+	}
+	if err != nil {
+		return nil, err
+	}
+
+	info.name = name
+	return info, nil
+}
+
+func (fs *FileSystem) readDirectoryLocked(path string) ([]*FileInfo, error) {
+	target, innerPath := fs.resolveMount(path)
+	if target != nil {
+		return target.ReadDirectory(innerPath)
+	}
+	if fs.lower != nil && fs.layerOf(fs.overlayPath(path)) == layerLower {
+		return fs.lower.ReadDirectory(fs.overlayPath(path))
+	}
+
+	names, err := fs.listDirectory(path, false)
+	if err != nil {
+		return nil, err
+	}
+
+	result := make([]*FileInfo, 0, len(names))
+	for _, name := range names {
+		if name == "." || name == ".." {
+			continue
+		}
+		info, err := fs.statInfoLocked(pathpkg.Join(path, name))
+		if err != nil {
+			return nil, err
+		}
+		result = append(result, info)
+	}
+	sort.Slice(result, func(i, j int) bool {
+		return result[i].name < result[j].name
+	})
+	return result, nil
+}
+
+func (fs *FileSystem) fileInfo(inodeIndex uint32, fileInode *inode.Inode) (*FileInfo, error) {
+	info := &FileInfo{
+		mode:       fileMode(fileInode),
+		modTime:    time.Unix(int64(fileInode.ModificationTime), 0),
+		inodeIndex: inodeIndex,
+		owner:      fs.userManager.GetUsername(fileInode.UserId),
+		group:      fs.groupManager.GetGroupName(fileInode.GroupId),
+	}
+
+	switch {
+	case fileInode.IsDevice():
+	case fileInode.IsFile():
+		size, err := fs.contentSize(inodeIndex, fileInode)
+		if err != nil {
+			return nil, err
+		}
+		info.size = size
+	default:
+		info.size = int64(fileInode.FileSize) * int64(fs.superblock.BlockSize)
+	}
+	return info, nil
+}
+
+// contentSize returns the length of the content of a regular file, which
+// ends at the first zero byte of its last block.
+func (fs *FileSystem) contentSize(inodeIndex uint32, fileInode *inode.Inode) (int64, error) {
+	if fileInode.FileSize == 0 {
+		return 0, nil
+	}
+
+	unlock := fs.inodeLocks.rlock(inodeIndex)
+	defer unlock()
+
+	blockIndices, err := fs.blockManager.GetBlockIndices(fileInode)
+	if err != nil {
+		return 0, err
+	}
+	data, err := fs.blockManager.ReadBlock(blockIndices[len(blockIndices)-1])
+	if err != nil {
+		return 0, err
+	}
+
+	end := len(data)
+	if contentEnd := bytes.IndexByte(data, 0); contentEnd != -1 {
+		end = contentEnd
+	}
+	return int64(fileInode.FileSize-1)*int64(fs.superblock.BlockSize) + int64(end), nil
+}
+
+func fileMode(fileInode *inode.Inode) iofs.FileMode {
+	permissions := fileInode.GetPermissions()
+	mode := iofs.FileMode(permissions & 0o777)
+	if permissions&inode.SetUserIdBit != 0 {
+		mode |= iofs.ModeSetuid
+	}
+	if permissions&inode.SetGroupIdBit != 0 {
+		mode |= iofs.ModeSetgid
+	}
+	if permissions&inode.StickyBit != 0 {
+		mode |= iofs.ModeSticky
+	}
+
+	switch {
+	case fileInode.IsDevice():
+		mode |= iofs.ModeDevice | iofs.ModeCharDevice
+	case !fileInode.IsFile():
+		mode |= iofs.ModeDir
+	}
+	return mode
+}
+
+// statProc describes a /proc entry, whose files are read to learn their
+// size. All entries carry the time of the mount point.
+func (fs *FileSystem) statProc(absolutePath string) (*FileInfo, error) {
+	entry, err := fs.lookupProc(absolutePath)
+	if err != nil {
+		return nil, err
+	}
+	nd, err := fs.lookup(procRoot)
+	if err != nil {
+		return nil, err
+	}
+
+	info := &FileInfo{
+		mode:    iofs.ModeDir | 0o555,
+		modTime: time.Unix(int64(nd.entry.ModificationTime), 0),
+		owner:   FSConfig.RootUsername,
+		group:   FSConfig.RootUsername,
+	}
+	if entry.read != nil {
+		content, err := entry.read(fs)
+		if err != nil {
+			return nil, err
+		}
+		info.mode = 0o444
+		info.size = int64(len(content))
+	}
+	return info, nil
+}
+
+func (s *Session) Stat(path string) (*FileInfo, error) {
+	unlock := s.lock()
+	defer unlock()
+
+	return s.fs.statInfoLocked(path)
+}
+
+func (s *Session) ReadDirectory(path string) ([]*FileInfo, error) {
+	unlock := s.lock()
+	defer unlock()
+
+	return s.fs.readDirectoryLocked(path)
+}
@@ -2,11 +2,17 @@ package superblock
 
 import (
 	"encoding/binary"
+	"file-system/internal/filesystem/blockdevice"
 	"file-system/internal/filesystem/inode"
-	"os"
 	"unsafe"
 )
 
+// Feature flags chosen at format time
+const (
+	FlagNormalizeNames       = 1 << 0
+	FlagCaseInsensitiveNames = 1 << 1
+)
+
 type Superblock struct {
 	MagicNumber    uint16
 	BlockCount     uint32
@@ -15,7 +21,8 @@ type Superblock struct {
 	FreeInodeCount uint32
 	BlockSize      uint32
 	InodeSize      uint32
-	file           *os.File
+	Flags          uint16
+	file           blockdevice.BlockDevice
 }
 
 func (s Superblock) Size() uint32 {
@@ -26,11 +33,12 @@ func (s Superblock) Size() uint32 {
 			unsafe.Sizeof(s.FreeBlockCount) +
 			unsafe.Sizeof(s.FreeInodeCount) +
 			unsafe.Sizeof(s.BlockSize) +
-			unsafe.Sizeof(s.InodeSize),
+			unsafe.Sizeof(s.InodeSize) +
+			unsafe.Sizeof(s.Flags),
 	)
 }
 
-func NewSuperblock(filesystemSizeInBytes, blockSize uint32, file *os.File) *Superblock {
+func NewSuperblock(filesystemSizeInBytes, blockSize uint32, file blockdevice.BlockDevice) *Superblock {
 	s := Superblock{}
 
 	blockCount := filesystemSizeInBytes / blockSize
@@ -47,7 +55,7 @@ func NewSuperblock(filesystemSizeInBytes, blockSize uint32, file *os.File) *Supe
 	return &s
 }
 
-func ReadSuperblockAt(file *os.File, offset uint32) (*Superblock, error) {
+func ReadSuperblockAt(file blockdevice.BlockDevice, offset uint32) (*Superblock, error) {
 	data := make([]byte, Superblock{}.Size())
 
 	_, err := file.ReadAt(data, int64(offset))
@@ -71,6 +79,7 @@ func decodeSuperblock(data []byte) *Superblock {
 	s.FreeInodeCount = binary.BigEndian.Uint32(data[14:18])
 	s.BlockSize = binary.BigEndian.Uint32(data[18:22])
 	s.InodeSize = binary.BigEndian.Uint32(data[22:26])
+	s.Flags = binary.BigEndian.Uint16(data[26:28])
 
 	return &s
 }
@@ -79,7 +88,7 @@ func (s Superblock) Save() error {
 	return s.writeAt(s.file, 0)
 }
 
-func (s Superblock) writeAt(file *os.File, offset uint32) error {
+func (s Superblock) writeAt(file blockdevice.BlockDevice, offset uint32) error {
 	data := encodeSuperblock(s)
 
 	_, err := file.WriteAt(data, int64(offset))
@@ -101,6 +110,11 @@ func encodeSuperblock(value Superblock) []byte {
 	binary.BigEndian.PutUint32(data[14:18], value.FreeInodeCount)
 	binary.BigEndian.PutUint32(data[18:22], value.BlockSize)
 	binary.BigEndian.PutUint32(data[22:26], value.InodeSize)
+	binary.BigEndian.PutUint16(data[26:28], value.Flags)
 
 	return data
 }
+
+func (s *Superblock) HasFlag(flag uint16) bool {
+	return s.Flags&flag != 0
+}
@@ -12,18 +12,30 @@ import (
 type User struct {
 	Username     string
 	UserId       uint16
+	GroupId      uint16
 	PasswordHash string
+
+	// Groups holds supplementary group IDs. It is not stored in the user
+	// record and is filled from the groups database on login.
+	Groups []uint16
 }
 
-func NewUser(username string, userId uint16, password string) *User {
+func NewUser(username string, userId uint16, groupId uint16, password string) *User {
 	return &User{
 		Username:     username,
 		UserId:       userId,
+		GroupId:      groupId,
 		PasswordHash: hashPassword(password),
 	}
 }
 
 func ReadUserFromString(str, password string) (*User, error) {
+	return ReadUserFromPasswordHash(str, hashPassword(password))
+}
+
+// ReadUserFromPasswordHash parses the user record and checks it against a
+// password hash instead of the password itself.
+func ReadUserFromPasswordHash(str, passwordHash string) (*User, error) {
 	parts := strings.Fields(str)
 
 	if len(parts) < 3 {
@@ -41,8 +53,16 @@ func ReadUserFromString(str, password string) (*User, error) {
 		PasswordHash: parts[2],
 	}
 
-	if hashPassword(password) != u.PasswordHash {
-		return nil, fmt.Errorf("%w - %s", errs.ErrIncorrectPassword, password)
+	if len(parts) > 3 {
+		groupId, err := strconv.ParseUint(parts[3], 10, 16)
+		if err != nil {
+			return nil, fmt.Errorf("error parsing GroupId: %v", err)
+		}
+		u.GroupId = uint16(groupId)
+	}
+
+	if passwordHash != u.PasswordHash {
+		return nil, fmt.Errorf("%w - %s", errs.ErrIncorrectPassword, u.Username)
 	}
 
 	return u, nil
@@ -63,8 +83,38 @@ func GetUserIdFromString(str string) (uint16, error) {
 	return uint16(userId), nil
 }
 
+func GetGroupIdFromString(str string) (uint16, error) {
+	parts := strings.Fields(str)
+
+	if len(parts) < 3 {
+		return 0, fmt.Errorf("invalid input format")
+	}
+	if len(parts) == 3 {
+		return 0, nil
+	}
+
+	groupId, err := strconv.ParseUint(parts[3], 10, 16)
+	if err != nil {
+		return 0, fmt.Errorf("error parsing GroupId: %v", err)
+	}
+
+	return uint16(groupId), nil
+}
+
 func (u User) GetUserString() string {
-	return fmt.Sprintf("%s %d %s", u.Username, u.UserId, u.PasswordHash)
+	return fmt.Sprintf("%s %d %s %d", u.Username, u.UserId, u.PasswordHash, u.GroupId)
+}
+
+func (u User) IsMemberOf(groupId uint16) bool {
+	if u.GroupId == groupId {
+		return true
+	}
+	for _, id := range u.Groups {
+		if id == groupId {
+			return true
+		}
+	}
+	return false
 }
 
 func hashPassword(password string) string {
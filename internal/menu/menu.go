@@ -2,18 +2,35 @@ package menu
 
 import (
 	"bufio"
+	"context"
 	"errors"
 	"file-system/internal/errs"
 	"file-system/internal/filesystem"
+	"file-system/internal/filesystem/blockdevice"
+	"file-system/internal/filesystem/directory/record"
+	"file-system/internal/ninep"
 	"fmt"
 	"log"
+	"net"
 	"os"
+	"os/signal"
 	"strconv"
 	"strings"
 )
 
+var findTypes = map[string]uint8{
+	"f": record.TypeRegular,
+	"d": record.TypeDirectory,
+	"c": record.TypeCharDevice,
+	"l": record.TypeSymlink,
+}
+
+const quotaReportHeader = "Пользователь\tБлоки\tМягкий\tЖёсткий\tЛьгота\tИноды\tМягкий\tЖёсткий\tЛьгота"
+
 type Menu struct {
 	fileSystem *filesystem.FileSystem
+	// 9P servers started by "serve", stopped with the file system
+	servers []*ninep.Server
 }
 
 func NewMenu() Menu {
@@ -22,12 +39,12 @@ func NewMenu() Menu {
 
 func (m Menu) Start() {
 	var err error
-	m.fileSystem, err = filesystem.OpenFilesystem()
+	m.fileSystem, err = openFileSystem()
 	if err != nil {
 		fmt.Printf("Не удалось открыть файловую систему из файла %s\n", filesystem.FSConfig.FileName)
 		ans := getYesOrNo("Форматировать новую файловую систему (все данные будут потеряны)? (y/n): ")
 		if ans {
-			m.fileSystem, err = filesystem.FormatFilesystem(filesystem.FSConfig.FileSize, filesystem.FSConfig.BlockSize)
+			m.fileSystem, err = formatFileSystem()
 			if err != nil {
 				log.Fatal(err)
 			}
@@ -35,7 +52,10 @@ func (m Menu) Start() {
 			return
 		}
 	}
-	defer m.fileSystem.CloseDataFile()
+	defer func() {
+		m.stopServers()
+		m.fileSystem.CloseDataFile()
+	}()
 
 	for {
 		fmt.Printf("%s@filesystem:%s$ ", m.fileSystem.GetCurrentUserName(), m.fileSystem.GetCurrentPath())
@@ -58,7 +78,9 @@ func (m Menu) Start() {
 		} else if parts[0] == "format" {
 			ans := getYesOrNo("Вы уверены, что хотите форматировать файловую систему (все данные будут потеряны)? (y/n): ")
 			if ans {
-				m.fileSystem, err = filesystem.FormatFilesystem(filesystem.FSConfig.FileSize, filesystem.FSConfig.BlockSize)
+				m.stopServers()
+				m.fileSystem.CloseDataFile()
+				m.fileSystem, err = formatFileSystem()
 				if err != nil {
 					log.Fatal(err)
 				}
@@ -114,21 +136,51 @@ func (m *Menu) executeCommand(command string, args []string) error {
 		}
 		return m.fileSystem.AppendToFile(args[0], args[1])
 	case "move":
+		var flag string
+		if len(args) > 0 && (args[0] == "-n" || args[0] == "-f") {
+			flag, args = args[0], args[1:]
+		}
 		if len(args) < 2 {
 			return fmt.Errorf("%w - %s", errs.ErrMissingArguments, command)
 		}
 		if len(args) > 2 {
 			return fmt.Errorf("%w - %s", errs.ErrUnknownArguments, args[2:])
 		}
+		if flag == "-f" {
+			return m.fileSystem.MoveFile(args[0], args[1])
+		}
+		err := m.fileSystem.MoveFileNoReplace(args[0], args[1])
+		if !errors.Is(err, errs.ErrRecordAlreadyExists) {
+			return err
+		}
+		if flag == "-n" || !getYesOrNo(fmt.Sprintf("Заменить %s? (y/n): ", args[1])) {
+			return nil
+		}
 		return m.fileSystem.MoveFile(args[0], args[1])
 	case "copy":
+		var opts []filesystem.CopyOption
+		for len(args) > 0 && strings.HasPrefix(args[0], "-") {
+			switch args[0] {
+			case "-a":
+				opts = append(opts, filesystem.CopyArchive())
+			case "-n":
+				opts = append(opts, filesystem.CopyNoClobber())
+			case "-f":
+				opts = append(opts, filesystem.CopyOverwrite())
+			case "-u":
+				opts = append(opts, filesystem.CopyUpdate())
+			default:
+				return fmt.Errorf("%w - %s", errs.ErrUnknownArguments, args[0])
+			}
+			args = args[1:]
+		}
 		if len(args) < 2 {
 			return fmt.Errorf("%w - %s", errs.ErrMissingArguments, command)
 		}
 		if len(args) > 2 {
 			return fmt.Errorf("%w - %s", errs.ErrUnknownArguments, args[2:])
 		}
-		return m.fileSystem.CopyFile(args[0], args[1])
+		return m.fileSystem.CopyFile(args[0], args[1], opts...)
 	case "read":
 		if len(args) < 1 {
 			return fmt.Errorf("%w - %s", errs.ErrMissingArguments, command)
@@ -163,10 +215,39 @@ func (m *Menu) executeCommand(command string, args []string) error {
 				return fmt.Errorf("%w - %s", errs.ErrUnknownArguments, args)
 			}
 		}
-		for _, name := range m.fileSystem.GetCurrentDirectoryRecords(long) {
+		records, err := m.fileSystem.GetCurrentDirectoryRecords(long)
+		if err != nil {
+			return err
+		}
+		for _, name := range records {
 			fmt.Println(name)
 		}
 		return nil
+	case "find":
+		path := "."
+		fileType := record.TypeUnknown
+		for i := 0; i < len(args); i++ {
+			if args[i] != "-type" {
+				path = args[i]
+				continue
+			}
+			if i+1 >= len(args) {
+				return fmt.Errorf("%w - %s", errs.ErrMissingArguments, command)
+			}
+			var ok bool
+			if fileType, ok = findTypes[args[i+1]]; !ok {
+				return fmt.Errorf("%w - %s", errs.ErrUnknownArguments, args[i+1])
+			}
+			i++
+		}
+		paths, err := m.fileSystem.Find(path, fileType)
+		if err != nil {
+			return err
+		}
+		for _, p := range paths {
+			fmt.Println(p)
+		}
+		return nil
 	case "cd":
 		if len(args) < 1 {
 			return fmt.Errorf("%w - %s", errs.ErrMissingArguments, command)
@@ -212,18 +293,240 @@ func (m *Menu) executeCommand(command string, args []string) error {
 		}
 		return m.fileSystem.DeleteUser(args[0])
 	case "chmod":
+		if len(args) < 2 {
+			return fmt.Errorf("%w - %s", errs.ErrMissingArguments, command)
+		}
+		if len(args) > 2 {
+			return fmt.Errorf("%w - %s", errs.ErrUnknownArguments, args[2:])
+		}
+		return m.fileSystem.ChangeMode(args[0], args[1])
+	case "groupadd":
+		if len(args) < 1 {
+			return fmt.Errorf("%w - %s", errs.ErrMissingArguments, command)
+		}
+		if len(args) > 1 {
+			return fmt.Errorf("%w - %s", errs.ErrUnknownArguments, args[1:])
+		}
+		return m.fileSystem.AddGroup(args[0])
+	case "groupdel":
 		if len(args) < 1 {
 			return fmt.Errorf("%w - %s", errs.ErrMissingArguments, command)
 		}
+		if len(args) > 1 {
+			return fmt.Errorf("%w - %s", errs.ErrUnknownArguments, args[1:])
+		}
+		return m.fileSystem.DeleteGroup(args[0])
+	case "usermod":
+		if len(args) < 3 {
+			return fmt.Errorf("%w - %s", errs.ErrMissingArguments, command)
+		}
+		if len(args) > 3 {
+			return fmt.Errorf("%w - %s", errs.ErrUnknownArguments, args[3:])
+		}
+		if args[0] != "-aG" {
+			return fmt.Errorf("%w - %s", errs.ErrUnknownArguments, args[0])
+		}
+		for _, groupName := range strings.Split(args[1], ",") {
+			if err := m.fileSystem.AddUserToGroup(args[2], groupName); err != nil {
+				return err
+			}
+		}
+		return nil
+	case "chgrp":
+		if len(args) < 2 {
+			return fmt.Errorf("%w - %s", errs.ErrMissingArguments, command)
+		}
 		if len(args) > 2 {
+			return fmt.Errorf("%w - %s", errs.ErrUnknownArguments, args[2:])
+		}
+		return m.fileSystem.ChangeGroup(args[1], args[0])
+	case "groups":
+		if len(args) > 1 {
 			return fmt.Errorf("%w - %s", errs.ErrUnknownArguments, args[1:])
 		}
-		path := args[0]
-		permissions, err := strconv.Atoi(args[1])
+		username := m.fileSystem.GetCurrentUserName()
+		if len(args) > 0 {
+			username = args[0]
+		}
+		groups, err := m.fileSystem.GetUserGroups(username)
+		if err != nil {
+			return err
+		}
+		fmt.Println(strings.Join(groups, " "))
+		return nil
+	case "quota":
+		if len(args) > 1 {
+			return fmt.Errorf("%w - %s", errs.ErrUnknownArguments, args[1:])
+		}
+		username := m.fileSystem.GetCurrentUserName()
+		if len(args) > 0 {
+			username = args[0]
+		}
+		report, err := m.fileSystem.GetQuotaReport(username)
+		if err != nil {
+			return err
+		}
+		fmt.Println(quotaReportHeader)
+		fmt.Println(report)
+		return nil
+	case "setquota":
+		if len(args) < 5 {
+			return fmt.Errorf("%w - %s", errs.ErrMissingArguments, command)
+		}
+		if len(args) > 5 {
+			return fmt.Errorf("%w - %s", errs.ErrUnknownArguments, args[5:])
+		}
+		limits := make([]uint32, 4)
+		for i, arg := range args[1:] {
+			value, err := strconv.ParseUint(arg, 10, 32)
+			if err != nil {
+				return fmt.Errorf("%w - %s", errs.ErrIllegalArgument, arg)
+			}
+			limits[i] = uint32(value)
+		}
+		return m.fileSystem.SetQuota(args[0], limits[0], limits[1], limits[2], limits[3])
+	case "repquota":
+		if len(args) > 0 {
+			return fmt.Errorf("%w - %s", errs.ErrUnknownArguments, args)
+		}
+		reports, err := m.fileSystem.GetQuotaReports()
 		if err != nil {
 			return err
 		}
-		return m.fileSystem.ChangePermissions(path, permissions)
+		fmt.Println(quotaReportHeader)
+		for _, report := range reports {
+			fmt.Println(report)
+		}
+		return nil
+	case "defrag":
+		if len(args) > 1 {
+			return fmt.Errorf("%w - %s", errs.ErrUnknownArguments, args[1:])
+		}
+		path := "/"
+		if len(args) == 1 {
+			path = args[0]
+		}
+		ctx, stop := signal.NotifyContext(context.Background(), os.Interrupt)
+		defer stop()
+		report, err := m.fileSystem.Defragment(ctx, path)
+		if report != nil {
+			fmt.Printf("Файлов: %d, перемещено: %d, пропущено: %d\n", report.Files, report.Moved, report.Skipped)
+			fmt.Printf("Фрагментов файлов: %d -> %d\n", report.ExtentsBefore, report.ExtentsAfter)
+			fmt.Printf("Фрагментация свободного места: %.2f%% -> %.2f%%\n", report.FreeFragmentationBefore, report.FreeFragmentationAfter)
+		}
+		return err
+	case "mount":
+		if len(args) == 0 {
+			for _, mountPath := range m.fileSystem.Mounts() {
+				fmt.Println(mountPath)
+			}
+			return nil
+		}
+		if args[0] == "-t" {
+			return m.mountOverlay(args[1:])
+		}
+		if len(args) < 2 {
+			return fmt.Errorf("%w - %s", errs.ErrMissingArguments, command)
+		}
+		if len(args) > 2 {
+			return fmt.Errorf("%w - %s", errs.ErrUnknownArguments, args[2:])
+		}
+		device, err := blockdevice.OpenFile(args[0])
+		if err != nil {
+			return err
+		}
+		if err := m.fileSystem.Mount(device, args[1]); err != nil {
+			device.Close()
+			return err
+		}
+		return nil
+	case "umount":
+		if len(args) < 1 {
+			return fmt.Errorf("%w - %s", errs.ErrMissingArguments, command)
+		}
+		if len(args) > 1 {
+			return fmt.Errorf("%w - %s", errs.ErrUnknownArguments, args[1:])
+		}
+		return m.fileSystem.Unmount(args[0])
+	case "umask":
+		if len(args) > 1 {
+			return fmt.Errorf("%w - %s", errs.ErrUnknownArguments, args[1:])
+		}
+		session := m.fileSystem.DefaultSession()
+		if len(args) == 0 {
+			fmt.Printf("%04o\n", session.Umask())
+			return nil
+		}
+		mask, err := strconv.ParseUint(args[0], 8, 9)
+		if err != nil {
+			return fmt.Errorf("%w - %s", errs.ErrIllegalArgument, args[0])
+		}
+		session.SetUmask(uint16(mask))
+		return nil
+	case "env":
+		session := m.fileSystem.DefaultSession()
+		if len(args) == 0 {
+			for _, variable := range session.Environ() {
+				fmt.Println(variable)
+			}
+			return nil
+		}
+		for _, arg := range args {
+			name, value, ok := strings.Cut(arg, "=")
+			if !ok || name == "" {
+				return fmt.Errorf("%w - %s", errs.ErrIllegalArgument, arg)
+			}
+			session.Setenv(name, value)
+		}
+		return nil
+	case "sync":
+		if len(args) > 0 {
+			return fmt.Errorf("%w - %s", errs.ErrUnknownArguments, args)
+		}
+		return m.fileSystem.Sync()
+	case "freefrag":
+		if len(args) > 0 {
+			return fmt.Errorf("%w - %s", errs.ErrUnknownArguments, args)
+		}
+		printFreeExtents(m.fileSystem.GetSpaceReport())
+		return nil
+	case "dumpfs":
+		if len(args) > 0 {
+			return fmt.Errorf("%w - %s", errs.ErrUnknownArguments, args)
+		}
+		report := m.fileSystem.GetSpaceReport()
+		fmt.Printf("Размер блока:\t%d\n", report.BlockSize)
+		fmt.Printf("Блоков:\t%d\n", report.BlockCount)
+		fmt.Printf("Инодов:\t%d\n", report.InodeCount)
+		fmt.Println("Счётчик\tСуперблок\tБитовая карта")
+		printCounter("Свободных блоков", report.SuperblockFreeBlocks, report.FreeBlocks)
+		printCounter("Свободных инодов", report.SuperblockFreeInodes, report.FreeInodes)
+		fmt.Printf("Занято инодов:\t%.2f%%\n", report.InodeUsage())
+		fmt.Println("Блоки\tЗанято\tЗаполнение")
+		for _, region := range report.Regions {
+			fmt.Printf("%d-%d\t%d\t%.2f%%\n", region.Start, region.End-1, region.Used, region.Utilisation())
+		}
+		printFreeExtents(report)
+		return nil
+	case "serve":
+		if len(args) < 2 {
+			return fmt.Errorf("%w - %s", errs.ErrMissingArguments, command)
+		}
+		if len(args) > 2 {
+			return fmt.Errorf("%w - %s", errs.ErrUnknownArguments, args[2:])
+		}
+		if args[0] != "9p" {
+			return fmt.Errorf("%w - %s", errs.ErrUnknownArguments, args[0])
+		}
+		l, err := net.Listen("tcp", args[1])
+		if err != nil {
+			return err
+		}
+		server := ninep.NewServer(m.fileSystem)
+		m.servers = append(m.servers, server)
+		go server.Serve(l)
+		fmt.Printf("9P сервер слушает %s\n", l.Addr())
+		return nil
 	case "help":
 		fmt.Println()
 		fmt.Println("Список доступных команд:")
@@ -232,15 +535,34 @@ func (m *Menu) executeCommand(command string, args []string) error {
 		fmt.Println("create <filename> <content> - Создает новый файл с указанным именем и содержимым (опционально).")
 		fmt.Println("edit <filepath> <content> - Меняет содержимое файла по указанному пути на заданное.")
 		fmt.Println("append <filename> <content> - Добавляет содержимое в конец файла.")
-		fmt.Println("move <from> <to> - Перемещает файл или директорию.")
-		fmt.Println("copy <from> <to> - Копирует файл или директорию.")
+		fmt.Println("move <-n|-f> <from> <to> - Перемещает файл или директорию. Существующую запись спрашивает, заменять ли (-n - не заменять, -f - заменять без вопроса).")
+		fmt.Println("copy <-a|-n|-f|-u> <from> <to> - Копирует файл или директорию (-a - с правами, владельцем и временем, -n - не заменять существующие файлы, -f - заменять, -u - заменять более старые).")
 		fmt.Println("read <filepath> - Выводит содержимое указанного файла.")
 		fmt.Println("delete <filepath> - Удаляет указанный файл.")
 		fmt.Println("list <-l> - Выводит список файлов и директорий в текущей директории (-l - длинный формат).")
+		fmt.Println("find <path> <-type f|d|c|l> - Рекурсивно выводит пути записей в директории (по умолчанию текущей), опционально только указанного типа.")
 		fmt.Println("changeuser <username> <password> - Сменяет текущего пользователя на указанного.")
 		fmt.Println("adduser <username> <password> - Добавляет нового пользователя с указанным именем и паролем.")
 		fmt.Println("deleteuser <username> - Удаляет указанного пользователя (только для root).")
-		fmt.Println("chmod <path> <value> - Изменяет права доступа к указанному файлу в соответствии с указанным значением.")
+		fmt.Println("chmod <path> <value> - Изменяет права доступа к указанному файлу (восьмеричное значение, например 4755, или символьное, например u+s,g+s,+t).")
+		fmt.Println("groupadd <group> - Создает новую группу (только для root).")
+		fmt.Println("groupdel <group> - Удаляет указанную группу (только для root).")
+		fmt.Println("usermod -aG <group1,group2> <username> - Добавляет пользователя в указанные группы (только для root).")
+		fmt.Println("chgrp <group> <path> - Изменяет группу указанного файла или директории.")
+		fmt.Println("groups <username> - Выводит список групп пользователя (по умолчанию текущего).")
+		fmt.Println("quota <username> - Выводит использование дисковой квоты пользователя (по умолчанию текущего).")
+		fmt.Println("setquota <username> <block-soft> <block-hard> <inode-soft> <inode-hard> - Устанавливает квоту пользователя (только для root, 0 - без ограничения).")
+		fmt.Println("repquota - Выводит отчёт по квотам всех пользователей (только для root).")
+		fmt.Println("mount <image> <path> - Подключает образ из файла к указанной директории (только для root, без аргументов выводит точки подключения).")
+		fmt.Println("mount -t overlay <lower> <upper> <path> - Подключает образ upper поверх доступного только для чтения образа lower.")
+		fmt.Println("umount <path> - Отключает образ, подключённый к указанной директории.")
+		fmt.Println("umask <mask> - Задаёт маску прав для новых файлов и директорий (без аргументов выводит текущую).")
+		fmt.Println("env <name=value> - Задаёт переменные окружения сеанса (пустое значение удаляет переменную, без аргументов выводит все).")
+		fmt.Println("sync - Записывает изменения из буферного кэша в файл образа.")
+		fmt.Println("freefrag - Выводит гистограмму свободных участков и самый длинный из них.")
+		fmt.Println("dumpfs - Выводит счётчики суперблока рядом с пересчитанными по битовым картам, заполнение областей диска и гистограмму свободных участков.")
+		fmt.Println("serve 9p <address> - Запускает 9P2000 сервер на указанном адресе, например :5640 (клиенты входят с паролем пользователя).")
+		fmt.Println("defrag <path> - Переносит блоки файлов и директорий (по умолчанию всей системы) в непрерывные участки (только для root, Ctrl+C прерывает).")
 		fmt.Println()
 		return nil;
 	default:
@@ -300,6 +622,64 @@ func parseCommandLine(command string) []string {
 	return args
 }
 
+// stopServers stops accepting 9P connections.
+func (m *Menu) stopServers() {
+	for _, server := range m.servers {
+		server.Close()
+	}
+	m.servers = nil
+}
+
+// mountOverlay handles "mount -t overlay <lower> <upper> <path>".
+func (m *Menu) mountOverlay(args []string) error {
+	if len(args) < 4 {
+		return fmt.Errorf("%w - mount", errs.ErrMissingArguments)
+	}
+	if len(args) > 4 {
+		return fmt.Errorf("%w - %s", errs.ErrUnknownArguments, args[4:])
+	}
+	if args[0] != "overlay" {
+		return fmt.Errorf("%w - %s", errs.ErrUnknownArguments, args[0])
+	}
+
+	lowerDevice, err := blockdevice.OpenFile(args[1])
+	if err != nil {
+		return err
+	}
+	upperDevice, err := blockdevice.OpenFile(args[2])
+	if err != nil {
+		lowerDevice.Close()
+		return err
+	}
+	if err := m.fileSystem.Mount(upperDevice, args[3], filesystem.WithLowerLayer(lowerDevice)); err != nil {
+		upperDevice.Close()
+		lowerDevice.Close()
+		return err
+	}
+	return nil
+}
+
+func openFileSystem() (*filesystem.FileSystem, error) {
+	device, err := blockdevice.OpenFile(filesystem.FSConfig.FileName)
+	if err != nil {
+		return nil, err
+	}
+	fileSystem, err := filesystem.OpenFilesystem(device)
+	if err != nil {
+		device.Close()
+		return nil, err
+	}
+	return fileSystem, nil
+}
+
+func formatFileSystem() (*filesystem.FileSystem, error) {
+	device, err := blockdevice.CreateFile(filesystem.FSConfig.FileName)
+	if err != nil {
+		return nil, err
+	}
+	return filesystem.FormatFilesystem(device, filesystem.FSConfig.FileSize, filesystem.FSConfig.BlockSize)
+}
+
 func getYesOrNo(prompt string) bool {
 	reader := bufio.NewReader(os.Stdin)
 
@@ -317,3 +697,24 @@ func getYesOrNo(prompt string) bool {
 		fmt.Println("Некорректный ввод, попробуйте ещё раз.")
 	}
 }
+
+func printFreeExtents(report *filesystem.SpaceReport) {
+	fmt.Printf("Свободных участков:\t%d\n", report.FreeExtents)
+	fmt.Printf("Самый длинный участок:\t%d\n", report.LargestFreeExtent)
+	fmt.Println("Длина\tУчастков\tБлоков\tДоля")
+	for _, bucket := range report.Histogram {
+		var share float64
+		if report.FreeBlocks > 0 {
+			share = 100 * float64(bucket.Blocks) / float64(report.FreeBlocks)
+		}
+		fmt.Printf("%d-%d\t%d\t%d\t%.2f%%\n", bucket.Min, bucket.Max, bucket.Extents, bucket.Blocks, share)
+	}
+}
+
+func printCounter(name string, cached, counted uint32) {
+	line := fmt.Sprintf("%s\t%d\t%d", name, cached, counted)
+	if cached != counted {
+		line += "\tрасхождение"
+	}
+	fmt.Println(line)
+}
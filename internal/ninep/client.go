@@ -0,0 +1,230 @@
+package ninep
+
+import (
+	"errors"
+	"fmt"
+	"io"
+	"net"
+	"sync"
+)
+
+// Client talks 9P2000 to a server, one request at a time.
+type Client struct {
+	rw    io.ReadWriteCloser
+	msize uint32
+
+	mu      sync.Mutex
+	nextTag uint16
+	nextFid uint32
+}
+
+// Dial connects to the server at the TCP address.
+func Dial(addr string) (*Client, error) {
+	conn, err := net.Dial("tcp", addr)
+	if err != nil {
+		return nil, err
+	}
+	c, err := NewClient(conn)
+	if err != nil {
+		conn.Close()
+		return nil, err
+	}
+	return c, nil
+}
+
+// NewClient agrees on the version with the server at the other end of rw.
+func NewClient(rw io.ReadWriteCloser) (*Client, error) {
+	c := &Client{rw: rw, msize: DefaultMsize}
+	response, err := c.rpc(&Fcall{Type: Tversion, Tag: NOTAG, Msize: DefaultMsize, Version: Version})
+	if err != nil {
+		return nil, err
+	}
+	if response.Version != Version {
+		return nil, fmt.Errorf("server speaks %s", response.Version)
+	}
+	c.msize = response.Msize
+	return c, nil
+}
+
+func (c *Client) Close() error {
+	return c.rw.Close()
+}
+
+// Attach logs the user in with the password and returns the fid of aname,
+// the root of the served tree if empty.
+func (c *Client) Attach(uname, password, aname string) (uint32, error) {
+	afid := c.newFid()
+	if _, err := c.rpc(&Fcall{Type: Tauth, Afid: afid, Uname: uname, Aname: aname}); err != nil {
+		return 0, err
+	}
+	defer c.Clunk(afid)
+	if _, err := c.Write(afid, 0, []byte(password)); err != nil {
+		return 0, err
+	}
+
+	fid := c.newFid()
+	if _, err := c.rpc(&Fcall{Type: Tattach, Fid: fid, Afid: afid, Uname: uname, Aname: aname}); err != nil {
+		return 0, err
+	}
+	return fid, nil
+}
+
+// Walk returns a new fid for the file the names lead to from fid. A walk
+// stopping early fails with the name it stopped at.
+func (c *Client) Walk(fid uint32, names ...string) (uint32, error) {
+	if len(names) > MaxWalk {
+		return 0, fmt.Errorf("too many names in walk: %d", len(names))
+	}
+	newfid := c.newFid()
+	response, err := c.rpc(&Fcall{Type: Twalk, Fid: fid, Newfid: newfid, Wname: names})
+	if err != nil {
+		return 0, err
+	}
+	if len(response.Wqid) != len(names) {
+		return 0, fmt.Errorf("walk stopped at %s", names[len(response.Wqid)])
+	}
+	return newfid, nil
+}
+
+func (c *Client) Open(fid uint32, mode uint8) (Qid, error) {
+	response, err := c.rpc(&Fcall{Type: Topen, Fid: fid, Mode: mode})
+	if err != nil {
+		return Qid{}, err
+	}
+	return response.Qid, nil
+}
+
+// Create creates the file in the directory of fid, which then stands for
+// the new file opened with mode.
+func (c *Client) Create(fid uint32, name string, perm uint32, mode uint8) (Qid, error) {
+	response, err := c.rpc(&Fcall{Type: Tcreate, Fid: fid, Name: name, Perm: perm, Mode: mode})
+	if err != nil {
+		return Qid{}, err
+	}
+	return response.Qid, nil
+}
+
+// Read reads up to count bytes at offset. It returns no data at the end.
+func (c *Client) Read(fid uint32, offset uint64, count uint32) ([]byte, error) {
+	response, err := c.rpc(&Fcall{Type: Tread, Fid: fid, Offset: offset, Count: min(count, c.msize-IOHDRSZ)})
+	if err != nil {
+		return nil, err
+	}
+	return response.Data, nil
+}
+
+// ReadAll reads the whole file from the start.
+func (c *Client) ReadAll(fid uint32) ([]byte, error) {
+	var result []byte
+	for {
+		data, err := c.Read(fid, uint64(len(result)), c.msize-IOHDRSZ)
+		if err != nil {
+			return nil, err
+		}
+		if len(data) == 0 {
+			return result, nil
+		}
+		result = append(result, data...)
+	}
+}
+
+// ReadDir reads all entries of the open directory.
+func (c *Client) ReadDir(fid uint32) ([]*Dir, error) {
+	data, err := c.ReadAll(fid)
+	if err != nil {
+		return nil, err
+	}
+
+	var result []*Dir
+	for len(data) > 0 {
+		var dir *Dir
+		if dir, data, err = unmarshalDir(data); err != nil {
+			return nil, err
+		}
+		result = append(result, dir)
+	}
+	return result, nil
+}
+
+// Write writes data at offset in pieces fitting into messages.
+func (c *Client) Write(fid uint32, offset uint64, data []byte) (uint32, error) {
+	var written uint32
+	for {
+		piece := data[written:min(len(data), int(written+c.msize-IOHDRSZ))]
+		response, err := c.rpc(&Fcall{Type: Twrite, Fid: fid, Offset: offset + uint64(written), Data: piece})
+		if err != nil {
+			return written, err
+		}
+		written += response.Count
+		if int(written) >= len(data) || response.Count == 0 {
+			return written, nil
+		}
+	}
+}
+
+func (c *Client) Clunk(fid uint32) error {
+	_, err := c.rpc(&Fcall{Type: Tclunk, Fid: fid})
+	return err
+}
+
+// Remove removes the file of fid, which is clunked even if that fails.
+func (c *Client) Remove(fid uint32) error {
+	_, err := c.rpc(&Fcall{Type: Tremove, Fid: fid})
+	return err
+}
+
+func (c *Client) Stat(fid uint32) (*Dir, error) {
+	response, err := c.rpc(&Fcall{Type: Tstat, Fid: fid})
+	if err != nil {
+		return nil, err
+	}
+	dir, _, err := unmarshalDir(response.Stat)
+	return dir, err
+}
+
+// Wstat changes the fields of dir that are not left untouched, see
+// NullDir.
+func (c *Client) Wstat(fid uint32, dir *Dir) error {
+	_, err := c.rpc(&Fcall{Type: Twstat, Fid: fid, Stat: dir.marshal()})
+	return err
+}
+
+func (c *Client) newFid() uint32 {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	c.nextFid++
+	return c.nextFid
+}
+
+// rpc sends the request and waits for its response. An Rerror becomes an
+// Error.
+func (c *Client) rpc(request *Fcall) (*Fcall, error) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+
+	if request.Type != Tversion {
+		c.nextTag++
+		if c.nextTag == NOTAG {
+			c.nextTag = 0
+		}
+		request.Tag = c.nextTag
+	}
+	if _, err := c.rw.Write(request.marshal()); err != nil {
+		return nil, err
+	}
+
+	response, err := readMessage(c.rw, c.msize)
+	if err != nil {
+		return nil, err
+	}
+	if response.Tag != request.Tag {
+		return nil, fmt.Errorf("response tag %d for request tag %d", response.Tag, request.Tag)
+	}
+	if response.Type == Rerror {
+		return nil, Error(response.Ename)
+	}
+	if response.Type != request.Type+1 {
+		return nil, errors.New("unexpected 9P response type")
+	}
+	return response, nil
+}
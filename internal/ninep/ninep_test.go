@@ -0,0 +1,261 @@
+package ninep
+
+import (
+	"file-system/internal/filesystem"
+	"file-system/internal/filesystem/blockdevice"
+	"file-system/internal/filesystem/user"
+	"net"
+	"testing"
+)
+
+func setupServer(t *testing.T) (*filesystem.FileSystem, func() *Client) {
+	fs, err := filesystem.FormatFilesystem(blockdevice.NewMemory(nil), filesystem.FSConfig.FileSize, filesystem.FSConfig.BlockSize)
+	if err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(func() { fs.CloseDataFile() })
+	server := NewServer(fs)
+
+	dial := func() *Client {
+		clientEnd, serverEnd := net.Pipe()
+		go server.ServeConn(serverEnd)
+		client, err := NewClient(clientEnd)
+		if err != nil {
+			t.Fatal(err)
+		}
+		t.Cleanup(func() { client.Close() })
+		return client
+	}
+	return fs, dial
+}
+
+func TestAttach(t *testing.T) {
+	fs, dial := setupServer(t)
+	fs.AddUser("user", "password")
+	client := dial()
+
+	if _, err := client.Attach("user", "wrong", ""); err == nil {
+		t.Error("attach with a wrong password succeeded")
+	}
+	if _, err := client.Attach("nobody", "password", ""); err == nil {
+		t.Error("attach of an unknown user succeeded")
+	}
+
+	root, err := client.Attach("user", "password", "")
+	if err != nil {
+		t.Fatalf("attach failed: %v", err)
+	}
+	dir, err := client.Stat(root)
+	if err != nil {
+		t.Fatalf("stat of the root failed: %v", err)
+	}
+	if dir.Qid.Type != QTDIR || dir.Mode&DMDIR == 0 || dir.Name != "/" {
+		t.Errorf("unexpected root %+v", dir)
+	}
+
+	// A user name is no path to a record planted elsewhere
+	fake := user.NewUser(filesystem.FSConfig.RootUsername, 0, 0, "x")
+	fs.CreateFileWithContent("/user/fake", fake.GetUserString())
+	if _, err := client.Attach("../user/fake", "x", ""); err == nil {
+		t.Error("attach with a path as user name succeeded")
+	}
+
+	// A tree may be attached below the root
+	fs.CreateDirectory("/export")
+	root, err = client.Attach("user", "password", "export")
+	if err != nil {
+		t.Fatalf("attach of a subtree failed: %v", err)
+	}
+	parent, err := client.Walk(root, "..")
+	if err != nil {
+		t.Fatalf("walk to .. failed: %v", err)
+	}
+	dir, _ = client.Stat(parent)
+	if dir.Name != "export" {
+		t.Errorf("walk to .. left the attached tree: %s", dir.Name)
+	}
+}
+
+func TestFiles(t *testing.T) {
+	fs, dial := setupServer(t)
+	client := dial()
+	root, err := client.Attach(filesystem.FSConfig.RootUsername, filesystem.FSConfig.RootPassword, "")
+	if err != nil {
+		t.Fatalf("attach failed: %v", err)
+	}
+
+	directory, _ := client.Walk(root)
+	if _, err := client.Create(directory, "dir", DMDIR|0o755, OREAD); err != nil {
+		t.Fatalf("create of a directory failed: %v", err)
+	}
+	client.Clunk(directory)
+	file, _ := client.Walk(root, "dir")
+	if _, err := client.Create(file, "file", 0o644, ORDWR); err != nil {
+		t.Fatalf("create of a file failed: %v", err)
+	}
+
+	// Writes larger than a message are split
+	content := make([]byte, DefaultMsize*2)
+	for i := range content {
+		content[i] = 'a' + byte(i%26)
+	}
+	if n, err := client.Write(file, 0, content); err != nil || int(n) != len(content) {
+		t.Fatalf("write failed: %d, %v", n, err)
+	}
+	if data, err := client.ReadAll(file); err != nil || string(data) != string(content) {
+		t.Errorf("read back %d bytes, %v", len(data), err)
+	}
+	client.Clunk(file)
+	if data, _ := fs.ReadFile("/dir/file"); data != string(content) {
+		t.Errorf("file system holds %d bytes", len(data))
+	}
+
+	listing, _ := client.Walk(root, "dir")
+	client.Open(listing, OREAD)
+	entries, err := client.ReadDir(listing)
+	if err != nil || len(entries) != 1 || entries[0].Name != "file" || entries[0].Length != uint64(len(content)) {
+		t.Errorf("unexpected entries %+v, %v", entries, err)
+	}
+	client.Clunk(listing)
+
+	// Renaming and truncating through wstat
+	file, err = client.Walk(root, "dir", "file")
+	if err != nil {
+		t.Fatalf("walk failed: %v", err)
+	}
+	change := NullDir()
+	change.Name = "renamed"
+	change.Length = 3
+	if err := client.Wstat(file, change); err != nil {
+		t.Fatalf("wstat failed: %v", err)
+	}
+	if data, err := fs.ReadFile("/dir/renamed"); err != nil || data != "abc" {
+		t.Errorf("renamed file holds %q, %v", data, err)
+	}
+	if dir, _ := client.Stat(file); dir.Name != "renamed" || dir.Length != 3 {
+		t.Errorf("unexpected stat after wstat %+v", dir)
+	}
+
+	if _, err := client.Walk(root, "dir", "missing"); err == nil {
+		t.Error("walk to a missing file succeeded")
+	}
+
+	directory, _ = client.Walk(root, "dir")
+	if err := client.Remove(directory); err == nil {
+		t.Error("remove of a non-empty directory succeeded")
+	}
+	if err := client.Remove(file); err != nil {
+		t.Fatalf("remove of a file failed: %v", err)
+	}
+	directory, _ = client.Walk(root, "dir")
+	if err := client.Remove(directory); err != nil {
+		t.Fatalf("remove of an empty directory failed: %v", err)
+	}
+	if _, err := fs.Stat("/dir"); err == nil {
+		t.Error("removed directory still exists")
+	}
+}
+
+func TestPermissions(t *testing.T) {
+	fs, dial := setupServer(t)
+	fs.AddUser("user", "password")
+	fs.CreateFileWithContent("/secret", "secret")
+	fs.ChangeMode("/secret", "600")
+
+	client := dial()
+	root, err := client.Attach("user", "password", "")
+	if err != nil {
+		t.Fatalf("attach failed: %v", err)
+	}
+
+	file, _ := client.Walk(root, "secret")
+	if _, err := client.Open(file, OREAD); err == nil {
+		t.Error("user opened a file of root only")
+	}
+	if err := client.Remove(file); err == nil {
+		t.Error("user removed a file of root")
+	}
+
+	directory, _ := client.Walk(root)
+	if _, err := client.Create(directory, "file", 0o644, OWRITE); err == nil {
+		t.Error("user created a file in the directory of root")
+	}
+
+	// The sessions of connections are independent of each other
+	rootClient := dial()
+	rootFid, err := rootClient.Attach(filesystem.FSConfig.RootUsername, filesystem.FSConfig.RootPassword, "")
+	if err != nil {
+		t.Fatalf("attach of root failed: %v", err)
+	}
+	file, _ = rootClient.Walk(rootFid, "secret")
+	if _, err := rootClient.Open(file, OREAD); err != nil {
+		t.Errorf("root failed to open the file: %v", err)
+	}
+	if data, _ := rootClient.ReadAll(file); string(data) != "secret" {
+		t.Errorf("root read %q", data)
+	}
+}
+
+func TestHangUp(t *testing.T) {
+	fs, _ := setupServer(t)
+	fs.CreateFileWithContent("/file", "content")
+	server := NewServer(fs)
+
+	clientEnd, serverEnd := net.Pipe()
+	served := make(chan error)
+	go func() { served <- server.ServeConn(serverEnd) }()
+	client, err := NewClient(clientEnd)
+	if err != nil {
+		t.Fatal(err)
+	}
+	root, err := client.Attach(filesystem.FSConfig.RootUsername, filesystem.FSConfig.RootPassword, "")
+	if err != nil {
+		t.Fatalf("attach failed: %v", err)
+	}
+	file, _ := client.Walk(root, "file")
+	if _, err := client.Open(file, OREAD); err != nil {
+		t.Fatalf("open failed: %v", err)
+	}
+	if err := fs.DeleteFile("/file"); err == nil {
+		t.Fatal("removed a file open through 9P")
+	}
+
+	// The files of a client that hangs up without clunking are closed
+	client.Close()
+	<-served
+	if err := fs.DeleteFile("/file"); err != nil {
+		t.Errorf("file still open after the client hung up: %v", err)
+	}
+}
+
+func TestDevices(t *testing.T) {
+	_, dial := setupServer(t)
+	client := dial()
+	root, err := client.Attach(filesystem.FSConfig.RootUsername, filesystem.FSConfig.RootPassword, "")
+	if err != nil {
+		t.Fatalf("attach failed: %v", err)
+	}
+
+	null, _ := client.Walk(root, "dev", "null")
+	if _, err := client.Open(null, ORDWR); err != nil {
+		t.Fatalf("open of /dev/null failed: %v", err)
+	}
+	if n, err := client.Write(null, 0, []byte("discarded")); err != nil || n != 9 {
+		t.Errorf("write to /dev/null: %d, %v", n, err)
+	}
+	if data, err := client.ReadAll(null); err != nil || len(data) != 0 {
+		t.Errorf("read of /dev/null: %q, %v", data, err)
+	}
+
+	zero, _ := client.Walk(root, "dev", "zero")
+	client.Open(zero, OREAD)
+	if data, err := client.Read(zero, 0, 4); err != nil || string(data) != "\x00\x00\x00\x00" {
+		t.Errorf("read of /dev/zero: %q, %v", data, err)
+	}
+
+	full, _ := client.Walk(root, "dev", "full")
+	client.Open(full, OWRITE)
+	if _, err := client.Write(full, 0, []byte("data")); err == nil {
+		t.Error("write to /dev/full succeeded")
+	}
+}
@@ -0,0 +1,443 @@
+// Package ninep serves a file system over the 9P2000 protocol and holds a
+// small client for it.
+package ninep
+
+import (
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"io"
+)
+
+// Version is the protocol version spoken by the server and the client.
+const Version = "9P2000"
+
+// Message types
+const (
+	Tversion uint8 = 100 + iota
+	Rversion
+	Tauth
+	Rauth
+	Tattach
+	Rattach
+	Terror // never sent
+	Rerror
+	Tflush
+	Rflush
+	Twalk
+	Rwalk
+	Topen
+	Ropen
+	Tcreate
+	Rcreate
+	Tread
+	Rread
+	Twrite
+	Rwrite
+	Tclunk
+	Rclunk
+	Tremove
+	Rremove
+	Tstat
+	Rstat
+	Twstat
+	Rwstat
+)
+
+// Open modes
+const (
+	OREAD   uint8 = 0
+	OWRITE  uint8 = 1
+	ORDWR   uint8 = 2
+	OEXEC   uint8 = 3
+	OTRUNC  uint8 = 0x10
+	ORCLOSE uint8 = 0x40
+)
+
+// Qid types and the directory bit of the mode in Dir
+const (
+	QTDIR  uint8  = 0x80
+	QTAUTH uint8  = 0x08
+	QTFILE uint8  = 0x00
+	DMDIR  uint32 = 0x80000000
+)
+
+const (
+	NOTAG uint16 = 0xFFFF
+	NOFID uint32 = 0xFFFFFFFF
+	// IOHDRSZ is the room taken by the header of Rread and Twrite
+	IOHDRSZ = 24
+	// MaxWalk is the most names a single Twalk may carry
+	MaxWalk = 16
+	// DefaultMsize is the largest message the server and the client offer
+	DefaultMsize = 8192 + IOHDRSZ
+)
+
+var errShortMessage = errors.New("short 9P message")
+
+// Qid identifies a file on the server.
+type Qid struct {
+	Type    uint8
+	Version uint32
+	Path    uint64
+}
+
+// Error is an Rerror returned by the server.
+type Error string
+
+func (e Error) Error() string {
+	return string(e)
+}
+
+// Fcall is a 9P message. Only the fields of its type are used.
+type Fcall struct {
+	Type    uint8
+	Tag     uint16
+	Fid     uint32
+	Afid    uint32
+	Newfid  uint32
+	Msize   uint32
+	Version string
+	Oldtag  uint16
+	Ename   string
+	Uname   string
+	Aname   string
+	Qid     Qid
+	Iounit  uint32
+	Wname   []string
+	Wqid    []Qid
+	Mode    uint8
+	Perm    uint32
+	Name    string
+	Offset  uint64
+	Count   uint32
+	Data    []byte
+	Stat    []byte
+}
+
+// Dir is the stat structure of a file. Wstat leaves fields holding their
+// "don't touch" value, see NullDir, unchanged.
+type Dir struct {
+	Type   uint16
+	Dev    uint32
+	Qid    Qid
+	Mode   uint32
+	Atime  uint32
+	Mtime  uint32
+	Length uint64
+	Name   string
+	Uid    string
+	Gid    string
+	Muid   string
+}
+
+// NullDir returns a Dir changing nothing in Wstat.
+func NullDir() *Dir {
+	return &Dir{
+		Type:   ^uint16(0),
+		Dev:    ^uint32(0),
+		Qid:    Qid{Type: ^uint8(0), Version: ^uint32(0), Path: ^uint64(0)},
+		Mode:   ^uint32(0),
+		Atime:  ^uint32(0),
+		Mtime:  ^uint32(0),
+		Length: ^uint64(0),
+	}
+}
+
+type encoder struct {
+	buf []byte
+}
+
+func (e *encoder) u8(v uint8) {
+	e.buf = append(e.buf, v)
+}
+
+func (e *encoder) u16(v uint16) {
+	e.buf = binary.LittleEndian.AppendUint16(e.buf, v)
+}
+
+func (e *encoder) u32(v uint32) {
+	e.buf = binary.LittleEndian.AppendUint32(e.buf, v)
+}
+
+func (e *encoder) u64(v uint64) {
+	e.buf = binary.LittleEndian.AppendUint64(e.buf, v)
+}
+
+func (e *encoder) str(s string) {
+	e.u16(uint16(len(s)))
+	e.buf = append(e.buf, s...)
+}
+
+func (e *encoder) qid(q Qid) {
+	e.u8(q.Type)
+	e.u32(q.Version)
+	e.u64(q.Path)
+}
+
+type decoder struct {
+	buf []byte
+	err error
+}
+
+// take returns the next n bytes. Past the end it records the error and
+// returns zeros enough for the fixed-size fields.
+func (d *decoder) take(n int) []byte {
+	if d.err != nil || len(d.buf) < n {
+		d.err = errShortMessage
+		return make([]byte, min(n, 8))
+	}
+	result := d.buf[:n]
+	d.buf = d.buf[n:]
+	return result
+}
+
+func (d *decoder) u8() uint8 {
+	return d.take(1)[0]
+}
+
+func (d *decoder) u16() uint16 {
+	return binary.LittleEndian.Uint16(d.take(2))
+}
+
+func (d *decoder) u32() uint32 {
+	return binary.LittleEndian.Uint32(d.take(4))
+}
+
+func (d *decoder) u64() uint64 {
+	return binary.LittleEndian.Uint64(d.take(8))
+}
+
+func (d *decoder) str() string {
+	return string(d.take(int(d.u16())))
+}
+
+func (d *decoder) qid() Qid {
+	return Qid{Type: d.u8(), Version: d.u32(), Path: d.u64()}
+}
+
+// marshal encodes the message together with its size.
+func (f *Fcall) marshal() []byte {
+	e := &encoder{buf: make([]byte, 4, 64)}
+	e.u8(f.Type)
+	e.u16(f.Tag)
+
+	switch f.Type {
+	case Tversion, Rversion:
+		e.u32(f.Msize)
+		e.str(f.Version)
+	case Tauth:
+		e.u32(f.Afid)
+		e.str(f.Uname)
+		e.str(f.Aname)
+	case Tattach:
+		e.u32(f.Fid)
+		e.u32(f.Afid)
+		e.str(f.Uname)
+		e.str(f.Aname)
+	case Rauth, Rattach:
+		e.qid(f.Qid)
+	case Rerror:
+		e.str(f.Ename)
+	case Tflush:
+		e.u16(f.Oldtag)
+	case Twalk:
+		e.u32(f.Fid)
+		e.u32(f.Newfid)
+		e.u16(uint16(len(f.Wname)))
+		for _, name := range f.Wname {
+			e.str(name)
+		}
+	case Rwalk:
+		e.u16(uint16(len(f.Wqid)))
+		for _, q := range f.Wqid {
+			e.qid(q)
+		}
+	case Topen:
+		e.u32(f.Fid)
+		e.u8(f.Mode)
+	case Ropen, Rcreate:
+		e.qid(f.Qid)
+		e.u32(f.Iounit)
+	case Tcreate:
+		e.u32(f.Fid)
+		e.str(f.Name)
+		e.u32(f.Perm)
+		e.u8(f.Mode)
+	case Tread:
+		e.u32(f.Fid)
+		e.u64(f.Offset)
+		e.u32(f.Count)
+	case Rread:
+		e.u32(uint32(len(f.Data)))
+		e.buf = append(e.buf, f.Data...)
+	case Twrite:
+		e.u32(f.Fid)
+		e.u64(f.Offset)
+		e.u32(uint32(len(f.Data)))
+		e.buf = append(e.buf, f.Data...)
+	case Rwrite:
+		e.u32(f.Count)
+	case Tclunk, Tremove, Tstat:
+		e.u32(f.Fid)
+	case Rstat:
+		e.u16(uint16(len(f.Stat)))
+		e.buf = append(e.buf, f.Stat...)
+	case Twstat:
+		e.u32(f.Fid)
+		e.u16(uint16(len(f.Stat)))
+		e.buf = append(e.buf, f.Stat...)
+	}
+
+	binary.LittleEndian.PutUint32(e.buf, uint32(len(e.buf)))
+	return e.buf
+}
+
+// unmarshal decodes a message without its size.
+func unmarshal(data []byte) (*Fcall, error) {
+	d := &decoder{buf: data}
+	f := &Fcall{Type: d.u8(), Tag: d.u16()}
+
+	switch f.Type {
+	case Tversion, Rversion:
+		f.Msize = d.u32()
+		f.Version = d.str()
+	case Tauth:
+		f.Afid = d.u32()
+		f.Uname = d.str()
+		f.Aname = d.str()
+	case Tattach:
+		f.Fid = d.u32()
+		f.Afid = d.u32()
+		f.Uname = d.str()
+		f.Aname = d.str()
+	case Rauth, Rattach:
+		f.Qid = d.qid()
+	case Rerror:
+		f.Ename = d.str()
+	case Tflush:
+		f.Oldtag = d.u16()
+	case Twalk:
+		f.Fid = d.u32()
+		f.Newfid = d.u32()
+		f.Wname = make([]string, d.u16())
+		if len(f.Wname) > MaxWalk {
+			return nil, fmt.Errorf("too many names in walk: %d", len(f.Wname))
+		}
+		for i := range f.Wname {
+			f.Wname[i] = d.str()
+		}
+	case Rwalk:
+		f.Wqid = make([]Qid, d.u16())
+		if len(f.Wqid) > MaxWalk {
+			return nil, fmt.Errorf("too many qids in walk: %d", len(f.Wqid))
+		}
+		for i := range f.Wqid {
+			f.Wqid[i] = d.qid()
+		}
+	case Topen:
+		f.Fid = d.u32()
+		f.Mode = d.u8()
+	case Ropen, Rcreate:
+		f.Qid = d.qid()
+		f.Iounit = d.u32()
+	case Tcreate:
+		f.Fid = d.u32()
+		f.Name = d.str()
+		f.Perm = d.u32()
+		f.Mode = d.u8()
+	case Tread:
+		f.Fid = d.u32()
+		f.Offset = d.u64()
+		f.Count = d.u32()
+	case Rread:
+		f.Data = d.take(int(d.u32()))
+	case Twrite:
+		f.Fid = d.u32()
+		f.Offset = d.u64()
+		f.Data = d.take(int(d.u32()))
+	case Rwrite:
+		f.Count = d.u32()
+	case Tclunk, Tremove, Tstat:
+		f.Fid = d.u32()
+	case Rstat:
+		f.Stat = d.take(int(d.u16()))
+	case Twstat:
+		f.Fid = d.u32()
+		f.Stat = d.take(int(d.u16()))
+	case Rflush, Rclunk, Rremove, Rwstat:
+	default:
+		return nil, fmt.Errorf("unknown 9P message type %d", f.Type)
+	}
+
+	if d.err != nil {
+		return nil, d.err
+	}
+	return f, nil
+}
+
+// readMessage reads one message of at most msize bytes.
+func readMessage(r io.Reader, msize uint32) (*Fcall, error) {
+	var size [4]byte
+	if _, err := io.ReadFull(r, size[:]); err != nil {
+		return nil, err
+	}
+	n := binary.LittleEndian.Uint32(size[:])
+	if n < 7 || n > msize {
+		return nil, fmt.Errorf("bad 9P message size %d", n)
+	}
+
+	data := make([]byte, n-4)
+	if _, err := io.ReadFull(r, data); err != nil {
+		return nil, err
+	}
+	return unmarshal(data)
+}
+
+// marshal encodes the stat structure together with its size.
+func (dir *Dir) marshal() []byte {
+	e := &encoder{buf: make([]byte, 2, 64)}
+	e.u16(dir.Type)
+	e.u32(dir.Dev)
+	e.qid(dir.Qid)
+	e.u32(dir.Mode)
+	e.u32(dir.Atime)
+	e.u32(dir.Mtime)
+	e.u64(dir.Length)
+	e.str(dir.Name)
+	e.str(dir.Uid)
+	e.str(dir.Gid)
+	e.str(dir.Muid)
+
+	binary.LittleEndian.PutUint16(e.buf, uint16(len(e.buf)-2))
+	return e.buf
+}
+
+// unmarshalDir decodes a stat structure and returns the bytes after it.
+func unmarshalDir(data []byte) (*Dir, []byte, error) {
+	d := &decoder{buf: data}
+	size := d.u16()
+	if d.err != nil || len(d.buf) < int(size) {
+		return nil, nil, errShortMessage
+	}
+	rest := d.buf[size:]
+	d.buf = d.buf[:size]
+
+	dir := &Dir{
+		Type:   d.u16(),
+		Dev:    d.u32(),
+		Qid:    d.qid(),
+		Mode:   d.u32(),
+		Atime:  d.u32(),
+		Mtime:  d.u32(),
+		Length: d.u64(),
+		Name:   d.str(),
+		Uid:    d.str(),
+		Gid:    d.str(),
+		Muid:   d.str(),
+	}
+	if d.err != nil {
+		return nil, nil, d.err
+	}
+	return dir, rest, nil
+}
@@ -0,0 +1,667 @@
+package ninep
+
+import (
+	"encoding/binary"
+	"errors"
+	"file-system/internal/errs"
+	"file-system/internal/filesystem"
+	"fmt"
+	"io"
+	"net"
+	"os"
+	pathpkg "path"
+	"strings"
+	"sync"
+)
+
+// Server serves a FileSystem over 9P2000. Attaching authenticates against
+// the users of the image: the client writes the password to the fid of
+// Tauth and passes it to Tattach, which logs the user in to a session of
+// its own. Fids name paths rather than inodes, and qid paths are inode
+// numbers, which repeat across mounted images. Requests of a connection
+// are answered in order.
+type Server struct {
+	fs *filesystem.FileSystem
+
+	mu        sync.Mutex
+	listeners map[net.Listener]bool
+	closed    bool
+}
+
+func NewServer(fs *filesystem.FileSystem) *Server {
+	return &Server{fs: fs, listeners: make(map[net.Listener]bool)}
+}
+
+// ListenAndServe listens on the TCP address and serves the connections.
+func (s *Server) ListenAndServe(addr string) error {
+	l, err := net.Listen("tcp", addr)
+	if err != nil {
+		return err
+	}
+	return s.Serve(l)
+}
+
+// Serve accepts connections on l until it is closed or Close is called.
+func (s *Server) Serve(l net.Listener) error {
+	s.mu.Lock()
+	if s.closed {
+		s.mu.Unlock()
+		return l.Close()
+	}
+	s.listeners[l] = true
+	s.mu.Unlock()
+	defer func() {
+		s.mu.Lock()
+		delete(s.listeners, l)
+		s.mu.Unlock()
+	}()
+
+	for {
+		conn, err := l.Accept()
+		if err != nil {
+			if errors.Is(err, net.ErrClosed) {
+				return nil
+			}
+			return err
+		}
+		go s.ServeConn(conn)
+	}
+}
+
+// Close stops all listeners, including those passed to Serve later. Open
+// connections are served until the clients hang up.
+func (s *Server) Close() error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	s.closed = true
+	var result error
+	for l := range s.listeners {
+		if err := l.Close(); err != nil && result == nil {
+			result = err
+		}
+	}
+	return result
+}
+
+// ServeConn answers requests read from rw until the client hangs up.
+func (s *Server) ServeConn(rw io.ReadWriteCloser) error {
+	c := &conn{server: s, rw: rw, msize: DefaultMsize, fids: make(map[uint32]*fid)}
+	defer c.close()
+
+	for {
+		request, err := readMessage(rw, c.msize)
+		if err != nil {
+			if errors.Is(err, io.EOF) {
+				return nil
+			}
+			return err
+		}
+
+		response, err := c.handle(request)
+		if err != nil {
+			response = &Fcall{Type: Rerror, Ename: err.Error()}
+		}
+		response.Tag = request.Tag
+		if _, err := rw.Write(response.marshal()); err != nil {
+			return err
+		}
+	}
+}
+
+// conn is the state of one client connection.
+type conn struct {
+	server *Server
+	rw     io.ReadWriteCloser
+	msize  uint32
+	// Set once Tversion agreed on the protocol
+	versioned bool
+	fids      map[uint32]*fid
+	// Sessions of the attaches, ended when the client hangs up
+	sessions []*filesystem.Session
+}
+
+// fid is a file of the client: the path it was walked to in the session
+// of its attach, or the password of an authentication in progress.
+type fid struct {
+	session *filesystem.Session
+	root    string
+	path    string
+	qid     Qid
+
+	open          bool
+	mode          uint8
+	fd            int
+	removeOnClunk bool
+	// Entries of an open directory and the offset the next read continues
+	// from
+	entries    []byte
+	nextOffset uint64
+
+	auth     bool
+	uname    string
+	password []byte
+}
+
+func (c *conn) handle(request *Fcall) (*Fcall, error) {
+	if request.Type != Tversion && !c.versioned {
+		return nil, errors.New("version not negotiated")
+	}
+
+	switch request.Type {
+	case Tversion:
+		return c.version(request)
+	case Tauth:
+		return c.auth(request)
+	case Tattach:
+		return c.attach(request)
+	case Tflush:
+		return &Fcall{Type: Rflush}, nil
+	case Twalk:
+		return c.walk(request)
+	case Topen:
+		return c.open(request)
+	case Tcreate:
+		return c.create(request)
+	case Tread:
+		return c.read(request)
+	case Twrite:
+		return c.write(request)
+	case Tclunk:
+		return c.clunk(request)
+	case Tremove:
+		return c.remove(request)
+	case Tstat:
+		return c.stat(request)
+	case Twstat:
+		return c.wstat(request)
+	}
+	return nil, fmt.Errorf("unexpected 9P message type %d", request.Type)
+}
+
+func (c *conn) version(request *Fcall) (*Fcall, error) {
+	c.close()
+	c.versioned = false
+	if request.Msize < 256 {
+		return nil, fmt.Errorf("msize %d too small", request.Msize)
+	}
+	c.msize = min(request.Msize, DefaultMsize)
+
+	version := "unknown"
+	if strings.HasPrefix(request.Version, Version) {
+		version = Version
+		c.versioned = true
+	}
+	return &Fcall{Type: Rversion, Msize: c.msize, Version: version}, nil
+}
+
+func (c *conn) auth(request *Fcall) (*Fcall, error) {
+	if _, ok := c.fids[request.Afid]; ok || request.Afid == NOFID {
+		return nil, fmt.Errorf("fid %d in use", request.Afid)
+	}
+	if err := checkUname(request.Uname); err != nil {
+		return nil, err
+	}
+	f := &fid{auth: true, uname: request.Uname, qid: Qid{Type: QTAUTH}}
+	c.fids[request.Afid] = f
+	return &Fcall{Type: Rauth, Qid: f.qid}, nil
+}
+
+// checkUname rejects user names that are no plain names. The file system
+// reads the user from the file of that name in /.users, which a path must
+// not lead out of.
+func checkUname(uname string) error {
+	if uname == "" || uname == "." || uname == ".." || strings.Contains(uname, "/") {
+		return fmt.Errorf("%w - %q", errs.ErrIncorrectFileName, uname)
+	}
+	return nil
+}
+
+func (c *conn) attach(request *Fcall) (*Fcall, error) {
+	if _, ok := c.fids[request.Fid]; ok {
+		return nil, fmt.Errorf("fid %d in use", request.Fid)
+	}
+	afid, ok := c.fids[request.Afid]
+	if !ok || !afid.auth || afid.uname != request.Uname {
+		return nil, fmt.Errorf("%w - authentication required", errs.ErrPermissionDenied)
+	}
+	if err := checkUname(request.Uname); err != nil {
+		return nil, err
+	}
+
+	password := strings.TrimSuffix(string(afid.password), "\n")
+	session, err := c.server.fs.NewSession(request.Uname, password)
+	if err != nil {
+		return nil, err
+	}
+
+	root := pathpkg.Join("/", request.Aname)
+	info, err := session.Stat(root)
+	if err == nil && !info.IsDir() {
+		err = fmt.Errorf("%w - %s", errs.ErrRecordIsNotDirectory, root)
+	}
+	if err != nil {
+		session.Close()
+		return nil, err
+	}
+
+	f := &fid{session: session, root: root, path: root, qid: qidOf(info)}
+	c.fids[request.Fid] = f
+	c.sessions = append(c.sessions, session)
+	return &Fcall{Type: Rattach, Qid: f.qid}, nil
+}
+
+func (c *conn) walk(request *Fcall) (*Fcall, error) {
+	f, err := c.fid(request.Fid)
+	if err != nil {
+		return nil, err
+	}
+	if f.open {
+		return nil, fmt.Errorf("fid %d is open", request.Fid)
+	}
+	if _, ok := c.fids[request.Newfid]; ok && request.Newfid != request.Fid {
+		return nil, fmt.Errorf("fid %d in use", request.Newfid)
+	}
+
+	path, qid := f.path, f.qid
+	var qids []Qid
+	for i, name := range request.Wname {
+		if qid.Type&QTDIR == 0 {
+			err = fmt.Errorf("%w - %s", errs.ErrRecordIsNotDirectory, pathpkg.Base(path))
+		} else if name == "" || strings.Contains(name, "/") {
+			err = fmt.Errorf("%w - %q", errs.ErrIncorrectFileName, name)
+		}
+
+		next := pathpkg.Join(path, name)
+		if name == ".." && path == f.root {
+			next = path
+		}
+		var info *filesystem.FileInfo
+		if err == nil {
+			info, err = f.session.Stat(next)
+		}
+		if err != nil {
+			if i == 0 {
+				return nil, err
+			}
+			return &Fcall{Type: Rwalk, Wqid: qids}, nil
+		}
+
+		path, qid = next, qidOf(info)
+		qids = append(qids, qid)
+	}
+
+	c.fids[request.Newfid] = &fid{session: f.session, root: f.root, path: path, qid: qid}
+	return &Fcall{Type: Rwalk, Wqid: qids}, nil
+}
+
+func (c *conn) open(request *Fcall) (*Fcall, error) {
+	f, err := c.fid(request.Fid)
+	if err != nil {
+		return nil, err
+	}
+	if f.open {
+		return nil, fmt.Errorf("fid %d is open", request.Fid)
+	}
+
+	if f.qid.Type&QTDIR != 0 {
+		if request.Mode&3 != OREAD || request.Mode&OTRUNC != 0 {
+			return nil, fmt.Errorf("%w - %s", errs.ErrRecordIsNotFile, pathpkg.Base(f.path))
+		}
+	} else if f.fd, err = f.session.OpenFile(f.path, openFlag(request.Mode)); err != nil {
+		return nil, err
+	}
+
+	f.open, f.mode = true, request.Mode
+	f.removeOnClunk = request.Mode&ORCLOSE != 0
+	return &Fcall{Type: Ropen, Qid: f.qid, Iounit: c.msize - IOHDRSZ}, nil
+}
+
+func (c *conn) create(request *Fcall) (*Fcall, error) {
+	f, err := c.fid(request.Fid)
+	if err != nil {
+		return nil, err
+	}
+	if f.open || f.qid.Type&QTDIR == 0 {
+		return nil, fmt.Errorf("%w - %s", errs.ErrRecordIsNotDirectory, pathpkg.Base(f.path))
+	}
+	if request.Name == "" || request.Name == "." || request.Name == ".." || strings.Contains(request.Name, "/") {
+		return nil, fmt.Errorf("%w - %q", errs.ErrIncorrectFileName, request.Name)
+	}
+	parent, err := f.session.Stat(f.path)
+	if err != nil {
+		return nil, err
+	}
+
+	path := pathpkg.Join(f.path, request.Name)
+	isDirectory := request.Perm&DMDIR != 0
+	// The new file gets the permissions asked for, limited by those of
+	// the directory
+	permissions := request.Perm & (^uint32(0o666) | uint32(parent.Mode().Perm())&0o666)
+	if isDirectory {
+		permissions = request.Perm & (^uint32(0o777) | uint32(parent.Mode().Perm())&0o777)
+		if request.Mode&3 != OREAD || request.Mode&OTRUNC != 0 {
+			return nil, fmt.Errorf("%w - %s", errs.ErrRecordIsNotFile, request.Name)
+		}
+		err = f.session.CreateDirectory(path)
+	} else {
+		f.fd, err = f.session.OpenFile(path, openFlag(request.Mode)|os.O_CREATE|os.O_EXCL)
+	}
+	if err != nil {
+		return nil, err
+	}
+
+	info, err := f.session.Stat(path)
+	if err == nil {
+		err = f.session.ChangeMode(path, fmt.Sprintf("%o", permissions&0o777))
+	}
+	if err != nil {
+		// The fid stays on the directory, which must not keep the new file
+		if !isDirectory {
+			f.session.CloseFile(f.fd)
+		}
+		f.session.DeleteFile(path)
+		return nil, err
+	}
+	f.path, f.open, f.mode = path, true, request.Mode
+	f.qid = qidOf(info)
+	f.removeOnClunk = request.Mode&ORCLOSE != 0
+	return &Fcall{Type: Rcreate, Qid: f.qid, Iounit: c.msize - IOHDRSZ}, nil
+}
+
+func (c *conn) read(request *Fcall) (*Fcall, error) {
+	f, err := c.openFid(request.Fid)
+	if err != nil {
+		return nil, err
+	}
+	if f.mode&3 == OWRITE {
+		return nil, fmt.Errorf("%w - fid %d not open for reading", errs.ErrBadDescriptor, request.Fid)
+	}
+	count := min(request.Count, c.msize-IOHDRSZ)
+
+	if f.qid.Type&QTDIR != 0 {
+		return c.readDirectory(f, request.Offset, count)
+	}
+
+	if _, err := f.session.Seek(f.fd, int64(request.Offset), io.SeekStart); err != nil {
+		return nil, err
+	}
+	data, err := f.session.Read(f.fd, int(count))
+	if err != nil && err != io.EOF {
+		return nil, err
+	}
+	return &Fcall{Type: Rread, Data: []byte(data)}, nil
+}
+
+// readDirectory returns the stat structures of the entries that fit into
+// count bytes. Reading from offset 0 lists the directory anew, any other
+// read must continue where the last one ended.
+func (c *conn) readDirectory(f *fid, offset uint64, count uint32) (*Fcall, error) {
+	if offset == 0 {
+		infos, err := f.session.ReadDirectory(f.path)
+		if err != nil {
+			return nil, err
+		}
+		f.entries = nil
+		for _, info := range infos {
+			f.entries = append(f.entries, dirOf(info).marshal()...)
+		}
+		f.nextOffset = 0
+	}
+	if offset != f.nextOffset {
+		return nil, fmt.Errorf("%w - directory offset %d", errs.ErrIllegalArgument, offset)
+	}
+
+	var data []byte
+	for rest := f.entries; len(rest) > 0; {
+		size := 2 + int(binary.LittleEndian.Uint16(rest))
+		if len(data)+size > int(count) {
+			break
+		}
+		data = append(data, rest[:size]...)
+		rest = rest[size:]
+	}
+	f.entries = f.entries[len(data):]
+	f.nextOffset += uint64(len(data))
+	return &Fcall{Type: Rread, Data: data}, nil
+}
+
+func (c *conn) write(request *Fcall) (*Fcall, error) {
+	f, ok := c.fids[request.Fid]
+	if ok && f.auth {
+		f.password = append(f.password, request.Data...)
+		return &Fcall{Type: Rwrite, Count: uint32(len(request.Data))}, nil
+	}
+
+	f, err := c.openFid(request.Fid)
+	if err != nil {
+		return nil, err
+	}
+	if f.mode&3 == OREAD || f.mode&3 == OEXEC || f.qid.Type&QTDIR != 0 {
+		return nil, fmt.Errorf("%w - fid %d not open for writing", errs.ErrBadDescriptor, request.Fid)
+	}
+
+	if _, err := f.session.Seek(f.fd, int64(request.Offset), io.SeekStart); err != nil {
+		return nil, err
+	}
+	n, err := f.session.Write(f.fd, string(request.Data))
+	if err != nil {
+		return nil, err
+	}
+	return &Fcall{Type: Rwrite, Count: uint32(n)}, nil
+}
+
+func (c *conn) clunk(request *Fcall) (*Fcall, error) {
+	f, ok := c.fids[request.Fid]
+	if !ok {
+		return nil, fmt.Errorf("unknown fid %d", request.Fid)
+	}
+	delete(c.fids, request.Fid)
+
+	err := c.release(f)
+	if f.removeOnClunk && err == nil {
+		err = c.removePath(f)
+	}
+	if err != nil {
+		return nil, err
+	}
+	return &Fcall{Type: Rclunk}, nil
+}
+
+// remove deletes the file and clunks the fid even if that fails.
+func (c *conn) remove(request *Fcall) (*Fcall, error) {
+	f, err := c.fid(request.Fid)
+	if err != nil {
+		return nil, err
+	}
+	delete(c.fids, request.Fid)
+
+	if err := c.release(f); err != nil {
+		return nil, err
+	}
+	if err := c.removePath(f); err != nil {
+		return nil, err
+	}
+	return &Fcall{Type: Rremove}, nil
+}
+
+// removePath deletes the file of the fid. Unlike DeleteFile, it refuses to
+// delete a directory that is not empty.
+func (c *conn) removePath(f *fid) error {
+	if f.path == f.root {
+		return fmt.Errorf("%w - %s", errs.ErrBusy, f.path)
+	}
+	if f.qid.Type&QTDIR != 0 {
+		infos, err := f.session.ReadDirectory(f.path)
+		if err != nil {
+			return err
+		}
+		if len(infos) > 0 {
+			return fmt.Errorf("%w - %s", errs.ErrDirectoryNotEmpty, pathpkg.Base(f.path))
+		}
+	}
+	return f.session.DeleteFile(f.path)
+}
+
+func (c *conn) stat(request *Fcall) (*Fcall, error) {
+	f, err := c.fid(request.Fid)
+	if err != nil {
+		return nil, err
+	}
+	info, err := f.session.Stat(f.path)
+	if err != nil {
+		return nil, err
+	}
+	return &Fcall{Type: Rstat, Stat: dirOf(info).marshal()}, nil
+}
+
+// wstat applies the fields of the stat structure that are not left
+// untouched one after another: name, length, mode, group and owner. The
+// times can't be set and are ignored.
+func (c *conn) wstat(request *Fcall) (*Fcall, error) {
+	f, err := c.fid(request.Fid)
+	if err != nil {
+		return nil, err
+	}
+	dir, _, err := unmarshalDir(request.Stat)
+	if err != nil {
+		return nil, err
+	}
+	info, err := f.session.Stat(f.path)
+	if err != nil {
+		return nil, err
+	}
+
+	if dir.Name != "" && dir.Name != info.Name() {
+		if f.path == f.root || strings.Contains(dir.Name, "/") {
+			return nil, fmt.Errorf("%w - %q", errs.ErrIncorrectFileName, dir.Name)
+		}
+		path := pathpkg.Join(pathpkg.Dir(f.path), dir.Name)
+		if err := f.session.MoveFileNoReplace(f.path, path); err != nil {
+			return nil, err
+		}
+		f.path = path
+	}
+
+	if dir.Length != ^uint64(0) && dir.Length != uint64(info.Size()) {
+		if info.IsDir() || dir.Length > uint64(info.Size()) {
+			return nil, fmt.Errorf("%w - length %d", errs.ErrIllegalArgument, dir.Length)
+		}
+		content, err := f.session.ReadFile(f.path)
+		if err != nil {
+			return nil, err
+		}
+		if err := f.session.EditFile(f.path, content[:dir.Length]); err != nil {
+			return nil, err
+		}
+	}
+
+	if dir.Mode != ^uint32(0) {
+		if (dir.Mode&DMDIR != 0) != info.IsDir() {
+			return nil, fmt.Errorf("%w - mode %o", errs.ErrIllegalArgument, dir.Mode)
+		}
+		if err := f.session.ChangeMode(f.path, fmt.Sprintf("%o", dir.Mode&0o777)); err != nil {
+			return nil, err
+		}
+	}
+
+	if dir.Gid != "" && dir.Gid != info.Group() {
+		if err := f.session.ChangeGroup(f.path, dir.Gid); err != nil {
+			return nil, err
+		}
+	}
+
+	if dir.Uid != "" && dir.Uid != info.Owner() {
+		if err := f.session.ChangeOwner(f.path, dir.Uid); err != nil {
+			return nil, err
+		}
+	}
+
+	return &Fcall{Type: Rwstat}, nil
+}
+
+// fid returns the fid, which may also be one of an authentication.
+func (c *conn) fid(number uint32) (*fid, error) {
+	f, ok := c.fids[number]
+	if !ok {
+		return nil, fmt.Errorf("unknown fid %d", number)
+	}
+	if f.auth {
+		return nil, fmt.Errorf("fid %d is an authentication fid", number)
+	}
+	return f, nil
+}
+
+// openFid returns the fid of an open file.
+func (c *conn) openFid(number uint32) (*fid, error) {
+	f, err := c.fid(number)
+	if err != nil {
+		return nil, err
+	}
+	if !f.open {
+		return nil, fmt.Errorf("fid %d is not open", number)
+	}
+	return f, nil
+}
+
+// release closes the descriptor of an open file.
+func (c *conn) release(f *fid) error {
+	if !f.open || f.qid.Type&QTDIR != 0 {
+		return nil
+	}
+	return f.session.CloseFile(f.fd)
+}
+
+// close releases the fids of the connection and ends its sessions, which
+// closes the files still open in them.
+func (c *conn) close() {
+	for number := range c.fids {
+		delete(c.fids, number)
+	}
+	for _, session := range c.sessions {
+		session.Close()
+	}
+	c.sessions = nil
+}
+
+func openFlag(mode uint8) int {
+	var flag int
+	switch mode & 3 {
+	case OWRITE:
+		flag = os.O_WRONLY
+	case ORDWR:
+		flag = os.O_RDWR
+	default:
+		flag = os.O_RDONLY
+	}
+	if mode&OTRUNC != 0 {
+		flag |= os.O_TRUNC
+	}
+	return flag
+}
+
+func qidOf(info *filesystem.FileInfo) Qid {
+	qid := Qid{Type: QTFILE, Version: uint32(info.ModTime().Unix()), Path: uint64(info.Inode())}
+	if info.IsDir() {
+		qid.Type = QTDIR
+	}
+	return qid
+}
+
+func dirOf(info *filesystem.FileInfo) *Dir {
+	dir := &Dir{
+		Qid:   qidOf(info),
+		Mode:  uint32(info.Mode().Perm()),
+		Atime: uint32(info.ModTime().Unix()),
+		Mtime: uint32(info.ModTime().Unix()),
+		Name:  info.Name(),
+		Uid:   info.Owner(),
+		Gid:   info.Group(),
+	}
+	if info.IsDir() {
+		dir.Mode |= DMDIR
+	} else {
+		dir.Length = uint64(info.Size())
+	}
+	return dir
+}
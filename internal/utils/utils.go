@@ -2,6 +2,7 @@ package utils
 
 import (
 	"errors"
+	"path"
 	"reflect"
 	"strings"
 )
@@ -73,3 +74,12 @@ func SplitPath(input string) (string, string) {
 
 	return firstPart, secondPart
 }
+
+// AbsolutePath resolves arg against currentPath lexically, collapsing ".",
+// ".." and repeated slashes.
+func AbsolutePath(currentPath, arg string) string {
+	if !strings.HasPrefix(arg, "/") {
+		arg = currentPath + "/" + arg
+	}
+	return path.Clean("/" + arg)
+}
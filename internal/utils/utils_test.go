@@ -51,3 +51,26 @@ func TestSplitPath(t *testing.T) {
 		}
 	}
 }
+
+func TestAbsolutePath(t *testing.T) {
+	tests := []struct {
+		currentPath  string
+		arg          string
+		expectedPath string
+	}{
+		{"/home/user", "file", "/home/user/file"},
+		{"/home/user", "../file", "/home/file"},
+		{"/home/user", "/proc/fs/stats", "/proc/fs/stats"},
+		{"/", "..", "/"},
+		{"/", ".", "/"},
+		{"/home", "dir//file/", "/home/dir/file"},
+		{"/home", "./dir/../file", "/home/file"},
+	}
+
+	for _, test := range tests {
+		result := AbsolutePath(test.currentPath, test.arg)
+		if result != test.expectedPath {
+			t.Errorf("For %s + %s, expected %s, but got %s", test.currentPath, test.arg, test.expectedPath, result)
+		}
+	}
+}